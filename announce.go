@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// announcer reports progress for --progress aural as plain lines of text,
+// printed only when there's news, instead of redrawing the bars with ANSI
+// escapes, which screen readers read out as a jumble. A download is
+// announced each time it passes another step of percentStep percent, or
+// every interval, and once more when it finishes, fails or has to wait.
+type announcer struct {
+	mutex       sync.Mutex
+	percentStep int64         // 0 to announce by time
+	interval    time.Duration // Also used for downloads of unknown size
+	last        map[*downloadTask]announcement
+}
+
+// announcement is what was last said about a task.
+type announcement struct {
+	percent int64
+	at      time.Time
+	state   string
+}
+
+// defaultAnnounceInterval is how often downloads of unknown size are
+// announced when --progress-interval is a percentage.
+const defaultAnnounceInterval = 30 * time.Second
+
+// newAnnouncer parses --progress and --progress-interval, returning nil for
+// the default progress bars. The interval is either a percentage, e.g. "10%",
+// or a duration, e.g. "30s".
+func newAnnouncer(mode, interval string) (*announcer, error) {
+	switch mode {
+	case "", "bar":
+		return nil, nil
+	case "aural":
+	default:
+		return nil, fmt.Errorf("invalid --progress %q: must be bar or aural", mode)
+	}
+
+	an := &announcer{interval: defaultAnnounceInterval, last: make(map[*downloadTask]announcement)}
+	if percent, ok := strings.CutSuffix(interval, "%"); ok {
+		step, err := strconv.ParseInt(percent, 10, 64)
+		if err != nil || step <= 0 || step > 100 {
+			return nil, fmt.Errorf("invalid --progress-interval %q: must be a percentage from 1%% to 100%%, or a duration", interval)
+		}
+		an.percentStep = step
+		return an, nil
+	}
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("invalid --progress-interval %q: must be a percentage, e.g. 10%%, or a duration, e.g. 30s", interval)
+	}
+	an.interval = duration
+	return an, nil
+}
+
+// update prints the announcements due for the tasks.
+func (an *announcer) update(tasks []*downloadTask) {
+	an.mutex.Lock()
+	defer an.mutex.Unlock()
+	now := time.Now()
+	for _, task := range tasks {
+		if message := an.news(task, now); message != "" {
+			fmt.Println(message)
+		}
+	}
+}
+
+// news returns what to announce about a task, or "" if nothing.
+func (an *announcer) news(task *downloadTask, now time.Time) string {
+	last, seen := an.last[task]
+	name := task.displayName()
+	if name == "" {
+		name = task.downloadURL
+	}
+
+	switch {
+	case task.failed():
+		if last.state == "failed" {
+			return ""
+		}
+		an.last[task] = announcement{state: "failed", at: now}
+		return trf("%s: Error: %s", name, task.error.Error())
+	case task.error != nil:
+		if last.state == "done" {
+			return ""
+		}
+		an.last[task] = announcement{state: "done", at: now}
+		return trf("%s: done", name)
+	}
+
+	if wait := task.getWaitString(); wait != "" {
+		if last.state == "waiting" {
+			return ""
+		}
+		an.last[task] = announcement{state: "waiting", percent: last.percent, at: now}
+		return fmt.Sprintf("%s: %s", name, wait)
+	}
+	bytesRead := task.getBytesRead()
+	if bytesRead == 0 {
+		return ""
+	}
+
+	if task.totalFileSize <= 0 {
+		if seen && last.state == "downloading" && now.Sub(last.at) < an.interval {
+			return ""
+		}
+		an.last[task] = announcement{state: "downloading", at: now}
+		return trf("%s: %s downloaded", name, strings.TrimSpace(humanReadableSize(bytesRead)))
+	}
+
+	percent := 100 * bytesRead / task.totalFileSize
+	if an.percentStep > 0 {
+		percent -= percent % an.percentStep
+		if seen && last.state == "downloading" && percent <= last.percent {
+			return ""
+		}
+	} else if seen && last.state == "downloading" && now.Sub(last.at) < an.interval {
+		return ""
+	}
+	an.last[task] = announcement{state: "downloading", percent: percent, at: now}
+	if remaining, ok := task.remainingTime(); ok && percent < 100 {
+		return trf("%s: %d%%, %s left", name, percent, strings.TrimSpace(durationToString(int64(remaining/time.Second))))
+	}
+	return trf("%s: %d%%", name, percent)
+}
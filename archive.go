@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// batchArchive is the archive --tar-output writes the batch's downloads
+// into instead of saving them as files: a tar, a gzipped tar, or a zip,
+// by the archive's extension. Each download is staged while it downloads,
+// then added to the archive by the releaser as soon as it completes, and
+// its staged file removed, so the downloads never appear as files of their
+// own and the staging area only ever holds those still in progress.
+type batchArchive struct {
+	path string
+
+	mutex  sync.Mutex
+	file   *os.File // Created with the first entry, nil until then
+	gzip   *gzip.Writer
+	tar    *tar.Writer
+	zip    *zip.Writer
+	closed bool
+}
+
+// newBatchArchive returns the archive for --tar-output, or nil if it isn't
+// set.
+func newBatchArchive(fileName string) *batchArchive {
+	if fileName == "" {
+		return nil
+	}
+	return &batchArchive{path: fileName}
+}
+
+// open creates the archive file and the writers for its format.
+func (ba *batchArchive) open() error {
+	if ba.file != nil {
+		return nil
+	}
+	if dir := filepath.Dir(ba.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.Create(ba.path)
+	if err != nil {
+		return err
+	}
+	ba.file = file
+	lower := strings.ToLower(ba.path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		ba.zip = zip.NewWriter(file)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		ba.gzip = gzip.NewWriter(file)
+		ba.tar = tar.NewWriter(ba.gzip)
+	default:
+		ba.tar = tar.NewWriter(file)
+	}
+	return nil
+}
+
+// entryName returns the path a download is stored under in the archive:
+// the path it would have been saved at, relative and with forward slashes.
+func entryName(fileName string) string {
+	name := filepath.ToSlash(fileName)
+	if volume := filepath.VolumeName(fileName); volume != "" {
+		name = name[len(volume):]
+	}
+	return strings.TrimLeft(path.Clean("/"+name), "/")
+}
+
+// add writes the task's staged file into the archive under the path it
+// would have been saved at, then removes the staged file.
+func (ba *batchArchive) add(dt *downloadTask) error {
+	source, err := os.Open(dt.fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	fileInfo, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	name := entryName(dt.finalName)
+
+	ba.mutex.Lock()
+	defer ba.mutex.Unlock()
+	if ba.closed {
+		return fmt.Errorf("%s is already closed", ba.path)
+	}
+	if err := ba.open(); err != nil {
+		return err
+	}
+	var entry io.Writer
+	if ba.zip != nil {
+		header, err := zip.FileInfoHeader(fileInfo)
+		if err != nil {
+			return err
+		}
+		header.Name, header.Method = name, zip.Deflate
+		if entry, err = ba.zip.CreateHeader(header); err != nil {
+			return err
+		}
+	} else {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: fileInfo.Size(), Mode: 0644, ModTime: fileInfo.ModTime()}
+		if err := ba.tar.WriteHeader(header); err != nil {
+			return err
+		}
+		entry = ba.tar
+	}
+	if _, err := io.Copy(entry, source); err != nil {
+		return err
+	}
+	source.Close()
+	return os.Remove(dt.fileName)
+}
+
+// close finishes the archive once the batch is over, creating an empty one
+// if nothing was added, and flushes it to disk for --fsync, and its
+// directory for --sync-dir.
+func (ba *batchArchive) close(fsync, syncDirectory bool) error {
+	if ba == nil {
+		return nil
+	}
+	ba.mutex.Lock()
+	defer ba.mutex.Unlock()
+	if ba.closed {
+		return nil
+	}
+	ba.closed = true
+	if err := ba.open(); err != nil {
+		return err
+	}
+	var err error
+	if ba.zip != nil {
+		err = ba.zip.Close()
+	} else {
+		err = ba.tar.Close()
+	}
+	if ba.gzip != nil {
+		if gzipErr := ba.gzip.Close(); err == nil {
+			err = gzipErr
+		}
+	}
+	if err == nil && fsync {
+		err = ba.file.Sync()
+	}
+	if closeErr := ba.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && syncDirectory {
+		err = syncDir(filepath.Dir(ba.path))
+	}
+	return err
+}
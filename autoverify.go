@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// autoVerifySums are where --auto-verify looks for a published checksum of
+// a download, in order, as templates for checksumLocation.
+var autoVerifySums = []string{"{url}.sha256", "{dir}/SHA256SUMS"}
+
+// discoverChecksum looks for a checksum published next to the task's
+// download and, failing that, for a detached signature of the file itself,
+// for --auto-verify. Finding neither is only worth a warning.
+func (dt *downloadTask) discoverChecksum(client *http.Client) error {
+	for _, template := range autoVerifySums {
+		sumsURL, err := checksumLocation(template, dt.downloadURL)
+		if err != nil {
+			return err
+		}
+		sums, err := dt.fetchPublished(client, sumsURL)
+		if err != nil {
+			return fmt.Errorf("fetching %s: %v", sumsURL, err)
+		}
+		if sums == nil {
+			continue
+		}
+		// A SHA256SUMS of another release may not list the file.
+		digest, err := checksumFor(sums, sumsURL, dt.downloadURL)
+		if err != nil {
+			transportLog.Warn("ignoring malformed checksum file", "url", sumsURL, "error", err)
+			continue
+		}
+		if digest != "" {
+			transportLog.Info("verifying with published checksum", "url", dt.downloadURL, "checksum", sumsURL)
+			dt.expectedSum = digest
+			return nil
+		}
+	}
+
+	// A signature can only be checked against the saved file.
+	if !dt.options.discard && !dt.options.streamsOutput() {
+		signature, err := dt.fetchPublished(client, dt.downloadURL+".asc")
+		if err != nil {
+			return fmt.Errorf("fetching %s.asc: %v", dt.downloadURL, err)
+		}
+		if signature != nil {
+			transportLog.Info("verifying with published signature", "url", dt.downloadURL)
+			dt.signature = signature
+			return nil
+		}
+	}
+
+	transportLog.Warn("no checksum or signature published, downloading unverified", "url", dt.downloadURL)
+	return nil
+}
+
+// listedInSums reports whether --sums lists the file the URL names, which
+// makes looking for a published checksum unnecessary.
+func (dt *downloadTask) listedInSums() bool {
+	name, err := dt.plannedName()
+	return err == nil && dt.options.checksums[name] != ""
+}
+
+// fetchPublished fetches a file that may not be published, returning nil if
+// the server answers with an error status. Servers such as S3 answer 403
+// rather than 404 for missing objects.
+func (dt *downloadTask) fetchPublished(client *http.Client, rawURL string) ([]byte, error) {
+	body, err := dt.fetchSmall(client, rawURL)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.statusCode < 500 {
+		return nil, nil
+	}
+	return body, err
+}
+
+// verifySignature checks the saved file against the signature found by
+// --auto-verify, with gpgv and its default keyring of trusted keys.
+func (dt *downloadTask) verifySignature() error {
+	if err := runGPGV(dt.ctx, "", dt.signature, dt.fileName); err != nil {
+		return &verifyError{fileName: dt.fileName, err: fmt.Errorf("%w: %v", ErrBadSignature, err)}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// batteryCheckInterval is how long a battery reading is trusted, and how
+// often paused downloads check again.
+const batteryCheckInterval = 30 * time.Second
+
+// batteryPolicy throttles or pauses downloads while a laptop runs on battery
+// below --battery-threshold percent.
+type batteryPolicy struct {
+	threshold int   // Charge in percent below which downloads are held back
+	rateLimit int64 // Rate limit in bytes per second while low, 0 to pause instead
+	mutex     sync.Mutex
+	checked   time.Time // When the battery was last read
+	low       bool      // Result of the last reading
+}
+
+// newBatteryPolicy returns the policy set by --battery-threshold and
+// --battery-rate-limit, or nil if no threshold is set.
+func newBatteryPolicy(threshold int, rateLimit string) (*batteryPolicy, error) {
+	if threshold == 0 {
+		if rateLimit != "" {
+			return nil, fmt.Errorf("--battery-rate-limit needs --battery-threshold")
+		}
+		return nil, nil
+	}
+	if threshold < 0 || threshold > 100 {
+		return nil, fmt.Errorf("invalid --battery-threshold %d: must be a percentage", threshold)
+	}
+	policy := &batteryPolicy{threshold: threshold}
+	if rateLimit != "" {
+		limit, err := parseRate(rateLimit)
+		if err != nil || limit == 0 {
+			return nil, fmt.Errorf("invalid --battery-rate-limit %q", rateLimit)
+		}
+		policy.rateLimit = limit
+	}
+	return policy, nil
+}
+
+// isLow reports whether the machine is on battery below the threshold,
+// reading the battery at most once per batteryCheckInterval. Where the power
+// source can't be read it never is.
+func (bp *batteryPolicy) isLow() bool {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if time.Since(bp.checked) < batteryCheckInterval {
+		return bp.low
+	}
+	onBattery, percent, err := powerStatus()
+	if err != nil {
+		transportLog.Debug("can't read the battery status", "error", err)
+	}
+	bp.low, bp.checked = onBattery && percent < bp.threshold, time.Now()
+	return bp.low
+}
+
+// checkBattery applies the battery policy between reads. While the battery
+// is low, the task's rate limit is lowered to --battery-rate-limit, or the
+// transfer is paused until the machine is plugged in or charged above the
+// threshold and then continues with a range request. Servers without range
+// support can't continue a paused transfer, so their downloads go on.
+func (dt *downloadTask) checkBattery(client *http.Client, request *http.Request) error {
+	policy := dt.options.battery
+	if policy == nil {
+		return nil
+	}
+	low := policy.isLow()
+	switch {
+	case low && policy.rateLimit > 0:
+		if !dt.batteryLimited && (dt.rateLimiter.limit == 0 || dt.rateLimiter.limit > policy.rateLimit) {
+			transportLog.Info("battery low, limiting rate", "url", dt.downloadURL, "limit", policy.rateLimit)
+			dt.normalLimit, dt.rateLimiter.limit = dt.rateLimiter.limit, policy.rateLimit
+			dt.batteryLimited = true
+		}
+	case low:
+		dt.mutex.Lock()
+		resumable := dt.ranges == rangesSupported
+		dt.mutex.Unlock()
+		if !resumable || dt.options.form != nil {
+			return nil
+		}
+
+		transportLog.Info("battery low, pausing", "url", dt.downloadURL)
+		dt.log.event("battery", map[string]interface{}{"threshold": policy.threshold})
+		dt.source.Close()
+		for policy.isLow() {
+			if err := dt.pause(time.Now().Add(batteryCheckInterval), "on battery, checking in", fmt.Sprintf("below %d%%", policy.threshold)); err != nil {
+				return err
+			}
+		}
+		return dt.reconnect(client, request)
+	case dt.batteryLimited:
+		dt.rateLimiter.limit, dt.batteryLimited = dt.normalLimit, false
+	}
+	return nil
+}
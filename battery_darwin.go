@@ -0,0 +1,26 @@
+//go:build darwin
+
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var pmsetPercentRegex = regexp.MustCompile(`(\d+)%`)
+
+// powerStatus asks pmset for the power source and battery charge. Its output
+// starts "Now drawing from 'Battery Power'" while on battery.
+func powerStatus() (onBattery bool, percent int, err error) {
+	output, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, 0, err
+	}
+	percent = 100
+	if match := pmsetPercentRegex.FindSubmatch(output); match != nil {
+		percent, _ = strconv.Atoi(string(match[1]))
+	}
+	return strings.Contains(string(output), "'Battery Power'"), percent, nil
+}
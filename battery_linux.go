@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// powerStatus reads the batteries in /sys/class/power_supply. The machine is
+// on battery while one is discharging; without a battery it never is.
+func powerStatus() (onBattery bool, percent int, err error) {
+	supplies, err := filepath.Glob("/sys/class/power_supply/*")
+	if err != nil {
+		return false, 0, err
+	}
+	percent = 100
+	for _, supply := range supplies {
+		if readSysfs(filepath.Join(supply, "type")) != "Battery" {
+			continue
+		}
+		if readSysfs(filepath.Join(supply, "status")) == "Discharging" {
+			onBattery = true
+		}
+		if capacity, err := strconv.Atoi(readSysfs(filepath.Join(supply, "capacity"))); err == nil && capacity < percent {
+			percent = capacity
+		}
+	}
+	return onBattery, percent, nil
+}
+
+// readSysfs returns the trimmed contents of a sysfs attribute, "" if it
+// can't be read.
+func readSysfs(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+// powerStatus reports that the power source can't be read on this platform.
+func powerStatus() (onBattery bool, percent int, err error) {
+	return false, 0, errors.New("battery status is not supported on this platform")
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetSystemPowerStatus = syscall.NewLazyDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is the SYSTEM_POWER_STATUS structure.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// powerStatus asks GetSystemPowerStatus for the power source and charge. The
+// machine is on battery when the AC line is offline.
+func powerStatus() (onBattery bool, percent int, err error) {
+	var status systemPowerStatus
+	if ok, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status))); ok == 0 {
+		return false, 0, err
+	}
+	percent = int(status.BatteryLifePercent)
+	if percent > 100 {
+		// 255 means the charge is unknown.
+		percent = 100
+	}
+	return status.ACLineStatus == 0, percent, nil
+}
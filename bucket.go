@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gcsEndpoint serves Google Cloud Storage buckets over the XML API, whose
+// listings have the same format as S3's.
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// bucketURL translates an s3://bucket/key or gs://bucket/key URL into the
+// HTTPS URL of the object, and the URL listing the objects whose keys start
+// with key as a directory, for --list and --recursive. S3 buckets are reached
+// at bucket.s3.amazonaws.com, or below s3Endpoint, path-style, when it is
+// set, for other regions and S3-compatible stores. Other URLs are returned
+// unchanged, with no listing URL.
+func bucketURL(rawURL, s3Endpoint string) (objectURL, listingURL string, err error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok || (scheme != "s3" && scheme != "gs") {
+		return rawURL, "", nil
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("missing bucket in %q", rawURL)
+	}
+
+	var root *url.URL
+	switch {
+	case scheme == "gs":
+		root, err = url.Parse(gcsEndpoint + "/" + bucket + "/")
+	case s3Endpoint != "":
+		root, err = url.Parse(strings.TrimSuffix(s3Endpoint, "/") + "/" + bucket + "/")
+	default:
+		root, err = url.Parse("https://" + bucket + ".s3.amazonaws.com/")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+
+	object := *root
+	object.Path += key
+	listing := *root
+	if listing.Path != "/" {
+		listing.Path = strings.TrimSuffix(listing.Path, "/")
+	}
+	prefix := key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	listing.RawQuery = url.Values{"prefix": {prefix}}.Encode()
+	return object.String(), listing.String(), nil
+}
+
+// listBucket lists the objects under the task's s3:// or gs:// prefix. The
+// listing is flat when recursive, and otherwise stops at the first "/" of
+// each key, like a directory listing.
+func (dt *downloadTask) listBucket(client *http.Client, lo *listingOptions) ([]listingEntry, error) {
+	page, err := url.Parse(dt.bucketListing)
+	if err != nil {
+		return nil, err
+	}
+	if !lo.recursive {
+		query := page.Query()
+		query.Set("delimiter", "/")
+		page.RawQuery = query.Encode()
+	}
+	entries, err := dt.listS3(client, page, nil, lo)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %v", dt.downloadURL, err)
+	}
+	return entries, nil
+}
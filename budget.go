@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultForegroundShare is the share of --total-rate-limit reserved for the
+// --foreground download.
+const defaultForegroundShare = "50%"
+
+// bandwidthBudget is the limiter shared by every download of the batch for
+// --total-rate-limit. Downloads draw on two token buckets: one for the
+// --foreground download, filled at its share of the budget, and one shared
+// by the rest, filled at the remainder. While only one kind is downloading
+// it gets the whole budget, and tokens one bucket has no room for spill into
+// the other, so bandwidth the foreground download can't use isn't wasted.
+type bandwidthBudget struct {
+	rate       int64   // Total bytes per second
+	share      float64 // Fraction reserved for the foreground download
+	foreground string  // URL of the foreground download, "" for none
+
+	// The buckets, background then foreground, hold the bytes each kind
+	// may read before waiting. A bucket goes negative when a read
+	// overdraws it, and the reader sleeps until it's paid back.
+	mutex   sync.Mutex
+	tokens  [2]float64
+	active  [2]int // Downloads of each kind in progress
+	running map[*downloadTask]bool
+	refill  time.Time
+}
+
+// newBandwidthBudget parses --total-rate-limit, --foreground and
+// --foreground-share, returning nil if there's no total rate limit.
+func newBandwidthBudget(totalRate, foreground, share, defaultScheme string) (*bandwidthBudget, error) {
+	if totalRate == "" {
+		if foreground != "" {
+			return nil, fmt.Errorf("--foreground needs --total-rate-limit to share")
+		}
+		return nil, nil
+	}
+	rate, err := parseRate(totalRate)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid --total-rate-limit %q: must be a rate, e.g. 2M", totalRate)
+	}
+	budget := newSharedRate(rate)
+	if foreground != "" {
+		if budget.foreground, err = normalizeURL(foreground, defaultScheme); err != nil {
+			return nil, fmt.Errorf("invalid --foreground: %s", err)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(share, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("invalid --foreground-share %q: must be a percentage between 0%% and 100%%, e.g. 70%%", share)
+		}
+		budget.share = percent / 100
+	}
+	return budget, nil
+}
+
+// newSharedRate returns a limiter of rate bytes per second shared by the
+// downloads that wait on it.
+func newSharedRate(rate int64) *bandwidthBudget {
+	return &bandwidthBudget{rate: rate, running: make(map[*downloadTask]bool), refill: time.Now()}
+}
+
+// kind returns which bucket the task draws on: 1 for the foreground
+// download, 0 for the others.
+func (bb *bandwidthBudget) kind(dt *downloadTask) int {
+	if bb.foreground != "" && dt.downloadURL == bb.foreground {
+		return 1
+	}
+	return 0
+}
+
+// rates returns how fast each bucket fills, given which kinds are active.
+func (bb *bandwidthBudget) rates() [2]float64 {
+	total := float64(bb.rate)
+	switch {
+	case bb.active[1] == 0:
+		return [2]float64{total, 0}
+	case bb.active[0] == 0:
+		return [2]float64{0, total}
+	}
+	return [2]float64{total * (1 - bb.share), total * bb.share}
+}
+
+// wait charges n bytes read by the task to its bucket, sleeping until the
+// budget allows them.
+func (bb *bandwidthBudget) wait(dt *downloadTask, n int) {
+	if bb == nil || n <= 0 {
+		return
+	}
+	kind := bb.kind(dt)
+
+	bb.mutex.Lock()
+	if !bb.running[dt] {
+		bb.running[dt] = true
+		bb.active[kind]++
+	}
+	now := time.Now()
+	rates := bb.rates()
+	elapsed := now.Sub(bb.refill).Seconds()
+	bb.refill = now
+	// A bucket holds a second's worth at its rate, and what it has no room
+	// for spills into the other, up to a second of the whole budget.
+	var spill [2]float64
+	for i := range bb.tokens {
+		bb.tokens[i] += elapsed * rates[i]
+		if bb.tokens[i] > rates[i] {
+			spill[1-i] = bb.tokens[i] - rates[i]
+			bb.tokens[i] = rates[i]
+		}
+	}
+	for i := range bb.tokens {
+		bb.tokens[i] += spill[i]
+		if bb.tokens[i] > float64(bb.rate) {
+			bb.tokens[i] = float64(bb.rate)
+		}
+	}
+	bb.tokens[kind] -= float64(n)
+	var delay time.Duration
+	if bb.tokens[kind] < 0 {
+		delay = time.Duration(-bb.tokens[kind] / rates[kind] * float64(time.Second))
+	}
+	bb.mutex.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-dt.ctx.Done():
+		}
+	}
+}
+
+// done stops counting the task as downloading, once it has finished.
+func (bb *bandwidthBudget) done(dt *downloadTask) {
+	if bb == nil {
+		return
+	}
+	bb.mutex.Lock()
+	defer bb.mutex.Unlock()
+	if bb.running[dt] {
+		delete(bb.running, dt)
+		bb.active[bb.kind(dt)]--
+	}
+}
+
+// waitBudgets charges n bytes read by the task to the rate limits it shares
+// with other downloads: --total-rate-limit and its group's --group-limit.
+func (dt *downloadTask) waitBudgets(n int) {
+	dt.options.budget.wait(dt, n)
+	if dt.group != nil {
+		dt.group.budget.wait(dt, n)
+	}
+}
+
+// leaveBudgets stops counting the finished task against the shared limits.
+func (dt *downloadTask) leaveBudgets() {
+	dt.options.budget.done(dt)
+	if dt.group != nil {
+		dt.group.budget.done(dt)
+	}
+}
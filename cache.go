@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// cacheCommand maintains the --cache directory.
+var cacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "Maintain the --cache directory",
+	Subcommands: []cli.Command{
+		{
+			Name:  "gc",
+			Usage: "Remove the least recently used files until the cache fits in --max-size",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "max-size",
+				},
+			},
+			Action: cacheGCAction,
+		},
+	},
+}
+
+// downloadCache is a content-addressable store of downloaded files, shared by
+// every batch given the same --cache directory, so that an artifact several
+// projects use is only downloaded once. Files are kept under their SHA-256 in
+// objects/, and index/ maps a URL and the ETag the server gave it to the
+// file's SHA-256, for downloads without a checksum to look up.
+type downloadCache struct {
+	dir string
+}
+
+// cacheIndexEntry is what index/ records about a URL and ETag.
+type cacheIndexEntry struct {
+	URL    string `json:"url"`
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// newDownloadCache opens the --cache directory, creating it if needed, or
+// returns nil if dir is "".
+func newDownloadCache(dir string) (*downloadCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	for _, sub := range []string{"objects", "index"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("invalid --cache: %v", err)
+		}
+	}
+	return &downloadCache{dir: dir}, nil
+}
+
+// objectPath returns where the file with a SHA-256 is kept, fanned out by the
+// first two digits as git does.
+func (dc *downloadCache) objectPath(digest string) string {
+	return filepath.Join(dc.dir, "objects", digest[:2], digest)
+}
+
+// indexPath returns where the entry for a URL and ETag is kept.
+func (dc *downloadCache) indexPath(rawURL, etag string) string {
+	key := sha256.Sum256([]byte(rawURL + "\n" + etag))
+	return filepath.Join(dc.dir, "index", hex.EncodeToString(key[:])+".json")
+}
+
+// cacheableETag returns the response's ETag if it identifies the content,
+// or "" for none or a weak one, which only promises equivalent content.
+func cacheableETag(response *http.Response) string {
+	etag := response.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
+
+// lookup returns the SHA-256 of the cached file for a download, found by its
+// expected checksum or else by its URL and ETag, or "" if it isn't cached.
+func (dc *downloadCache) lookup(dt *downloadTask, response *http.Response) string {
+	digest := dt.expectedSum
+	if digest == "" {
+		etag := cacheableETag(response)
+		if etag == "" {
+			return ""
+		}
+		data, err := os.ReadFile(dc.indexPath(dt.downloadURL, etag))
+		if err != nil {
+			return ""
+		}
+		var entry cacheIndexEntry
+		if json.Unmarshal(data, &entry) != nil || len(entry.SHA256) != sha256.Size*2 {
+			return ""
+		}
+		digest = entry.SHA256
+	}
+	if _, err := os.Stat(dc.objectPath(digest)); err != nil {
+		return ""
+	}
+	return digest
+}
+
+// fromCache copies the cached file for the task's download to fileName,
+// reporting whether there was one. The cached file's time is updated so
+// that gc keeps recently used files.
+func (dt *downloadTask) fromCache(response *http.Response, fileName string) (bool, error) {
+	dc := dt.options.cache
+	digest := dc.lookup(dt, response)
+	if digest == "" {
+		return false, nil
+	}
+	object := dc.objectPath(digest)
+	size, err := copyFile(object, fileName)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	os.Chtimes(object, now, now)
+	transportLog.Info("copied from cache", "url", dt.downloadURL, "sha256", digest)
+	dt.log.event("cache_hit", map[string]interface{}{"sha256": digest})
+	dt.cachedSum = digest
+	dt.startTime = now
+	dt.fileName = fileName
+	dt.totalFileSize = size
+	dt.bytesRead = size
+	return true, nil
+}
+
+// store adds a completed download to the cache. Failing to is logged, and
+// doesn't fail the download.
+func (dc *downloadCache) store(dt *downloadTask) {
+	if dc == nil || dt.cachedSum != "" || dt.options.discard || dt.options.streamsOutput() || dt.options.form != nil || dt.fileName == "" {
+		return
+	}
+	var digest string
+	if dt.hasher != nil {
+		digest = hex.EncodeToString(dt.hasher.Sum(nil))
+	} else {
+		var err error
+		if digest, err = hashFile(dt.fileName); err != nil {
+			transportLog.Warn("caching the download failed", "url", dt.downloadURL, "error", err)
+			return
+		}
+	}
+
+	object := dc.objectPath(digest)
+	size, err := fileSize(object)
+	if err != nil {
+		size, err = dc.addObject(dt.fileName, object)
+	}
+	if err != nil {
+		transportLog.Warn("caching the download failed", "url", dt.downloadURL, "error", err)
+		return
+	}
+	if response := dt.getLastResponse(); response != nil {
+		if etag := cacheableETag(response); etag != "" {
+			data, _ := json.Marshal(cacheIndexEntry{URL: dt.downloadURL, ETag: etag, SHA256: digest, Size: size})
+			if err := writeFileAtomic(dc.indexPath(dt.downloadURL, etag), data); err != nil {
+				transportLog.Warn("indexing the cached download failed", "url", dt.downloadURL, "error", err)
+			}
+		}
+	}
+}
+
+// addObject copies a file into the cache under a temporary name and renames
+// it into place, so that a concurrent lookup never sees half a file.
+func (dc *downloadCache) addObject(fileName, object string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		return 0, err
+	}
+	temp := fmt.Sprintf("%s.%d.tmp", object, os.Getpid())
+	size, err := copyFile(fileName, temp)
+	if err == nil {
+		err = os.Rename(temp, object)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return 0, err
+	}
+	return size, nil
+}
+
+// writeFileAtomic writes a small file under a temporary name and renames it
+// into place.
+func writeFileAtomic(fileName string, data []byte) error {
+	temp := fmt.Sprintf("%s.%d.tmp", fileName, os.Getpid())
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, fileName); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// copyFile copies src to dst, replacing dst, and returns the size copied.
+// Copies are used rather than links so that editing a downloaded file can't
+// change the cache.
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+func fileSize(fileName string) (int64, error) {
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+// cacheObject is a file in objects/, for gc.
+type cacheObject struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// cacheGCAction removes the least recently used files from the cache until
+// it fits in --max-size, then the index entries of the files removed.
+func cacheGCAction(c *cli.Context) error {
+	dir := c.GlobalString("cache")
+	if dir == "" || c.String("max-size") == "" || c.NArg() != 0 {
+		return cli.NewExitError("usage: gograb --cache <dir> cache gc --max-size <size>", exitUsageError)
+	}
+	maxSize, err := parseSize(c.String("max-size"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("invalid --max-size: %s", err), exitUsageError)
+	}
+
+	var objects []cacheObject
+	var total int64
+	err = filepath.WalkDir(filepath.Join(dir, "objects"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, cacheObject{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].modTime.Before(objects[j].modTime) })
+	var removed int
+	var freed int64
+	for _, object := range objects {
+		if total-freed <= maxSize {
+			break
+		}
+		if err := os.Remove(object.path); err != nil {
+			return cli.NewExitError(err.Error(), exitAllFailed)
+		}
+		removed++
+		freed += object.size
+	}
+
+	// Index entries of removed files would only ever miss.
+	indexes, err := os.ReadDir(filepath.Join(dir, "index"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	dc := &downloadCache{dir: dir}
+	for _, index := range indexes {
+		indexPath := filepath.Join(dir, "index", index.Name())
+		data, err := os.ReadFile(indexPath)
+		if err != nil {
+			continue
+		}
+		var entry cacheIndexEntry
+		if json.Unmarshal(data, &entry) != nil || len(entry.SHA256) != sha256.Size*2 {
+			os.Remove(indexPath)
+			continue
+		}
+		if _, err := os.Stat(dc.objectPath(entry.SHA256)); errors.Is(err, fs.ErrNotExist) {
+			os.Remove(indexPath)
+		}
+	}
+
+	fmt.Printf("Removed %d files, freeing %s; the cache now holds %s\n", removed, strings.TrimSpace(humanReadableSize(freed)), strings.TrimSpace(humanReadableSize(total-freed)))
+	return nil
+}
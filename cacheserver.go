@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// cacheSumHeader carries a download's expected SHA-256 to the cache server,
+// which can then serve the file by checksum and verifies it before storing.
+const cacheSumHeader = "X-Gograb-Sha256"
+
+// cacheServerCommand serves the --cache directory to other gograb clients.
+var cacheServerCommand = cli.Command{
+	Name:  "cache-server",
+	Usage: "Serve the --cache directory to other gograb clients, downloading what it lacks",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:3142",
+		},
+	},
+	Action: cacheServerAction,
+}
+
+// hopHeaders are the headers of a single connection, which a proxy mustn't
+// pass on.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// cacheServer is a caching proxy for a LAN, such as a CI farm: clients given
+// --cache-server ask it for their downloads at /fetch?url=..., and it serves
+// the files it has in its cache and downloads the others, storing them as it
+// passes them on, so each artifact crosses the WAN once.
+type cacheServer struct {
+	cache  *downloadCache
+	client *http.Client
+}
+
+// cacheServerAction runs the cache server until it is killed.
+func cacheServerAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return cli.NewExitError("usage: gograb --cache <dir> cache-server [--listen addr]", exitUsageError)
+	}
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	if options.cache == nil {
+		return cli.NewExitError("usage: gograb --cache <dir> cache-server [--listen addr]", exitUsageError)
+	}
+	// The server downloads for itself rather than through another one.
+	options.cacheServer = nil
+
+	server := &cacheServer{cache: options.cache, client: newHTTPClient(options)}
+	fmt.Printf("Serving %s on %s\n", options.cache.dir, c.String("listen"))
+	if err := http.ListenAndServe(c.String("listen"), server); err != nil {
+		return cli.NewExitError(err.Error(), exitNetworkError)
+	}
+	return nil
+}
+
+func (cs *cacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/fetch" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "only GET and HEAD are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+		http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	digest := strings.ToLower(r.Header.Get(cacheSumHeader))
+	if len(digest) != sha256.Size*2 {
+		digest = ""
+	}
+
+	if digest != "" && cs.serveObject(w, r, digest, "") {
+		return
+	}
+
+	// A file cached under the URL and the ETag upstream still sends is served
+	// from the cache, with the rest of upstream's headers, which a HEAD
+	// request fetches without the file.
+	// Servers that refuse HEAD have the file's ETag checked as it arrives.
+	head, err := cs.fetch(r, http.MethodHead, upstream)
+	if err == nil {
+		head.Body.Close()
+		if cs.serveIndexed(w, r, head, upstream.String()) {
+			return
+		}
+	}
+	headFailed := err != nil || head.StatusCode >= 400
+
+	response := head
+	if r.Method != http.MethodHead {
+		response, err = cs.fetch(r, r.Method, upstream)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	if headFailed && cs.serveIndexed(w, r, response, upstream.String()) {
+		return
+	}
+
+	copyHeaders(w.Header(), response.Header)
+	w.WriteHeader(response.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	// Only whole files are stored; ranges and errors are passed on as they are.
+	if response.StatusCode != http.StatusOK {
+		io.Copy(w, response.Body)
+		return
+	}
+	cs.relayAndStore(w, response, upstream.String(), digest)
+}
+
+// fetch sends the client's request upstream with the method given.
+func (cs *cacheServer) fetch(r *http.Request, method string, upstream *url.URL) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), method, upstream.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header = r.Header.Clone()
+	for _, header := range append(hopHeaders, cacheSumHeader) {
+		request.Header.Del(header)
+	}
+	// Files are cached as the server stores them, not as sent compressed.
+	request.Header.Set("Accept-Encoding", "identity")
+	// A HEAD request only asks for the whole file's ETag.
+	if method == http.MethodHead {
+		request.Header.Del("Range")
+		request.Header.Del("If-Range")
+	}
+	return cs.client.Do(request)
+}
+
+// serveIndexed serves the file cached under the URL and the ETag of
+// upstream's response, reporting whether the cache has it.
+func (cs *cacheServer) serveIndexed(w http.ResponseWriter, r *http.Request, response *http.Response, upstream string) bool {
+	etag := cacheableETag(response)
+	if etag == "" || response.StatusCode != http.StatusOK {
+		return false
+	}
+	data, err := os.ReadFile(cs.cache.indexPath(upstream, etag))
+	if err != nil {
+		return false
+	}
+	var entry cacheIndexEntry
+	if json.Unmarshal(data, &entry) != nil || len(entry.SHA256) != sha256.Size*2 {
+		return false
+	}
+	if _, err := os.Stat(cs.cache.objectPath(entry.SHA256)); err != nil {
+		return false
+	}
+	copyHeaders(w.Header(), response.Header)
+	return cs.serveObject(w, r, entry.SHA256, etag)
+}
+
+// serveObject serves a cached file, with range support, reporting whether
+// the cache has it.
+func (cs *cacheServer) serveObject(w http.ResponseWriter, r *http.Request, digest, etag string) bool {
+	file, err := os.Open(cs.cache.objectPath(digest))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	for _, header := range []string{"Content-Length", "Content-Range", "Content-Encoding", "Accept-Ranges"} {
+		w.Header().Del(header)
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("X-Cache", "HIT")
+	schedulerLog.Info("serving from cache", "sha256", digest, "client", r.RemoteAddr)
+	http.ServeContent(w, r, "", fileInfo.ModTime(), file)
+	return true
+}
+
+// relayAndStore passes a file on to the client while writing it to the
+// cache. It is stored once complete, if it matches digest when one was
+// given; a client that goes away doesn't stop the download, and a failure to
+// write to the cache only stops it being stored, not passed on.
+func (cs *cacheServer) relayAndStore(w http.ResponseWriter, response *http.Response, upstream, digest string) {
+	temp, err := os.CreateTemp(filepath.Join(cs.cache.dir, "objects"), "fetch-*.tmp")
+	if err != nil {
+		io.Copy(w, response.Body)
+		return
+	}
+	defer os.Remove(temp.Name())
+
+	hasher := sha256.New()
+	var clientErr, cacheErr error
+	buffer := make([]byte, 256*1024)
+	var size int64
+	for {
+		n, readErr := response.Body.Read(buffer)
+		if n > 0 {
+			if cacheErr == nil {
+				if _, cacheErr = temp.Write(buffer[:n]); cacheErr != nil {
+					schedulerLog.Warn("writing to the cache failed", "url", upstream, "error", cacheErr)
+				}
+			}
+			if clientErr != nil && cacheErr != nil {
+				temp.Close()
+				return
+			}
+			hasher.Write(buffer[:n])
+			size += int64(n)
+			if clientErr == nil {
+				_, clientErr = w.Write(buffer[:n])
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			temp.Close()
+			schedulerLog.Warn("fetching for the cache failed", "url", upstream, "error", readErr)
+			return
+		}
+	}
+	if err := temp.Close(); err != nil || cacheErr != nil {
+		return
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if digest != "" && sum != digest {
+		schedulerLog.Warn("not caching a file that failed verification", "url", upstream, "expected", digest, "got", sum)
+		return
+	}
+	object := cs.cache.objectPath(sum)
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		return
+	}
+	if err := os.Rename(temp.Name(), object); err != nil {
+		schedulerLog.Warn("storing in the cache failed", "url", upstream, "error", err)
+		return
+	}
+	if etag := cacheableETag(response); etag != "" {
+		data, _ := json.Marshal(cacheIndexEntry{URL: upstream, ETag: etag, SHA256: sum, Size: size})
+		writeFileAtomic(cs.cache.indexPath(upstream, etag), data)
+	}
+	schedulerLog.Info("cached", "url", upstream, "sha256", sum, "size", size)
+}
+
+// copyHeaders copies the end-to-end headers of a response.
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append([]string(nil), values...)
+	}
+	for _, header := range hopHeaders {
+		dst.Del(header)
+	}
+}
+
+// cacheServerTransport sends GET and HEAD requests to a cache server,
+// leaving the rest, such as --form submissions, to the next transport. The
+// response keeps the original request, so that file names and redirects are
+// derived from the download's URL.
+type cacheServerTransport struct {
+	server *url.URL
+	next   http.RoundTripper
+}
+
+func (ct *cacheServerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if (request.Method != http.MethodGet && request.Method != http.MethodHead) || request.Body != nil {
+		return ct.next.RoundTrip(request)
+	}
+	fetchURL := *ct.server
+	fetchURL.Path = strings.TrimSuffix(fetchURL.Path, "/") + "/fetch"
+	fetchURL.RawQuery = url.Values{"url": {request.URL.String()}}.Encode()
+	proxied := request.Clone(request.Context())
+	proxied.URL = &fetchURL
+	proxied.Host = ""
+	response, err := ct.next.RoundTrip(proxied)
+	if err != nil {
+		return nil, err
+	}
+	response.Request = request
+	return response, nil
+}
+
+// parseCacheServer parses --cache-server, or returns nil if value is "".
+func parseCacheServer(value string) (*url.URL, error) {
+	if value == "" {
+		return nil, nil
+	}
+	server, err := url.Parse(value)
+	if err != nil || (server.Scheme != "http" && server.Scheme != "https") || server.Host == "" {
+		return nil, fmt.Errorf("invalid --cache-server %q: must be an http or https URL", value)
+	}
+	return server, nil
+}
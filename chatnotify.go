@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const chatNotifyTimeout = 30 * time.Second // Longest a chat message may take to post
+
+// Default message templates, used when a notifier doesn't give its own.
+const (
+	defaultBatchTemplate   = `gograb on {{.Host}}: {{.Completed}} of {{.Total}} downloads completed{{if .Failed}}, {{.Failed}} failed{{end}} in {{.Duration}}`
+	defaultFailureTemplate = `gograb on {{.Host}}: {{.URL}} failed: {{.Error}}`
+)
+
+// chatNotifier posts to one chat service, as configured in the --notify
+// file.
+type chatNotifier struct {
+	Type     string `json:"type"`               // "slack", "discord" or "telegram"
+	Webhook  string `json:"webhook,omitempty"`  // Incoming webhook URL, for Slack and Discord
+	Token    string `json:"token,omitempty"`    // Bot token, for Telegram
+	Chat     string `json:"chat,omitempty"`     // Chat ID, for Telegram
+	On       string `json:"on,omitempty"`       // "batch", "failure" or "both" (the default)
+	Template string `json:"template,omitempty"` // text/template for the message, "" for the default
+
+	template *template.Template
+}
+
+// chatEvent is what a notifier's template is executed with. Batch messages
+// fill in the counts, failure messages the task's details.
+type chatEvent struct {
+	Event     string // "batch" or "failure"
+	Host      string
+	Total     int
+	Completed int
+	Failed    int
+	Duration  time.Duration
+	URL       string
+	File      string
+	Error     string
+}
+
+// chatNotifiers sends the messages of every notifier in the --notify file.
+// Failure messages are posted in the background while the batch goes on.
+type chatNotifiers struct {
+	notifiers []*chatNotifier
+	client    *http.Client
+	pending   sync.WaitGroup
+}
+
+// loadChatNotifiers reads the --notify file, a JSON object with a
+// "notifiers" list, or returns nil if fileName is "".
+func loadChatNotifiers(fileName string) (*chatNotifiers, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --notify: %v", err)
+	}
+	var config struct {
+		Notifiers []*chatNotifier `json:"notifiers"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid --notify %s: %v", fileName, err)
+	}
+	for i, notifier := range config.Notifiers {
+		if err := notifier.validate(); err != nil {
+			return nil, fmt.Errorf("invalid --notify %s: notifier %d: %v", fileName, i+1, err)
+		}
+	}
+	return &chatNotifiers{notifiers: config.Notifiers, client: &http.Client{Timeout: chatNotifyTimeout}}, nil
+}
+
+func (cn *chatNotifier) validate() error {
+	switch cn.Type {
+	case "slack", "discord":
+		if cn.Webhook == "" {
+			return fmt.Errorf("%s needs a webhook", cn.Type)
+		}
+	case "telegram":
+		if cn.Token == "" || cn.Chat == "" {
+			return fmt.Errorf("telegram needs a token and a chat")
+		}
+	default:
+		return fmt.Errorf("unknown type %q: must be slack, discord or telegram", cn.Type)
+	}
+	switch cn.On {
+	case "":
+		cn.On = "both"
+	case "batch", "failure", "both":
+	default:
+		return fmt.Errorf("invalid on %q: must be batch, failure or both", cn.On)
+	}
+	if cn.Template != "" {
+		var err error
+		if cn.template, err = template.New(cn.Type).Parse(cn.Template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// message renders the notifier's message for an event.
+func (cn *chatNotifier) message(event chatEvent) (string, error) {
+	tmpl := cn.template
+	if tmpl == nil {
+		text := defaultBatchTemplate
+		if event.Event == "failure" {
+			text = defaultFailureTemplate
+		}
+		tmpl = template.Must(template.New("default").Parse(text))
+	}
+	var message strings.Builder
+	if err := tmpl.Execute(&message, event); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// post sends a message in the form the notifier's service expects.
+func (cn *chatNotifier) post(client *http.Client, message string) error {
+	endpoint := cn.Webhook
+	var payload interface{}
+	switch cn.Type {
+	case "slack":
+		payload = map[string]string{"text": message}
+	case "discord":
+		payload = map[string]string{"content": message}
+	case "telegram":
+		endpoint = "https://api.telegram.org/bot" + url.PathEscape(cn.Token) + "/sendMessage"
+		payload = map[string]string{"chat_id": cn.Chat, "text": message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	response, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", cn.Type, response.Status)
+	}
+	return nil
+}
+
+// notify posts the event to every notifier that wants it. Failures to post
+// are logged and otherwise ignored.
+func (cns *chatNotifiers) notify(event chatEvent) {
+	for _, notifier := range cns.notifiers {
+		if notifier.On != "both" && notifier.On != event.Event {
+			continue
+		}
+		message, err := notifier.message(event)
+		if err == nil {
+			err = notifier.post(cns.client, message)
+		}
+		if err != nil {
+			schedulerLog.Warn("chat notification failed", "type", notifier.Type, "event", event.Event, "error", err)
+		}
+	}
+}
+
+// taskFailed posts a failure message for the task in the background.
+func (cns *chatNotifiers) taskFailed(dt *downloadTask) {
+	if cns == nil {
+		return
+	}
+	hostname, _ := os.Hostname()
+	event := chatEvent{Event: "failure", Host: hostname, URL: dt.downloadURL, File: dt.displayName(), Error: dt.error.Error()}
+	cns.pending.Add(1)
+	go func() {
+		defer cns.pending.Done()
+		cns.notify(event)
+	}()
+}
+
+// batchDone posts the batch summary, once any failure messages still in
+// flight have been posted.
+func (cns *chatNotifiers) batchDone(tasks []*downloadTask, started time.Time) {
+	if cns == nil {
+		return
+	}
+	cns.pending.Wait()
+	hostname, _ := os.Hostname()
+	event := chatEvent{Event: "batch", Host: hostname, Duration: time.Since(started).Round(time.Second)}
+	for _, task := range tasks {
+		if task == nil {
+			continue
+		}
+		event.Total++
+		if task.failed() {
+			event.Failed++
+		} else {
+			event.Completed++
+		}
+	}
+	cns.notify(event)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AndrewBlackwell/gograb/termutil"
+	"github.com/urfave/cli"
+)
+
+// checkCommand verifies local files against a checksum file.
+var checkCommand = cli.Command{
+	Name:      "check",
+	Usage:     "Verify local files against a SHA256SUMS file in parallel",
+	ArgsUsage: "[dir]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "sums",
+		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Value: runtime.NumCPU(),
+		},
+	},
+	Action: checkAction,
+}
+
+// checkResult is the outcome of verifying one file.
+type checkResult struct {
+	name   string
+	status string // "OK", "FAILED" or "MISSING"
+}
+
+// checkAction hashes every file listed in --sums, relative to dir (the current
+// directory by default), with --jobs files hashed at once, and reports the
+// files that are missing or don't match.
+func checkAction(c *cli.Context) error {
+	if c.NArg() > 1 || c.String("sums") == "" {
+		return cli.NewExitError("usage: gograb check --sums <SHA256SUMS> [--jobs N] [dir]", exitUsageError)
+	}
+	dir := "."
+	if c.NArg() == 1 {
+		dir = c.Args().First()
+	}
+	jobs := c.Int("jobs")
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	entries, err := readChecksumFile(c.String("sums"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	var totalBytes, hashedBytes, checkedFiles int64
+	for _, entry := range entries {
+		if fileInfo, err := os.Stat(filepath.Join(dir, filepath.FromSlash(entry.name))); err == nil {
+			totalBytes += fileInfo.Size()
+		}
+	}
+
+	results := make([]checkResult, len(entries))
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+
+	done, progressDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		showCheckProgress(done, &hashedBytes, totalBytes, &checkedFiles, len(entries))
+		close(progressDone)
+	}()
+
+	for i, entry := range entries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, entry checkResult, digest string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer atomic.AddInt64(&checkedFiles, 1)
+
+			sum, err := hashFileWithProgress(filepath.Join(dir, filepath.FromSlash(entry.name)), &hashedBytes)
+			switch {
+			case os.IsNotExist(err):
+				entry.status = "MISSING"
+			case err != nil || sum != digest:
+				entry.status = "FAILED"
+			default:
+				entry.status = "OK"
+			}
+			results[i] = entry
+		}(i, checkResult{name: entry.name}, entry.digest)
+	}
+	wg.Wait()
+	close(done)
+	<-progressDone
+
+	var failed int
+	for _, result := range results {
+		if result.status != "OK" {
+			failed++
+			fmt.Printf("%s: %s\n", result.name, result.status)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d files failed verification.\n", failed, len(results))
+		return cli.NewExitError("", exitVerifyError)
+	}
+	fmt.Printf("All %d files verified.\n", len(results))
+	return nil
+}
+
+// showCheckProgress redraws a single progress line until done is closed.
+func showCheckProgress(done chan struct{}, hashedBytes *int64, totalBytes int64, checkedFiles *int64, totalFiles int) {
+	width, err := termutil.TerminalWidth()
+	if err != nil {
+		width = 80
+	}
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	draw := func() {
+		hashed := atomic.LoadInt64(hashedBytes)
+		ratio := 1.0
+		if totalBytes > 0 {
+			ratio = float64(hashed) / float64(totalBytes)
+		}
+		info := fmt.Sprintf("|%s/%s|%d/%d files", strings.TrimSpace(humanReadableSize(hashed)), strings.TrimSpace(humanReadableSize(totalBytes)), atomic.LoadInt64(checkedFiles), totalFiles)
+		output := info
+		if barLength := width - visibleWidth(info) - 3; barLength > 4 {
+			output = "[" + renderBar(barLength, ratio) + "]" + info
+		}
+		fmt.Printf("\r%s", output)
+	}
+
+	for {
+		select {
+		case <-done:
+			draw()
+			fmt.Println()
+			return
+		case <-ticker.C:
+			draw()
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// checksumEntry is one line of a SHA256SUMS-style file.
+type checksumEntry struct {
+	name   string // File name as listed, possibly with a relative directory
+	digest string // Lowercase hex SHA-256 digest
+}
+
+// readChecksumFile reads a SHA256SUMS-style file with one "<hex digest>  <name>"
+// entry per line, as written by sha256sum (a "*" before the name marks binary
+// mode and is ignored).
+func readChecksumFile(fileName string) ([]checksumEntry, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseChecksums(file, fileName)
+}
+
+// parseChecksums parses SHA256SUMS-style lines, naming source in errors.
+func parseChecksums(reader io.Reader, source string) ([]checksumEntry, error) {
+	var entries []checksumEntry
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: malformed checksum line", source, line)
+		}
+		digest := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-256 digest %q", source, line, fields[0])
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(text[len(fields[0]):]), "*")
+		entries = append(entries, checksumEntry{name: name, digest: digest})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseChecksumFile reads a SHA256SUMS-style file into a map of digests keyed
+// by base name, since downloads are saved under the base name of the URL.
+func parseChecksumFile(fileName string) (map[string]string, error) {
+	entries, err := readChecksumFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		sums[path.Base(entry.name)] = entry.digest
+	}
+	return sums, nil
+}
+
+// hashFile returns the hex SHA-256 digest of a file's contents.
+func hashFile(fileName string) (string, error) {
+	return hashFileWithProgress(fileName, nil)
+}
+
+// hashFileWithProgress hashes a file like hashFile, atomically adding the
+// number of bytes hashed to progress as it goes when progress isn't nil.
+func hashFileWithProgress(fileName string, progress *int64) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if progress != nil {
+		reader = &countingReader{reader: file, count: progress}
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// countingReader atomically adds the number of bytes read to count.
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	atomic.AddInt64(cr.count, int64(n))
+	return n, err
+}
+
+// checksumMatches reports whether fileName exists locally with the checksum
+// expected for the task, or listed for it in --sums.
+func (dt *downloadTask) checksumMatches(fileName string) bool {
+	expected := dt.expectedSum
+	if expected == "" {
+		expected = dt.options.checksums[filepath.Base(fileName)]
+	}
+	if expected == "" || dt.options.discard {
+		return false
+	}
+	sum, err := hashFile(fileName)
+	return err == nil && sum == expected
+}
+
+// verify checks a successfully completed download against its --sums
+// checksum, and its signature if --auto-verify found one, returning a
+// verifyError on mismatch. The digest computed while
+// streaming is used when available; otherwise the saved file is hashed.
+func (dt *downloadTask) verify(err error) error {
+	if err == io.EOF && dt.signature != nil {
+		if sigErr := dt.verifySignature(); sigErr != nil {
+			return sigErr
+		}
+	}
+	if err != io.EOF || dt.expectedSum == "" {
+		return err
+	}
+
+	verifySpan := span{parentID: dt.spanID, name: "verify", kind: spanKindInternal, start: time.Now(), attributes: map[string]string{"hash": "sha256"}}
+	defer func() {
+		verifySpan.end = time.Now()
+		dt.options.tracer.record(verifySpan)
+	}()
+
+	var sum string
+	if dt.hasher != nil {
+		sum = hex.EncodeToString(dt.hasher.Sum(nil))
+	} else {
+		var hashErr error
+		if sum, hashErr = hashFile(dt.fileName); hashErr != nil {
+			verifySpan.err = hashErr.Error()
+			return hashErr
+		}
+	}
+
+	if sum != dt.expectedSum {
+		verifySpan.err = "sha256 mismatch"
+		return &verifyError{fileName: dt.fileName, err: fmt.Errorf("%w: sha256 expected %s, got %s", ErrChecksumMismatch, dt.expectedSum, sum)}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionExtensions are the --compress formats and the extension each
+// adds to the saved file's name.
+var compressionExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// parseCompression validates a --compress format, "" for none.
+func parseCompression(format string) (string, error) {
+	format = strings.ToLower(format)
+	if _, ok := compressionExtensions[format]; format != "" && !ok {
+		return "", fmt.Errorf("invalid --compress %q: must be zstd or gzip", format)
+	}
+	return format, nil
+}
+
+// streamOutput writes a download through a stream, such as a compressor or
+// an encryptor, on its way to the file. A stream can only be written in
+// order, so these downloads are neither segmented nor resumed.
+type streamOutput struct {
+	output outputFile
+	stream io.WriteCloser
+	closed bool
+}
+
+// newCompressedOutput wraps output in a compressor for format, counting the
+// compressed bytes written into written.
+func newCompressedOutput(output outputFile, format string, written *int64) (*streamOutput, error) {
+	counter := &countingWriter{writer: output, count: written}
+	var compressor io.WriteCloser
+	switch format {
+	case "gzip":
+		compressor = gzip.NewWriter(counter)
+	case "zstd":
+		encoder, err := zstd.NewWriter(counter)
+		if err != nil {
+			return nil, err
+		}
+		compressor = encoder
+	default:
+		return nil, fmt.Errorf("unknown compression format %q", format)
+	}
+	return &streamOutput{output: output, stream: compressor}, nil
+}
+
+func (so *streamOutput) Write(p []byte) (int, error) {
+	return so.stream.Write(p)
+}
+
+// WriteAt isn't supported: a stream can only be written in order.
+func (so *streamOutput) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("compressed or encrypted output only supports sequential writes")
+}
+
+// finishStream writes the end of the stream, once.
+func (so *streamOutput) finishStream() error {
+	if so.closed {
+		return nil
+	}
+	so.closed = true
+	return so.stream.Close()
+}
+
+// Sync ends the stream and flushes the file to disk, if the output supports
+// that. Nothing more can be written afterwards.
+func (so *streamOutput) Sync() error {
+	if err := so.finishStream(); err != nil {
+		return err
+	}
+	if syncer, ok := so.output.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Close ends the stream and closes the output beneath it.
+func (so *streamOutput) Close() error {
+	err := so.finishStream()
+	if closeErr := so.output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// getCompressedString describes how much a --compress download has written,
+// e.g. "212.40MB zstd", or returns "" if it isn't compressed.
+func (dt *downloadTask) getCompressedString() string {
+	if dt.options.compress == "" || dt.options.discard || dt.uploadFile != "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %s", strings.TrimSpace(humanReadableSize(atomic.LoadInt64(&dt.compressed))), dt.options.compress)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// credentialHelper looks up per-host credentials by running a helper that
+// speaks git's credential helper protocol, so tokens can come from the
+// platform keychain through the helpers git already ships with
+// (git-credential-osxkeychain, git-credential-manager,
+// git-credential-libsecret) instead of appearing on the command line. A nil
+// credentialHelper never returns credentials.
+type credentialHelper struct {
+	command []string
+	mutex   sync.Mutex
+	cache   map[string]string // Authorization header by scheme://host, "" if the helper had none
+}
+
+// newCredentialHelper creates a helper for the given command, or returns nil
+// if it is empty. As with git, a bare name such as "osxkeychain" runs
+// "git-credential-osxkeychain".
+func newCredentialHelper(command string) *credentialHelper {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) == 1 && !strings.ContainsAny(fields[0], `/\`) {
+		fields[0] = "git-credential-" + fields[0]
+	}
+	return &credentialHelper{command: fields, cache: make(map[string]string)}
+}
+
+// authorization returns the Authorization header to send to the URL's host,
+// or "" if the helper has no credentials for it. The helper is run once per
+// host.
+func (ch *credentialHelper) authorization(u *url.URL) (string, error) {
+	if ch == nil {
+		return "", nil
+	}
+	key := u.Scheme + "://" + u.Host
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if value, ok := ch.cache[key]; ok {
+		return value, nil
+	}
+
+	value, err := ch.get(u)
+	if err != nil {
+		return "", err
+	}
+	ch.cache[key] = value
+	return value, nil
+}
+
+// get runs "<helper> get" for the URL's host and converts the answer into an
+// Authorization header: Basic for a username and password, or the given
+// scheme for an authtype and credential.
+func (ch *credentialHelper) get(u *url.URL) (string, error) {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "protocol=%s\nhost=%s\n", u.Scheme, u.Host)
+	if u.User != nil {
+		fmt.Fprintf(&input, "username=%s\n", u.User.Username())
+	}
+	input.WriteString("\n")
+
+	cmd := exec.Command(ch.command[0], append(ch.command[1:], "get")...)
+	cmd.Stdin = &input
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s: %v", ch.command[0], err)
+	}
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), "="); ok {
+			fields[key] = value
+		}
+	}
+
+	switch {
+	case fields["authtype"] != "" && fields["credential"] != "":
+		return fields["authtype"] + " " + fields["credential"], nil
+	case fields["password"] != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(fields["username"]+":"+fields["password"])), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// batchDedupe spots downloads of the batch that are the same file, for
+// --dedupe: mirrored paths on one host, which answer with the same strong
+// ETag and Content-Length. The first of them downloads the file and the
+// others wait for it, then copy or hard link it instead of downloading it
+// again.
+type batchDedupe struct {
+	link bool // Hard link the copies where the file system allows
+
+	mutex   sync.Mutex
+	entries map[string]*dedupeEntry // By host, ETag and length
+}
+
+// dedupeEntry is a file being downloaded once for the batch.
+type dedupeEntry struct {
+	owner  *downloadTask
+	done   chan struct{} // Closed once the owner has finished
+	source string        // The owner's completed file, "" if it failed
+}
+
+// newBatchDedupe parses --dedupe, copy or link, returning nil if it isn't set.
+func newBatchDedupe(mode string) (*batchDedupe, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "copy", "link":
+		return &batchDedupe{link: mode == "link", entries: make(map[string]*dedupeEntry)}, nil
+	}
+	return nil, fmt.Errorf("invalid --dedupe %q: must be copy or link", mode)
+}
+
+// claim returns the entry of a download already fetching the content of the
+// task's response, or nil if there is none, in which case the task is the
+// one that fetches it for any others.
+func (bd *batchDedupe) claim(dt *downloadTask, response *http.Response) *dedupeEntry {
+	if bd == nil || dt.options.discard || dt.options.form != nil || dt.options.splitSize > 0 {
+		return nil
+	}
+	etag := cacheableETag(response)
+	if etag == "" || response.ContentLength < 0 || response.StatusCode != http.StatusOK {
+		return nil
+	}
+	key := response.Request.URL.Host + "\n" + etag + "\n" + strconv.FormatInt(response.ContentLength, 10)
+
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+	if entry := bd.entries[key]; entry != nil {
+		if entry.owner == dt {
+			return nil
+		}
+		return entry
+	}
+	bd.entries[key] = &dedupeEntry{owner: dt, done: make(chan struct{})}
+	return nil
+}
+
+// finished hands the task's file on to the downloads waiting for it, if it
+// fetched one for them. A failed download hands on nothing: those waiting
+// download the file themselves, and the next to come along fetches it for
+// any after it.
+func (bd *batchDedupe) finished(dt *downloadTask, succeeded bool) {
+	if bd == nil {
+		return
+	}
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+	for key, entry := range bd.entries {
+		if entry.owner != dt {
+			continue
+		}
+		if succeeded {
+			entry.source = dt.fileName
+		} else {
+			delete(bd.entries, key)
+		}
+		close(entry.done)
+	}
+}
+
+// fromDuplicate waits for the download fetching the same file as the task
+// and puts a copy of it at fileName, reporting whether there was one to
+// copy. If the other download failed, or its file can't be copied, the task
+// downloads the file itself.
+func (dt *downloadTask) fromDuplicate(entry *dedupeEntry, fileName string) (bool, error) {
+	select {
+	case <-entry.done:
+	case <-dt.ctx.Done():
+		return false, dt.ctx.Err()
+	}
+	if entry.source == "" {
+		return false, nil
+	}
+
+	var size int64
+	err := os.ErrInvalid
+	if dt.options.dedupe.link {
+		os.Remove(fileName)
+		if err = os.Link(entry.source, fileName); err == nil {
+			size, err = fileSize(fileName)
+		}
+	}
+	// Linking fails across file systems, and on some that can't.
+	if err != nil {
+		size, err = copyFile(entry.source, fileName)
+	}
+	if err != nil {
+		transportLog.Warn("copying the duplicate download failed, downloading", "url", dt.downloadURL, "from", entry.owner.downloadURL, "error", err)
+		return false, nil
+	}
+	transportLog.Info("same file as another download, copied", "url", dt.downloadURL, "from", entry.owner.downloadURL)
+	dt.log.event("duplicate", map[string]interface{}{"of": entry.owner.downloadURL})
+	dt.startTime = time.Now()
+	dt.fileName = fileName
+	dt.totalFileSize = size
+	dt.bytesRead = size
+	return true, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	directAlign      = 4096        // Alignment of direct I/O offsets, lengths and memory
+	directBufferSize = 1024 * 1024 // Bytes collected before each direct write
+)
+
+// directOutput writes a download around the page cache, for --direct-io, so
+// that a multi-hundred-GB file doesn't evict everything else the machine has
+// cached. Direct I/O needs aligned offsets, lengths and memory, so writes are
+// collected into an aligned buffer and written a megabyte at a time; the
+// unaligned start of a resumed file and the end of the download go through
+// the regular file.
+type directOutput struct {
+	file   *os.File // The file opened normally, for unaligned writes
+	direct *os.File // The same file opened for direct I/O
+	buffer []byte   // Aligned buffer, filled up to len
+	offset int64    // File offset the buffer starts at
+}
+
+// newDirectOutput wraps the output file for direct I/O. Writing continues at
+// the file's current offset.
+func newDirectOutput(file *os.File) (*directOutput, error) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := openDirect(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &directOutput{file: file, direct: direct, buffer: alignedBuffer(directBufferSize)[:0], offset: offset}, nil
+}
+
+// alignedBuffer allocates a buffer whose memory starts on a directAlign
+// boundary.
+func alignedBuffer(size int) []byte {
+	buffer := make([]byte, size+directAlign)
+	skip := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buffer[0])) % directAlign); remainder != 0 {
+		skip = directAlign - remainder
+	}
+	return buffer[skip : skip+size]
+}
+
+func (out *directOutput) Write(p []byte) (int, error) {
+	written := 0
+	// Bring a resumed file's offset up to alignment with regular writes.
+	if head := int((directAlign - out.offset%directAlign) % directAlign); head > 0 && len(out.buffer) == 0 {
+		if head > len(p) {
+			head = len(p)
+		}
+		n, err := out.file.WriteAt(p[:head], out.offset)
+		out.offset += int64(n)
+		if err != nil {
+			return n, err
+		}
+		p, written = p[head:], n
+	}
+
+	for len(p) > 0 {
+		n := copy(out.buffer[len(out.buffer):cap(out.buffer)], p)
+		out.buffer = out.buffer[:len(out.buffer)+n]
+		p, written = p[n:], written+n
+		if len(out.buffer) == cap(out.buffer) {
+			if err := out.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the aligned part of the buffer with direct I/O and, if final
+// is set, the rest through the regular file.
+func (out *directOutput) flush(final bool) error {
+	aligned := len(out.buffer) / directAlign * directAlign
+	if aligned > 0 {
+		if _, err := out.direct.WriteAt(out.buffer[:aligned], out.offset); err != nil {
+			return err
+		}
+		out.offset += int64(aligned)
+		out.buffer = out.buffer[:copy(out.buffer, out.buffer[aligned:])]
+	}
+	if final && len(out.buffer) > 0 {
+		if _, err := out.file.WriteAt(out.buffer, out.offset); err != nil {
+			return err
+		}
+		out.offset += int64(len(out.buffer))
+		out.buffer = out.buffer[:0]
+	}
+	return nil
+}
+
+// WriteAt isn't supported: the buffering relies on writes being sequential,
+// so --direct-io downloads aren't segmented.
+func (out *directOutput) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("direct I/O output only supports sequential writes")
+}
+
+// Sync writes out the rest of the buffer and flushes the file to disk.
+func (out *directOutput) Sync() error {
+	if err := out.flush(true); err != nil {
+		return err
+	}
+	return out.file.Sync()
+}
+
+func (out *directOutput) Close() error {
+	err := out.flush(true)
+	if closeErr := out.direct.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
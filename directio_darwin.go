@@ -0,0 +1,22 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens a file for writing with F_NOCACHE set, macOS's way of
+// bypassing the buffer cache.
+func openDirect(fileName string) (*os.File, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_NOCACHE, 1); errno != 0 {
+		file.Close()
+		return nil, errno
+	}
+	return file, nil
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens a file for writing with O_DIRECT, bypassing the page cache.
+func openDirect(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
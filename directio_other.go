@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openDirect reports that direct I/O isn't supported on this platform.
+func openDirect(fileName string) (*os.File, error) {
+	return nil, errors.New("--direct-io is not supported on this platform")
+}
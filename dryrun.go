@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// resolve follows redirects for the task's URL and derives the output filename
+// and size without downloading the body. HEAD is tried first, falling back to
+// a GET whose body is discarded unread for servers that reject HEAD.
+func (dt *downloadTask) resolve(client *http.Client) (*http.Response, error) {
+	request, err := dt.newRequest("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	response, err := dt.do(client, request)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && (statusErr.statusCode == http.StatusMethodNotAllowed || statusErr.statusCode == http.StatusNotImplemented) {
+		if request, err = dt.newRequest("GET"); err != nil {
+			return nil, err
+		}
+		response, err = dt.do(client, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	if dt.fileName, err = dt.outputFilename(response); err != nil {
+		return nil, err
+	}
+	dt.totalFileSize = response.ContentLength
+	dt.ranges = rangeSupportOf(response)
+	if dt.ranges == rangesUnknown {
+		if dt.ranges, err = dt.probeRanges(client); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// drainFeed appends the tasks sent on feed to tasks until feed is closed. A
+// nil feed, when there is no stdin or --watch-dir input, adds nothing.
+func drainFeed(tasks []*downloadTask, feed <-chan *downloadTask) []*downloadTask {
+	if feed == nil {
+		return tasks
+	}
+	for task := range feed {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// dryRun prints what each task would download and where it would be saved,
+// without writing anything to disk. It returns the batch exit code.
+func dryRun(tasks []*downloadTask) int {
+	for _, task := range tasks {
+		if task == nil {
+			continue
+		}
+		client := task.httpClient()
+		fmt.Println(task.downloadURL)
+		if task.resolveErr != nil {
+			task.error = task.resolveErr
+			fmt.Printf("  Error: %s\n", task.resolveErr)
+			continue
+		}
+
+		// Submitting a form can have side effects, so it isn't done for a
+		// dry run and the name and size of the response stay unknown.
+		if form := task.options.form; form != nil {
+			if size, err := form.size(); err != nil {
+				task.error = err
+				fmt.Printf("  Error: %s\n", err)
+			} else {
+				fmt.Printf("  would POST form: %d fields, %s\n", len(form.fields), strings.TrimSpace(humanReadableSize(size)))
+			}
+			continue
+		}
+
+		response, err := task.resolve(client)
+		if err != nil {
+			task.error = err
+			fmt.Printf("  Error: %s\n", err)
+			continue
+		}
+
+		if finalURL := response.Request.URL.String(); finalURL != task.downloadURL {
+			fmt.Printf("  redirected to: %s\n", finalURL)
+		}
+		fmt.Printf("  save to: %s\n", task.fileName)
+		if task.totalFileSize > 0 {
+			fmt.Printf("  size: %s\n", strings.TrimSpace(humanReadableSize(task.totalFileSize)))
+		} else {
+			fmt.Println("  size: unknown")
+		}
+		fmt.Printf("  ranges: %s\n", task.ranges)
+		if fileInfo, err := os.Stat(task.fileName); err == nil && !fileInfo.IsDir() {
+			switch {
+			case fileInfo.Size() == task.totalFileSize:
+				fmt.Println("  existing file: already downloaded")
+			case task.ranges == rangesSupported:
+				fmt.Printf("  existing file: %s, would resume\n", strings.TrimSpace(humanReadableSize(fileInfo.Size())))
+			default:
+				fmt.Printf("  existing file: %s, would download again\n", strings.TrimSpace(humanReadableSize(fileInfo.Size())))
+			}
+		}
+		if task.rateLimiter.limit > 0 {
+			fmt.Printf("  rate limit: %s/s\n", strings.TrimSpace(humanReadableSize(task.rateLimiter.limit)))
+		}
+		if len(task.options.headers) > 0 {
+			names := make([]string, 0, len(task.options.headers))
+			for name := range task.options.headers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Printf("  headers: %s\n", strings.Join(names, ", "))
+		}
+	}
+
+	return batchExitCode(tasks)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestOptions() *taskOptions {
+	return &taskOptions{
+		hosts:   newHostTracker(0, 0),
+		hsts:    &hstsCache{},
+		names:   newNameClaims(),
+		headers: map[string]string{},
+	}
+}
+
+func TestDrainFeed(t *testing.T) {
+	first, second := &downloadTask{}, &downloadTask{}
+	feed := make(chan *downloadTask, 1)
+	feed <- second
+	close(feed)
+
+	tests := []struct {
+		name string
+		feed <-chan *downloadTask
+		want int
+	}{
+		{"no stdin or watch dir", nil, 1},
+		{"closed feed", feed, 2},
+	}
+	for _, test := range tests {
+		done := make(chan []*downloadTask)
+		go func() { done <- drainFeed([]*downloadTask{first}, test.feed) }()
+		select {
+		case tasks := <-done:
+			if len(tasks) != test.want {
+				t.Errorf("%s: got %d tasks, want %d", test.name, len(tasks), test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: drainFeed didn't return", test.name)
+		}
+	}
+}
+
+func TestDryRunWithoutFeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "5")
+	}))
+	defer server.Close()
+
+	task, err := newDownloadTask(context.Background(), server.URL+"/file.bin", newTestOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int)
+	go func() { done <- dryRun(drainFeed([]*downloadTask{task}, nil)) }()
+	select {
+	case code := <-done:
+		if code != exitOK {
+			t.Errorf("dryRun returned %d, want %d", code, exitOK)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("dry run without stdin or --watch-dir didn't return")
+	}
+	if task.totalFileSize != 5 {
+		t.Errorf("size is %d, want 5", task.totalFileSize)
+	}
+}
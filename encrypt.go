@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// parseEncryption parses an --encrypt value, "age:" followed by an age
+// X25519 public key, and returns the recipient to encrypt saved files to, or
+// nil if value is "".
+func parseEncryption(value string) (age.Recipient, error) {
+	if value == "" {
+		return nil, nil
+	}
+	scheme, key, ok := strings.Cut(value, ":")
+	if !ok || scheme != "age" {
+		return nil, fmt.Errorf("invalid --encrypt %q: must be age:<recipient>, e.g. age:age1...", value)
+	}
+	recipient, err := age.ParseX25519Recipient(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --encrypt %q: %v", value, err)
+	}
+	return recipient, nil
+}
+
+// newEncryptedOutput wraps output in an age encryptor for recipient, so the
+// download is never written to disk in plaintext. Only the holder of the
+// recipient's identity can decrypt the file, with age -d.
+func newEncryptedOutput(output outputFile, recipient age.Recipient) (*streamOutput, error) {
+	encryptor, err := age.Encrypt(output, recipient)
+	if err != nil {
+		return nil, err
+	}
+	return &streamOutput{output: output, stream: encryptor}, nil
+}
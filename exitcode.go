@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Process exit codes reported at the end of a batch.
+const (
+	exitOK             = 0 // Every task succeeded
+	exitPartialFailure = 1 // Some tasks failed
+	exitAllFailed      = 2 // Every task failed
+	exitNetworkError   = 3 // All failures were network/transport errors
+	exitAuthError      = 4 // All failures were authentication/authorization errors
+	exitVerifyError    = 5 // All failures were integrity verification errors
+	exitUsageError     = 6 // Invalid arguments, nothing was downloaded
+)
+
+// Failure classes. Download errors wrap or match one of these when their class
+// is known, so callers branch on errors.Is instead of the error text.
+var (
+	ErrAuth             = errors.New("authentication failed")
+	ErrNotFound         = errors.New("not found")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrBadSignature     = errors.New("bad signature")
+	ErrStalled          = errors.New("download stalled")
+	ErrCancelled        = errors.New("download cancelled")
+)
+
+var errAlreadyDownloaded = errors.New("file already downloaded")
+
+// httpStatusError reports a response with an unexpected HTTP status code. It
+// matches ErrAuth for 401, 403 and 407 and ErrNotFound for 404 and 410.
+type httpStatusError struct {
+	statusCode int
+	body       string        // Start of the response body, if captured
+	retryAfter time.Duration // Delay requested by the server's Retry-After header
+}
+
+func (e *httpStatusError) Error() string {
+	if e.body != "" {
+		return fmt.Sprintf("HTTP request failed with status: %d: %s", e.statusCode, e.body)
+	}
+	return fmt.Sprintf("HTTP request failed with status: %d", e.statusCode)
+}
+
+func (e *httpStatusError) Is(target error) bool {
+	switch e.statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusProxyAuthRequired:
+		return target == ErrAuth
+	case http.StatusNotFound, http.StatusGone:
+		return target == ErrNotFound
+	}
+	return false
+}
+
+// verifyError reports a downloaded file that failed an integrity check.
+type verifyError struct {
+	fileName string
+	err      error // What failed, e.g. wrapping ErrChecksumMismatch
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("%s: verification failed: %v", e.fileName, e.err)
+}
+
+func (e *verifyError) Unwrap() error {
+	return e.err
+}
+
+// classifyError maps an error to one of the class-specific exit codes, or
+// returns exitOK when the error doesn't belong to a distinct class.
+func classifyError(err error) int {
+	var verifyErr *verifyError
+	var pinErr *pinError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrAuth):
+		return exitAuthError
+	case errors.Is(err, ErrChecksumMismatch), errors.As(err, &verifyErr), errors.As(err, &pinErr):
+		return exitVerifyError
+	case errors.As(err, &netErr), errors.Is(err, ErrStalled):
+		return exitNetworkError
+	}
+	return exitOK
+}
+
+// batchExitCode computes the process exit code for a finished batch. When every
+// failure shares the same class (auth, network, verify) that class's code is
+// returned; otherwise the result distinguishes partial from total failure.
+// Tasks cancelled or never started because of the batch failure policy count
+// as failures but don't affect the class.
+func batchExitCode(tasks []*downloadTask) int {
+	var total, failed int
+	class := exitOK
+	classified, mixed := false, false
+
+	for _, task := range tasks {
+		if task == nil {
+			continue
+		}
+		total++
+		if !task.failed() {
+			continue
+		}
+		failed++
+		if task.canceled() {
+			continue
+		}
+
+		taskClass := classifyError(task.error)
+		if !classified {
+			class, classified = taskClass, true
+		} else if class != taskClass {
+			mixed = true
+		}
+	}
+
+	switch {
+	case failed == 0:
+		return exitOK
+	case class != exitOK && !mixed:
+		return class
+	case failed == total:
+		return exitAllFailed
+	default:
+		return exitPartialFailure
+	}
+}
+
+// exitCodeOf returns the exit code an action's error ends the process with.
+func exitCodeOf(err error) int {
+	var exitErr cli.ExitCoder
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return exitPartialFailure
+	}
+}
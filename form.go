@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// formField is one --form field: a value, or a file uploaded from a path.
+type formField struct {
+	name  string
+	value string
+	file  string // Path of the file to upload, "" for a plain value
+}
+
+// formBody is a multipart/form-data request body that is streamed from the
+// files on disk rather than built in memory, so large uploads don't need to
+// fit in RAM.
+type formBody struct {
+	fields   []formField
+	boundary string
+}
+
+// parseForm parses --form values of the form "name=value" or "name=@path",
+// returning nil when there are none.
+func parseForm(values []string) (*formBody, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	body := &formBody{boundary: multipart.NewWriter(io.Discard).Boundary()}
+	for _, value := range values {
+		name, fieldValue, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --form %q: must be name=value or name=@path", value)
+		}
+		field := formField{name: name, value: fieldValue}
+		if strings.HasPrefix(fieldValue, "@") {
+			field.file, field.value = fieldValue[1:], ""
+			if fileInfo, err := os.Stat(field.file); err != nil {
+				return nil, fmt.Errorf("invalid --form %q: %v", value, err)
+			} else if !fileInfo.Mode().IsRegular() {
+				return nil, fmt.Errorf("invalid --form %q: %s is not a regular file", value, field.file)
+			}
+		}
+		body.fields = append(body.fields, field)
+	}
+	return body, nil
+}
+
+// contentType returns the Content-Type header for the body.
+func (fb *formBody) contentType() string {
+	return "multipart/form-data; boundary=" + fb.boundary
+}
+
+// size returns the exact length of the body: the multipart framing, written
+// with empty files, plus the size of each file.
+func (fb *formBody) size() (int64, error) {
+	var framing int64
+	writer := multipart.NewWriter(&countingWriter{count: &framing})
+	writer.SetBoundary(fb.boundary)
+
+	var files int64
+	for _, field := range fb.fields {
+		if field.file == "" {
+			writer.WriteField(field.name, field.value)
+			continue
+		}
+		if _, err := writer.CreateFormFile(field.name, filepath.Base(field.file)); err != nil {
+			return 0, err
+		}
+		fileInfo, err := os.Stat(field.file)
+		if err != nil {
+			return 0, err
+		}
+		files += fileInfo.Size()
+	}
+	writer.Close()
+	return framing + files, nil
+}
+
+// open returns a reader producing the body, counting the bytes read into sent.
+func (fb *formBody) open(sent *int64) io.ReadCloser {
+	atomic.StoreInt64(sent, 0)
+	reader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(fb.write(pipeWriter))
+	}()
+	return struct {
+		io.Reader
+		io.Closer
+	}{&countingReader{reader: reader, count: sent}, reader}
+}
+
+// write writes the multipart body to w.
+func (fb *formBody) write(w io.Writer) error {
+	writer := multipart.NewWriter(w)
+	writer.SetBoundary(fb.boundary)
+	for _, field := range fb.fields {
+		if field.file == "" {
+			if err := writer.WriteField(field.name, field.value); err != nil {
+				return err
+			}
+			continue
+		}
+		part, err := writer.CreateFormFile(field.name, filepath.Base(field.file))
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(field.file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// countingWriter passes writes on to writer, or discards them if it is nil,
+// atomically adding the number of bytes written to count.
+type countingWriter struct {
+	writer io.Writer
+	count  *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := len(p), error(nil)
+	if cw.writer != nil {
+		n, err = cw.writer.Write(p)
+	}
+	atomic.AddInt64(cw.count, int64(n))
+	return n, err
+}
+
+// newDownloadRequest creates the request that fetches the task's file: a GET,
+// or with --form a POST of the multipart form whose response is downloaded.
+// The body is left for do to open, once for every attempt.
+func (dt *downloadTask) newDownloadRequest() (*http.Request, error) {
+	form := dt.options.form
+	if form == nil {
+		request, err := dt.newRequest("GET")
+		if err == nil && !dt.options.newerThan.IsZero() {
+			request.Header.Set("If-Modified-Since", dt.options.newerThan.UTC().Format(http.TimeFormat))
+		}
+		return request, err
+	}
+	request, err := dt.newRequest("POST")
+	if err != nil {
+		return nil, err
+	}
+	size, err := form.size()
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", form.contentType())
+	request.GetBody = func() (io.ReadCloser, error) {
+		return form.open(&dt.uploadBytes), nil
+	}
+	atomic.StoreInt64(&dt.uploadTotal, size)
+	return request, nil
+}
+
+// getUploadString describes the progress of the task's form upload, e.g.
+// "Uploading [====>    ] 1.20MB/3.40MB", or returns "" if nothing is being
+// uploaded. width is the space available for it, 0 for no bar.
+func (dt *downloadTask) getUploadString(width int) string {
+	sent, total := atomic.LoadInt64(&dt.uploadBytes), atomic.LoadInt64(&dt.uploadTotal)
+	if total <= 0 || sent <= 0 {
+		return ""
+	}
+	info := fmt.Sprintf(" %s/%s", strings.TrimSpace(humanReadableSize(sent)), strings.TrimSpace(humanReadableSize(total)))
+	if barLength := width - len("Uploading []") - visibleWidth(info); barLength > 4 {
+		return "Uploading [" + renderBar(barLength, float64(sent)/float64(total)) + "]" + info
+	}
+	return fmt.Sprintf("Uploading %.2f%%%s", 100*float64(sent)/float64(total), info)
+}
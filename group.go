@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// taskGroup is a named set of downloads, chosen by host or URL with
+// --group, that share a rate limit and a concurrency limit and are totalled
+// together in the progress display.
+type taskGroup struct {
+	name     string
+	patterns []string         // Host globs the group's URLs match
+	urls     []*regexp.Regexp // URL patterns the group's URLs match
+	budget   *bandwidthBudget // Rate shared by the group from --group-limit, nil for none
+	slots    chan struct{}    // Downloads of the group running, from --group-concurrency, nil for no limit
+}
+
+// taskGroups are the groups in the order they were first given, which is
+// the order they are tried in.
+type taskGroups []*taskGroup
+
+// parseGroups parses the --group name=host glob or name=URL pattern rules,
+// repeated to add hosts and URLs to a group, and each group's --group-limit
+// name=rate and --group-concurrency name=N.
+func parseGroups(groups, limits, concurrency []string) (taskGroups, error) {
+	var tg taskGroups
+	byName := make(map[string]*taskGroup)
+	for _, value := range groups {
+		name, pattern, ok := strings.Cut(value, "=")
+		name, pattern = strings.TrimSpace(name), strings.TrimSpace(pattern)
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid --group %q: must be name=host or name=url", value)
+		}
+		group := byName[name]
+		if group == nil {
+			group = &taskGroup{name: name}
+			byName[name] = group
+			tg = append(tg, group)
+		}
+		if strings.Contains(pattern, "://") {
+			group.urls = append(group.urls, urlPattern(pattern))
+			continue
+		}
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --group %q: %v", value, err)
+		}
+		group.patterns = append(group.patterns, pattern)
+	}
+
+	for _, value := range limits {
+		name, rate, _ := strings.Cut(value, "=")
+		limit, err := parseRate(strings.TrimSpace(rate))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid --group-limit %q: must be name=rate, e.g. docs=1M", value)
+		}
+		group := byName[strings.TrimSpace(name)]
+		if group == nil {
+			return nil, fmt.Errorf("invalid --group-limit %q: no --group %s", value, name)
+		}
+		group.budget = newSharedRate(limit)
+	}
+	for _, value := range concurrency {
+		name, count, _ := strings.Cut(value, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid --group-concurrency %q: must be name=N, e.g. docs=2", value)
+		}
+		group := byName[strings.TrimSpace(name)]
+		if group == nil {
+			return nil, fmt.Errorf("invalid --group-concurrency %q: no --group %s", value, name)
+		}
+		group.slots = make(chan struct{}, n)
+	}
+	return tg, nil
+}
+
+// urlPattern compiles a --group URL pattern, in which "*" stands for any
+// run of characters, slashes included, and everything else for itself. The
+// scheme and host are matched case-insensitively, like host globs.
+func urlPattern(pattern string) *regexp.Regexp {
+	scheme, rest, _ := strings.Cut(pattern, "://")
+	host, pathPart := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, pathPart = rest[:i], rest[i:]
+	}
+	quote := func(s string) string {
+		return strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, ".*")
+	}
+	return regexp.MustCompile("^(?i:" + quote(scheme+"://"+host) + ")" + quote(pathPart) + "$")
+}
+
+// match returns the group of a URL, or nil if it's in none. Groups are
+// tried in order, each by its URL patterns and then its host globs.
+func (tg taskGroups) match(rawURL string) *taskGroup {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, group := range tg {
+		for _, pattern := range group.urls {
+			if pattern.MatchString(rawURL) {
+				return group
+			}
+		}
+		for _, pattern := range group.patterns {
+			if ok, _ := path.Match(pattern, host); ok {
+				return group
+			}
+		}
+	}
+	return nil
+}
+
+// enter waits for a slot of the group's --group-concurrency, if it has one,
+// reporting whether it took one. Meanwhile it gives back the download's slot
+// of --max-concurrent, if it has one, so that downloads of other groups can
+// start.
+func (group *taskGroup) enter(ctx context.Context, slots chan struct{}) (bool, error) {
+	if group == nil || group.slots == nil {
+		return false, nil
+	}
+	select {
+	case group.slots <- struct{}{}:
+		return true, nil
+	default:
+	}
+
+	if slots != nil {
+		<-slots
+		defer func() { slots <- struct{}{} }()
+	}
+	select {
+	case group.slots <- struct{}{}:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// leave gives back the task's slot of --group-concurrency.
+func (group *taskGroup) leave() {
+	<-group.slots
+}
+
+// groupTotals returns a line per group for the progress display: how many of
+// its downloads are done, how much of their total size has arrived and how
+// fast, e.g. "[docs] 2 of 5 done|12.3MB of 40.0MB|1.2MB/s".
+func groupTotals(tasks []*downloadTask) []string {
+	type totals struct {
+		count, done, failed int
+		bytes, size         int64
+		speed               float64
+	}
+	var order []string
+	byName := make(map[string]*totals)
+	for _, task := range tasks {
+		if task.group == nil {
+			continue
+		}
+		t := byName[task.group.name]
+		if t == nil {
+			t = &totals{}
+			byName[task.group.name] = t
+			order = append(order, task.group.name)
+		}
+		t.count++
+		switch {
+		case task.failed():
+			t.failed++
+		case task.error != nil:
+			t.done++
+		default:
+			task.mutex.Lock()
+			t.speed += task.bytesPerSecond
+			task.mutex.Unlock()
+		}
+		t.bytes += task.getBytesRead()
+		if task.totalFileSize > 0 {
+			t.size += task.totalFileSize
+		}
+	}
+
+	lines := make([]string, 0, len(order))
+	for _, name := range order {
+		t := byName[name]
+		line := fmt.Sprintf("[%s] %s", name, trf("%d of %d done", t.done, t.count))
+		if t.failed > 0 {
+			line += ", " + trf("%d failed", t.failed)
+		}
+		line += fmt.Sprintf("|%s of %s|%s/s", strings.TrimSpace(humanReadableSize(t.bytes)), strings.TrimSpace(humanReadableSize(t.size)), strings.TrimSpace(humanReadableSize(int64(t.speed))))
+		lines = append(lines, line)
+	}
+	return lines
+}
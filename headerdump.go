@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// headerDump writes the final response headers of every task to the
+// --dump-headers file, in the format of curl's --dump-header, with a comment
+// line naming the task's URL before each response.
+type headerDump struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// newHeaderDump creates the --dump-headers file, or returns nil if fileName
+// is "".
+func newHeaderDump(fileName string) (*headerDump, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --dump-headers: %v", err)
+	}
+	return &headerDump{file: file}, nil
+}
+
+// write appends the last response the task received. Tasks that never got a
+// response, such as those skipped by --sums, are left out.
+func (hd *headerDump) write(dt *downloadTask) {
+	if hd == nil {
+		return
+	}
+	response := dt.getLastResponse()
+	if response == nil {
+		return
+	}
+	hd.mutex.Lock()
+	defer hd.mutex.Unlock()
+	fmt.Fprintf(hd.file, "# %s\r\n%s %s\r\n", dt.downloadURL, response.Proto, response.Status)
+	response.Header.Write(hd.file)
+	fmt.Fprint(hd.file, "\r\n")
+}
+
+// getLastResponse returns the last response the task received, nil if none.
+func (dt *downloadTask) getLastResponse() *http.Response {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	return dt.lastResponse
+}
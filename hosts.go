@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const breakerMaxCooldown = 10 * time.Minute // Upper bound for a repeatedly reopened circuit
+
+// hostState holds the throttling and circuit breaker state of a single host.
+type hostState struct {
+	backoffUntil  time.Time     // No requests should be sent before this time
+	backoffReason string        // Why the host is being backed off from
+	failures      int           // Consecutive failed requests
+	openUntil     time.Time     // The circuit stays open until this time
+	cooldown      time.Duration // How long the circuit was last opened for
+	probing       bool          // A probe request is in flight on a half-open circuit
+	nextStart     time.Time     // Earliest start for the next task under --wait
+}
+
+// hostTracker tracks per-host state shared by every task in a batch, so that
+// a throttling response seen by one task delays the others using that host,
+// and a host that keeps failing is given a rest instead of more requests.
+type hostTracker struct {
+	mutex            sync.Mutex
+	hosts            map[string]*hostState
+	breakerThreshold int           // Consecutive failures that open the circuit, 0 disables it
+	breakerCooldown  time.Duration // How long the circuit stays open the first time
+}
+
+// newHostTracker creates an empty host tracker with the given circuit breaker settings.
+func newHostTracker(breakerThreshold int, breakerCooldown time.Duration) *hostTracker {
+	return &hostTracker{
+		hosts:            make(map[string]*hostState),
+		breakerThreshold: breakerThreshold,
+		breakerCooldown:  breakerCooldown,
+	}
+}
+
+// state returns the state for host, creating it if needed. The caller must
+// hold the mutex.
+func (t *hostTracker) state(host string) *hostState {
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &hostState{}
+		t.hosts[host] = state
+	}
+	return state
+}
+
+// backoff delays further requests to host until the given time. An existing
+// longer backoff is kept.
+func (t *hostTracker) backoff(host string, until time.Time, reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.state(host)
+	if until.After(state.backoffUntil) {
+		transportLog.Info("backing off host", "host", host, "until", until.Format(time.RFC3339), "reason", reason)
+		state.backoffUntil = until
+		state.backoffReason = reason
+	}
+}
+
+// backoffFor returns when requests to host may resume and why, or the zero
+// time if the host isn't being backed off from.
+func (t *hostTracker) backoffFor(host string) (time.Time, string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.state(host)
+	if time.Now().Before(state.backoffUntil) {
+		return state.backoffUntil, state.backoffReason
+	}
+	return time.Time{}, ""
+}
+
+// reserveStart returns when the next task for host may start, so that task
+// starts are spaced at least delay apart.
+func (t *hostTracker) reserveStart(host string, delay time.Duration) time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.state(host)
+	start := state.nextStart
+	if now := time.Now(); start.Before(now) {
+		start = now
+	}
+	state.nextStart = start.Add(delay)
+	return start
+}
+
+// observe inspects a response for throttling signals: a Retry-After header on
+// 429/503 responses, or an exhausted X-RateLimit-Remaining quota with an
+// X-RateLimit-Reset time.
+func (t *hostTracker) observe(host string, response *http.Response) {
+	now := time.Now()
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		if wait, ok := parseRetryAfter(response.Header.Get("Retry-After"), now); ok {
+			t.backoff(host, now.Add(wait), "server throttled")
+			return
+		}
+	}
+
+	if strings.TrimSpace(response.Header.Get("X-RateLimit-Remaining")) == "0" {
+		if until, ok := parseRateLimitReset(response.Header.Get("X-RateLimit-Reset"), now); ok {
+			t.backoff(host, until, "rate limit exhausted")
+		}
+	}
+}
+
+// parseRateLimitReset parses an X-RateLimit-Reset header. Servers send either
+// a Unix timestamp or a number of seconds until the quota resets; values too
+// large to be a delay are treated as timestamps.
+func parseRateLimitReset(value string, now time.Time) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	if seconds > 1000000000 {
+		return time.Unix(seconds, 0), true
+	}
+	return now.Add(time.Duration(seconds) * time.Second), true
+}
+
+// admit checks the host's circuit before a request. It returns the zero time
+// if the request may be sent, or when to check again while the circuit is
+// open. Once the cooldown has passed a single request is let through as a
+// probe, reported by probe; the others keep waiting until it succeeds or
+// fails. A probe that is never recorded must be ended with endProbe.
+func (t *hostTracker) admit(host string) (until time.Time, probe bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.breakerThreshold <= 0 {
+		return time.Time{}, false
+	}
+
+	state := t.state(host)
+	now := time.Now()
+	switch {
+	case state.failures < t.breakerThreshold:
+		return time.Time{}, false
+	case now.Before(state.openUntil):
+		return state.openUntil, false
+	case state.probing:
+		return now.Add(time.Second), false
+	default:
+		state.probing = true
+		return time.Time{}, true
+	}
+}
+
+// endProbe lets another request probe the host, after the one admitted as
+// its probe was given up without an outcome, such as by a cancelled pause.
+func (t *hostTracker) endProbe(host string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.state(host).probing = false
+}
+
+// record updates the host's circuit with the outcome of a request. Transport
+// errors and 5xx responses count as host failures; anything else, including
+// 4xx responses, shows the host is alive and closes the circuit.
+func (t *hostTracker) record(host string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.breakerThreshold <= 0 {
+		return
+	}
+
+	state := t.state(host)
+	wasProbing := state.probing
+	state.probing = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if !isHostFailure(err) {
+		state.failures = 0
+		state.cooldown = 0
+		return
+	}
+
+	state.failures++
+	if state.failures < t.breakerThreshold {
+		return
+	}
+	if wasProbing && state.cooldown > 0 {
+		state.cooldown *= 2
+		if state.cooldown > breakerMaxCooldown {
+			state.cooldown = breakerMaxCooldown
+		}
+	} else if state.cooldown == 0 {
+		state.cooldown = t.breakerCooldown
+	}
+	state.openUntil = time.Now().Add(state.cooldown)
+	transportLog.Warn("circuit opened", "host", host, "failures", state.failures, "cooldown", state.cooldown)
+}
+
+// isHostFailure reports whether err suggests the host itself is unhealthy.
+func isHostFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
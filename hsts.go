@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errPlaintextRefused is returned for http:// URLs under --https-only.
+var errPlaintextRefused = errors.New("refusing plaintext HTTP (--https-only)")
+
+// hstsEntry is a host's HTTP Strict Transport Security policy.
+type hstsEntry struct {
+	Expires           time.Time `json:"expires"`
+	IncludeSubdomains bool      `json:"include_subdomains,omitempty"`
+}
+
+// hstsCache remembers the hosts that asked, through a
+// Strict-Transport-Security header, to only be reached over HTTPS. It is
+// kept in the user cache directory so the policy outlives a single run.
+type hstsCache struct {
+	mutex     sync.Mutex
+	path      string // "" if the cache can't be saved
+	entries   map[string]hstsEntry
+	warned    map[string]bool // Hosts already warned about plaintext credentials
+	httpsOnly bool            // Refuse http:// URLs that can't be upgraded
+}
+
+// loadHSTSCache reads the HSTS cache. A missing or unreadable cache starts empty.
+func loadHSTSCache(httpsOnly bool) *hstsCache {
+	cache := &hstsCache{entries: make(map[string]hstsEntry), warned: make(map[string]bool), httpsOnly: httpsOnly}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return cache
+	}
+	cache.path = filepath.Join(dir, "gograb", "hsts.json")
+	if data, err := os.ReadFile(cache.path); err == nil {
+		json.Unmarshal(data, &cache.entries)
+	}
+	return cache
+}
+
+// known reports whether host has an unexpired HSTS policy, either its own or
+// one of its parent domains' with includeSubDomains.
+func (hc *hstsCache) known(host string) bool {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	now := time.Now()
+	if entry, ok := hc.entries[host]; ok && now.Before(entry.Expires) {
+		return true
+	}
+	for domain := host; strings.Contains(domain, "."); {
+		domain = domain[strings.Index(domain, ".")+1:]
+		if entry, ok := hc.entries[domain]; ok && entry.IncludeSubdomains && now.Before(entry.Expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// secure upgrades an http:// URL to https:// when its host is known to use
+// HSTS. It returns errPlaintextRefused for other http:// URLs under
+// --https-only.
+func (hc *hstsCache) secure(u *url.URL) error {
+	if u.Scheme != "http" {
+		return nil
+	}
+	if hc.known(strings.ToLower(u.Hostname())) {
+		u.Scheme = "https"
+		if u.Port() == "80" {
+			u.Host = u.Hostname()
+		}
+		return nil
+	}
+	if hc.httpsOnly {
+		return fmt.Errorf("%s: %w", u.Redacted(), errPlaintextRefused)
+	}
+	return nil
+}
+
+// observe records the Strict-Transport-Security policy of an HTTPS response.
+// Browsers ignore the header over plain HTTP, and so does this.
+func (hc *hstsCache) observe(response *http.Response) {
+	header := response.Header.Get("Strict-Transport-Security")
+	if header == "" || response.Request == nil || response.Request.URL.Scheme != "https" || response.TLS == nil {
+		return
+	}
+
+	var maxAge int64 = -1
+	var includeSubdomains bool
+	for _, directive := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			if seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil && seconds >= 0 {
+				maxAge = seconds
+			}
+		case "includesubdomains":
+			includeSubdomains = true
+		}
+	}
+	if maxAge < 0 {
+		return
+	}
+
+	host := strings.ToLower(response.Request.URL.Hostname())
+	entry := hstsEntry{Expires: time.Now().Add(time.Duration(maxAge) * time.Second), IncludeSubdomains: includeSubdomains}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	old, ok := hc.entries[host]
+	if maxAge == 0 {
+		if !ok {
+			return
+		}
+		delete(hc.entries, host)
+	} else {
+		// Renewals happen on every response; only save when the policy
+		// changed or was close to lapsing.
+		if ok && old.IncludeSubdomains == includeSubdomains && entry.Expires.Sub(old.Expires) < 24*time.Hour {
+			return
+		}
+		hc.entries[host] = entry
+	}
+	hc.save()
+}
+
+// save writes the cache. The caller must hold the mutex.
+func (hc *hstsCache) save() {
+	if hc.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(hc.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(hc.path), 0700); err == nil {
+		os.WriteFile(hc.path, data, 0600)
+	}
+}
+
+// warnCredentials warns, once per host, when a request carries credentials
+// over plaintext HTTP, where anyone on the path can read them.
+func (hc *hstsCache) warnCredentials(request *http.Request) {
+	if request.URL.Scheme != "http" || (request.Header.Get("Authorization") == "" && request.URL.User == nil) {
+		return
+	}
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if hc.warned[request.URL.Host] {
+		return
+	}
+	hc.warned[request.URL.Host] = true
+	transportLog.Warn("sending credentials over plaintext HTTP, anyone on the network path can read them", "host", request.URL.Host)
+}
+
+// secureURL applies the HSTS policy and --https-only to a URL given on the
+// command line, returning the URL to download from.
+func (options *taskOptions) secureURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if err := options.hsts.secure(parsed); err != nil {
+		return "", err
+	}
+	return parsed.String(), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// htmlSniffLength is how much of a response the --html-guard looks at,
+// which is all http.DetectContentType reads.
+const htmlSniffLength = 512
+
+// ErrHTMLPage is the reason a download fails under --html-guard fail.
+var ErrHTMLPage = errors.New("got an HTML page instead of the file")
+
+// htmlPageExtensions are extensions of pages servers generate as HTML, which
+// aren't suspect when they turn out to be.
+var htmlPageExtensions = map[string]bool{
+	".asp":  true,
+	".aspx": true,
+	".cgi":  true,
+	".jsp":  true,
+	".php":  true,
+	".pl":   true,
+}
+
+// parseHTMLGuard checks --html-guard: warn, the default, fail or off. An
+// unset mode is warn.
+func parseHTMLGuard(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "warn", nil
+	case "warn", "fail", "off":
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid --html-guard %q: must be warn, fail or off", mode)
+}
+
+// expectsHTML reports whether a file saved under fileName may well be an
+// HTML page: it has an HTML extension, one of a page generated by the
+// server, or none to go by.
+func expectsHTML(fileName string) bool {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	if extension == "" || htmlPageExtensions[extension] {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(extension))
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// guardHTML looks at the start of a fresh download's body for an HTML page
+// where the file's name promises something else, such as a captive portal,
+// a login form or an error page served with a 200 in place of an archive.
+// The task is marked suspect, or with --html-guard fail, fails. The bytes
+// read are put back for the download.
+func (dt *downloadTask) guardHTML(response *http.Response, fileName string) error {
+	if dt.options.htmlGuard == "off" || dt.options.htmlGuard == "" || response.StatusCode != http.StatusOK || expectsHTML(fileName) {
+		return nil
+	}
+	buffered := bufio.NewReaderSize(response.Body, htmlSniffLength)
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{buffered, response.Body}
+	head, _ := buffered.Peek(htmlSniffLength)
+	if mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head)); mediaType != "text/html" {
+		return nil
+	}
+
+	reason, err := "an HTML page", ErrHTMLPage
+	if match := titleRegex.FindSubmatch(head); match != nil {
+		title := strings.Join(strings.Fields(string(match[1])), " ")
+		reason, err = fmt.Sprintf("an HTML page titled %q", title), fmt.Errorf("%w, titled %q", ErrHTMLPage, title)
+	}
+	// The page may be a captive portal's, which the next download to start
+	// waits out.
+	dt.options.portal.recheck()
+	if dt.options.htmlGuard == "fail" {
+		return &verifyError{fileName: fileName, err: err}
+	}
+	transportLog.Warn("download looks like an HTML page, not the file asked for", "url", dt.downloadURL, "file", fileName, "page", reason)
+	dt.log.event("suspect", map[string]interface{}{"reason": reason})
+	dt.setSuspect(reason)
+	return nil
+}
+
+// setSuspect records what --html-guard found in place of the file. The
+// progress display reads it while the task runs.
+func (dt *downloadTask) setSuspect(reason string) {
+	dt.mutex.Lock()
+	dt.suspect = reason
+	dt.mutex.Unlock()
+}
+
+// getSuspect returns what --html-guard found in place of the file, "" if
+// nothing suspect.
+func (dt *downloadTask) getSuspect() string {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	return dt.suspect
+}
+
+// printSuspects lists the downloads --html-guard found to be HTML pages,
+// which are likely to be login or error pages rather than the files.
+func printSuspects(tasks []*downloadTask) {
+	for _, task := range tasks {
+		if task == nil {
+			continue
+		}
+		if suspect := task.getSuspect(); suspect != "" {
+			fmt.Println(trf("%s: suspect, got %s instead of the file", task.displayName(), suspect))
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// catalogs translate the strings of the progress display and the batch
+// summary, keyed by the English text. Strings a catalog lacks, and log
+// messages and errors from elsewhere, stay in English.
+var catalogs = map[string]map[string]string{
+	"de": {
+		"Waiting...":                      "Warte...",
+		"Error: %s":                       "Fehler: %s",
+		"%s: Error: %s":                   "%s: Fehler: %s",
+		"size unknown":                    "Größe unbekannt",
+		"N/A":                             "k. A.",
+		"done ~%s":                        "fertig ~%s",
+		"Download completed.":             "Download abgeschlossen.",
+		"Download completed with errors.": "Download mit Fehlern abgeschlossen.",
+		"Upload completed.":               "Upload abgeschlossen.",
+		"Upload completed with errors.":   "Upload mit Fehlern abgeschlossen.",
+		"waiting":                         "warte",
+		"backing off":                     "pausiere",
+		"retrying in":                     "neuer Versuch in",
+		"offline, retrying in":            "offline, neuer Versuch in",
+		"metered, checking in":            "getaktete Verbindung, Prüfung in",
+		"on battery, checking in":         "im Akkubetrieb, Prüfung in",
+		"sign-in required, checking in":   "Anmeldung erforderlich, Prüfung in",
+		"politeness delay":                "Höflichkeitspause",
+		"%s: done":                        "%s: fertig",
+		"%s: %s downloaded":               "%s: %s heruntergeladen",
+		"%s: %d%%, %s left":               "%s: %d%%, noch %s",
+		"%d of %d done":                   "%d von %d fertig",
+		"%d failed":                       "%d fehlgeschlagen",
+		"%.1f files/s":                    "%.1f Dateien/s",
+		"%s: saved as %s, another download has that name": "%s: als %s gespeichert, ein anderer Download hat diesen Namen",
+		"%s: suspect, got %s instead of the file":         "%s: verdächtig, statt der Datei kam %s",
+	},
+	"es": {
+		"Waiting...":                      "Esperando...",
+		"Error: %s":                       "Error: %s",
+		"%s: Error: %s":                   "%s: Error: %s",
+		"size unknown":                    "tamaño desconocido",
+		"N/A":                             "N/D",
+		"done ~%s":                        "termina ~%s",
+		"Download completed.":             "Descarga completada.",
+		"Download completed with errors.": "Descarga completada con errores.",
+		"Upload completed.":               "Subida completada.",
+		"Upload completed with errors.":   "Subida completada con errores.",
+		"waiting":                         "esperando",
+		"backing off":                     "en pausa",
+		"retrying in":                     "reintentando en",
+		"offline, retrying in":            "sin conexión, reintentando en",
+		"metered, checking in":            "conexión medida, comprobando en",
+		"on battery, checking in":         "con batería, comprobando en",
+		"sign-in required, checking in":   "requiere inicio de sesión, comprobando en",
+		"politeness delay":                "pausa de cortesía",
+		"%s: done":                        "%s: completado",
+		"%s: %s downloaded":               "%s: %s descargados",
+		"%s: %d%%, %s left":               "%s: %d%%, quedan %s",
+		"%d of %d done":                   "%d de %d completadas",
+		"%d failed":                       "%d fallidas",
+		"%.1f files/s":                    "%.1f archivos/s",
+		"%s: saved as %s, another download has that name": "%s: guardado como %s, otra descarga tiene ese nombre",
+		"%s: suspect, got %s instead of the file":         "%s: sospechoso, se recibió %s en lugar del archivo",
+	},
+	"fr": {
+		"Waiting...":                      "En attente...",
+		"Error: %s":                       "Erreur : %s",
+		"%s: Error: %s":                   "%s : Erreur : %s",
+		"size unknown":                    "taille inconnue",
+		"N/A":                             "N/D",
+		"done ~%s":                        "fin ~%s",
+		"Download completed.":             "Téléchargement terminé.",
+		"Download completed with errors.": "Téléchargement terminé avec des erreurs.",
+		"Upload completed.":               "Envoi terminé.",
+		"Upload completed with errors.":   "Envoi terminé avec des erreurs.",
+		"waiting":                         "attente",
+		"backing off":                     "temporisation",
+		"retrying in":                     "nouvel essai dans",
+		"offline, retrying in":            "hors ligne, nouvel essai dans",
+		"metered, checking in":            "connexion limitée, vérification dans",
+		"on battery, checking in":         "sur batterie, vérification dans",
+		"sign-in required, checking in":   "connexion requise, vérification dans",
+		"politeness delay":                "délai de politesse",
+		"%s: done":                        "%s : terminé",
+		"%s: %s downloaded":               "%s : %s téléchargés",
+		"%s: %d%%, %s left":               "%s : %d %%, encore %s",
+		"%d of %d done":                   "%d sur %d terminés",
+		"%d failed":                       "%d en échec",
+		"%.1f files/s":                    "%.1f fichiers/s",
+		"%s: saved as %s, another download has that name": "%s : enregistré sous %s, un autre téléchargement porte ce nom",
+		"%s: suspect, got %s instead of the file":         "%s : suspect, reçu %s au lieu du fichier",
+	},
+	"ja": {
+		"Waiting...":                      "待機中...",
+		"Error: %s":                       "エラー: %s",
+		"%s: Error: %s":                   "%s: エラー: %s",
+		"size unknown":                    "サイズ不明",
+		"N/A":                             "不明",
+		"done ~%s":                        "完了予定 ~%s",
+		"Download completed.":             "ダウンロードが完了しました。",
+		"Download completed with errors.": "ダウンロードが完了しましたが、エラーがありました。",
+		"Upload completed.":               "アップロードが完了しました。",
+		"Upload completed with errors.":   "アップロードが完了しましたが、エラーがありました。",
+		"waiting":                         "待機中",
+		"backing off":                     "バックオフ中",
+		"retrying in":                     "再試行まで",
+		"offline, retrying in":            "オフライン、再試行まで",
+		"metered, checking in":            "従量制接続、再確認まで",
+		"on battery, checking in":         "バッテリー駆動、再確認まで",
+		"sign-in required, checking in":   "サインインが必要、確認まで",
+		"politeness delay":                "リクエスト間隔の待機",
+		"%s: done":                        "%s: 完了",
+		"%s: %s downloaded":               "%s: %s ダウンロード済み",
+		"%s: %d%%, %s left":               "%s: %d%%、残り %s",
+		"%d of %d done":                   "%d / %d 完了",
+		"%d failed":                       "%d 件失敗",
+		"%.1f files/s":                    "%.1f ファイル/秒",
+		"%s: saved as %s, another download has that name": "%s: 別のダウンロードと名前が重なるため %s として保存",
+		"%s: suspect, got %s instead of the file":         "%s: 疑わしい、ファイルの代わりに %s を受信",
+	},
+}
+
+// messages is the catalog in use, nil for English.
+var messages map[string]string
+
+// tr translates a UI string, returning it as it is if the catalog in use
+// doesn't have it.
+func tr(message string) string {
+	if translated, ok := messages[message]; ok {
+		return translated
+	}
+	return message
+}
+
+// trf translates a format string, then formats it.
+func trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(tr(format), args...)
+}
+
+// setLanguage chooses the catalog from --lang, a language such as "de" or a
+// JSON file of translations, or else from the locale in LC_ALL, LC_MESSAGES
+// or LANG, in the order POSIX gives them precedence. Locales without a
+// catalog fall back to English, but an unknown --lang is an error.
+func setLanguage(lang string) error {
+	if strings.HasSuffix(lang, ".json") {
+		data, err := os.ReadFile(lang)
+		if err != nil {
+			return fmt.Errorf("invalid --lang: %v", err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("invalid --lang %s: %v", lang, err)
+		}
+		messages = catalog
+		return nil
+	}
+
+	explicit := lang != ""
+	for _, variable := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if lang != "" {
+			break
+		}
+		lang = os.Getenv(variable)
+	}
+	// "de_DE.UTF-8@euro" and "de-DE" both select "de".
+	lang = strings.ToLower(lang)
+	if i := strings.IndexAny(lang, "_-.@"); i >= 0 {
+		lang = lang[:i]
+	}
+
+	switch catalog, ok := catalogs[lang]; {
+	case ok:
+		messages = catalog
+	case lang == "" || lang == "c" || lang == "posix" || lang == "en" || !explicit:
+		messages = nil
+	default:
+		available := make([]string, 0, len(catalogs))
+		for name := range catalogs {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		return fmt.Errorf("invalid --lang %q: must be en, %s, or a JSON catalog", lang, strings.Join(available, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// releaseInterval is how often the releaser checks for finished downloads.
+const releaseInterval = 100 * time.Millisecond
+
+// releaser hands finished downloads on to whatever consumes them: it moves
+// each staged file into place, or adds it to the --tar-output archive, runs
+// --exec on it and, under --in-order, prints its path. With --in-order,
+// files download concurrently but are released strictly in the order they
+// were given, each once every download before it has finished; otherwise
+// each is released as soon as it's done. A download that failed is passed
+// over without being released.
+type releaser struct {
+	inOrder bool
+	execCmd string
+	archive *batchArchive // Where files go instead of into place, nil to move them there
+
+	mutex    sync.Mutex
+	released map[*downloadTask]bool // Tasks released, or passed over as failed
+	notices  []string               // Paths released but not yet printed
+}
+
+// newReleaser returns the releaser for --in-order, --exec and --tar-output,
+// or nil if none is set.
+func newReleaser(inOrder bool, execCmd string, archive *batchArchive) *releaser {
+	if !inOrder && execCmd == "" && archive == nil {
+		return nil
+	}
+	return &releaser{inOrder: inOrder, execCmd: execCmd, archive: archive, released: make(map[*downloadTask]bool)}
+}
+
+// run releases the tasks of the batch as they finish, until done is closed
+// once every task has, then releases those left.
+func (rl *releaser) run(live *liveTasks, done <-chan struct{}) {
+	ticker := time.NewTicker(releaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			rl.releaseFinished(live.list())
+			return
+		case <-ticker.C:
+			rl.releaseFinished(live.list())
+		}
+	}
+}
+
+// releaseFinished releases the finished tasks not released yet, stopping
+// at the first unfinished one under --in-order.
+func (rl *releaser) releaseFinished(tasks []*downloadTask) {
+	for _, task := range tasks {
+		if rl.isReleased(task) {
+			continue
+		}
+		select {
+		case <-task.completionChan:
+		default:
+			if rl.inOrder {
+				return
+			}
+			continue
+		}
+		if !task.failed() {
+			if err := rl.release(task); err != nil {
+				uiLog.Warn("releasing a download failed", "url", task.downloadURL, "error", err)
+				task.error = err
+			}
+		}
+		rl.mutex.Lock()
+		rl.released[task] = true
+		rl.mutex.Unlock()
+	}
+}
+
+// isReleased reports whether the task is finished with: released, or passed
+// over because it failed. Without a releaser every task is.
+func (rl *releaser) isReleased(task *downloadTask) bool {
+	if rl == nil {
+		return true
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.released[task]
+}
+
+// forget drops a released task that the batch no longer lists.
+func (rl *releaser) forget(task *downloadTask) {
+	if rl == nil {
+		return
+	}
+	rl.mutex.Lock()
+	delete(rl.released, task)
+	rl.mutex.Unlock()
+}
+
+// release moves a task's file into place and hands it on. Under
+// --tar-output, only files downloaded go into the archive, rather than
+// those already there or not modified.
+func (rl *releaser) release(task *downloadTask) error {
+	if rl.archive != nil {
+		if task.error != io.EOF || task.finalName == "" {
+			return nil
+		}
+		if err := rl.archive.add(task); err != nil {
+			task.options.staging.hold()
+			return fmt.Errorf("adding %s to %s: %w", task.finalName, rl.archive.path, err)
+		}
+		return nil
+	}
+	if err := task.unstage(); err != nil {
+		return fmt.Errorf("moving %s into place: %w", task.finalName, err)
+	}
+	if task.options.discard || task.fileName == "" {
+		return nil
+	}
+	if rl.execCmd != "" {
+		if err := task.runExec(rl.execCmd); err != nil {
+			return err
+		}
+	}
+	if rl.inOrder {
+		rl.mutex.Lock()
+		rl.notices = append(rl.notices, task.fileName)
+		rl.mutex.Unlock()
+	}
+	return nil
+}
+
+// printNotices prints the paths released since it was last called, between
+// updates of the progress display so that they don't garble it.
+func (rl *releaser) printNotices() {
+	if rl == nil {
+		return
+	}
+	rl.mutex.Lock()
+	notices := rl.notices
+	rl.notices = nil
+	rl.mutex.Unlock()
+	for _, notice := range notices {
+		fmt.Println(notice)
+	}
+}
+
+// runExec runs --exec on the task's file once it is in place, with the same
+// "{}" substitution and environment as --scan-cmd. It isn't stopped when the
+// batch is, so that a file handed on is processed in full. A command that
+// fails fails the download.
+func (dt *downloadTask) runExec(command string) error {
+	args := hookArgs(command, dt.fileName)
+	cmd := exec.CommandContext(context.Background(), args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), dt.hookEnv("ok")...)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	reason := fmt.Sprintf("--exec %s on %s: %v", args[0], dt.fileName, err)
+	if firstLine, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n"); firstLine != "" {
+		reason += ": " + firstLine
+	}
+	return errors.New(reason)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// linkcheckCommand checks that URLs resolve without downloading them.
+var linkcheckCommand = cli.Command{
+	Name:      "linkcheck",
+	Usage:     "Check URLs with HEAD requests and report their status, redirects, size and latency",
+	ArgsUsage: "[url...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "input, i",
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Value: 8,
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+		},
+	},
+	Action: linkcheckAction,
+}
+
+// linkHop is one redirect a link went through: the redirect's status and
+// the URL it pointed to.
+type linkHop struct {
+	Status int    `json:"status"`
+	URL    string `json:"url"`
+}
+
+// linkResult is the outcome of checking one link.
+type linkResult struct {
+	URL       string    `json:"url"`
+	Status    int       `json:"status,omitempty"` // 0 if the request failed
+	Error     string    `json:"error,omitempty"`
+	Redirects []linkHop `json:"redirects,omitempty"`
+	FinalURL  string    `json:"final_url,omitempty"`
+	Size      int64     `json:"size"` // -1 if the server didn't say
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+// ok reports whether the link works.
+func (lr *linkResult) ok() bool {
+	return lr.Error == "" && lr.Status < 400
+}
+
+// readURLList reads a list of URLs, one per line, from a file or "-" for
+// stdin. Blank lines and lines starting with # are skipped.
+func readURLList(fileName string) ([]string, error) {
+	var reader io.Reader = os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	var urls []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// linkcheckAction checks the URLs given on the command line and in --input,
+// with at most --concurrency requests in flight, then prints a report in the
+// order the URLs were given, as text or, with --format json, as JSON.
+func linkcheckAction(c *cli.Context) error {
+	args := []string(c.Args())
+	if c.String("input") != "" {
+		urls, err := readURLList(c.String("input"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitUsageError)
+		}
+		args = append(args, urls...)
+	}
+	if len(args) == 0 {
+		return cli.NewExitError("usage: gograb linkcheck [-i urls.txt] [--concurrency N] [--format text|json] [url...]", exitUsageError)
+	}
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		return cli.NewExitError(fmt.Sprintf("invalid --format %q: must be text or json", format), exitUsageError)
+	}
+	if c.Int("concurrency") <= 0 {
+		return cli.NewExitError("--concurrency must be positive", exitUsageError)
+	}
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	ctx := context.Background()
+	tasks := make([]*downloadTask, 0, len(args))
+	for _, arg := range args {
+		task, err := newDownloadTask(ctx, arg, options)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+		}
+		tasks = append(tasks, task)
+	}
+
+	client := newHTTPClient(options)
+	results := make([]linkResult, len(tasks))
+	slots := make(chan struct{}, c.Int("concurrency"))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, task *downloadTask) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = task.checkLink(client)
+		}(i, task)
+	}
+	wg.Wait()
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(results)
+	} else {
+		printLinkReport(results)
+	}
+
+	var ok int
+	for i := range results {
+		if results[i].ok() {
+			ok++
+		}
+	}
+	switch {
+	case ok == len(results):
+		return nil
+	case ok == 0:
+		return cli.NewExitError("", exitAllFailed)
+	default:
+		return cli.NewExitError("", exitPartialFailure)
+	}
+}
+
+// checkLink sends a HEAD request for the task's URL, following redirects
+// like a download would and recording each one. Servers that refuse HEAD
+// are asked again with a GET whose body isn't read.
+func (dt *downloadTask) checkLink(client *http.Client) linkResult {
+	result := linkResult{URL: dt.downloadURL, Size: -1}
+	var hops []linkHop
+	tracing := *client
+	tracing.CheckRedirect = func(request *http.Request, via []*http.Request) error {
+		hops = append(hops, linkHop{Status: request.Response.StatusCode, URL: request.URL.String()})
+		return client.CheckRedirect(request, via)
+	}
+
+	start := time.Now()
+	response, err := dt.sendLinkCheck(&tracing, http.MethodHead)
+	if err == nil && (response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented) {
+		response.Body.Close()
+		hops = nil
+		start = time.Now()
+		response, err = dt.sendLinkCheck(&tracing, http.MethodGet)
+	}
+	result.LatencyMS = time.Since(start).Milliseconds()
+	result.Redirects = hops
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response.Body.Close()
+
+	result.Status = response.StatusCode
+	result.Size = response.ContentLength
+	if len(hops) > 0 {
+		result.FinalURL = response.Request.URL.String()
+	}
+	return result
+}
+
+// sendLinkCheck sends one link check request.
+func (dt *downloadTask) sendLinkCheck(client *http.Client, method string) (*http.Response, error) {
+	request, err := dt.newRequest(method)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(request)
+}
+
+// printLinkReport writes one line per link, followed by its redirects and
+// any error, then a count of the broken links.
+func printLinkReport(results []linkResult) {
+	var broken int
+	// The size column is wider for --bytes.
+	width := sizeWidth()
+	indent := width + 20
+	fmt.Printf("%-6s %*s  %7s  %s\n", "Status", width, "Size", "Latency", "URL")
+	for _, result := range results {
+		status := "error"
+		if result.Error == "" {
+			status = fmt.Sprint(result.Status)
+		}
+		size := "-"
+		if result.Size >= 0 {
+			size = humanReadableSize(result.Size)
+		}
+		latency := (time.Duration(result.LatencyMS) * time.Millisecond).String()
+		fmt.Printf("%-6s %*s  %7s  %s\n", status, width, size, latency, result.URL)
+		for _, hop := range result.Redirects {
+			fmt.Printf("%*s %d -> %s\n", indent, "", hop.Status, hop.URL)
+		}
+		if result.Error != "" {
+			fmt.Printf("%*s %s\n", indent, "", result.Error)
+		}
+		if !result.ok() {
+			broken++
+		}
+	}
+	fmt.Printf("%d of %d links broken\n", broken, len(results))
+}
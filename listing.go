@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxListingSize = 16 * Megabyte // Listings larger than this are truncated
+
+// listingOptions controls how remote directory listings are expanded.
+type listingOptions struct {
+	recursive bool     // Descend into subdirectories
+	accept    []string // Only keep files whose name matches one of these globs
+	reject    []string // Drop files whose name matches one of these globs
+}
+
+// listingEntry is a file found in a remote directory listing.
+type listingEntry struct {
+	url    string // Absolute URL of the file
+	relDir string // Directory relative to the listing root, "" for the root itself
+}
+
+// s3ListBucketResult is the subset of an S3 ListObjects (v1 or v2) response
+// needed to enumerate files.
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string   `xml:"Name"`
+	Prefix                string   `xml:"Prefix"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextMarker            string   `xml:"NextMarker"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+var hrefRegex = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// matches reports whether a file name passes the --accept and --reject globs.
+func (lo *listingOptions) matches(name string) bool {
+	for _, pattern := range lo.reject {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(lo.accept) == 0 {
+		return true
+	}
+	for _, pattern := range lo.accept {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// list expands the task's URL, which must point at an Apache/nginx style
+// autoindex page, an S3 XML bucket listing or an s3:// or gs:// prefix, into
+// the files it contains.
+// Only links below the listed directory are followed, so parent directory
+// and sorting links are ignored.
+func (dt *downloadTask) list(client *http.Client, lo *listingOptions) ([]listingEntry, error) {
+	if dt.bucketListing != "" {
+		return dt.listBucket(client, lo)
+	}
+	root, err := url.Parse(dt.downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+
+	var entries []listingEntry
+	visited := map[string]bool{root.String(): true}
+	queue := []*url.URL{root}
+
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		body, err := dt.fetchListing(client, dir)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %v", dir, err)
+		}
+
+		if isS3Listing(body) {
+			found, err := dt.listS3(client, dir, body, lo)
+			if err != nil {
+				return nil, fmt.Errorf("listing %s: %v", dir, err)
+			}
+			entries = append(entries, found...)
+			continue
+		}
+
+		for _, match := range hrefRegex.FindAllSubmatch(body, -1) {
+			link, err := dir.Parse(string(match[1]))
+			if err != nil || link.Host != root.Host || link.RawQuery != "" {
+				continue
+			}
+			link.Fragment = ""
+			if !strings.HasPrefix(link.Path, dir.Path) || link.Path == dir.Path {
+				continue
+			}
+
+			if strings.HasSuffix(link.Path, "/") {
+				if lo.recursive && !visited[link.String()] {
+					visited[link.String()] = true
+					queue = append(queue, link)
+				}
+				continue
+			}
+			if !lo.matches(path.Base(link.Path)) {
+				continue
+			}
+			entries = append(entries, listingEntry{
+				url:    link.String(),
+				relDir: cleanRelDir(strings.TrimPrefix(path.Dir(link.Path)+"/", root.Path)),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// cleanRelDir normalizes a relative directory taken from a listing so that it
+// can't climb out of the output directory, e.g. through ".." in an S3 key.
+func cleanRelDir(relDir string) string {
+	cleaned := strings.TrimPrefix(path.Clean("/"+relDir), "/")
+	if cleaned == "" {
+		return ""
+	}
+	return filepath.FromSlash(cleaned)
+}
+
+// fetchListing downloads a listing page.
+func (dt *downloadTask) fetchListing(client *http.Client, dir *url.URL) ([]byte, error) {
+	request, err := newRequestWithHeaders(dt.ctx, "GET", dir.String(), dt.options.headers)
+	if err != nil {
+		return nil, err
+	}
+	response, err := dt.do(client, request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(io.LimitReader(response.Body, maxListingSize))
+}
+
+// isS3Listing reports whether a listing body is an S3 ListBucketResult document.
+func isS3Listing(body []byte) bool {
+	head := body
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return bytes.Contains(head, []byte("<ListBucketResult"))
+}
+
+// listS3 collects the objects of an S3 listing, following pagination and, when
+// recursive, descending into common prefixes. Object URLs are formed relative
+// to the bucket root, which is the first path segment for path-style URLs.
+func (dt *downloadTask) listS3(client *http.Client, dir *url.URL, body []byte, lo *listingOptions) ([]listingEntry, error) {
+	var entries []listingEntry
+	var rootPrefix string
+	first := true
+	pending := []*url.URL{dir}
+
+	for len(pending) > 0 {
+		page := pending[0]
+		pending = pending[1:]
+
+		for {
+			if body == nil {
+				var err error
+				if body, err = dt.fetchListing(client, page); err != nil {
+					return nil, err
+				}
+			}
+			var result s3ListBucketResult
+			if err := xml.Unmarshal(body, &result); err != nil {
+				return nil, err
+			}
+			body = nil
+			if first {
+				rootPrefix, first = result.Prefix, false
+			}
+
+			bucketRoot := "/"
+			if strings.HasPrefix(page.Path, "/"+result.Name+"/") || page.Path == "/"+result.Name {
+				bucketRoot = "/" + result.Name + "/"
+			}
+			for _, object := range result.Contents {
+				if strings.HasSuffix(object.Key, "/") || !lo.matches(path.Base(object.Key)) {
+					continue
+				}
+				objectURL := &url.URL{Scheme: page.Scheme, Host: page.Host, Path: bucketRoot + object.Key}
+				relDir := ""
+				if dir := path.Dir(object.Key); dir != "." {
+					relDir = strings.TrimPrefix(dir+"/", rootPrefix)
+				}
+				entries = append(entries, listingEntry{url: objectURL.String(), relDir: cleanRelDir(relDir)})
+			}
+			if lo.recursive {
+				for _, prefix := range result.CommonPrefixes {
+					sub := *page
+					query := sub.Query()
+					query.Set("prefix", prefix.Prefix)
+					query.Set("delimiter", "/")
+					query.Del("marker")
+					query.Del("continuation-token")
+					sub.RawQuery = query.Encode()
+					pending = append(pending, &sub)
+				}
+			}
+
+			if !result.IsTruncated {
+				break
+			}
+			next := *page
+			query := next.Query()
+			switch {
+			case result.NextContinuationToken != "":
+				query.Set("continuation-token", result.NextContinuationToken)
+			case result.NextMarker != "":
+				query.Set("marker", result.NextMarker)
+			case len(result.Contents) > 0:
+				query.Set("marker", result.Contents[len(result.Contents)-1].Key)
+			default:
+				return entries, nil
+			}
+			next.RawQuery = query.Encode()
+			page = &next
+		}
+	}
+	return entries, nil
+}
+
+// expandListings replaces each task with one task per file found in its
+// listing. The files keep the rate limit of the listing they came from and are
+// saved in the same directory layout.
+func expandListings(tasks []*downloadTask, lo *listingOptions) ([]*downloadTask, error) {
+	var expanded []*downloadTask
+	for _, task := range tasks {
+		// A task a resolver failed on has no listing, only its error.
+		if task.resolveErr != nil {
+			expanded = append(expanded, task)
+			continue
+		}
+		entries, err := task.list(task.httpClient(), lo)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			fileTask, err := newDownloadTask(task.ctx, entry.url, task.options)
+			if err != nil {
+				return nil, err
+			}
+			fileTask.rateLimiter.limit = task.rateLimiter.limit
+			fileTask.outputDir = entry.relDir
+			expanded = append(expanded, fileTask)
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli"
+)
+
+const defaultLockFile = "gograb.lock"
+
+// fetchCommand downloads the artifacts pinned in a lock file.
+var fetchCommand = cli.Command{
+	Name:      "fetch",
+	Usage:     "Download the artifacts pinned in a lock file, verifying their size and hash",
+	ArgsUsage: "[dir]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "lock",
+			Value: defaultLockFile,
+		},
+	},
+	Action: fetchAction,
+}
+
+// lockCommand maintains a lock file.
+var lockCommand = cli.Command{
+	Name:  "lock",
+	Usage: "Maintain a lock file of pinned artifacts",
+	Subcommands: []cli.Command{
+		{
+			Name:      "add",
+			Usage:     "Download URLs and pin their size and hash in the lock file",
+			ArgsUsage: "url...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "lock",
+					Value: defaultLockFile,
+				},
+				cli.StringFlag{
+					Name: "path",
+				},
+			},
+			Action: lockAddAction,
+		},
+	},
+}
+
+// A lock file is a sync manifest in which every file has a size and a
+// SHA-256, so that builds fetching from it get exactly the artifacts that
+// were pinned.
+
+// loadLockFile reads a lock file, checking that every file is pinned.
+func loadLockFile(fileName string, keepEncoded bool) (*syncManifest, error) {
+	lock, err := loadManifest(fileName, keepEncoded)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range lock.Files {
+		if entry.Size <= 0 || len(entry.SHA256) != 64 {
+			return nil, fmt.Errorf("%s: entry %d (%s) isn't pinned: it needs a size and a sha256, which gograb lock add records", fileName, i+1, entry.URL)
+		}
+	}
+	return lock, nil
+}
+
+// fetchAction downloads the lock file's artifacts that are missing or
+// changed in the directory, the current one by default.
+func fetchAction(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return cli.NewExitError("usage: gograb fetch [--lock gograb.lock] [dir]", exitUsageError)
+	}
+	dir := "."
+	if c.NArg() == 1 {
+		dir = c.Args().First()
+	}
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	lock, err := loadLockFile(c.String("lock"), options.keepEncodedNames)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tasks, _, err := manifestTasks(ctx, dir, lock, options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d of %d artifacts need downloading.\n", len(tasks), len(lock.Files))
+	if len(tasks) == 0 {
+		return nil
+	}
+	return runBatch(ctx, cancel, c, tasks)
+}
+
+// lockAddAction downloads the URLs into a temporary directory, hashes them,
+// and adds them to the lock file, replacing the entries of the same URLs.
+// The lock file is created if it doesn't exist.
+func lockAddAction(c *cli.Context) error {
+	if c.NArg() == 0 || (c.String("path") != "" && c.NArg() != 1) {
+		return cli.NewExitError("usage: gograb lock add [--lock gograb.lock] [--path path] url...", exitUsageError)
+	}
+	lockFile := c.String("lock")
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	lock := &syncManifest{}
+	if _, err := os.Stat(lockFile); err == nil {
+		if lock, err = loadManifest(lockFile, options.keepEncodedNames); err != nil {
+			return cli.NewExitError(err.Error(), exitUsageError)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	dir, err := os.MkdirTemp("", "gograb-lock-")
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tasks := make([]*downloadTask, 0, c.NArg())
+	for _, arg := range c.Args() {
+		task, err := newDownloadTask(ctx, arg, options)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+		}
+		task.outputDir = dir
+		tasks = append(tasks, task)
+	}
+	if err := runBatch(ctx, cancel, c, tasks); err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		fileInfo, err := os.Stat(task.fileName)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitAllFailed)
+		}
+		sum, err := hashFile(task.fileName)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitAllFailed)
+		}
+		entry := manifestEntry{URL: task.downloadURL, Path: filepath.Base(task.fileName), Size: fileInfo.Size(), SHA256: sum}
+		if c.String("path") != "" {
+			entry.Path = filepath.ToSlash(cleanRelDir(c.String("path")))
+		}
+		lock.pin(entry)
+		fmt.Printf("Pinned %s: %d bytes, sha256 %s\n", entry.URL, entry.Size, entry.SHA256)
+	}
+
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	if err := writeFileAtomic(lockFile, append(data, '\n')); err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	return nil
+}
+
+// pin adds an entry to the manifest, replacing any entry for the same URL.
+func (manifest *syncManifest) pin(entry manifestEntry) {
+	for i := range manifest.Files {
+		if manifest.Files[i].URL == entry.URL {
+			manifest.Files[i] = entry
+			return
+		}
+	}
+	manifest.Files = append(manifest.Files, entry)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Per-module loggers. They discard everything until setupLogging runs.
+var (
+	schedulerLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+	transportLog = schedulerLog
+	uiLog        = schedulerLog
+)
+
+// setupLogging configures the module loggers to write to stderr in the given
+// format ("text" or "json"), dropping records below level.
+func setupLogging(format, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q: must be debug, info, warn or error", level)
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	default:
+		return fmt.Errorf("invalid --log-format %q: must be text or json", format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	schedulerLog = logger.With("module", "scheduler")
+	transportLog = logger.With("module", "transport")
+	uiLog = logger.With("module", "ui")
+	return nil
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,20 +16,565 @@ import (
 
 // displayUsage provides the usage instructions for the program.
 func displayUsage() {
-	usage := `To use: grab [--header <header> [--header <header>]] [[rate limit:]url...]
+	usage := `To use: grab [--header <header> [--header <header>]] [options] [[rate limit:]url...]
+A URL of - reads more URLs from stdin, one per line, and downloads them as they arrive
+--watch-dir: Download the URLs of .txt and .json job files dropped into this directory, moving each to processed/ once queued
 --header: Specify your HTTP header in the format "key:value"
-rate limit: limits the download speed, unit is in KBs
-url...: URLs to download`
+--fail-fast, --abort-on-error: Cancel the remaining downloads as soon as one fails
+--max-failures: Stop starting new downloads once this many have failed
+--max-concurrent: Maximum number of downloads running at once (default: all)
+--dry-run: Print what would be downloaded and where, without writing anything
+--default-scheme: Scheme to prepend to URLs given without one (http or https)
+--show-error-body: Include the first N bytes of 4xx/5xx response bodies in errors
+--retries: Retry failed requests up to N times (network errors, 408, 429 and 5xx)
+--retry-on: Also retry these status codes, e.g. --retry-on 404
+--breaker-threshold: Consecutive failures that pause a host (default: 5, 0 disables)
+--breaker-cooldown: How long a failing host is paused before a probe request (default: 30s)
+--stall-timeout: Fail a download that receives nothing for this long, e.g. 1m (default: no limit)
+--auto-segments: Add parallel connections per download while they improve throughput
+--tcp-nodelay: Disable Nagle's algorithm on download connections (default: true)
+--tcp-read-buffer: Socket receive buffer size, e.g. 4M, for long fat networks
+--tcp-congestion: TCP congestion control algorithm, e.g. bbr (Linux only)
+--prefetch: Get queued downloads' hosts ready while they wait: dns looks them up, tls also connects and completes the TLS handshake
+--interface, --source-ip: Connect from this network interface or local address; repeat to spread connections across several
+--discard: Download and count the bytes without saving anything to disk
+--wait: Minimum delay between starting downloads from the same host, e.g. 2s
+--random-wait: Vary --wait randomly between 0.5 and 1.5 times its value
+--sums: SHA256SUMS file; skip files whose local copy matches and verify the rest
+--release-verify: Keyring of trusted OpenPGP keys; verify each download against its signed published checksum
+--release-sums: Where the signed checksum is published, from {url}, {dir} and {name} (default: {url}.sha256)
+--auto-verify: Verify downloads against a published .sha256, SHA256SUMS or .asc signature when there is one
+--cache: Directory of downloaded files shared between batches, reused for the same checksum or URL and ETag
+--dedupe: Download a file once when several URLs of the batch give the same ETag and size from one host, and copy or link it to the others
+--cache-server: Fetch through the gograb cache-server at this URL, e.g. http://cache.lan:3142
+--list: Treat the URLs as directory listings and download the files they link to
+--recursive, -r: Like --list, descending into subdirectories
+--accept, --reject: Comma-separated globs of file names to keep or skip in listings
+--newer-than: Only download resources modified after this file's modification time or timestamp, e.g. 2024-05-01
+--if-size-differs: HEAD each URL first and skip it when the local file already has the remote size
+--email-to: Mail a summary to these addresses when the batch finishes; repeatable or comma-separated
+--email-from, --smtp-server, --smtp-user, --smtp-password: Sender and SMTP server for --email-to (default localhost:25)
+--notify: JSON file of Slack, Discord and Telegram notifiers to post to when the batch finishes or a download fails
+--progress-fd: Also write progress as JSON lines to this open file descriptor, e.g. 3, for GUI wrappers
+--progress: How to show progress, bar or aural, plain announcements for screen readers (default: bar)
+--progress-interval: How often --progress aural announces a download, a percentage or a duration (default: 10%)
+--lang: Language of the progress display, de, es, fr, ja or a JSON catalog (default: from LC_ALL, LC_MESSAGES or LANG)
+--si: Show sizes and speeds in decimal units, where 1MB is 10^6 bytes, instead of 1024-based ones
+--bytes: Show sizes and speeds as exact byte counts, e.g. 1,048,576B
+--show-resolved: Show the IP address of the server and the final URL after redirects in each progress line
+--dump-headers: Write the final response headers of every download to this file, like curl -D
+--trace: Log connections, TLS handshakes, headers and body chunks of every request to this file, like curl --trace
+--script: Starlark file whose rename, request_headers and should_retry functions customize each task
+--resolver: Run a command to find the files behind matching URLs, as [host glob=]command; repeatable
+--s3-endpoint: Reach s3:// buckets path-style below this URL, for other regions and S3-compatible stores
+--adopt-partials: Resume .part, .crdownload and aria2 files left by other download managers
+--resume-from: Resume the one URL given from this partial download of the same file from another URL, once its last bytes match
+--zsync: Update files already on disk by downloading only the blocks that changed, using the zsync control file published with them
+--zsync-file: zsync control file for --zsync, a URL or file from {url}, {dir} and {name} (default: {url}.zsync)
+--resume-unsafe: When a server ignores ranges, read and drop the bytes already downloaded instead of starting over
+--task-logs: Directory to write one JSON log per download into (requests, responses, retries, result)
+--otlp-endpoint: Export OpenTelemetry traces to this OTLP/HTTP collector, e.g. http://localhost:4318
+--log-format: Format of the diagnostic log on stderr, text or json (default: text)
+--log-level: Lowest level logged: debug, info, warn or error (default: warn)
+--credential-helper: git credential helper supplying per-host credentials, e.g. osxkeychain
+--https-only: Refuse plaintext HTTP URLs and redirects, unless the host is known to use HSTS
+--pin-sha256: Pin a host's public key as host=BASE64 (SPKI SHA-256); may be repeated
+--proxy-for: Reach hosts matching a glob through a proxy, as host=proxy URL or host=direct; may be repeated
+--ssh-tunnel: Connect through this SSH jump host, as [user@]host[:port], to reach hosts inside a private network
+--restrict-to: Fail any download whose output path would resolve outside this directory
+--scan-cmd: Command run on each completed file, e.g. 'clamscan {}'; nonzero exit quarantines it
+--expected-size: Size to show progress against when the server sends no Content-Length, as SIZE or SIZE:url
+--form: POST a multipart form and download the response, as name=value or name=@path; may be repeated
+--adjust-extension, -E: Add an extension from the Content-Type to file names without one, e.g. .html or .json
+--default-name: Name to save URLs without a file name under, {host} for the host name (default: index.html)
+--name-from-title: Name HTML pages after their <title>, unless the server sends a Content-Disposition name
+--html-guard: What to do when a file that shouldn't be HTML starts like an HTML page, such as a login or error page: warn, fail or off (default: warn)
+--numbered: Prefix each file name with its position in the batch, e.g. 07-download.php
+--in-order: Download concurrently, but move files into place, run --exec and print their paths strictly in the order given
+--exec: Command run on each file once it's in place, e.g. 'tar -xf {}'; a nonzero exit fails the download
+--pipe-to: Command to stream each download to on stdin while it downloads, in order, a verified piece at a time
+--pipe-pieces: Piece manifest --pipe-to verifies pieces against, a URL or file from {url}, {dir} and {name} (default: {url}.pieces.json)
+--all-or-nothing: Download into a staging directory and move the files into place only if every download succeeds
+--write-manifest: After the batch, write the saved files' paths, URLs, SHA-256s, sizes and times to this JSON or .csv file
+--reproducible: Fail unless every URL has a SHA-256 pinned by --sums, and give saved files fixed times and modes
+--network-probe: URL to check the network with when requests fail; while it doesn't answer, downloads wait instead of failing
+--network-probe-interval: How often to check the network while it is down or requires sign-in (default: 10s)
+--portal-check: Check for a captive portal before starting each download, and wait while the network requires sign-in
+--portal-probe: URL --portal-check requests, which must answer 204 No Content (default: http://connectivitycheck.gstatic.com/generate_204)
+--group: Put downloads from hosts matching a glob, or URLs matching a pattern with * wildcards, in a named group, as name=host or name=url; repeatable
+--group-limit: Rate limit shared by a group's downloads, as name=rate, e.g. docs=1M; repeatable
+--group-concurrency: Maximum number of a group's downloads running at once, as name=N; repeatable
+--total-rate-limit: Rate limit shared by all downloads together, e.g. 2M
+--foreground: URL of the download to reserve part of --total-rate-limit for, with the others sharing the rest
+--foreground-share: Percentage of --total-rate-limit reserved for --foreground while others download (default: 50%)
+--metered-rate-limit: Rate limit for every download while the connection is metered, e.g. 200 or 1M
+--metered-max-size: Hold back downloads larger than this until the connection is no longer metered
+--ignore-metered: Download normally on metered connections, ignoring the two options above
+--battery-threshold: Pause downloads while on battery below this percentage, until plugged in
+--battery-rate-limit: Rate limit to apply below --battery-threshold instead of pausing, e.g. 200 or 1M
+--background: Run at low CPU and disk priority with small buffers, so large downloads don't slow down the desktop
+--small-files: Tune for batches of many tiny files: shared keep-alive connections, flushes at the end, and a files/s counter instead of a line per file
+--fsync: Flush each completed file to disk, before it is moved into place, so it survives a power loss
+--sync-dir: Also flush the directory of each completed file, making its name durable too
+--direct-io: Write files around the page cache, so huge downloads don't evict other programs' cached data
+--compress: Compress files as they are saved, with zstd or gzip, adding .zst or .gz to their names
+--encrypt: Encrypt files as they are saved, to an age recipient given as age:<recipient>, adding .age to their names
+--split-output: Save files as numbered parts of at most this size, e.g. 4G, with a manifest for gograb join
+--tar-output: Write the batch's downloads into this archive as they complete instead of saving them as files: .tar, .tar.gz, .tgz or .zip, staging each in the working directory until it is added
+--stdout-mux: Stream the downloads to stdout as one framed stream, tagged with task IDs, instead of saving them; everything else goes to stderr
+--piece-hashes: Write the hashes of each piece of this length, e.g. 4M, to <name>.pieces.json for torrent or metalink tools
+--piece-algorithm: Hash pieces with sha1, as BitTorrent does, or sha256 (default sha1)
+--keep-encoded-names: Keep file names from URL paths percent-encoded, e.g. my%20file.zip, instead of decoding them
+rate limit: limits the download speed, in KiB/s unless given a unit, e.g. 200, 512K, 1.5M; 0 for unlimited
+url...: URLs to download, or s3://bucket/key and gs://bucket/key; Google Drive and OneDrive share links download the shared file
+
+Commands:
+warm [--method head|range] [--bytes N] [--repeat N] [--rate N] [--ramp duration] [--concurrency N] url...
+    Request URLs without saving them to warm CDN caches, then print a per-status summary
+sync --manifest <manifest.json> [--delete] <dir>
+    Download the manifest files that are missing or changed in dir; --delete removes unlisted files
+check --sums <SHA256SUMS> [--jobs N] [dir]
+    Verify local files against a checksum file in parallel
+export-queue [rate limit:]url...
+    Print the downloads, options and progress so far as JSON, e.g. gograb export-queue url... > q.json
+import-queue <queue.json>
+    Download a batch written by export-queue, resuming from the partial files present
+login <provider.json>
+    Log in to an OAuth2 provider with the device flow; its tokens are then sent to the provider's hosts
+put [--method PUT|POST] [--content-type type] <file> <[rate limit:]url>
+    Upload a file with the same progress, rate limiting, retries and headers as downloads
+update [--blockmap url] <old-file> <[rate limit:]url>
+    Patch a local file into the version at url, downloading only the blocks that differ from the block map
+join [--output file] [--delete] <name.parts.json>
+    Reassemble a file saved with --split-output, checking each part; --delete removes the parts
+cache gc --max-size <size>
+    Remove the least recently used files from the --cache directory until it fits in size, e.g. 20G
+cache-server [--listen addr]
+    Serve the --cache directory to clients given --cache-server, downloading and storing what it lacks;
+    it listens on 127.0.0.1:3142 by default and has no authentication, so only listen on a trusted network
+fetch [--lock gograb.lock] [dir]
+    Download the artifacts pinned in a lock file that are missing or changed in dir
+lock add [--lock gograb.lock] [--path path] url...
+    Download URLs and pin their size and sha256 in a lock file, replacing their old entries
+linkcheck [-i urls.txt] [--concurrency N] [--format text|json] [url...]
+    Check URLs with HEAD requests and report their status, redirects, size and latency
+
+Exit codes: 0 all succeeded, 1 some failed, 2 all failed,
+3 network error, 4 authentication error, 5 verification error,
+6 invalid arguments`
 	fmt.Println(usage)
 }
 
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// newApp builds the command line: the global flags, the subcommands and the
+// action that downloads the URLs given.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "gograb"
 	app.Flags = []cli.Flag{
 		cli.StringSliceFlag{
 			Name: "header",
 		},
+		cli.BoolFlag{
+			Name: "fail-fast, abort-on-error",
+		},
+		cli.IntFlag{
+			Name: "max-failures",
+		},
+		cli.IntFlag{
+			Name: "max-concurrent",
+		},
+		cli.BoolFlag{
+			Name: "dry-run",
+		},
+		cli.StringFlag{
+			Name: "default-scheme",
+		},
+		cli.Int64Flag{
+			Name: "show-error-body",
+		},
+		cli.IntFlag{
+			Name: "retries",
+		},
+		cli.StringSliceFlag{
+			Name: "retry-on",
+		},
+		cli.IntFlag{
+			Name:  "breaker-threshold",
+			Value: 5,
+		},
+		cli.DurationFlag{
+			Name:  "breaker-cooldown",
+			Value: 30 * time.Second,
+		},
+		cli.DurationFlag{
+			Name: "stall-timeout",
+		},
+		cli.BoolFlag{
+			Name: "auto-segments",
+		},
+		cli.BoolTFlag{
+			Name: "tcp-nodelay",
+		},
+		cli.StringFlag{
+			Name: "tcp-read-buffer",
+		},
+		cli.StringFlag{
+			Name: "tcp-congestion",
+		},
+		cli.StringFlag{
+			Name: "prefetch",
+		},
+		cli.StringSliceFlag{
+			Name: "interface",
+		},
+		cli.StringSliceFlag{
+			Name: "source-ip",
+		},
+		cli.BoolFlag{
+			Name: "discard",
+		},
+		cli.DurationFlag{
+			Name: "wait",
+		},
+		cli.BoolFlag{
+			Name: "random-wait",
+		},
+		cli.StringFlag{
+			Name: "sums",
+		},
+		cli.StringFlag{
+			Name: "release-verify",
+		},
+		cli.BoolFlag{
+			Name: "auto-verify",
+		},
+		cli.StringFlag{
+			Name: "dedupe",
+		},
+		cli.StringFlag{
+			Name:   "cache",
+			EnvVar: "GOGRAB_CACHE",
+		},
+		cli.StringFlag{
+			Name:   "cache-server",
+			EnvVar: "GOGRAB_CACHE_SERVER",
+		},
+		cli.StringFlag{
+			Name:  "release-sums",
+			Value: defaultReleaseSums,
+		},
+		cli.BoolFlag{
+			Name: "list",
+		},
+		cli.BoolFlag{
+			Name: "recursive, r",
+		},
+		cli.StringSliceFlag{
+			Name: "resolver",
+		},
+		cli.StringFlag{
+			Name: "script",
+		},
+		cli.StringFlag{
+			Name: "newer-than",
+		},
+		cli.BoolFlag{
+			Name: "if-size-differs",
+		},
+		cli.StringSliceFlag{
+			Name: "email-to",
+		},
+		cli.StringFlag{
+			Name: "email-from",
+		},
+		cli.StringFlag{
+			Name:  "smtp-server",
+			Value: "localhost:25",
+		},
+		cli.StringFlag{
+			Name: "smtp-user",
+		},
+		cli.StringFlag{
+			Name:   "smtp-password",
+			EnvVar: "GOGRAB_SMTP_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "notify",
+			EnvVar: "GOGRAB_NOTIFY",
+		},
+		cli.IntFlag{
+			Name: "progress-fd",
+		},
+		cli.StringFlag{
+			Name:   "lang",
+			EnvVar: "GOGRAB_LANG",
+		},
+		cli.BoolFlag{
+			Name: "si",
+		},
+		cli.BoolFlag{
+			Name: "show-resolved",
+		},
+		cli.BoolFlag{
+			Name: "bytes",
+		},
+		cli.StringFlag{
+			Name:   "progress",
+			Value:  "bar",
+			EnvVar: "GOGRAB_PROGRESS",
+		},
+		cli.StringFlag{
+			Name:  "progress-interval",
+			Value: "10%",
+		},
+		cli.StringFlag{
+			Name: "dump-headers",
+		},
+		cli.StringFlag{
+			Name: "trace",
+		},
+		cli.StringFlag{
+			Name:   "s3-endpoint",
+			EnvVar: "AWS_ENDPOINT_URL_S3",
+		},
+		cli.StringSliceFlag{
+			Name: "accept",
+		},
+		cli.StringSliceFlag{
+			Name: "reject",
+		},
+		cli.BoolFlag{
+			Name: "adopt-partials",
+		},
+		cli.StringFlag{
+			Name: "resume-from",
+		},
+		cli.BoolFlag{
+			Name: "zsync",
+		},
+		cli.StringFlag{
+			Name:  "zsync-file",
+			Value: defaultZsyncFile,
+		},
+		cli.BoolFlag{
+			Name: "resume-unsafe",
+		},
+		cli.StringFlag{
+			Name: "task-logs",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "warn",
+		},
+		cli.StringFlag{
+			Name: "credential-helper",
+		},
+		cli.BoolFlag{
+			Name: "https-only",
+		},
+		cli.StringSliceFlag{
+			Name: "pin-sha256",
+		},
+		cli.StringSliceFlag{
+			Name: "proxy-for",
+		},
+		cli.StringFlag{
+			Name: "ssh-tunnel",
+		},
+		cli.StringFlag{
+			Name: "restrict-to",
+		},
+		cli.StringFlag{
+			Name: "scan-cmd",
+		},
+		cli.StringSliceFlag{
+			Name: "expected-size",
+		},
+		cli.StringSliceFlag{
+			Name: "form",
+		},
+		cli.BoolFlag{
+			Name: "adjust-extension, E",
+		},
+		cli.StringFlag{
+			Name: "watch-dir",
+		},
+		cli.BoolFlag{
+			Name: "name-from-title",
+		},
+		cli.StringFlag{
+			Name:  "html-guard",
+			Value: "warn",
+		},
+		cli.BoolFlag{
+			Name: "numbered",
+		},
+		cli.StringFlag{
+			Name:  "default-name",
+			Value: "index.html",
+		},
+		cli.BoolFlag{
+			Name: "keep-encoded-names",
+		},
+		cli.BoolFlag{
+			Name: "in-order",
+		},
+		cli.StringFlag{
+			Name: "pipe-to",
+		},
+		cli.StringFlag{
+			Name:  "pipe-pieces",
+			Value: defaultPipePieces,
+		},
+		cli.StringFlag{
+			Name: "exec",
+		},
+		cli.BoolFlag{
+			Name: "all-or-nothing",
+		},
+		cli.StringFlag{
+			Name: "write-manifest",
+		},
+		cli.BoolFlag{
+			Name: "reproducible",
+		},
+		cli.StringFlag{
+			Name: "network-probe",
+		},
+		cli.DurationFlag{
+			Name:  "network-probe-interval",
+			Value: 10 * time.Second,
+		},
+		cli.BoolFlag{
+			Name: "portal-check",
+		},
+		cli.StringFlag{
+			Name:  "portal-probe",
+			Value: defaultPortalProbe,
+		},
+		cli.StringSliceFlag{
+			Name: "group",
+		},
+		cli.StringSliceFlag{
+			Name: "group-limit",
+		},
+		cli.StringSliceFlag{
+			Name: "group-concurrency",
+		},
+		cli.StringFlag{
+			Name: "total-rate-limit",
+		},
+		cli.StringFlag{
+			Name: "foreground",
+		},
+		cli.StringFlag{
+			Name:  "foreground-share",
+			Value: defaultForegroundShare,
+		},
+		cli.StringFlag{
+			Name:   "metered-rate-limit",
+			EnvVar: "GOGRAB_METERED_RATE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "metered-max-size",
+			EnvVar: "GOGRAB_METERED_MAX_SIZE",
+		},
+		cli.BoolFlag{
+			Name: "ignore-metered",
+		},
+		cli.IntFlag{
+			Name: "battery-threshold",
+		},
+		cli.StringFlag{
+			Name: "battery-rate-limit",
+		},
+		cli.BoolFlag{
+			Name: "background",
+		},
+		cli.BoolFlag{
+			Name: "small-files",
+		},
+		cli.BoolFlag{
+			Name: "fsync",
+		},
+		cli.BoolFlag{
+			Name: "sync-dir",
+		},
+		cli.BoolFlag{
+			Name: "direct-io",
+		},
+		cli.StringFlag{
+			Name: "compress",
+		},
+		cli.StringFlag{
+			Name: "encrypt",
+		},
+		cli.StringFlag{
+			Name: "split-output",
+		},
+		cli.StringFlag{
+			Name: "tar-output",
+		},
+		cli.BoolFlag{
+			Name: "stdout-mux",
+		},
+		cli.StringFlag{
+			Name: "piece-hashes",
+		},
+		cli.StringFlag{
+			Name:  "piece-algorithm",
+			Value: "sha1",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		warmCommand,
+		syncCommand,
+		checkCommand,
+		exportQueueCommand,
+		importQueueCommand,
+		loginCommand,
+		putCommand,
+		updateCommand,
+		joinCommand,
+		cacheCommand,
+		cacheServerCommand,
+		fetchCommand,
+		lockCommand,
+		linkcheckCommand,
+	}
+
+	app.Before = func(c *cli.Context) error {
+		if err := setupLogging(c.String("log-format"), c.String("log-level")); err != nil {
+			return cli.NewExitError(err.Error(), exitUsageError)
+		}
+		if err := setLanguage(c.String("lang")); err != nil {
+			return cli.NewExitError(err.Error(), exitUsageError)
+		}
+		if err := setSizeUnits(c.Bool("si"), c.Bool("bytes")); err != nil {
+			return cli.NewExitError(err.Error(), exitUsageError)
+		}
+		if c.Bool("background") {
+			if err := lowerPriority(); err != nil {
+				schedulerLog.Warn("can't lower the process priority", "error", err)
+			}
+		}
+		return nil
 	}
 
 	// Override the default help printer with our custom usage display.
@@ -37,60 +584,317 @@ func main() {
 
 	// Define the action executed when the program runs.
 	app.Action = func(c *cli.Context) error {
-		if c.NArg() == 0 {
+		watchDir := c.String("watch-dir")
+		if c.NArg() == 0 && watchDir == "" {
 			displayUsage()
 			return nil
 		}
+		if watchDir != "" {
+			if c.Bool("dry-run") {
+				return cli.NewExitError("--dry-run can't be used with --watch-dir", exitUsageError)
+			}
+			if fileInfo, err := os.Stat(watchDir); err != nil {
+				return cli.NewExitError(fmt.Sprintf("invalid --watch-dir: %v", err), exitUsageError)
+			} else if !fileInfo.IsDir() {
+				return cli.NewExitError(fmt.Sprintf("invalid --watch-dir %s: not a directory", watchDir), exitUsageError)
+			}
+		}
+
+		options, err := newTaskOptions(c)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitUsageError)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Validate every URL before starting anything. "-" reads more URLs
+		// from stdin as the batch runs.
+		var tasks []*downloadTask
+		var invalid []string
+		streaming := false
+		for _, arg := range c.Args() {
+			if arg == stdinArg {
+				streaming = true
+				continue
+			}
+			task, err := newDownloadTask(ctx, arg, options)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("Error: %s", err))
+				continue
+			}
+			tasks = append(tasks, task)
+		}
+		if len(invalid) > 0 {
+			return cli.NewExitError(strings.Join(invalid, "\n"), exitUsageError)
+		}
 
-		headers := c.StringSlice("header")
-		headerMap := parseHeaders(headers)
-		tasks := make([]*downloadTask, c.NArg())
+		var listing *listingOptions
+		if c.Bool("list") || c.Bool("recursive") {
+			listing = &listingOptions{
+				recursive: c.Bool("recursive"),
+				accept:    splitList(c.StringSlice("accept")),
+				reject:    splitList(c.StringSlice("reject")),
+			}
+		}
+		if tasks, err = prepareTasks(tasks, options, listing); err != nil {
+			return err
+		}
+		if options.resumeFrom != "" && (len(tasks) != 1 || streaming || watchDir != "") {
+			return cli.NewExitError("--resume-from needs exactly one URL to resume", exitUsageError)
+		}
 
-		for i, url := range c.Args() {
-			task := newDownloadTask(url, headerMap)
-			if task != nil {
-				go task.start()
-				tasks[i] = task
+		// URLs from stdin and --watch-dir are downloaded as they arrive.
+		prepare := func(tasks []*downloadTask) ([]*downloadTask, error) {
+			return prepareTasks(tasks, options, listing)
+		}
+		var feeds []<-chan *downloadTask
+		if streaming {
+			feeds = append(feeds, streamTasks(ctx, os.Stdin, options, prepare))
+		}
+		if watchDir != "" {
+			feeds = append(feeds, watchJobs(ctx, watchDir, options, prepare))
+		}
+		var feed <-chan *downloadTask
+		if len(feeds) > 0 {
+			feed = mergeFeeds(feeds...)
+		}
+
+		if c.Bool("dry-run") {
+			// A dry run lists the whole input, so it waits for the end of it.
+			if code := dryRun(drainFeed(tasks, feed)); code != exitOK {
+				return cli.NewExitError("", code)
 			}
+			return nil
 		}
 
-		width, err := termutil.TerminalWidth()
-		hasWidth := err == nil
+		return runStreamingBatch(ctx, cancel, c, options, tasks, feed)
+	}
+	return app
+}
+
+// prepareTasks replaces page URLs with the files a resolver finds behind
+// them, then, with listing set, expands directory listings into the files
+// they contain. Errors are returned as cli exit errors.
+func prepareTasks(tasks []*downloadTask, options *taskOptions, listing *listingOptions) ([]*downloadTask, error) {
+	tasks = resolveTasks(tasks, options.resolvers)
+	if listing != nil {
+		var err error
+		if tasks, err = expandListings(tasks, listing); err != nil {
+			code := classifyError(err)
+			if code == exitOK {
+				code = exitAllFailed
+			}
+			return nil, cli.NewExitError(fmt.Sprintf("Error: %s", err), code)
+		}
+	}
+	return tasks, nil
+}
 
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
+// runBatch runs the tasks with the scheduler configured by the global flags,
+// showing their progress, and returns the outcome of the batch as an exit code.
+func runBatch(ctx context.Context, cancel context.CancelFunc, c *cli.Context, tasks []*downloadTask) error {
+	var options *taskOptions
+	if len(tasks) > 0 {
+		options = tasks[0].options
+	}
+	return runStreamingBatch(ctx, cancel, c, options, tasks, nil)
+}
 
-		isFirstUpdate := true
+// runStreamingBatch is runBatch for a batch that also runs the tasks sent on
+// feed while it runs, such as URLs read from stdin, until feed is closed.
+// feed is nil for a batch of only the tasks given.
+func runStreamingBatch(ctx context.Context, cancel context.CancelFunc, c *cli.Context, options *taskOptions, tasks []*downloadTask, feed <-chan *downloadTask) (result error) {
+	if len(tasks) > 0 && tasks[0].options.reproducible {
+		if err := checkPinned(tasks); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+		}
+	}
 
-		// Goroutine to update terminal output periodically.
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					if !isFirstUpdate {
-						termutil.ClearLines(int16(len(tasks)))
+	live := &liveTasks{retiring: c.GlobalString("watch-dir") != ""}
+	for _, task := range tasks {
+		live.add(task)
+	}
+	if options != nil {
+		options.numberWidth = len(strconv.Itoa(len(tasks)))
+		if feed != nil && options.numberWidth < 3 {
+			// The batch's size isn't known up front.
+			options.numberWidth = 3
+		}
+	}
+
+	announcer, err := newAnnouncer(c.GlobalString("progress"), c.GlobalString("progress-interval"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	// --small-files runs a bounded number of downloads at once, each
+	// reusing the connections the last ones left.
+	maxConcurrent := c.GlobalInt("max-concurrent")
+	if maxConcurrent <= 0 && options != nil && options.smallFiles != nil {
+		maxConcurrent = options.smallFiles.connections
+	}
+
+	started := time.Now()
+	sched := newScheduler(ctx, cancel, schedulerOptions{
+		maxConcurrent: maxConcurrent,
+		maxFailures:   c.GlobalInt("max-failures"),
+		abortOnError:  c.GlobalBool("fail-fast"),
+		wait:          c.GlobalDuration("wait"),
+		randomWait:    c.GlobalBool("random-wait"),
+	})
+
+	width, err := termutil.TerminalWidth()
+	hasWidth := err == nil
+	if !hasWidth {
+		uiLog.Debug("terminal width unknown, showing progress without bars", "error", err)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Lines of progress shown, to clear before the next update.
+	shown := 0
+
+	var progress *progressFD
+	var releaser *releaser
+	if options != nil {
+		progress = options.progress
+		releaser = options.releaser
+		if options.prefetch != nil {
+			prefetched := make(chan struct{})
+			defer close(prefetched)
+			go options.prefetch.run(live, prefetched)
+		}
+		defer func() { progress.done(tasks, exitCodeOf(result)) }()
+	}
+
+	// Goroutine to update terminal output periodically.
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				current := live.list()
+				if announcer != nil {
+					releaser.printNotices()
+					announcer.update(current)
+				} else if options != nil && options.smallFiles != nil {
+					if shown > 0 {
+						termutil.ClearLines(int16(shown))
+					}
+					releaser.printNotices()
+					fmt.Println(smallFilesTotals(current, started))
+					shown = 1
+				} else {
+					if shown > 0 {
+						termutil.ClearLines(int16(shown))
+					}
+					releaser.printNotices()
+					updateTerminal(hasWidth, current, width)
+					totals := groupTotals(current)
+					for _, line := range totals {
+						fmt.Println(line)
 					}
-					updateTerminal(hasWidth, tasks, width)
-					isFirstUpdate = false
+					shown = len(current) + len(totals)
 				}
+				progress.update(current)
+				live.retire(releaser)
 			}
-		}()
+		}
+	}()
 
-		// Wait for all tasks to finish.
+	// Run all tasks, and those fed in until the feed ends or the batch
+	// stops, and wait for them to finish.
+	queue := make(chan *downloadTask)
+	go func() {
+		defer close(queue)
 		for _, task := range tasks {
-			if task != nil {
-				<-task.completionChan
+			queue <- task
+		}
+		for feed != nil && sched.stopped() == nil {
+			select {
+			case task, ok := <-feed:
+				if !ok {
+					return
+				}
+				live.add(task)
+				queue <- task
+			case <-ctx.Done():
+				return
 			}
 		}
-
-		time.Sleep(time.Second)
-		fmt.Println("Download completed.")
-		return nil
+	}()
+	if releaser != nil {
+		finished, released := make(chan struct{}), make(chan struct{})
+		go func() {
+			releaser.run(live, finished)
+			close(released)
+		}()
+		sched.runQueue(queue)
+		close(finished)
+		<-released
+	} else {
+		sched.runQueue(queue)
 	}
+	tasks = live.list()
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+	time.Sleep(time.Second)
+	releaser.printNotices()
+	if announcer != nil {
+		announcer.update(tasks)
+	}
+	if len(tasks) > 0 {
+		// Mailed last, once the files are in place, whatever the outcome.
+		defer tasks[0].options.email.send(tasks, started)
+		defer tasks[0].options.chat.batchDone(tasks, started)
+		if err := tasks[0].options.tracer.export(); err != nil {
+			transportLog.Warn("trace export failed", "error", err)
+		}
+		if err := tasks[0].options.smallFiles.flush(); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: flushing downloads to disk: %s", err), exitAllFailed)
+		}
+		if err := tasks[0].options.archive.close(tasks[0].options.fsync, tasks[0].options.syncDir); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: writing %s: %s", tasks[0].options.archive.path, err), exitAllFailed)
+		}
+		if err := tasks[0].options.staging.finish(tasks); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: moving downloads into place: %s", err), exitAllFailed)
+		}
+		if tasks[0].options.pieceLength > 0 {
+			if err := writePieceFiles(tasks); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Error: writing piece hashes: %s", err), exitAllFailed)
+			}
+		}
+		if options := tasks[0].options; options.reproducible {
+			if err := normalizeFiles(tasks, options.epoch); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitAllFailed)
+			}
+		}
+		if manifest := tasks[0].options.manifestFile; manifest != "" {
+			if err := writeProvenance(manifest, tasks); err != nil {
+				return cli.NewExitError(fmt.Sprintf("Error: writing %s: %s", manifest, err), exitAllFailed)
+			}
+		}
+	}
+	if len(tasks) > 0 && tasks[0] != nil && tasks[0].options.smallFiles != nil {
+		printFailures(tasks)
+	}
+	printRenames(tasks)
+	printSuspects(tasks)
+	transfer := "Download"
+	if len(tasks) == 1 && tasks[0] != nil && tasks[0].uploadFile != "" {
+		transfer = "Upload"
+	}
+	code := batchExitCode(tasks)
+	if code == exitAllFailed && live.retiredCount() > 0 {
+		// Downloads that succeeded under --watch-dir are no longer listed.
+		code = exitPartialFailure
 	}
+	if code != exitOK {
+		fmt.Println(tr(transfer + " completed with errors."))
+		return cli.NewExitError("", code)
+	}
+	fmt.Println(tr(transfer + " completed."))
+	return nil
 }
 
 // updateTerminal refreshes the terminal output to show download progress.
@@ -100,57 +904,64 @@ func updateTerminal(hasWidth bool, tasks []*downloadTask, terminalWidth int) {
 
 		// Handle errors
 		if task.error != nil && task.error != io.EOF {
-			if task.fileName == "" {
-				output = fmt.Sprintf("Error: %s", task.error.Error())
+			if task.displayName() == "" {
+				output = trf("Error: %s", task.error.Error())
 			} else {
-				output = fmt.Sprintf("%s: Error: %s", task.fileName, task.error.Error())
+				output = trf("%s: Error: %s", task.displayName(), task.error.Error())
 			}
 		} else if task.getBytesRead() > 0 {
 			var etaInfo, fileSizeInfo, fileNameInfo string
 
 			displayFileNameLength := 20
-			fileNameInfo = truncateFileName(task.fileName, displayFileNameLength)
+			fileNameInfo = truncateFileName(task.displayName(), displayFileNameLength)
 
-			if task.totalFileSize <= 0 {
-				fileSizeInfo = fmt.Sprintf("|%s", humanReadableSize(task.getBytesRead()))
-			} else {
+			// Without a Content-Length the amount downloaded is shown in place
+			// of the size, and "size unknown" in place of the ETA.
+			sizeKnown := task.totalFileSize > 0
+			if sizeKnown {
 				fileSizeInfo = fmt.Sprintf("|%s", humanReadableSize(task.totalFileSize))
+				etaInfo = fmt.Sprintf("%s|%s/s|%s", task.getETAString(), task.getSpeedString(), task.getRangesString())
+			} else {
+				fileSizeInfo = fmt.Sprintf("|%s", humanReadableSize(task.getBytesRead()))
+				etaInfo = fmt.Sprintf("%s|%s/s|%s", tr("size unknown"), task.getSpeedString(), task.getRangesString())
 			}
+			if compressed := task.getCompressedString(); compressed != "" {
+				etaInfo += "|" + compressed
+			}
+			etaInfo += task.getResolvedString()
 
-			etaInfo = fmt.Sprintf("%s|%s/s", task.getETAString(), task.getSpeedString())
-
-			if hasWidth && task.totalFileSize > 0 {
+			if hasWidth {
 				progressBarLength := terminalWidth - visibleWidth(fileSizeInfo+etaInfo) - displayFileNameLength
 				if progressBarLength > 4 {
 					fileSizeInfo += "["
 					etaInfo = "]" + etaInfo
 
-					ratio := float64(task.getBytesRead()) / float64(task.totalFileSize)
-					progressBarLength -= 2
-					bar := strings.Repeat(" ", progressBarLength)
-					progressWidth := int(float64(progressBarLength) * ratio)
-					progress := ""
-					if progressWidth > 0 {
-						progress = strings.Repeat("=", progressWidth)
-					}
-					if progressWidth+1 < len(bar) {
-						bar = strings.Join([]string{progress, ">", bar[progressWidth+1:]}, "")
-					} else {
-						bar = strings.Join([]string{progress, ">"}, "")
+					var bar string
+					switch {
+					case sizeKnown:
+						bar = renderBar(progressBarLength-2, float64(task.getBytesRead())/float64(task.totalFileSize))
+					case task.error == io.EOF:
+						bar = renderBar(progressBarLength-2, 1)
+					default:
+						bar = renderIndeterminateBar(progressBarLength-2, time.Now().Unix())
 					}
 					output = strings.Join([]string{fileNameInfo, fileSizeInfo, bar, etaInfo}, "")
-				} else if progressBarLength < 0 {
-					output = output[:terminalWidth]
 				} else {
 					output = strings.Join([]string{fileNameInfo, fileSizeInfo, etaInfo}, "")
 				}
-			} else if task.totalFileSize > 0 {
+			} else if sizeKnown {
 				output = strings.Join([]string{fileNameInfo, fileSizeInfo, fmt.Sprintf("|%.2f%%", 100*float64(task.getBytesRead())/float64(task.totalFileSize)), etaInfo}, "")
 			} else {
-				output = strings.Join([]string{fileNameInfo, fmt.Sprintf("|%s", humanReadableSize(task.getBytesRead()))}, "")
+				output = strings.Join([]string{fileNameInfo, fileSizeInfo, "|", etaInfo}, "")
 			}
+		} else if wait := task.getWaitString(); wait != "" {
+			output = wait
+		} else if upload := task.getUploadString(terminalWidth); hasWidth && upload != "" {
+			output = upload
+		} else if upload := task.getUploadString(0); upload != "" {
+			output = upload
 		} else {
-			output = "Waiting..."
+			output = tr("Waiting...")
 		}
 
 		if hasWidth {
@@ -166,6 +977,41 @@ func updateTerminal(hasWidth bool, tasks []*downloadTask, terminalWidth int) {
 	}
 }
 
+// renderBar draws the inside of a progress bar of the given length, e.g.
+// "=====>    ", filled according to ratio.
+func renderBar(length int, ratio float64) string {
+	// An --expected-size estimate can be exceeded.
+	if ratio > 1 {
+		ratio = 1
+	}
+	bar := strings.Repeat(" ", length)
+	progressWidth := int(float64(length) * ratio)
+	progress := ""
+	if progressWidth > 0 {
+		progress = strings.Repeat("=", progressWidth)
+	}
+	if progressWidth+1 < len(bar) {
+		return strings.Join([]string{progress, ">", bar[progressWidth+1:]}, "")
+	}
+	return strings.Join([]string{progress, ">"}, "")
+}
+
+// renderIndeterminateBar draws the inside of a progress bar of the given
+// length for a download of unknown size: a "<=>" marker that moves one step
+// back and forth across the bar with every frame, e.g. "   <=>    ".
+func renderIndeterminateBar(length int, frame int64) string {
+	const marker = "<=>"
+	if length <= len(marker) {
+		return strings.Repeat(" ", length)
+	}
+	span := int64(length - len(marker))
+	position := frame % (2 * span)
+	if position > span {
+		position = 2*span - position
+	}
+	return strings.Repeat(" ", int(position)) + marker + strings.Repeat(" ", length-len(marker)-int(position))
+}
+
 // truncateFileName shortens or pads the filename to fit within a specific width.
 func truncateFileName(fileName string, maxWidth int) string {
 	if len(fileName) < maxWidth {
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// runApp runs the command line with args, returning the error it fails with
+// rather than exiting.
+func runApp(t *testing.T, args ...string) error {
+	t.Helper()
+	exiter := cli.OsExiter
+	cli.OsExiter = func(int) {}
+	defer func() { cli.OsExiter = exiter }()
+	return newApp().Run(append([]string{"gograb"}, args...))
+}
+
+func TestSubcommandHTMLGuard(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	if err := runApp(t, "warm", server.URL+"/file.bin"); err != nil {
+		t.Fatalf("warm without --html-guard failed: %v", err)
+	}
+	if err := runApp(t, "--html-guard", "fail", "warm", server.URL+"/file.bin"); err != nil {
+		t.Fatalf("warm with --html-guard fail failed: %v", err)
+	}
+	if err := runApp(t, "--html-guard", "bogus", "warm", server.URL+"/file.bin"); err == nil {
+		t.Error("warm with --html-guard bogus succeeded, want an error")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("server got %d requests, want 2", n)
+	}
+}
+
+func TestPutGlobalHeader(t *testing.T) {
+	var method, header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, header = r.Method, r.Header.Get("X-Token")
+	}))
+	defer server.Close()
+
+	fileName := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(fileName, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runApp(t, "--header", "X-Token: secret", "put", fileName, server.URL+"/report.txt"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if method != http.MethodPut || header != "secret" {
+		t.Errorf("server got %s with X-Token %q, want PUT with %q", method, header, "secret")
+	}
+}
+
+func TestUpdateGlobalHeader(t *testing.T) {
+	content := []byte("hello WORLD")
+	manifest := pieceManifest{File: "file.bin", Size: int64(len(content)), PieceLength: 4, Hash: "sha256"}
+	for start := 0; start < len(content); start += 4 {
+		end := start + 4
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha256.Sum256(content[start:end])
+		manifest.Pieces = append(manifest.Pieces, hex.EncodeToString(sum[:]))
+	}
+	blockMap, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var headers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.bin.pieces.json" {
+			w.Write(blockMap)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			mutex.Lock()
+			headers = append(headers, r.Header.Get("X-Token"))
+			mutex.Unlock()
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	fileName := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(fileName, []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = runApp(t, "--header", "X-Token: secret", "update", "--blockmap", server.URL+"/file.bin.pieces.json", fileName, server.URL+"/file.bin")
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if data, _ := os.ReadFile(fileName); !bytes.Equal(data, content) {
+		t.Errorf("file is %q after the update, want %q", data, content)
+	}
+	if len(headers) == 0 {
+		t.Fatal("server got no range requests")
+	}
+	for _, header := range headers {
+		if header != "secret" {
+			t.Errorf("range request had X-Token %q, want %q", header, "secret")
+		}
+	}
+}
+
+func TestSubcommandGlobalHeader(t *testing.T) {
+	var mutex sync.Mutex
+	var headers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		headers = append(headers, r.Header.Get("X-Token"))
+		mutex.Unlock()
+		http.ServeContent(w, r, "file.bin", time.Time{}, strings.NewReader("hello"))
+	}))
+	defer server.Close()
+
+	writeJSON := func(fileName string, v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+
+	tests := []struct {
+		name string
+		args func(dir string) []string
+	}{
+		{"sync", func(dir string) []string {
+			manifest := writeJSON(filepath.Join(dir, "manifest.json"), syncManifest{Files: []manifestEntry{{URL: server.URL + "/file.bin"}}})
+			return []string{"sync", "--manifest", manifest, filepath.Join(dir, "out")}
+		}},
+		{"import-queue", func(dir string) []string {
+			queue := writeJSON(filepath.Join(dir, "queue.json"), queueState{Tasks: []queueEntry{{URL: server.URL + "/file.bin", Path: "file.bin"}}})
+			return []string{"import-queue", queue}
+		}},
+		{"lock add", func(dir string) []string {
+			return []string{"lock", "add", server.URL + "/file.bin"}
+		}},
+		{"fetch", func(dir string) []string {
+			sum := sha256.Sum256([]byte("hello"))
+			entry := manifestEntry{URL: server.URL + "/file.bin", Path: "file.bin", Size: 5, SHA256: hex.EncodeToString(sum[:])}
+			writeJSON(filepath.Join(dir, defaultLockFile), syncManifest{Files: []manifestEntry{entry}})
+			return []string{"fetch"}
+		}},
+		{"linkcheck", func(dir string) []string {
+			return []string{"linkcheck", server.URL + "/file.bin"}
+		}},
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, test := range tests {
+		headers = nil
+		// Downloads are saved relative to the current directory.
+		dir := t.TempDir()
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"--header", "X-Token: secret"}, test.args(dir)...)
+		if err := runApp(t, args...); err != nil {
+			t.Errorf("%s failed: %v", test.name, err)
+			continue
+		}
+		if len(headers) == 0 {
+			t.Errorf("%s: server got no requests", test.name)
+		}
+		for _, header := range headers {
+			if header != "secret" {
+				t.Errorf("%s: request had X-Token %q, want %q", test.name, header, "secret")
+			}
+		}
+	}
+}
+
+func TestExportQueueGlobalHeader(t *testing.T) {
+	stdout := os.Stdout
+	output, err := os.Create(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	os.Stdout = output
+	err = runApp(t, "--header", "X-Token: secret", "export-queue", "https://example.com/file.bin")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("export-queue failed: %v", err)
+	}
+
+	data, err := os.ReadFile(output.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state queueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("export-queue wrote %q: %v", data, err)
+	}
+	if state.Headers["X-Token"] != "secret" {
+		t.Errorf("exported headers are %v, want X-Token: secret", state.Headers)
+	}
+}
+
+func TestCacheServerGlobalCache(t *testing.T) {
+	// An address it can't listen on stops the server once it has passed the
+	// check for --cache.
+	err := runApp(t, "--cache", t.TempDir(), "cache-server", "--listen", "127.0.0.1:-1")
+	exitErr, ok := err.(cli.ExitCoder)
+	if !ok || exitErr.ExitCode() != exitNetworkError {
+		t.Errorf("cache-server returned %v, want exit code %d", err, exitNetworkError)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// meteredCheckInterval is how long a metered check is trusted, and how often
+// downloads held back by --metered-max-size check again.
+const meteredCheckInterval = 30 * time.Second
+
+// meteredPolicy is what gograb does on a metered connection, such as a
+// phone's hotspot: cap the rate limit and hold back large downloads until
+// the connection is no longer metered.
+type meteredPolicy struct {
+	rateLimit int64 // Rate limit in bytes per second, 0 to leave rates alone
+	maxSize   int64 // Larger downloads wait for an unmetered connection, 0 for no limit
+	mutex     sync.Mutex
+	checked   time.Time // When the connection was last checked
+	metered   bool      // Result of the last check
+}
+
+// newMeteredPolicy returns the policy set by --metered-rate-limit and
+// --metered-max-size, or nil if neither is set or --ignore-metered is.
+func newMeteredPolicy(rateLimit, maxSize string, ignore bool) (*meteredPolicy, error) {
+	if ignore || (rateLimit == "" && maxSize == "") {
+		return nil, nil
+	}
+	policy := &meteredPolicy{}
+	if rateLimit != "" {
+		limit, err := parseRate(rateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --metered-rate-limit: %s", err)
+		}
+		policy.rateLimit = limit
+	}
+	if maxSize != "" {
+		size, err := parseSize(maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --metered-max-size: %s", err)
+		}
+		policy.maxSize = size
+	}
+	return policy, nil
+}
+
+// isMetered reports whether the connection is metered, checking at most once
+// per meteredCheckInterval. Where that can't be detected it never is.
+func (mp *meteredPolicy) isMetered() bool {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if time.Since(mp.checked) < meteredCheckInterval {
+		return mp.metered
+	}
+	metered, err := connectionMetered()
+	if err != nil {
+		transportLog.Debug("can't tell whether the connection is metered", "error", err)
+	}
+	mp.metered, mp.checked = metered, time.Now()
+	return metered
+}
+
+// holdBack reports whether a download of the given size should wait for an
+// unmetered connection.
+func (mp *meteredPolicy) holdBack(size int64) bool {
+	return mp != nil && mp.maxSize > 0 && size > mp.maxSize && mp.isMetered()
+}
+
+// applyMeteredLimit lowers the task's rate limit to --metered-rate-limit
+// while the connection is metered.
+func (dt *downloadTask) applyMeteredLimit() {
+	policy := dt.options.metered
+	if policy == nil || policy.rateLimit == 0 || !policy.isMetered() {
+		return
+	}
+	if dt.rateLimiter.limit == 0 || dt.rateLimiter.limit > policy.rateLimit {
+		transportLog.Info("metered connection, limiting rate", "url", dt.downloadURL, "limit", policy.rateLimit)
+		dt.rateLimiter.limit = policy.rateLimit
+	}
+}
+
+// waitUnmetered pauses the task until the connection is no longer metered.
+func (dt *downloadTask) waitUnmetered() error {
+	transportLog.Info("metered connection, holding back large download", "url", dt.downloadURL)
+	dt.log.event("metered", nil)
+	for dt.options.metered.isMetered() {
+		if err := dt.pause(time.Now().Add(meteredCheckInterval), "metered, checking in", "larger than --metered-max-size"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// connectionMetered asks NetworkManager whether the connection is metered.
+// Its Metered property is 1 (yes) or 3 (guessed yes) for metered
+// connections, such as a phone's hotspot.
+func connectionMetered() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "busctl", "--system", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		return false, err
+	}
+	// The output is the D-Bus signature and value, e.g. "u 1".
+	fields := strings.Fields(string(output))
+	if len(fields) != 2 {
+		return false, nil
+	}
+	return fields[1] == "1" || fields[1] == "3", nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// connectionMetered reports that metered connections can't be detected:
+// outside Linux, with NetworkManager, there is no way to ask without
+// platform frameworks.
+func connectionMetered() (bool, error) {
+	return false, errors.New("metered connection detection is not supported on this platform")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Frame types of the --stdout-mux stream.
+const (
+	muxBegin = 'B' // A download starts; the payload is JSON describing it
+	muxData  = 'D' // Bytes of the download, in order
+	muxEnd   = 'E' // The download is over; the payload is "" if it succeeded, or why it failed
+)
+
+// muxHeaderLength is the length of a frame header: the type, the task ID
+// and the payload's length.
+const muxHeaderLength = 9
+
+// stdoutMux writes the batch's downloads to stdout, for --stdout-mux, as one
+// stream of frames that a consumer splits back into the files. Each frame is
+// a byte for its type, then the download's task ID, its position in the
+// batch from 1, and the length of the payload that follows, both as
+// big-endian uint32s. Frames of downloads running at once are interleaved,
+// but a download's own frames arrive in order: a begin frame, its data, and
+// an end frame.
+type stdoutMux struct {
+	mutex sync.Mutex
+	out   io.Writer
+	err   error // The first failed write, after which nothing more is written
+}
+
+// muxBeginFrame is the payload of a begin frame.
+type muxBeginFrame struct {
+	URL  string `json:"url"`
+	Name string `json:"name"` // Where the file would have been saved, with forward slashes
+	Size int64  `json:"size"` // -1 if the server didn't say
+}
+
+// newStdoutMux returns the multiplexer for --stdout-mux, or nil if it isn't
+// on. It takes over stdout, and from then on everything else gograb prints
+// there, such as the progress display, goes to stderr instead.
+func newStdoutMux(enabled bool) *stdoutMux {
+	if !enabled {
+		return nil
+	}
+	mux := &stdoutMux{out: os.Stdout}
+	os.Stdout = os.Stderr
+	return mux
+}
+
+// frame writes one frame.
+func (mux *stdoutMux) frame(kind byte, id int, payload []byte) error {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	if mux.err != nil {
+		return mux.err
+	}
+	var header [muxHeaderLength]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:5], uint32(id))
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+	if _, mux.err = mux.out.Write(header[:]); mux.err == nil && len(payload) > 0 {
+		_, mux.err = mux.out.Write(payload)
+	}
+	return mux.err
+}
+
+// open sends the begin frame of the task's download and returns its output.
+// The size is that of the data frames to come, unknown when the download is
+// compressed or encrypted on the way.
+func (mux *stdoutMux) open(dt *downloadTask, fileName string, size int64) (outputFile, error) {
+	if size <= 0 || dt.options.compress != "" || dt.options.recipient != nil {
+		size = -1
+	}
+	payload, err := json.Marshal(muxBeginFrame{URL: dt.downloadURL, Name: filepath.ToSlash(fileName), Size: size})
+	if err != nil {
+		return nil, err
+	}
+	if err := mux.frame(muxBegin, dt.index, payload); err != nil {
+		return nil, err
+	}
+	dt.muxBegun = true
+	return &muxOutput{mux: mux, id: dt.index}, nil
+}
+
+// end sends the end frame of a download that began, once it is over and
+// verified, so that a consumer can tell a complete file from a failed one.
+func (mux *stdoutMux) end(dt *downloadTask, err error) {
+	if mux == nil || !dt.muxBegun {
+		return
+	}
+	var reason []byte
+	if err != io.EOF && err != nil {
+		reason = []byte(err.Error())
+	}
+	mux.frame(muxEnd, dt.index, reason)
+}
+
+// muxOutput is the outputFile of a download sent to stdout as data frames.
+type muxOutput struct {
+	mux *stdoutMux
+	id  int
+}
+
+func (mo *muxOutput) Write(p []byte) (int, error) {
+	if err := mo.mux.frame(muxData, mo.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteAt isn't supported: the stream can only be written in order.
+func (mo *muxOutput) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("--stdout-mux only supports sequential writes")
+}
+
+// Close does nothing: the end frame is sent once the download is verified.
+func (mo *muxOutput) Close() error {
+	return nil
+}
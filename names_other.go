@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+// caseInsensitiveNames is false where names that differ only in case are
+// different files. Case-insensitive volumes elsewhere aren't detected.
+const caseInsensitiveNames = false
+
+// platformFileName returns a file name derived from a response unchanged:
+// outside Windows any name without a slash is valid.
+func platformFileName(name string) string {
+	return name
+}
+
+// longPath returns the path unchanged: there is no path length limit to
+// work around outside Windows.
+func longPath(p string) string {
+	return p
+}
@@ -0,0 +1,51 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// caseInsensitiveNames is true where the file system treats names that
+// differ only in case as the same file.
+const caseInsensitiveNames = true
+
+// reservedNameRegex matches the device names Windows reserves in every
+// directory, with or without an extension.
+var reservedNameRegex = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[0-9]|LPT[0-9])(\..*)?$`)
+
+// platformFileName makes a file name derived from a response valid on
+// Windows. Characters it doesn't allow become "_", trailing dots and spaces,
+// which it would silently drop, are removed, and reserved device names such
+// as CON or NUL.txt get a "_" after their base name.
+func platformFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"|?*\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if trimmed := strings.TrimRight(name, ". "); trimmed != "" {
+		name = trimmed
+	}
+	if reservedNameRegex.MatchString(name) {
+		extension := filepath.Ext(name)
+		name = strings.TrimSuffix(name, extension) + "_" + extension
+	}
+	return name
+}
+
+// longPath returns paths too long for the classic 260 character limit in
+// their absolute form, which the os package opens with the \\?\ prefix that
+// lifts the limit. It can't do that for relative paths.
+func longPath(p string) string {
+	if len(p) < 248 {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// preferredExtensions are the extensions used for common types, where
+// mime.ExtensionsByType would list several, such as ".htm" and ".html".
+var preferredExtensions = map[string]string{
+	"text/html":              ".html",
+	"application/xhtml+xml":  ".xhtml",
+	"application/json":       ".json",
+	"text/plain":             ".txt",
+	"text/css":               ".css",
+	"text/csv":               ".csv",
+	"text/xml":               ".xml",
+	"application/xml":        ".xml",
+	"text/javascript":        ".js",
+	"application/javascript": ".js",
+	"application/pdf":        ".pdf",
+	"application/zip":        ".zip",
+	"application/gzip":       ".gz",
+	"image/jpeg":             ".jpg",
+	"image/png":              ".png",
+	"image/svg+xml":          ".svg",
+}
+
+// adjustExtension appends the extension of contentType to a file name that
+// has none, like wget's --adjust-extension, so that an API endpoint saved as
+// "status" opens as "status.json". Names that already have an extension and
+// types without a known one are left alone.
+func adjustExtension(fileName, contentType string) string {
+	if filepath.Ext(fileName) != "" || contentType == "" {
+		return fileName
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fileName
+	}
+	mediaType = strings.ToLower(mediaType)
+	if extension, ok := preferredExtensions[mediaType]; ok {
+		return fileName + extension
+	}
+	if extensions, err := mime.ExtensionsByType(mediaType); err == nil && len(extensions) > 0 {
+		return fileName + extensions[0]
+	}
+	return fileName
+}
+
+// responseFilename derives the name a response is saved under: the one from
+// extractFilename, adjusted as the options ask. URLs without a file name, such
+// as https://example.com/, are saved under --default-name, where "{host}"
+// stands for the host name.
+func (options *taskOptions) responseFilename(response *http.Response) (string, error) {
+	fileName, err := extractFilename(response, options.keepEncodedNames)
+	if err == ErrMissingFilename && options.defaultName != "" {
+		fileName, err = options.defaultFilename(response.Request.URL.Hostname()), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if options.adjustExtension {
+		fileName = adjustExtension(fileName, response.Header.Get("Content-Type"))
+	}
+	return platformFileName(fileName), nil
+}
+
+// defaultFilename returns the --default-name for a URL on host that has no
+// file name of its own.
+func (options *taskOptions) defaultFilename(host string) string {
+	return strings.ReplaceAll(options.defaultName, "{host}", strings.ReplaceAll(host, ":", "_"))
+}
+
+// outputFilename derives the name the task saves a response under: the one
+// from responseFilename, or from the page's title with --name-from-title, as
+// the --script rename hook changes it, then numbered with --numbered.
+func (dt *downloadTask) outputFilename(response *http.Response) (string, error) {
+	fileName, err := dt.options.responseFilename(response)
+	if dt.options.nameFromTitle && response.Header.Get("Content-Disposition") == "" {
+		if title := titleName(response); title != "" {
+			fileName, err = platformFileName(title), nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if fileName, err = dt.options.script.renameFile(dt.downloadURL, fileName); err != nil {
+		return "", err
+	}
+	if dt.options.numbered && dt.index > 0 {
+		fileName = fmt.Sprintf("%0*d-%s", dt.options.numberWidth, dt.index, fileName)
+	}
+	return fileName, nil
+}
+
+// titleScanLimit is how much of an HTML page --name-from-title reads to find
+// its <title>.
+const titleScanLimit = 64 * 1024
+
+var titleRegex = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// titleName returns a file name made from the <title> of an HTML response,
+// e.g. "Quarterly Report.html", or "" if it isn't HTML or has no title. The
+// start of the body read to find it is put back for the download.
+func titleName(response *http.Response) string {
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return ""
+	}
+	buffered := bufio.NewReaderSize(response.Body, titleScanLimit)
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{buffered, response.Body}
+	head, _ := buffered.Peek(titleScanLimit)
+
+	match := titleRegex.FindSubmatch(head)
+	if match == nil {
+		return ""
+	}
+	title := strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " ")
+	// Titles often contain slashes, as in "Docs / Install", which must not
+	// make a path, and can be as long as a sentence.
+	title = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 32 {
+			return '_'
+		}
+		return r
+	}, strings.ToValidUTF8(title, "_"))
+	if runes := []rune(title); len(runes) > 100 {
+		title = strings.TrimSpace(string(runes[:100]))
+	}
+	if title == "" || title == "." || title == ".." {
+		return ""
+	}
+	return title + ".html"
+}
+
+// nameClaims is the registry of the paths a batch saves to, so that two
+// downloads that would be saved under the same name, such as
+// a/report.pdf and b/report.pdf, don't overwrite each other halfway
+// through. Where the file system ignores case, names that differ only in
+// case, such as README and readme, are the same name. Each task reserves the
+// name its URL gives when it joins the batch, in input order, so which of
+// them is renamed doesn't depend on which server answers first.
+type nameClaims struct {
+	mutex sync.Mutex
+	paths map[string]*downloadTask // Owner of each claimed path, by its key
+	owned map[*downloadTask]string // Key of each task's path
+}
+
+func newNameClaims() *nameClaims {
+	return &nameClaims{paths: make(map[string]*downloadTask), owned: make(map[*downloadTask]string)}
+}
+
+// reserve claims the path the task's URL names for it, as it joins the batch.
+// Names only known from the response, and with --numbered, which keeps
+// names apart anyway, are claimed when the download starts.
+func (nc *nameClaims) reserve(dt *downloadTask) {
+	if nc == nil || dt.options.numbered {
+		return
+	}
+	if name, err := dt.plannedName(); err == nil {
+		nc.claim(dt, filepath.Join(dt.outputDir, name))
+	}
+}
+
+// claim returns the path the task saves fileName under: fileName itself, or
+// if another task of the batch has that name, the first of "name (2).ext",
+// "name (3).ext" and so on that's free. A task claiming again, as when it's
+// retried, keeps the path it has; one that claims another name gives up the
+// path it reserved.
+func (nc *nameClaims) claim(dt *downloadTask, fileName string) string {
+	if nc == nil {
+		return fileName
+	}
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	extension := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, extension)
+	candidate := fileName
+	for n := 2; ; n++ {
+		key := candidate
+		if caseInsensitiveNames {
+			key = strings.ToLower(candidate)
+		}
+		if owner, ok := nc.paths[key]; !ok || owner == dt {
+			if previous, ok := nc.owned[dt]; ok && previous != key {
+				delete(nc.paths, previous)
+			}
+			nc.paths[key] = dt
+			nc.owned[dt] = key
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, extension)
+	}
+}
+
+// printRenames lists the downloads saved under another name than they asked
+// for, because another download of the batch had it.
+func printRenames(tasks []*downloadTask) {
+	for _, task := range tasks {
+		if task != nil && task.renamedFrom != "" && task.displayName() != "" {
+			fmt.Println(trf("%s: saved as %s, another download has that name", task.downloadURL, task.displayName()))
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// networkMonitor tells whether the network is up by requesting a probe URL,
+// so that tasks can wait out an outage instead of failing.
+type networkMonitor struct {
+	probeURL string
+	interval time.Duration // How often to probe while the network is down
+	client   *http.Client
+	mutex    sync.Mutex
+	checked  time.Time // When the probe was last requested
+	online   bool      // Result of the last probe
+}
+
+// newNetworkMonitor returns a monitor for --network-probe, or nil if no probe
+// URL was given.
+func newNetworkMonitor(probeURL string, interval time.Duration, defaultScheme string) (*networkMonitor, error) {
+	if probeURL == "" {
+		return nil, nil
+	}
+	probeURL, err := normalizeURL(probeURL, defaultScheme)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --network-probe: %v", err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid --network-probe-interval %s: must be positive", interval)
+	}
+	timeout := interval
+	if timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	return &networkMonitor{probeURL: probeURL, interval: interval, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// reachable reports whether the probe URL answers with any HTTP response.
+// Tasks that fail together share one probe: a result less than a second old
+// is reused.
+func (nm *networkMonitor) reachable(ctx context.Context) bool {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	if time.Since(nm.checked) < time.Second {
+		return nm.online
+	}
+
+	nm.online = false
+	if request, err := http.NewRequestWithContext(ctx, "HEAD", nm.probeURL, nil); err == nil {
+		if response, err := nm.client.Do(request); err == nil {
+			response.Body.Close()
+			nm.online = true
+		}
+	}
+	nm.checked = time.Now()
+	return nm.online
+}
+
+// waitForNetwork checks the network after a failure and, if it is down,
+// pauses the task until the probe answers again. It returns whether the
+// network was down, in which case the failure says nothing about the server
+// and the request should simply be made again.
+func (dt *downloadTask) waitForNetwork() (bool, error) {
+	network := dt.options.network
+	if network == nil || network.reachable(dt.ctx) {
+		return false, nil
+	}
+
+	transportLog.Warn("network unreachable, waiting for it to come back", "url", dt.downloadURL, "probe", network.probeURL)
+	dt.log.event("offline", map[string]interface{}{"probe": network.probeURL})
+	for {
+		if err := dt.pause(time.Now().Add(network.interval), "offline, retrying in", "no response from "+network.probeURL); err != nil {
+			return true, err
+		}
+		if network.reachable(dt.ctx) {
+			transportLog.Info("network reachable again", "url", dt.downloadURL)
+			dt.log.event("online", nil)
+			return true, nil
+		}
+	}
+}
+
+// resumeAfterOutage is called when reading the response fails. If the network
+// went down, it waits for it to come back and requests the rest of the file,
+// returning whether the transfer can go on from the new response.
+func (dt *downloadTask) resumeAfterOutage(client *http.Client, request *http.Request) bool {
+	if dt.options.network == nil || dt.options.form != nil || dt.ctx.Err() != nil {
+		return false
+	}
+	if waited, err := dt.waitForNetwork(); err != nil || !waited {
+		return false
+	}
+
+	dt.source.Close()
+	return dt.reconnect(client, request) == nil
+}
+
+// reconnect replaces a response that was broken off, or closed to pause the
+// transfer, with a request for the rest of the file from the bytes read so
+// far.
+func (dt *downloadTask) reconnect(client *http.Client, request *http.Request) error {
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", dt.getBytesRead()))
+	response, err := dt.do(client, request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		if !dt.options.resumeUnsafe {
+			response.Body.Close()
+			return fmt.Errorf("server didn't resume the transfer: %s", response.Status)
+		}
+		if err := dt.skipPrefix(response.Body, dt.getBytesRead()); err != nil {
+			response.Body.Close()
+			return err
+		}
+		dt.setRanges(rangesUnsupported)
+		dt.source = dt.guardStall(response.Body)
+		return nil
+	}
+	dt.setRanges(rangesSupported)
+	dt.source = dt.guardStall(response.Body)
+	return nil
+}
+
+// skipPrefix reads and drops the first n bytes of a response that started
+// over from the beginning, for --resume-unsafe. Nothing checks that they
+// match the bytes already downloaded, only that the stream is long enough.
+func (dt *downloadTask) skipPrefix(body io.Reader, n int64) error {
+	transportLog.Info("server ignored the range, skipping what was already downloaded", "url", dt.downloadURL, "bytes", n)
+	dt.log.event("skip", map[string]interface{}{"bytes": n})
+	skipped, err := io.CopyN(io.Discard, body, n)
+	if err == io.EOF {
+		return fmt.Errorf("stream ended after %d bytes, before the %d already downloaded", skipped, n)
+	}
+	return err
+}
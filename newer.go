@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNotModified = errors.New("not modified since --newer-than")
+
+// parseNewerThan parses a --newer-than reference: the modification time of
+// an existing file, or a timestamp given as RFC 3339, a date, or "@" and
+// Unix seconds. It returns the zero time for "".
+func parseNewerThan(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if fileInfo, err := os.Stat(value); err == nil {
+		return fileInfo.ModTime(), nil
+	}
+	if seconds, ok := strings.CutPrefix(value, "@"); ok {
+		if unix, err := strconv.ParseInt(seconds, 10, 64); err == nil {
+			return time.Unix(unix, 0), nil
+		}
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --newer-than %q: must be an existing file or a time, e.g. 2024-05-01T00:00:00Z, 2024-05-01 or @1714521600", value)
+}
+
+// notNewer reports whether a response shows that the resource hasn't changed
+// since the --newer-than reference: the server answered 304 Not Modified to
+// If-Modified-Since, or, for servers that ignore it, sent a Last-Modified
+// time no later than the reference.
+func (options *taskOptions) notNewer(response *http.Response, err error) bool {
+	if options.newerThan.IsZero() {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusNotModified
+	}
+	if err != nil {
+		return false
+	}
+	lastModified, parseErr := http.ParseTime(response.Header.Get("Last-Modified"))
+	return parseErr == nil && !lastModified.After(options.newerThan.Truncate(time.Second))
+}
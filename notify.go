@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// emailNotifier mails a summary of the batch once it is over, for long
+// unattended transfers, such as overnight ones on a server.
+type emailNotifier struct {
+	to       []string
+	from     string
+	server   string // host:port of the SMTP server
+	user     string // "" to send without authenticating
+	password string
+}
+
+// newEmailNotifier builds the notifier from the --email-to and --smtp-*
+// flags, or returns nil if --email-to isn't set.
+func newEmailNotifier(c *cli.Context) (*emailNotifier, error) {
+	to := splitList(c.GlobalStringSlice("email-to"))
+	if len(to) == 0 {
+		return nil, nil
+	}
+	en := &emailNotifier{
+		to:       to,
+		from:     c.GlobalString("email-from"),
+		server:   c.GlobalString("smtp-server"),
+		user:     c.GlobalString("smtp-user"),
+		password: c.GlobalString("smtp-password"),
+	}
+	if _, _, err := net.SplitHostPort(en.server); err != nil {
+		return nil, fmt.Errorf("invalid --smtp-server %q: must be host:port, e.g. smtp.example.com:587", en.server)
+	}
+	if en.from == "" {
+		hostname, _ := os.Hostname()
+		en.from = "gograb@" + hostname
+	}
+	return en, nil
+}
+
+// send mails the summary of the batch: how many downloads succeeded, then a
+// line per task. A failure to send is logged, and doesn't change the
+// outcome of the batch.
+func (en *emailNotifier) send(tasks []*downloadTask, started time.Time) {
+	if en == nil {
+		return
+	}
+	var failed, total int
+	var lines bytes.Buffer
+	for _, task := range tasks {
+		if task == nil {
+			continue
+		}
+		total++
+		status, err := task.finishStatus(task.error)
+		if task.failed() {
+			failed++
+		}
+		switch {
+		case err != nil:
+			fmt.Fprintf(&lines, "%-8s %s: %v\r\n", status, task.downloadURL, err)
+		case task.fileName != "" && task.renamedFrom != "":
+			fmt.Fprintf(&lines, "%-8s %s (%s, renamed from %s)\r\n", status, task.displayName(), strings.TrimSpace(humanReadableSize(task.getBytesRead())), filepath.Base(task.renamedFrom))
+		case task.fileName != "":
+			fmt.Fprintf(&lines, "%-8s %s (%s)\r\n", status, task.displayName(), strings.TrimSpace(humanReadableSize(task.getBytesRead())))
+		default:
+			fmt.Fprintf(&lines, "%-8s %s\r\n", status, task.downloadURL)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	subject := fmt.Sprintf("gograb on %s: %d of %d downloads completed", hostname, total-failed, total)
+	if failed > 0 {
+		subject = fmt.Sprintf("gograb on %s: %d of %d downloads failed", hostname, failed, total)
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		en.from, strings.Join(en.to, ", "), subject, time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "The batch started at %s and took %s.\r\n\r\n", started.Format(time.RFC1123), time.Since(started).Round(time.Second))
+	message.Write(lines.Bytes())
+
+	var auth smtp.Auth
+	if en.user != "" {
+		host, _, _ := net.SplitHostPort(en.server)
+		auth = smtp.PlainAuth("", en.user, en.password, host)
+	}
+	if err := smtp.SendMail(en.server, auth, en.from, en.to, message.Bytes()); err != nil {
+		schedulerLog.Warn("sending the summary email failed", "server", en.server, "error", err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// loginCommand obtains OAuth2 tokens for the hosts of a provider through the
+// device authorization flow.
+var loginCommand = cli.Command{
+	Name:      "login",
+	Usage:     "Log in to an OAuth2 provider with the device flow and cache its tokens",
+	ArgsUsage: "<provider.json>",
+	Action:    loginAction,
+}
+
+// oauthProvider is a provider config for login.
+type oauthProvider struct {
+	ClientID                    string   `json:"client_id"`
+	ClientSecret                string   `json:"client_secret,omitempty"`
+	DeviceAuthorizationEndpoint string   `json:"device_authorization_endpoint"`
+	TokenEndpoint               string   `json:"token_endpoint"`
+	Scope                       string   `json:"scope,omitempty"`
+	Hosts                       []string `json:"hosts"` // Download hosts the tokens are sent to
+}
+
+// oauthToken is a cached token, with what's needed to refresh it.
+type oauthToken struct {
+	AccessToken   string    `json:"access_token"`
+	TokenType     string    `json:"token_type,omitempty"`
+	RefreshToken  string    `json:"refresh_token,omitempty"`
+	Expiry        time.Time `json:"expiry,omitempty"`
+	TokenEndpoint string    `json:"token_endpoint"`
+	ClientID      string    `json:"client_id"`
+	ClientSecret  string    `json:"client_secret,omitempty"`
+}
+
+// tokenResponse is a token endpoint response, successful or not.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// tokenStore caches OAuth2 tokens by host in the user's config directory. A
+// nil tokenStore has no tokens.
+type tokenStore struct {
+	mutex  sync.Mutex
+	path   string
+	tokens map[string]*oauthToken
+}
+
+// tokenStorePath returns where tokens are cached, e.g.
+// ~/.config/gograb/tokens.json on Linux.
+func tokenStorePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gograb", "tokens.json"), nil
+}
+
+// loadTokenStore reads the token cache, returning nil if there is none.
+func loadTokenStore() (*tokenStore, error) {
+	path, err := tokenStorePath()
+	if err != nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	store := &tokenStore{path: path}
+	if err := json.Unmarshal(data, &store.tokens); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return store, nil
+}
+
+// save writes the token cache, readable only by the user. The caller must
+// hold the mutex.
+func (ts *tokenStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(ts.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ts.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ts.path, data, 0600)
+}
+
+// authorization returns the Authorization header for host, refreshing an
+// expired token first, or "" if there's no token for the host.
+func (ts *tokenStore) authorization(host string) (string, error) {
+	if ts == nil {
+		return "", nil
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	token, ok := ts.tokens[strings.ToLower(host)]
+	if !ok {
+		return "", nil
+	}
+	if !token.Expiry.IsZero() && time.Until(token.Expiry) < 30*time.Second {
+		if token.RefreshToken == "" {
+			return "", fmt.Errorf("OAuth2 token for %s expired, run gograb login again", host)
+		}
+		refreshed, err := requestToken(token.TokenEndpoint, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {token.RefreshToken},
+			"client_id":     {token.ClientID},
+			"client_secret": {token.ClientSecret},
+		})
+		if err != nil {
+			return "", fmt.Errorf("refreshing OAuth2 token for %s: %v", host, err)
+		}
+		// Every host sharing the old token gets the new one.
+		for _, other := range ts.tokens {
+			if other.RefreshToken == token.RefreshToken {
+				other.update(refreshed)
+			}
+		}
+		if err := ts.save(); err != nil {
+			return "", err
+		}
+	}
+
+	tokenType := token.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + token.AccessToken, nil
+}
+
+// update replaces the token with a token endpoint response. Servers that
+// don't rotate refresh tokens omit them, so the old one is kept.
+func (token *oauthToken) update(response *tokenResponse) {
+	token.AccessToken = response.AccessToken
+	token.TokenType = response.TokenType
+	if response.RefreshToken != "" {
+		token.RefreshToken = response.RefreshToken
+	}
+	token.Expiry = time.Time{}
+	if response.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+}
+
+// requestToken posts a token request, returning the response or its OAuth2
+// error as an error.
+func requestToken(endpoint string, form url.Values) (*tokenResponse, error) {
+	for key, value := range form {
+		if len(value) == 1 && value[0] == "" {
+			delete(form, key)
+		}
+	}
+	response, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var token tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("%s: %s", endpoint, response.Status)
+	}
+	if token.Error != "" {
+		return &token, &oauthError{code: token.Error, description: token.Description}
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("%s: no access token in response", endpoint)
+	}
+	return &token, nil
+}
+
+// oauthError is an error response from an OAuth2 endpoint.
+type oauthError struct {
+	code        string
+	description string
+}
+
+func (e *oauthError) Error() string {
+	if e.description != "" {
+		return e.code + ": " + e.description
+	}
+	return e.code
+}
+
+// loginAction runs the OAuth2 device authorization flow (RFC 8628) for a
+// provider: it shows the user a code to enter in their browser, polls until
+// they have approved it, then caches the tokens for the provider's hosts.
+func loginAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("usage: gograb login <provider.json>", exitUsageError)
+	}
+	data, err := os.ReadFile(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	var provider oauthProvider
+	if err := json.Unmarshal(data, &provider); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %v", c.Args().First(), err), exitUsageError)
+	}
+	if provider.ClientID == "" || provider.DeviceAuthorizationEndpoint == "" || provider.TokenEndpoint == "" || len(provider.Hosts) == 0 {
+		return cli.NewExitError(fmt.Sprintf("%s: client_id, device_authorization_endpoint, token_endpoint and hosts are required", c.Args().First()), exitUsageError)
+	}
+
+	form := url.Values{"client_id": {provider.ClientID}}
+	if provider.Scope != "" {
+		form.Set("scope", provider.Scope)
+	}
+	response, err := http.PostForm(provider.DeviceAuthorizationEndpoint, form)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitNetworkError)
+	}
+	var device struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int64  `json:"expires_in"`
+		Interval                int64  `json:"interval"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&device)
+	response.Body.Close()
+	if err != nil || device.DeviceCode == "" {
+		return cli.NewExitError(fmt.Sprintf("device authorization failed: %s", response.Status), exitAuthError)
+	}
+
+	if device.VerificationURIComplete != "" {
+		fmt.Printf("Open %s to log in, and check that it shows the code %s.\n", device.VerificationURIComplete, device.UserCode)
+	} else {
+		fmt.Printf("Open %s and enter the code %s to log in.\n", device.VerificationURI, device.UserCode)
+	}
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	if device.ExpiresIn <= 0 {
+		deadline = time.Now().Add(15 * time.Minute)
+	}
+
+	var token *tokenResponse
+	for token == nil {
+		if time.Now().After(deadline) {
+			return cli.NewExitError("login timed out", exitAuthError)
+		}
+		time.Sleep(interval)
+		token, err = requestToken(provider.TokenEndpoint, url.Values{
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code":   {device.DeviceCode},
+			"client_id":     {provider.ClientID},
+			"client_secret": {provider.ClientSecret},
+		})
+		var oauthErr *oauthError
+		switch {
+		case errors.As(err, &oauthErr) && oauthErr.code == "authorization_pending":
+			token = nil
+		case errors.As(err, &oauthErr) && oauthErr.code == "slow_down":
+			token = nil
+			interval += 5 * time.Second
+		case err != nil:
+			return cli.NewExitError(fmt.Sprintf("login failed: %s", err), exitAuthError)
+		}
+	}
+
+	store, err := loadTokenStore()
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	if store == nil {
+		path, err := tokenStorePath()
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitAllFailed)
+		}
+		store = &tokenStore{path: path}
+	}
+	if store.tokens == nil {
+		store.tokens = make(map[string]*oauthToken)
+	}
+	for _, host := range provider.Hosts {
+		cached := &oauthToken{TokenEndpoint: provider.TokenEndpoint, ClientID: provider.ClientID, ClientSecret: provider.ClientSecret}
+		cached.update(token)
+		store.tokens[strings.ToLower(host)] = cached
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.save(); err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	fmt.Printf("Logged in. Tokens for %s saved to %s.\n", strings.Join(provider.Hosts, ", "), store.path)
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/urfave/cli"
+)
+
+// taskOptions holds the settings shared by every task in a batch.
+type taskOptions struct {
+	headers          map[string]string   // Custom HTTP headers sent with every request
+	defaultScheme    string              // Scheme prepended to URLs given without one
+	errorBodyLimit   int64               // Bytes of 4xx/5xx response bodies to include in errors
+	retry            retryPolicy         // Which failed requests to retry
+	stallTimeout     time.Duration       // How long a download may receive nothing before it fails, 0 for no limit
+	hosts            *hostTracker        // Per-host throttling shared across tasks
+	autoSegments     bool                // Split downloads across connections while it helps
+	tcp              tcpOptions          // Socket tuning for download connections
+	discard          bool                // Download without writing anything to disk
+	checksums        map[string]string   // Expected SHA-256 by file name, from --sums
+	adoptPartials    bool                // Resume partial files left by other download managers
+	resumeFrom       string              // Partial file from another URL for the one download to resume from, "" for none
+	zsync            bool                // Update existing files by downloading only the blocks that changed
+	zsyncFile        string              // Where --zsync finds control files, from {url}, {dir} and {name}
+	resumeUnsafe     bool                // Skip the downloaded prefix of a restarted stream instead of starting over
+	taskLogDir       string              // Directory for per-task logs, "" to disable
+	tracer           *tracer             // OpenTelemetry span collector, nil if not tracing
+	credentials      *credentialHelper   // Per-host credential lookup, nil if not configured
+	tokens           *tokenStore         // OAuth2 tokens cached by gograb login, nil if none
+	hsts             *hstsCache          // Hosts to reach only over HTTPS, and --https-only
+	pins             map[string][]string // Pinned public key digests by host, from --pin-sha256
+	proxies          proxyRules          // Proxies by host from --proxy-for, before the environment's
+	sshTunnel        *sshTunnel          // Jump host connections go through, nil to connect directly
+	release          *releaseVerifier    // Signed checksums from --release-verify, nil if not set
+	autoVerify       bool                // Look for checksums and signatures published next to downloads
+	cache            *downloadCache      // Content-addressable store from --cache, nil if not set
+	cacheServer      *url.URL            // gograb cache-server to fetch through, nil to fetch directly
+	prefetch         *prefetcher         // Gets queued downloads' connections ready for --prefetch, nil if not set
+	smallFiles       *smallFiles         // Shared connections and batched flushes for --small-files, nil if not set
+	dedupe           *batchDedupe        // Downloads of the batch fetching the same file, for --dedupe, nil if not set
+	restrictTo       string              // Resolved directory all output must stay inside, "" for anywhere
+	scanCmd          string              // Command run on each completed file, "" for none
+	pipeTo           string              // Command fed each download, verified piece by piece, "" for none
+	pipePieces       string              // Where --pipe-to finds piece manifests, from {url}, {dir} and {name}
+	expectedSizes    map[string]int64    // Sizes by URL for responses without Content-Length, "" for any URL
+	form             *formBody           // Multipart form POSTed to each URL, nil to GET them
+	adjustExtension  bool                // Add an extension from the Content-Type to names without one
+	defaultName      string              // Name for URLs without one, "{host}" replaced; "" to fail instead
+	keepEncodedNames bool                // Keep names from URL paths percent-encoded instead of decoding them
+	nameFromTitle    bool                // Name HTML pages after their <title>
+	htmlGuard        string              // What to do about HTML pages in place of files: warn, fail or off
+	numbered         bool                // Prefix names with the task's position in the batch
+	numberWidth      int                 // Digits --numbered pads positions to, set for each batch
+	names            *nameClaims         // Output paths used by the batch, to keep names differing in case apart
+	staging          *stagingArea        // Where --all-or-nothing and --in-order downloads wait, nil if not set
+	releaser         *releaser           // Hands finished files on for --in-order, --exec and --tar-output, nil if none is set
+	archive          *batchArchive       // Archive --tar-output adds the downloads to, nil to save them as files
+	mux              *stdoutMux          // Where --stdout-mux frames the downloads, nil to save them as files
+	manifestFile     string              // Where to record the files the batch saved, "" for nowhere
+	reproducible     bool                // Require pinned hashes and give saved files fixed metadata
+	epoch            time.Time           // Modification time of files saved under --reproducible
+	network          *networkMonitor     // Probe to wait out network outages with, nil to fail instead
+	portal           *portalMonitor      // Probe for captive portals to wait out, nil not to check
+	metered          *meteredPolicy      // What to do on metered connections, nil to ignore them
+	battery          *batteryPolicy      // What to do on a low battery, nil to ignore it
+	budget           *bandwidthBudget    // Rate shared by all downloads from --total-rate-limit, nil for none
+	groups           taskGroups          // Groups of downloads from --group, with their limits
+	background       bool                // Use small buffers, for --background
+	fsync            bool                // Flush completed files to disk before reporting success
+	syncDir          bool                // Flush the directories of completed files to disk
+	directIO         bool                // Write around the page cache
+	compress         string              // Format to compress saved files with, "" for none
+	recipient        age.Recipient       // Who saved files are encrypted to, nil to save them in plaintext
+	splitSize        int64               // Largest part file --split-output writes, 0 to save whole files
+	pieceLength      int64               // Length of the pieces --piece-hashes hashes, 0 to not hash pieces
+	pieceAlgorithm   string              // Hash used for each piece, "sha1" or "sha256"
+	s3Endpoint       string              // Where s3:// buckets are reached, path-style, "" for AWS
+	resolvers        []resolver          // --resolver commands, tried before the built-in resolvers
+	script           *taskScript         // Hooks from --script, nil if none
+	headerDump       *headerDump         // Where --dump-headers writes response headers, nil if not set
+	wireTrace        *wireTrace          // Where --trace logs the wire exchange, nil if not set
+	newerThan        time.Time           // Only download resources modified after this, zero for any
+	ifSizeDiffers    bool                // Skip files whose size matches the remote Content-Length
+	showResolved     bool                // Show the server address and final URL in the progress lines
+	email            *emailNotifier      // Who to mail the batch summary to, nil for nobody
+	chat             *chatNotifiers      // Chat services from --notify, nil for none
+	progress         *progressFD         // Where --progress-fd frames go, nil if not set
+}
+
+// newTaskOptions builds the task options from the global command-line flags.
+// It reads them through c's parents, so a subcommand can pass its own context.
+func newTaskOptions(c *cli.Context) (*taskOptions, error) {
+	options := &taskOptions{
+		headers:          parseHeaders(c.GlobalStringSlice("header")),
+		defaultScheme:    c.GlobalString("default-scheme"),
+		errorBodyLimit:   c.GlobalInt64("show-error-body"),
+		hosts:            newHostTracker(c.GlobalInt("breaker-threshold"), c.GlobalDuration("breaker-cooldown")),
+		stallTimeout:     c.GlobalDuration("stall-timeout"),
+		autoSegments:     c.GlobalBool("auto-segments"),
+		discard:          c.GlobalBool("discard"),
+		adoptPartials:    c.GlobalBool("adopt-partials"),
+		resumeFrom:       c.GlobalString("resume-from"),
+		zsync:            c.GlobalBool("zsync"),
+		zsyncFile:        c.GlobalString("zsync-file"),
+		resumeUnsafe:     c.GlobalBool("resume-unsafe"),
+		taskLogDir:       c.GlobalString("task-logs"),
+		tracer:           newTracer(c.GlobalString("otlp-endpoint")),
+		credentials:      newCredentialHelper(c.GlobalString("credential-helper")),
+		hsts:             loadHSTSCache(c.GlobalBool("https-only")),
+		scanCmd:          c.GlobalString("scan-cmd"),
+		pipeTo:           c.GlobalString("pipe-to"),
+		pipePieces:       c.GlobalString("pipe-pieces"),
+		adjustExtension:  c.GlobalBool("adjust-extension"),
+		nameFromTitle:    c.GlobalBool("name-from-title"),
+		numbered:         c.GlobalBool("numbered"),
+		defaultName:      c.GlobalString("default-name"),
+		keepEncodedNames: c.GlobalBool("keep-encoded-names"),
+		names:            newNameClaims(),
+		manifestFile:     c.GlobalString("write-manifest"),
+		reproducible:     c.GlobalBool("reproducible"),
+		background:       c.GlobalBool("background"),
+		fsync:            c.GlobalBool("fsync"),
+		smallFiles:       newSmallFiles(c.GlobalBool("small-files"), c.GlobalInt("max-concurrent")),
+		syncDir:          c.GlobalBool("sync-dir"),
+		directIO:         c.GlobalBool("direct-io"),
+		s3Endpoint:       c.GlobalString("s3-endpoint"),
+		ifSizeDiffers:    c.GlobalBool("if-size-differs"),
+		showResolved:     c.GlobalBool("show-resolved"),
+		autoVerify:       c.GlobalBool("auto-verify"),
+	}
+	if options.defaultScheme != "" && options.defaultScheme != "http" && options.defaultScheme != "https" {
+		return nil, fmt.Errorf("invalid --default-scheme %q: must be http or https", options.defaultScheme)
+	}
+	if strings.ContainsAny(options.defaultName, `/\`) || options.defaultName == "." || options.defaultName == ".." {
+		return nil, fmt.Errorf("invalid --default-name %q: must be a file name, not a path", options.defaultName)
+	}
+
+	if options.s3Endpoint != "" {
+		if _, err := normalizeURL(options.s3Endpoint, ""); err != nil {
+			return nil, fmt.Errorf("invalid --s3-endpoint: %v", err)
+		}
+	}
+
+	if options.manifestFile != "" && options.discard {
+		return nil, fmt.Errorf("--write-manifest can't be combined with --discard, which saves no files")
+	}
+
+	if value := c.GlobalString("split-output"); value != "" {
+		size, err := parseSize(value)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid --split-output %q: must be a part size, e.g. 4G", value)
+		}
+		options.splitSize = size
+		switch {
+		case options.discard:
+			return nil, fmt.Errorf("--split-output can't be combined with --discard, which saves no files")
+		case c.GlobalBool("direct-io"), c.GlobalBool("all-or-nothing"), c.GlobalBool("in-order"), options.scanCmd != "":
+			return nil, fmt.Errorf("--split-output can't be combined with --direct-io, --all-or-nothing, --in-order or --scan-cmd")
+		}
+	}
+
+	if options.pipeTo != "" && (options.discard || options.splitSize > 0 || c.GlobalString("compress") != "" || c.GlobalString("encrypt") != "" || c.GlobalBool("direct-io")) {
+		return nil, fmt.Errorf("--pipe-to can't be combined with --discard, --split-output, --compress, --encrypt or --direct-io")
+	}
+
+	// --stdout-mux streams the downloads instead of saving them, so nothing
+	// that works on the saved files applies.
+	if c.GlobalBool("stdout-mux") && (options.discard || options.splitSize > 0 || c.GlobalString("tar-output") != "" || c.GlobalBool("direct-io") || c.GlobalBool("all-or-nothing") || c.GlobalBool("in-order") || c.GlobalString("exec") != "" || options.scanCmd != "" || options.pipeTo != "" || c.GlobalString("dedupe") != "" || c.GlobalString("piece-hashes") != "" || options.reproducible || options.manifestFile != "") {
+		return nil, fmt.Errorf("--stdout-mux can't be combined with --discard, --split-output, --tar-output, --direct-io, --all-or-nothing, --in-order, --exec, --scan-cmd, --pipe-to, --dedupe, --piece-hashes, --reproducible or --write-manifest")
+	}
+	options.mux = newStdoutMux(c.GlobalBool("stdout-mux"))
+
+	var err error
+	if options.network, err = newNetworkMonitor(c.GlobalString("network-probe"), c.GlobalDuration("network-probe-interval"), options.defaultScheme); err != nil {
+		return nil, err
+	}
+	if options.portal, err = newPortalMonitor(c.GlobalBool("portal-check"), c.GlobalString("portal-probe"), c.GlobalDuration("network-probe-interval"), options.defaultScheme); err != nil {
+		return nil, err
+	}
+	if options.metered, err = newMeteredPolicy(c.GlobalString("metered-rate-limit"), c.GlobalString("metered-max-size"), c.GlobalBool("ignore-metered")); err != nil {
+		return nil, err
+	}
+	if options.compress, err = parseCompression(c.GlobalString("compress")); err != nil {
+		return nil, err
+	}
+	if options.recipient, err = parseEncryption(c.GlobalString("encrypt")); err != nil {
+		return nil, err
+	}
+	if value := c.GlobalString("piece-hashes"); value != "" {
+		if options.pieceLength, err = parseSize(value); err != nil || options.pieceLength <= 0 {
+			return nil, fmt.Errorf("invalid --piece-hashes %q: must be a piece length, e.g. 4M", value)
+		}
+		if options.discard || options.compress != "" || options.recipient != nil {
+			return nil, fmt.Errorf("--piece-hashes can't be combined with --discard, --compress or --encrypt")
+		}
+		if options.pieceAlgorithm, err = parsePieceAlgorithm(c.GlobalString("piece-algorithm")); err != nil {
+			return nil, err
+		}
+	}
+	if options.budget, err = newBandwidthBudget(c.GlobalString("total-rate-limit"), c.GlobalString("foreground"), c.GlobalString("foreground-share"), options.defaultScheme); err != nil {
+		return nil, err
+	}
+	if options.groups, err = parseGroups(c.GlobalStringSlice("group"), c.GlobalStringSlice("group-limit"), c.GlobalStringSlice("group-concurrency")); err != nil {
+		return nil, err
+	}
+	if options.battery, err = newBatteryPolicy(c.GlobalInt("battery-threshold"), c.GlobalString("battery-rate-limit")); err != nil {
+		return nil, err
+	}
+	if options.reproducible {
+		if options.epoch, err = sourceDateEpoch(); err != nil {
+			return nil, err
+		}
+	}
+	if c.GlobalBool("all-or-nothing") {
+		if c.GlobalBool("in-order") {
+			return nil, fmt.Errorf("--in-order can't be combined with --all-or-nothing, which releases every file at the end")
+		}
+		options.staging = &stagingArea{}
+	}
+	if c.GlobalBool("in-order") && !options.discard {
+		options.staging = &stagingArea{inOrder: true}
+	}
+	if archive := c.GlobalString("tar-output"); archive != "" {
+		switch {
+		case options.discard, options.splitSize > 0, c.GlobalBool("all-or-nothing"), c.GlobalString("exec") != "", c.GlobalString("dedupe") != "", options.zsync, options.resumeFrom != "", c.GlobalString("piece-hashes") != "", options.reproducible, options.manifestFile != "":
+			return nil, fmt.Errorf("--tar-output can't be combined with --discard, --split-output, --all-or-nothing, --exec, --dedupe, --zsync, --resume-from, --piece-hashes, --reproducible or --write-manifest")
+		}
+		options.archive = newBatchArchive(archive)
+		options.staging = &stagingArea{inOrder: true}
+	}
+	options.releaser = newReleaser(c.GlobalBool("in-order"), c.GlobalString("exec"), options.archive)
+
+	retryStatus, err := parseRetryOn(c.GlobalStringSlice("retry-on"))
+	if err != nil {
+		return nil, err
+	}
+	options.retry = retryPolicy{maxRetries: c.GlobalInt("retries"), retryStatus: retryStatus}
+
+	options.tcp = tcpOptions{noDelay: c.GlobalBoolT("tcp-nodelay"), congestion: c.GlobalString("tcp-congestion")}
+	if value := c.GlobalString("tcp-read-buffer"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --tcp-read-buffer: %s", err)
+		}
+		options.tcp.readBuffer = int(size)
+	}
+	if options.tcp.sources, err = parseSources(splitList(c.GlobalStringSlice("interface")), splitList(c.GlobalStringSlice("source-ip"))); err != nil {
+		return nil, err
+	}
+	if err := options.tcp.validate(); err != nil {
+		return nil, err
+	}
+
+	if options.pins, err = parsePins(splitList(c.GlobalStringSlice("pin-sha256"))); err != nil {
+		return nil, err
+	}
+	if options.proxies, err = parseProxyRules(splitList(c.GlobalStringSlice("proxy-for"))); err != nil {
+		return nil, err
+	}
+	if options.sshTunnel, err = parseSSHTunnel(c.GlobalString("ssh-tunnel")); err != nil {
+		return nil, err
+	}
+	if options.cache, err = newDownloadCache(c.GlobalString("cache")); err != nil {
+		return nil, err
+	}
+	if options.cacheServer, err = parseCacheServer(c.GlobalString("cache-server")); err != nil {
+		return nil, err
+	}
+	if options.prefetch, err = newPrefetcher(c.GlobalString("prefetch"), options); err != nil {
+		return nil, err
+	}
+	if options.htmlGuard, err = parseHTMLGuard(c.GlobalString("html-guard")); err != nil {
+		return nil, err
+	}
+	if options.dedupe, err = newBatchDedupe(c.GlobalString("dedupe")); err != nil {
+		return nil, err
+	}
+	if options.release, err = newReleaseVerifier(c.GlobalString("release-verify"), c.GlobalString("release-sums")); err != nil {
+		return nil, err
+	}
+
+	if dir := c.GlobalString("restrict-to"); dir != "" {
+		if options.restrictTo, err = resolvePath(dir); err != nil {
+			return nil, fmt.Errorf("invalid --restrict-to: %s", err)
+		}
+	}
+
+	if options.expectedSizes, err = parseExpectedSizes(c.GlobalStringSlice("expected-size"), options.defaultScheme); err != nil {
+		return nil, err
+	}
+
+	if scriptFile := c.GlobalString("script"); scriptFile != "" {
+		if options.script, err = loadScript(scriptFile); err != nil {
+			return nil, err
+		}
+	}
+	if options.headerDump, err = newHeaderDump(c.GlobalString("dump-headers")); err != nil {
+		return nil, err
+	}
+	if options.wireTrace, err = newWireTrace(c.GlobalString("trace")); err != nil {
+		return nil, err
+	}
+	if options.newerThan, err = parseNewerThan(c.GlobalString("newer-than")); err != nil {
+		return nil, err
+	}
+	if options.email, err = newEmailNotifier(c); err != nil {
+		return nil, err
+	}
+	if options.chat, err = loadChatNotifiers(c.GlobalString("notify")); err != nil {
+		return nil, err
+	}
+	if options.progress, err = openProgressFD(c.GlobalInt("progress-fd")); err != nil {
+		return nil, err
+	}
+	if options.resolvers, err = parseResolvers(c.GlobalStringSlice("resolver")); err != nil {
+		return nil, err
+	}
+
+	if options.form, err = parseForm(c.GlobalStringSlice("form")); err != nil {
+		return nil, err
+	}
+	if options.resumeFrom != "" && (options.discard || options.form != nil || options.streamsOutput() || options.ifSizeDiffers) {
+		return nil, fmt.Errorf("--resume-from can't be combined with --discard, --form, --split-output, --compress, --encrypt, --stdout-mux or --if-size-differs")
+	}
+	if options.zsync && (options.discard || options.form != nil || options.streamsOutput() || options.pipeTo != "" || options.directIO || options.resumeFrom != "") {
+		return nil, fmt.Errorf("--zsync can't be combined with --discard, --form, --split-output, --compress, --encrypt, --stdout-mux, --pipe-to, --direct-io or --resume-from")
+	}
+
+	if options.tokens, err = loadTokenStore(); err != nil {
+		return nil, err
+	}
+
+	if sumsFile := c.GlobalString("sums"); sumsFile != "" {
+		if options.checksums, err = parseChecksumFile(sumsFile); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+// parseExpectedSizes parses --expected-size values: "SIZE" applies to every
+// URL, "SIZE:url" to one URL, like the rate limit prefix of URL arguments.
+func parseExpectedSizes(values []string, defaultScheme string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for _, value := range values {
+		sizeValue, rawURL, _ := strings.Cut(value, ":")
+		size, err := parseSize(sizeValue)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid --expected-size %q: must be SIZE or SIZE:url, e.g. 4.7G", value)
+		}
+		if rawURL != "" {
+			if rawURL, err = normalizeURL(rawURL, defaultScheme); err != nil {
+				return nil, fmt.Errorf("invalid --expected-size %q: %v", value, err)
+			}
+		}
+		sizes[rawURL] = size
+	}
+	return sizes, nil
+}
+
+// expectedSize returns the --expected-size for a URL, or 0 if none was given.
+func (options *taskOptions) expectedSize(url string) int64 {
+	if size, ok := options.expectedSizes[url]; ok {
+		return size
+	}
+	return options.expectedSizes[""]
+}
+
+// bufferSize returns the size of each task's read buffer. --background uses
+// smaller reads, which hand the CPU and disk back to other programs more
+// often.
+func (options *taskOptions) bufferSize() int {
+	if options.background {
+		return 4 * 1024
+	}
+	return 32 * 1024
+}
+
+// streamsOutput reports whether saved files are written through a compressor
+// or encryptor, split into parts, or framed on stdout, which can only be
+// written in order, from the start.
+func (options *taskOptions) streamsOutput() bool {
+	return options.compress != "" || options.recipient != nil || options.splitSize > 0 || options.mux != nil
+}
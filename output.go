@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// outputFile is where a task writes the downloaded bytes. Segmented downloads
+// write at arbitrary offsets, so sequential writing alone isn't enough.
+type outputFile interface {
+	io.WriteCloser
+	io.WriterAt
+}
+
+// discardOutput is an outputFile that drops everything written to it, used by
+// --discard to download without touching the disk.
+type discardOutput struct{}
+
+func (discardOutput) Write(p []byte) (int, error)            { return len(p), nil }
+func (discardOutput) WriteAt(p []byte, _ int64) (int, error) { return len(p), nil }
+func (discardOutput) Close() error                           { return nil }
+
+// closeOutput closes the task's output once the transfer is over. A failure
+// to close, which can be the first sign of a failed write on network file
+// systems, replaces the success of an otherwise complete download. With
+// --fsync a complete file is flushed to disk first, and with --sync-dir so is
+// its directory entry, so that it survives a power loss; under --small-files
+// both are put off until the end of the batch, unless --in-order moves the
+// file before then. Under --tar-output, the file is only staged until it is
+// added to the archive, which is flushed instead. A split download's
+// manifest is only written once it is complete.
+func (dt *downloadTask) closeOutput(err error) error {
+	if dt.destination == nil {
+		return err
+	}
+	fsync := dt.options.fsync && dt.options.archive == nil
+	syncDirs := dt.options.syncDir && dt.options.archive == nil && !dt.options.discard
+	// Under --in-order a staged file is moved into place by the releaser
+	// while the batch runs, before it could be flushed at its end.
+	inOrder := dt.options.staging != nil && dt.options.staging.inOrder
+	deferSync := dt.options.smallFiles != nil && dt.parts == nil && !dt.options.discard && !inOrder
+	if err == io.EOF && fsync && !deferSync {
+		if file, ok := dt.destination.(interface{ Sync() error }); ok {
+			if syncErr := file.Sync(); syncErr != nil {
+				dt.destination.Close()
+				return syncErr
+			}
+		}
+	}
+	if closeErr := dt.destination.Close(); closeErr != nil && err == io.EOF {
+		return closeErr
+	}
+	if err == io.EOF && dt.parts != nil {
+		if manifestErr := dt.parts.writeManifest(); manifestErr != nil {
+			return manifestErr
+		}
+	}
+	if err == io.EOF && deferSync && (fsync || syncDirs) {
+		dt.options.smallFiles.syncLater(dt.fileName, fsync, syncDirs)
+	}
+	if err == io.EOF && syncDirs && !deferSync {
+		if syncErr := syncDir(filepath.Dir(dt.fileName)); syncErr != nil {
+			return syncErr
+		}
+	}
+	return err
+}
+
+// syncDir flushes a directory to disk, making the files created in or
+// renamed into it durable. Windows doesn't allow syncing directories, and
+// makes the entries durable with the files.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
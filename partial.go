@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// resumeFromCheckLength is how much of the end of a --resume-from file is
+// compared with the same range from the new URL.
+const resumeFromCheckLength = 64 * 1024
+
+// partialSuffixes are the names other download managers give a file while it
+// is being downloaded: Firefox and many others use ".part", Chrome uses
+// ".crdownload". Both write the file sequentially, so the partial file can be
+// resumed from its size.
+var partialSuffixes = []string{".part", ".crdownload"}
+
+// adoptPartial looks for a partial download of fileName left by another tool
+// and, if one is found that is shorter than the remote size, moves it into
+// place so the download resumes from it.
+func adoptPartial(fileName string, remoteSize int64) error {
+	if _, err := os.Stat(fileName); err == nil {
+		return nil
+	}
+	for _, suffix := range partialSuffixes {
+		partName := fileName + suffix
+		fileInfo, err := os.Stat(partName)
+		if err != nil || fileInfo.IsDir() || (remoteSize > 0 && fileInfo.Size() >= remoteSize) {
+			continue
+		}
+		return os.Rename(partName, fileName)
+	}
+	return nil
+}
+
+// adoptResumeFrom moves the --resume-from file, a partial download of the
+// same file from another URL, to fileName so that the download resumes from
+// it. Its last bytes are first compared with the same range from the task's
+// URL, so that a partial file of a different build, or a mirror serving
+// another file under the same name, fails the download rather than being
+// extended into a corrupt file.
+func (dt *downloadTask) adoptResumeFrom(client *http.Client, request *http.Request, fileName string, remoteSize int64) error {
+	partName := dt.options.resumeFrom
+	fileInfo, err := os.Stat(partName)
+	if err != nil {
+		return fmt.Errorf("--resume-from: %v", err)
+	}
+	size := fileInfo.Size()
+	switch {
+	case fileInfo.IsDir():
+		return fmt.Errorf("--resume-from %s: is a directory", partName)
+	case remoteSize <= 0:
+		return fmt.Errorf("--resume-from: %s doesn't send its size, so %s can't be checked against it", dt.downloadURL, partName)
+	case size > remoteSize:
+		return fmt.Errorf("--resume-from: %s has %d bytes, more than the %d of %s", partName, size, remoteSize, dt.downloadURL)
+	}
+
+	if size > 0 {
+		start := size - resumeFromCheckLength
+		if start < 0 {
+			start = 0
+		}
+		local := make([]byte, size-start)
+		file, err := os.Open(partName)
+		if err != nil {
+			return err
+		}
+		_, err = file.ReadAt(local, start)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		remote, err := dt.fetchRange(client, request, start, size, remoteSize)
+		if err != nil {
+			return fmt.Errorf("--resume-from: checking %s against %s: %v", partName, dt.downloadURL, err)
+		}
+		if !bytes.Equal(local, remote) {
+			return &verifyError{fileName: partName, err: fmt.Errorf("%w: its last %d bytes differ from %s", ErrChecksumMismatch, len(local), dt.downloadURL)}
+		}
+	}
+	transportLog.Info("resuming from another download's partial file", "url", dt.downloadURL, "file", partName, "bytes", size)
+	dt.log.event("resume_from", map[string]interface{}{"file": partName, "bytes": size})
+
+	from, _ := filepath.Abs(partName)
+	to, _ := filepath.Abs(fileName)
+	if from == to {
+		return nil
+	}
+	if _, err := os.Stat(fileName); err == nil {
+		return fmt.Errorf("--resume-from: %s already exists", fileName)
+	}
+	// Renaming fails across file systems, where the file is copied instead.
+	if err := os.Rename(partName, fileName); err != nil {
+		if _, err := copyFile(partName, fileName); err != nil {
+			os.Remove(fileName)
+			return err
+		}
+		return os.Remove(partName)
+	}
+	return nil
+}
+
+// adoptAria2 prepares a file left by aria2 for resuming. aria2 preallocates
+// the file and fills it out of order, recording the finished pieces in a
+// ".aria2" control file next to it, so the file's size says nothing about how
+// much has been downloaded. The file is truncated to the pieces finished in a
+// row from the start and the control file removed.
+func adoptAria2(fileName string) error {
+	controlName := fileName + ".aria2"
+	control, err := os.Open(controlName)
+	if err != nil {
+		return nil
+	}
+	done, err := readAria2Control(control)
+	control.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", controlName, err)
+	}
+
+	if err := os.Truncate(fileName, done); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(controlName)
+}
+
+// readAria2Control reads an aria2 control file and returns how many bytes from
+// the start of the file are complete. Only the big-endian version 1 format
+// is understood.
+func readAria2Control(r io.Reader) (int64, error) {
+	var header struct {
+		Version     uint16
+		Extension   uint32
+		InfoHashLen uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+	if header.Version != 1 {
+		return 0, errors.New("unsupported aria2 control file version")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(header.InfoHashLen)); err != nil {
+		return 0, err
+	}
+
+	var pieces struct {
+		PieceLength  uint32
+		TotalLength  uint64
+		UploadLength uint64
+		BitfieldLen  uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &pieces); err != nil {
+		return 0, err
+	}
+	if pieces.BitfieldLen > 1<<24 {
+		return 0, errors.New("corrupt aria2 control file")
+	}
+	bitfield := make([]byte, pieces.BitfieldLen)
+	if _, err := io.ReadFull(r, bitfield); err != nil {
+		return 0, err
+	}
+
+	// Pieces are numbered from the most significant bit of the first byte.
+	var finished int64
+	for _, b := range bitfield {
+		finished += int64(bits.LeadingZeros8(^b))
+		if b != 0xff {
+			break
+		}
+	}
+	done := finished * int64(pieces.PieceLength)
+	if done > int64(pieces.TotalLength) {
+		done = int64(pieces.TotalLength)
+	}
+	return done, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pieceHashes are the --piece-algorithm choices: SHA-1 as BitTorrent v1
+// uses, or SHA-256 as Metalink allows.
+var pieceHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// pieceManifest lists the piece hashes of a download, for building a torrent
+// or metalink from it without reading the file again.
+type pieceManifest struct {
+	File        string   `json:"file"`
+	Size        int64    `json:"size"`
+	PieceLength int64    `json:"pieceLength"`
+	Hash        string   `json:"hash"`
+	Pieces      []string `json:"pieces"` // Hex digests, in order; the last piece may be short
+}
+
+// pieceMatches reports whether data is piece i of the manifest.
+func (manifest *pieceManifest) pieceMatches(i int, data []byte) bool {
+	hasher := pieceHashes[manifest.Hash]()
+	hasher.Write(data)
+	return strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), manifest.Pieces[i])
+}
+
+// pieceHasher hashes data in pieces of a fixed length as it is written.
+type pieceHasher struct {
+	pieceLength int64
+	newHash     func() hash.Hash
+	current     hash.Hash
+	filled      int64 // Bytes in the current piece
+	size        int64
+	pieces      []string
+}
+
+func newPieceHasher(pieceLength int64, algorithm string) *pieceHasher {
+	return &pieceHasher{pieceLength: pieceLength, newHash: pieceHashes[algorithm]}
+}
+
+func (ph *pieceHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if ph.current == nil {
+			ph.current = ph.newHash()
+		}
+		chunk := p
+		if room := ph.pieceLength - ph.filled; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		ph.current.Write(chunk)
+		ph.filled += int64(len(chunk))
+		ph.size += int64(len(chunk))
+		if ph.filled == ph.pieceLength {
+			ph.finishPiece()
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// finishPiece records the hash of the current piece, if it has any data.
+func (ph *pieceHasher) finishPiece() {
+	if ph.current != nil {
+		ph.pieces = append(ph.pieces, hex.EncodeToString(ph.current.Sum(nil)))
+		ph.current, ph.filled = nil, 0
+	}
+}
+
+// hashPieces hashes a file in pieces, for downloads whose data wasn't all
+// streamed past a pieceHasher, such as segmented or resumed ones.
+func hashPieces(fileName string, pieceLength int64, algorithm string) (*pieceHasher, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := newPieceHasher(pieceLength, algorithm)
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+// writePieceFiles writes "<name>.pieces.json" next to each file the batch
+// downloaded, once the batch is over and --all-or-nothing downloads are in
+// place. A split download's pieces cover the reassembled file.
+func writePieceFiles(tasks []*downloadTask) error {
+	for _, task := range tasks {
+		if task == nil || task.error != io.EOF || task.finalName != "" || task.uploadFile != "" {
+			continue
+		}
+		options := task.options
+		hasher := task.pieces
+		if hasher == nil {
+			var err error
+			if hasher, err = hashPieces(task.fileName, options.pieceLength, options.pieceAlgorithm); err != nil {
+				return err
+			}
+		}
+		hasher.finishPiece()
+		manifest := pieceManifest{
+			File:        filepath.Base(task.fileName),
+			Size:        hasher.size,
+			PieceLength: options.pieceLength,
+			Hash:        options.pieceAlgorithm,
+			Pieces:      hasher.pieces,
+		}
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(task.fileName+".pieces.json", append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePieceAlgorithm validates a --piece-algorithm name.
+func parsePieceAlgorithm(name string) (string, error) {
+	name = strings.ToLower(name)
+	if _, ok := pieceHashes[name]; !ok {
+		return "", fmt.Errorf("invalid --piece-algorithm %q: must be sha1 or sha256", name)
+	}
+	return name, nil
+}
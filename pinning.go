@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// pinError reports a server whose certificate chain contains none of the
+// public keys pinned for its host with --pin-sha256.
+type pinError struct {
+	host string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("%s: certificate chain doesn't match any pinned key", e.host)
+}
+
+// parsePins parses --pin-sha256 values of the form "host=BASE64", where
+// BASE64 is the SHA-256 digest of a certificate's SubjectPublicKeyInfo as
+// used by HPKP. A host may be given several pins, e.g. a current and a backup
+// key.
+func parsePins(values []string) (map[string][]string, error) {
+	pins := make(map[string][]string)
+	for _, value := range values {
+		host, pin, ok := strings.Cut(value, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid --pin-sha256 %q: must be host=BASE64", value)
+		}
+		if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid --pin-sha256 %q: not a base64 SHA-256 digest", value)
+		}
+		host = strings.ToLower(host)
+		pins[host] = append(pins[host], pin)
+	}
+	return pins, nil
+}
+
+// verifyPins returns a TLS connection check that fails unless one of the
+// certificates in the verified chain has a pinned public key. Hosts without
+// pins are only subject to the usual certificate verification.
+func verifyPins(pins map[string][]string) func(tls.ConnectionState) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	return func(state tls.ConnectionState) error {
+		host := strings.ToLower(state.ServerName)
+		hostPins, ok := pins[host]
+		if !ok {
+			return nil
+		}
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				keyPin := base64.StdEncoding.EncodeToString(digest[:])
+				for _, pin := range hostPins {
+					if pin == keyPin {
+						return nil
+					}
+				}
+			}
+		}
+		return &pinError{host: host}
+	}
+}
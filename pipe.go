@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPipePieces = "{url}.pieces.json"    // Where --pipe-to looks for a download's piece hashes
+	pipePollInterval  = 100 * time.Millisecond // How often the next piece is checked for while downloading
+)
+
+// errPipeClosed is returned when the --pipe-to command stops reading, which
+// its exit status explains.
+var errPipeClosed = errors.New("--pipe-to command stopped reading")
+
+// pipeFeed hands a download to the --pipe-to command while it is still
+// downloading. The command reads the file on its stdin, in order, one piece
+// at a time: each piece is passed on once it is on disk and matches its hash
+// in the piece manifest published with the download, as --piece-hashes
+// writes it, so the command never reads a byte that failed verification.
+type pipeFeed struct {
+	dt       *downloadTask
+	manifest *pieceManifest
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	ctx      context.Context
+	cancel   context.CancelFunc
+	complete chan struct{} // Closed once the whole file is on disk
+	done     chan struct{} // Closed once the command has exited
+
+	mutex sync.Mutex
+	err   error // Why feeding the command failed, nil so far
+}
+
+// startPipe fetches the download's piece manifest and starts the --pipe-to
+// command, feeding it pieces as they arrive. The manifest must be for size
+// bytes, the size the server sent, if it sent one; a size only given by
+// --expected-size isn't checked, since the manifest is the better source.
+func (dt *downloadTask) startPipe(client *http.Client, size int64) error {
+	if dt.options.pipeTo == "" || dt.pipe != nil {
+		return nil
+	}
+	manifest, err := dt.fetchPieceManifest(client, dt.options.pipePieces)
+	if err != nil {
+		return err
+	}
+	if size > 0 && manifest.Size != size {
+		return &verifyError{fileName: dt.fileName, err: fmt.Errorf("%w: piece manifest is for %d bytes, the server sent %d", ErrChecksumMismatch, manifest.Size, size)}
+	}
+
+	ctx, cancel := context.WithCancel(dt.ctx)
+	args := strings.Fields(dt.options.pipeTo)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "GOGRAB_URL="+dt.downloadURL, "GOGRAB_PATH="+dt.fileName)
+	// The progress display has stdout.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("--pipe-to: %v", err)
+	}
+
+	pf := &pipeFeed{
+		dt:       dt,
+		manifest: manifest,
+		cmd:      cmd,
+		stdin:    stdin,
+		ctx:      ctx,
+		cancel:   cancel,
+		complete: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	dt.pipe = pf
+	go pf.run(args[0])
+	return nil
+}
+
+// fetchPieceManifest reads the download's piece manifest from a location
+// such as --pipe-pieces, a URL or a local file, with {url}, {dir} and {name}
+// replaced as in --release-sums.
+func (dt *downloadTask) fetchPieceManifest(client *http.Client, template string) (*pieceManifest, error) {
+	location, err := checksumLocation(template, dt.downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if strings.Contains(location, "://") {
+		data, err = dt.fetchSmall(client, location)
+	} else {
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching piece manifest %s: %v", location, err)
+	}
+
+	var manifest pieceManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("piece manifest %s: %v", location, err)
+	}
+	if _, ok := pieceHashes[manifest.Hash]; !ok {
+		return nil, fmt.Errorf("piece manifest %s: unknown hash %q", location, manifest.Hash)
+	}
+	if manifest.PieceLength <= 0 || manifest.Size < 0 || int64(len(manifest.Pieces)) != (manifest.Size+manifest.PieceLength-1)/manifest.PieceLength {
+		return nil, fmt.Errorf("piece manifest %s: %d pieces don't cover %d bytes", location, len(manifest.Pieces), manifest.Size)
+	}
+	return &manifest, nil
+}
+
+// run feeds the command, then waits for it to exit.
+func (pf *pipeFeed) run(name string) {
+	defer close(pf.done)
+	err := pf.feed()
+	pf.stdin.Close()
+	if err != nil && err != errPipeClosed {
+		pf.cancel()
+	}
+	if waitErr := pf.cmd.Wait(); waitErr != nil && (err == nil || err == errPipeClosed) {
+		if pf.dt.ctx.Err() != nil {
+			err = pf.dt.ctx.Err()
+		} else {
+			err = fmt.Errorf("--pipe-to %s: %v", name, waitErr)
+		}
+	}
+	pf.mutex.Lock()
+	pf.err = err
+	pf.mutex.Unlock()
+}
+
+// feed writes each piece to the command once it is on disk and verified.
+func (pf *pipeFeed) feed() error {
+	file, err := os.Open(pf.dt.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	manifest := pf.manifest
+	buffer := make([]byte, manifest.PieceLength)
+	var offset int64
+	for i := range manifest.Pieces {
+		piece := buffer
+		if remaining := manifest.Size - offset; remaining < int64(len(piece)) {
+			piece = piece[:remaining]
+		}
+		if err := pf.waitFor(offset + int64(len(piece))); err != nil {
+			return err
+		}
+		if _, err := file.ReadAt(piece, offset); err != nil {
+			return err
+		}
+		if !manifest.pieceMatches(i, piece) {
+			return &verifyError{fileName: pf.dt.fileName, err: fmt.Errorf("%w: piece %d of %d", ErrChecksumMismatch, i+1, len(manifest.Pieces))}
+		}
+		if _, err := pf.stdin.Write(piece); err != nil {
+			return errPipeClosed
+		}
+		offset += int64(len(piece))
+	}
+
+	// A file longer than the manifest has more than was verified.
+	if err := pf.waitFor(-1); err != nil {
+		return err
+	}
+	if fileInfo, err := file.Stat(); err != nil {
+		return err
+	} else if fileInfo.Size() != manifest.Size {
+		return &verifyError{fileName: pf.dt.fileName, err: fmt.Errorf("%w: %d bytes, the piece manifest has %d", ErrChecksumMismatch, fileInfo.Size(), manifest.Size)}
+	}
+	return nil
+}
+
+// waitFor blocks until the first end bytes of the file are on disk, or with
+// an end of -1, until the whole file is.
+func (pf *pipeFeed) waitFor(end int64) error {
+	for {
+		select {
+		case <-pf.complete:
+			if end < 0 {
+				return nil
+			}
+			fileInfo, err := os.Stat(pf.dt.fileName)
+			if err != nil {
+				return err
+			}
+			if fileInfo.Size() < end {
+				return &verifyError{fileName: pf.dt.fileName, err: fmt.Errorf("%w: %d bytes, the piece manifest has %d", ErrChecksumMismatch, fileInfo.Size(), pf.manifest.Size)}
+			}
+			return nil
+		case <-pf.ctx.Done():
+			return pf.ctx.Err()
+		default:
+		}
+		if end >= 0 && pf.dt.getBytesRead() >= end {
+			return nil
+		}
+		select {
+		case <-pf.complete:
+		case <-pf.ctx.Done():
+		case <-time.After(pipePollInterval):
+		}
+	}
+}
+
+// failure returns why feeding the command failed, so that the download can
+// stop early, or nil.
+func (pf *pipeFeed) failure() error {
+	if pf == nil {
+		return nil
+	}
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	return pf.err
+}
+
+// endPipe finishes the --pipe-to command once the download is over: if it
+// succeeded, the rest of the file is fed to the command, starting it first
+// for a file copied from the --cache, and the download fails if the command
+// does; otherwise the command is stopped.
+func (dt *downloadTask) endPipe(client *http.Client, err error) error {
+	if dt.options.pipeTo == "" {
+		return err
+	}
+	if err == io.EOF {
+		// The file is already on disk, and feed checks its size.
+		if startErr := dt.startPipe(client, 0); startErr != nil {
+			return startErr
+		}
+	}
+	pf := dt.pipe
+	if pf == nil {
+		return err
+	}
+	if err != io.EOF {
+		pf.cancel()
+		<-pf.done
+		return err
+	}
+	close(pf.complete)
+	<-pf.done
+	if pipeErr := pf.failure(); pipeErr != nil {
+		return pipeErr
+	}
+	return err
+}
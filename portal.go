@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPortalProbe = "http://connectivitycheck.gstatic.com/generate_204" // Answers 204 unless a portal intercepts it
+	portalCheckTTL     = 30 * time.Second                                    // How long a probe finding no portal is trusted
+)
+
+// portalMonitor spots captive portals, for --portal-check: hotel and
+// airport networks that answer every request with their sign-in page until
+// the user signs in. It requests a probe URL over plain HTTP that always
+// answers 204 No Content; any other answer, usually a redirect to the
+// portal, means the network requires sign-in, and downloads wait instead of
+// saving the portal's page in place of each file.
+type portalMonitor struct {
+	probeURL string
+	interval time.Duration // How often to probe while behind the portal
+	client   *http.Client
+
+	mutex   sync.Mutex
+	checked time.Time // When the probe was last requested
+	portal  string    // Host of the portal found by the last probe, "" for none
+}
+
+// newPortalMonitor returns a monitor for --portal-check with --portal-probe,
+// or nil if the check isn't on.
+func newPortalMonitor(enabled bool, probeURL string, interval time.Duration, defaultScheme string) (*portalMonitor, error) {
+	if !enabled {
+		return nil, nil
+	}
+	probeURL, err := normalizeURL(probeURL, defaultScheme)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --portal-probe: %v", err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid --network-probe-interval %s: must be positive", interval)
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		// The portal is where the probe is redirected to.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &portalMonitor{probeURL: probeURL, interval: interval, client: client}, nil
+}
+
+// check returns the host of the captive portal in the way, or "" if there
+// is none. A probe finding no portal is trusted for portalCheckTTL, and one
+// finding a portal until the next interval, so tasks starting together share
+// one probe. A probe that gets no answer at all finds no portal: an outage
+// is --network-probe's business.
+func (pm *portalMonitor) check(ctx context.Context) string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	ttl := portalCheckTTL
+	if pm.portal != "" {
+		ttl = time.Second
+	}
+	if !pm.checked.IsZero() && time.Since(pm.checked) < ttl {
+		return pm.portal
+	}
+
+	pm.portal = ""
+	if request, err := http.NewRequestWithContext(ctx, "GET", pm.probeURL, nil); err == nil {
+		if response, err := pm.client.Do(request); err == nil {
+			body, _ := io.ReadAll(io.LimitReader(response.Body, 1))
+			response.Body.Close()
+			if response.StatusCode != http.StatusNoContent && !(response.StatusCode == http.StatusOK && len(body) == 0) {
+				pm.portal = request.URL.Host
+				if location, err := response.Location(); err == nil {
+					pm.portal = location.Host
+				}
+			}
+		}
+	}
+	pm.checked = time.Now()
+	return pm.portal
+}
+
+// recheck makes the next check probe again, as when a download turned out
+// to be an HTML page that may be the portal's.
+func (pm *portalMonitor) recheck() {
+	if pm == nil {
+		return
+	}
+	pm.mutex.Lock()
+	pm.checked = time.Time{}
+	pm.mutex.Unlock()
+}
+
+// waitForSignIn holds the task back before it starts while the network
+// requires sign-in, probing again every interval until it doesn't.
+func (dt *downloadTask) waitForSignIn() error {
+	portal := dt.options.portal
+	if portal == nil {
+		return nil
+	}
+	host := portal.check(dt.ctx)
+	if host == "" {
+		return nil
+	}
+
+	transportLog.Warn("network requires sign-in, waiting", "url", dt.downloadURL, "portal", host)
+	dt.log.event("captive_portal", map[string]interface{}{"portal": host})
+	for host != "" {
+		if err := dt.pause(time.Now().Add(portal.interval), "sign-in required, checking in", "network requires sign-in at "+host); err != nil {
+			return err
+		}
+		host = portal.check(dt.ctx)
+	}
+	transportLog.Info("signed in to the network", "url", dt.downloadURL)
+	return nil
+}
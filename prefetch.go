@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	prefetchAhead    = 4                // Queued downloads looked ahead to
+	prefetchInterval = time.Second      // How often the queue is looked at
+	prefetchDNSTTL   = time.Minute      // How long a prefetched lookup is used
+	prefetchConnTTL  = 20 * time.Second // How long a warm connection is kept, before servers time it out
+)
+
+// prefetcher gets the next downloads in the queue ready to start, for
+// --prefetch: it looks up their hosts' addresses, which Go doesn't cache, and
+// with "tls" also connects and completes the TLS handshake, so that a
+// download starting once a slot frees up transfers from its first round
+// trip. Downloads through a proxy, an SSH tunnel or a cache server aren't
+// prefetched, since their connections go elsewhere.
+type prefetcher struct {
+	tls    bool
+	config *tls.Config // For warm connections, with the same pins as downloads
+
+	mutex    sync.Mutex
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	lookups  map[string]prefetchedLookup
+	warm     map[string][]warmConn // By host:port
+	inFlight map[string]bool       // Hosts being looked up or connected to
+}
+
+type prefetchedLookup struct {
+	addrs []string
+	at    time.Time
+}
+
+type warmConn struct {
+	conn *tls.Conn
+	at   time.Time
+}
+
+// newPrefetcher parses --prefetch, dns or tls, returning nil if it isn't set.
+func newPrefetcher(mode string, options *taskOptions) (*prefetcher, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "dns", "tls":
+	default:
+		return nil, fmt.Errorf("invalid --prefetch %q: must be dns or tls", mode)
+	}
+	if options.sshTunnel != nil || options.cacheServer != nil {
+		return nil, nil
+	}
+	return &prefetcher{
+		tls:      mode == "tls",
+		config:   &tls.Config{VerifyConnection: verifyPins(options.pins)},
+		dial:     options.tcp.dialContext(),
+		lookups:  make(map[string]prefetchedLookup),
+		warm:     make(map[string][]warmConn),
+		inFlight: make(map[string]bool),
+	}, nil
+}
+
+// run prefetches for the next queued downloads of the batch until done is
+// closed, then closes the warm connections left over.
+func (pf *prefetcher) run(live *liveTasks, done <-chan struct{}) {
+	ticker := time.NewTicker(prefetchInterval)
+	defer ticker.Stop()
+	for {
+		pf.prefetch(live.list())
+		select {
+		case <-done:
+			pf.mutex.Lock()
+			for addr, conns := range pf.warm {
+				for _, warm := range conns {
+					warm.conn.Close()
+				}
+				delete(pf.warm, addr)
+			}
+			pf.mutex.Unlock()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prefetch starts looking up, and connecting to, the hosts of the next
+// queued downloads that need it.
+func (pf *prefetcher) prefetch(tasks []*downloadTask) {
+	ahead := 0
+	wanted := make(map[string]int) // Warm connections wanted by host:port
+	for _, task := range tasks {
+		if ahead == prefetchAhead {
+			break
+		}
+		if task.error != nil || !task.startTime.IsZero() || task.uploadFile != "" {
+			continue
+		}
+		ahead++
+		parsed, err := url.Parse(task.downloadURL)
+		if err != nil || task.proxied(parsed) {
+			continue
+		}
+		port := parsed.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[parsed.Scheme]
+		}
+		addr := net.JoinHostPort(parsed.Hostname(), port)
+		if pf.tls && parsed.Scheme == "https" {
+			wanted[addr]++
+		}
+
+		pf.mutex.Lock()
+		lookup, looked := pf.lookups[parsed.Hostname()]
+		fresh := looked && time.Since(lookup.at) < prefetchDNSTTL
+		busy := pf.inFlight[addr]
+		if !fresh && !busy {
+			pf.inFlight[addr] = true
+			go pf.lookUp(parsed.Hostname(), addr)
+		}
+		pf.mutex.Unlock()
+	}
+
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	for addr, conns := range pf.warm {
+		// Connections kept too long are closed, as the server may drop them.
+		kept := conns[:0]
+		for _, warm := range conns {
+			if time.Since(warm.at) < prefetchConnTTL {
+				kept = append(kept, warm)
+			} else {
+				warm.conn.Close()
+			}
+		}
+		pf.warm[addr] = kept
+	}
+	for addr, count := range wanted {
+		if len(pf.warm[addr]) < count && !pf.inFlight["tls "+addr] {
+			pf.inFlight["tls "+addr] = true
+			go pf.connect(addr)
+		}
+	}
+}
+
+// lookUp resolves a host, caching its addresses for the dialer.
+func (pf *prefetcher) lookUp(host, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	delete(pf.inFlight, addr)
+	if err != nil {
+		transportLog.Debug("prefetching DNS failed", "host", host, "error", err)
+		return
+	}
+	pf.lookups[host] = prefetchedLookup{addrs: addrs, at: time.Now()}
+}
+
+// connect opens a connection to addr and completes the TLS handshake,
+// keeping it for the next download from there.
+func (pf *prefetcher) connect(addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := pf.dialTLS(ctx, "tcp", addr)
+
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	delete(pf.inFlight, "tls "+addr)
+	if err != nil {
+		transportLog.Debug("prefetching a TLS connection failed", "addr", addr, "error", err)
+		return
+	}
+	pf.warm[addr] = append(pf.warm[addr], warmConn{conn: conn.(*tls.Conn), at: time.Now()})
+}
+
+// dialContext wraps a dialer to connect to the addresses prefetched for a
+// host, rather than looking it up again.
+func (pf *prefetcher) dialContext(next func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if pf == nil {
+		return next
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return next(ctx, network, address)
+		}
+		pf.mutex.Lock()
+		lookup, ok := pf.lookups[host]
+		pf.mutex.Unlock()
+		if !ok || time.Since(lookup.at) >= prefetchDNSTTL {
+			return next(ctx, network, address)
+		}
+		for _, ip := range lookup.addrs {
+			if conn, err := next(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return next(ctx, network, address)
+	}
+}
+
+// dialTLS hands out a warm connection to addr if there is one, or else
+// connects and completes the handshake as the transport would.
+func (pf *prefetcher) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	pf.mutex.Lock()
+	if conns := pf.warm[addr]; len(conns) > 0 {
+		warm := conns[len(conns)-1]
+		pf.warm[addr] = conns[:len(conns)-1]
+		if time.Since(warm.at) < prefetchConnTTL {
+			pf.mutex.Unlock()
+			return warm.conn, nil
+		}
+		warm.conn.Close()
+	}
+	pf.mutex.Unlock()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pf.dialContext(pf.dial)(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	config := pf.config.Clone()
+	config.ServerName = host
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// proxied reports whether the task's requests to a URL go through a proxy.
+func (dt *downloadTask) proxied(parsed *url.URL) bool {
+	if dt.proxySet {
+		return dt.proxy != nil
+	}
+	proxy, err := dt.options.proxies.proxy(&http.Request{URL: parsed})
+	return err != nil || proxy != nil
+}
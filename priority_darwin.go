@@ -0,0 +1,16 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+const (
+	prioDarwinProcess = 4      // PRIO_DARWIN_PROCESS
+	prioDarwinBG      = 0x1000 // PRIO_DARWIN_BG
+)
+
+// lowerPriority puts the process in the background band, which lowers both
+// its CPU and its disk and network I/O priority, like taskpolicy -b.
+func lowerPriority() error {
+	return syscall.Setpriority(prioDarwinProcess, 0, prioDarwinBG)
+}
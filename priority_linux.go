@@ -0,0 +1,39 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1 // IOPRIO_WHO_PROCESS
+	ioprioClassIdle  = 3 // IOPRIO_CLASS_IDLE: disk time only when no one else wants it
+	ioprioClassShift = 13
+)
+
+// lowerPriority lowers the CPU priority to nice 10 and the I/O priority to
+// the idle class, like running under "nice ionice -c3". Both are per thread
+// on Linux, so every thread of the process is changed; threads started later
+// inherit the priority of the thread that starts them.
+func lowerPriority() error {
+	threads, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, thread := range threads {
+		tid, err := strconv.Atoi(thread.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 10); err != nil {
+			return err
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
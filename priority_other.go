@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+// lowerPriority reports that the priority can't be lowered on this platform.
+func lowerPriority() error {
+	return errors.New("--background is not supported on this platform")
+}
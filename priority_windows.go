@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// processModeBackgroundBegin is PROCESS_MODE_BACKGROUND_BEGIN.
+const processModeBackgroundBegin = 0x00100000
+
+var procSetPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+// lowerPriority puts the process in background mode, which lowers its CPU,
+// I/O and memory priority.
+func lowerPriority() error {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if ok, _, err := procSetPriorityClass.Call(uintptr(process), processModeBackgroundBegin); ok == 0 {
+		return err
+	}
+	return nil
+}
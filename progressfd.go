@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressFD writes machine-readable progress to the file descriptor given
+// with --progress-fd, so that GUI wrappers can draw their own bars while the
+// terminal output stays as it is. Each frame is a line of JSON: a "progress"
+// frame with the state of every task, once a second, then a "done" frame
+// with the batch's exit code.
+type progressFD struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	started time.Time
+	closed  bool
+}
+
+// progressFrame is one line written to --progress-fd.
+type progressFrame struct {
+	Type      string         `json:"type"` // "progress" or "done"
+	ElapsedMS int64          `json:"elapsed_ms"`
+	Tasks     []taskProgress `json:"tasks,omitempty"`
+	ExitCode  *int           `json:"exit_code,omitempty"` // Only in "done" frames
+}
+
+// taskProgress is the state of one task in a progress frame, in the order
+// the tasks were given.
+type taskProgress struct {
+	URL            string  `json:"url"`
+	File           string  `json:"file,omitempty"`
+	Group          string  `json:"group,omitempty"`
+	State          string  `json:"state"` // queued, waiting, downloading, done, failed or canceled
+	Bytes          int64   `json:"bytes"`
+	Total          int64   `json:"total"` // -1 if the size is unknown
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETASeconds     int64   `json:"eta_seconds"`   // -1 if unknown
+	ETA            string  `json:"eta,omitempty"` // When the download should be done, in RFC 3339
+	Error          string  `json:"error,omitempty"`
+	Suspect        string  `json:"suspect,omitempty"` // What --html-guard found in place of the file
+}
+
+// openProgressFD opens --progress-fd, or returns nil if fd is 0. The
+// descriptor must already be open, e.g. with 3>progress.jsonl in the shell.
+func openProgressFD(fd int) (*progressFD, error) {
+	if fd == 0 {
+		return nil, nil
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid --progress-fd %d", fd)
+	}
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if file == nil {
+		return nil, fmt.Errorf("invalid --progress-fd %d", fd)
+	}
+	if _, err := file.Stat(); err != nil {
+		return nil, fmt.Errorf("invalid --progress-fd %d: %v", fd, err)
+	}
+	return &progressFD{encoder: json.NewEncoder(file), started: time.Now()}, nil
+}
+
+// update writes a progress frame for the tasks.
+func (pf *progressFD) update(tasks []*downloadTask) {
+	if pf == nil {
+		return
+	}
+	frame := progressFrame{Type: "progress", Tasks: make([]taskProgress, 0, len(tasks))}
+	for _, task := range tasks {
+		frame.Tasks = append(frame.Tasks, task.progress())
+	}
+	pf.write(frame)
+}
+
+// done writes the final frame with the exit code. Frames after it are
+// dropped, so that a late tick can't follow it.
+func (pf *progressFD) done(tasks []*downloadTask, exitCode int) {
+	if pf == nil {
+		return
+	}
+	pf.update(tasks)
+	pf.write(progressFrame{Type: "done", ExitCode: &exitCode})
+}
+
+func (pf *progressFD) write(frame progressFrame) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	if pf.closed {
+		return
+	}
+	frame.ElapsedMS = time.Since(pf.started).Milliseconds()
+	if err := pf.encoder.Encode(frame); err != nil {
+		// A wrapper that stops reading shouldn't stop the downloads.
+		uiLog.Debug("writing to --progress-fd failed, no longer writing progress", "error", err)
+		pf.closed = true
+	}
+	if frame.Type == "done" {
+		pf.closed = true
+	}
+}
+
+// progress returns the task's state for a progress frame.
+func (dt *downloadTask) progress() taskProgress {
+	dt.mutex.Lock()
+	speed := dt.bytesPerSecond
+	waiting := time.Now().Before(dt.waitUntil)
+	suspect := dt.suspect
+	dt.mutex.Unlock()
+	remaining, remainingKnown := dt.remainingTime()
+
+	progress := taskProgress{
+		URL:            dt.downloadURL,
+		File:           dt.displayName(),
+		Bytes:          dt.getBytesRead(),
+		Total:          -1,
+		BytesPerSecond: speed,
+		ETASeconds:     -1,
+		Suspect:        suspect,
+	}
+	if dt.group != nil {
+		progress.Group = dt.group.name
+	}
+	if dt.totalFileSize > 0 {
+		progress.Total = dt.totalFileSize
+	}
+	if remainingKnown && dt.error == nil {
+		progress.ETASeconds = int64(remaining / time.Second)
+		progress.ETA = time.Now().Add(remaining).Format(time.RFC3339)
+	}
+
+	switch {
+	case dt.error == nil && waiting:
+		progress.State = "waiting"
+	case dt.error == nil && dt.startTime.IsZero():
+		progress.State = "queued"
+	case dt.error == nil:
+		progress.State = "downloading"
+	case dt.canceled():
+		progress.State = "canceled"
+	case dt.failed():
+		progress.State = "failed"
+	default:
+		progress.State = "done"
+	}
+	if dt.failed() {
+		progress.Error = dt.error.Error()
+	}
+	return progress
+}
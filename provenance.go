@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// provenanceEntry records one file of a batch for --write-manifest. It
+// extends the sync manifest entry, so a JSON manifest can be given to gograb
+// sync to fetch the same files again.
+type provenanceEntry struct {
+	manifestEntry
+	Downloaded time.Time `json:"downloaded"` // When the download finished
+}
+
+// writeProvenance writes the files the batch saved, with their URL, SHA-256,
+// size and time of download, to fileName: as CSV if it ends in ".csv",
+// otherwise as JSON. Under --reproducible every time is SOURCE_DATE_EPOCH, so
+// the manifest only changes when the files do.
+func writeProvenance(fileName string, tasks []*downloadTask) error {
+	var entries []provenanceEntry
+	for _, task := range savedTasks(tasks) {
+		fileInfo, err := os.Stat(task.fileName)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(task.fileName)
+		if err != nil {
+			return err
+		}
+		downloaded := task.endTime.UTC().Truncate(time.Second)
+		if task.options.reproducible {
+			downloaded = task.options.epoch
+		}
+		entries = append(entries, provenanceEntry{
+			manifestEntry: manifestEntry{URL: task.downloadURL, Path: filepath.ToSlash(task.fileName), Size: fileInfo.Size(), SHA256: sum},
+			Downloaded:    downloaded,
+		})
+	}
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+		var buffer bytes.Buffer
+		writer := csv.NewWriter(&buffer)
+		writer.Write([]string{"path", "url", "sha256", "size", "downloaded"})
+		for _, entry := range entries {
+			writer.Write([]string{entry.Path, entry.URL, entry.SHA256, strconv.FormatInt(entry.Size, 10), entry.Downloaded.Format(time.RFC3339)})
+		}
+		writer.Flush()
+		data = buffer.Bytes()
+	} else {
+		manifest := struct {
+			Files []provenanceEntry `json:"files"`
+		}{entries}
+		var err error
+		if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// savedTasks returns the tasks whose file is in place once the batch is over:
+// those that downloaded it or found it already present. Failed downloads,
+// files still held back by --all-or-nothing, split downloads, which have a
+// manifest of their own, and uploads are left out.
+func savedTasks(tasks []*downloadTask) []*downloadTask {
+	var saved []*downloadTask
+	for _, task := range tasks {
+		if task == nil || task.fileName == "" || task.finalName != "" || task.parts != nil || task.uploadFile != "" || task.options.discard {
+			continue
+		}
+		if task.error == io.EOF || task.error == errAlreadyDownloaded {
+			saved = append(saved, task)
+		}
+	}
+	return saved
+}
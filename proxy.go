@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// proxyRule sends the requests to hosts matching a glob through a proxy.
+type proxyRule struct {
+	pattern string
+	proxy   *url.URL // nil to connect directly
+}
+
+// proxyRules are the --proxy-for rules, tried in order. Hosts no rule
+// matches use the proxy from the environment, as without any rules.
+type proxyRules []proxyRule
+
+// parseProxyRules parses --proxy-for values of the form "host glob=proxy",
+// where proxy is a proxy URL or "direct".
+func parseProxyRules(values []string) (proxyRules, error) {
+	var rules proxyRules
+	for _, value := range values {
+		pattern, proxy, ok := strings.Cut(value, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid --proxy-for %q: must be host=proxy", value)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --proxy-for %q: %v", value, err)
+		}
+		proxyURL, err := parseProxy(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --proxy-for %q: %v", value, err)
+		}
+		rules = append(rules, proxyRule{pattern: pattern, proxy: proxyURL})
+	}
+	return rules, nil
+}
+
+// parseProxy parses a proxy URL, returning nil for "direct".
+func parseProxy(value string) (*url.URL, error) {
+	value = strings.TrimSpace(value)
+	if value == "direct" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy must be an http://, https:// or socks5:// URL, or direct")
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL has no host")
+	}
+	return proxyURL, nil
+}
+
+// proxy chooses the proxy for a request by its host, for http.Transport.
+// It's asked again for every redirect, so a redirect to another host can
+// change the proxy.
+func (rules proxyRules) proxy(request *http.Request) (*url.URL, error) {
+	host := strings.ToLower(request.URL.Hostname())
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.pattern, host); ok {
+			return rule.proxy, nil
+		}
+	}
+	return http.ProxyFromEnvironment(request)
+}
+
+// httpClient returns a client for the task's requests, going through the
+// proxy its queue entry names, if any, instead of the --proxy-for rules.
+// Under --small-files, the other tasks share one.
+func (dt *downloadTask) httpClient() *http.Client {
+	if dt.options.smallFiles != nil && !dt.proxySet {
+		return dt.options.smallFiles.httpClient(dt.options)
+	}
+	client := newHTTPClient(dt.options)
+	if dt.proxySet {
+		transport := client.Transport
+		if cacheTransport, ok := transport.(*cacheServerTransport); ok {
+			transport = cacheTransport.next
+		}
+		transport.(*http.Transport).Proxy = http.ProxyURL(dt.proxy)
+	}
+	return client
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// exportQueueCommand writes a batch of downloads as portable JSON.
+var exportQueueCommand = cli.Command{
+	Name:      "export-queue",
+	Usage:     "Write a batch of downloads, with their progress so far, as JSON",
+	ArgsUsage: "[rate limit:]url...",
+	Action:    exportQueueAction,
+}
+
+// importQueueCommand runs a batch of downloads written by export-queue.
+var importQueueCommand = cli.Command{
+	Name:      "import-queue",
+	Usage:     "Download a batch written by export-queue",
+	ArgsUsage: "<queue.json>",
+	Action:    importQueueAction,
+}
+
+// queueEntry is one download of an exported queue.
+type queueEntry struct {
+	URL       string `json:"url"`
+	RateLimit int64  `json:"rate_limit,omitempty"` // Bytes per second, 0 for unlimited
+	Path      string `json:"path,omitempty"`       // Where the file is saved, "" if named by the server
+	Offset    int64  `json:"offset,omitempty"`     // Bytes already downloaded to Path
+	Proxy     string `json:"proxy,omitempty"`      // Proxy URL or "direct" for this download, "" for the --proxy-for rules
+}
+
+// queueState is a batch of downloads that can be moved between machines.
+type queueState struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Tasks   []queueEntry      `json:"tasks"`
+}
+
+// exportQueueAction prints the queue for the given URLs and global flags,
+// recording how much of each file is already on disk.
+func exportQueueAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("usage: gograb [options] export-queue [rate limit:]url...", exitUsageError)
+	}
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	state := queueState{Headers: options.headers}
+	for _, arg := range c.Args() {
+		task, err := newDownloadTask(context.Background(), arg, options)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+		}
+		entry := queueEntry{URL: task.downloadURL, RateLimit: task.rateLimiter.limit}
+		if name, err := task.plannedName(); err == nil {
+			entry.Path = filepath.ToSlash(filepath.Join(task.outputDir, name))
+			if fileInfo, err := os.Stat(entry.Path); err == nil && !fileInfo.IsDir() {
+				entry.Offset = fileInfo.Size()
+			}
+		}
+		state.Tasks = append(state.Tasks, entry)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+	return nil
+}
+
+// importQueueAction downloads the tasks of an exported queue, resuming from
+// the partial files present. Headers given on the command line override the
+// exported ones.
+func importQueueAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("usage: gograb [options] import-queue <queue.json>", exitUsageError)
+	}
+	data, err := os.ReadFile(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	var state queueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %v", c.Args().First(), err), exitUsageError)
+	}
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	for key, value := range state.Headers {
+		if _, ok := options.headers[key]; !ok {
+			options.headers[key] = value
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tasks := make([]*downloadTask, 0, len(state.Tasks))
+	for i, entry := range state.Tasks {
+		task, err := entry.newTask(ctx, options)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error: task %d: %s", i+1, err), exitUsageError)
+		}
+		if localPath := cleanRelDir(entry.Path); localPath != "" {
+			var size int64
+			if fileInfo, err := os.Stat(localPath); err == nil {
+				size = fileInfo.Size()
+			}
+			if size < entry.Offset {
+				fmt.Printf("%s: %s of %s exported are present, resuming from there\n", localPath, strings.TrimSpace(humanReadableSize(size)), strings.TrimSpace(humanReadableSize(entry.Offset)))
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return runBatch(ctx, cancel, c, tasks)
+}
+
+// newTask creates the download of a queue entry, saved to its path, if it
+// has one, relative to the current directory.
+func (entry queueEntry) newTask(ctx context.Context, options *taskOptions) (*downloadTask, error) {
+	task, err := newDownloadTask(ctx, entry.URL, options)
+	if err != nil {
+		return nil, err
+	}
+	task.rateLimiter.limit = entry.RateLimit
+	if entry.Proxy != "" {
+		if task.proxy, err = parseProxy(entry.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy: %s", err)
+		}
+		task.proxySet = true
+	}
+	if localPath := cleanRelDir(entry.Path); localPath != "" {
+		if dir := filepath.Dir(localPath); dir != "." {
+			task.outputDir = dir
+		}
+		task.outputName = filepath.Base(localPath)
+	}
+	return task, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// rangeCheckLength is the length of the ranges checkRanges asks for.
+const rangeCheckLength = 256
+
+// rangeSupport records whether a server accepts byte range requests, which
+// decides whether an interrupted download can be resumed.
+type rangeSupport int
+
+const (
+	rangesUnknown     rangeSupport = iota // The server didn't say
+	rangesSupported                       // Accept-Ranges: bytes, or a 206 response
+	rangesUnsupported                     // Accept-Ranges: none, or a range request answered with 200
+)
+
+// String describes the range support for the task line and dry run output.
+func (rs rangeSupport) String() string {
+	switch rs {
+	case rangesSupported:
+		return "resumable"
+	case rangesUnsupported:
+		return "not resumable"
+	default:
+		return "resumable?"
+	}
+}
+
+// rangeSupportOf reads the range support advertised by a response.
+func rangeSupportOf(response *http.Response) rangeSupport {
+	if response.StatusCode == http.StatusPartialContent || response.Header.Get("Content-Range") != "" {
+		return rangesSupported
+	}
+	switch strings.ToLower(strings.TrimSpace(response.Header.Get("Accept-Ranges"))) {
+	case "bytes":
+		return rangesSupported
+	case "none":
+		return rangesUnsupported
+	}
+	return rangesUnknown
+}
+
+// probeRanges asks for the first byte of the task's URL to find out whether
+// the server honours range requests when its headers don't say.
+func (dt *downloadTask) probeRanges(client *http.Client) (rangeSupport, error) {
+	request, err := dt.newRequest("GET")
+	if err != nil {
+		return rangesUnknown, err
+	}
+	request.Header.Set("Range", "bytes=0-0")
+	response, err := dt.do(client, request)
+	if err != nil {
+		return rangesUnknown, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1))
+	if response.StatusCode == http.StatusPartialContent {
+		return rangesSupported, nil
+	}
+	return rangesUnsupported, nil
+}
+
+// checkRanges asks for two overlapping ranges from the middle of a file of
+// size bytes, before a download is split across connections, and reports
+// whether the server sent exactly the bytes asked for. Some servers send
+// Accept-Ranges: bytes and then ignore the offset, or answer with the wrong
+// range, which would corrupt a segmented download; a download from them is
+// kept to one connection, and not resumed either.
+func (dt *downloadTask) checkRanges(client *http.Client, request *http.Request, size int64) bool {
+	start := size/2 - rangeCheckLength
+	first, err := dt.fetchRange(client, request, start, start+2*rangeCheckLength, size)
+	var second []byte
+	if err == nil {
+		second, err = dt.fetchRange(client, request, start+rangeCheckLength, start+3*rangeCheckLength, size)
+	}
+	if err == nil && !bytes.Equal(first[rangeCheckLength:], second[:rangeCheckLength]) {
+		err = errors.New("overlapping ranges differ")
+	}
+	if err != nil {
+		transportLog.Warn("server doesn't honour ranges, downloading over one connection", "url", dt.downloadURL, "error", err)
+		dt.setRanges(rangesUnsupported)
+		return false
+	}
+	return true
+}
+
+// fetchRange fetches the bytes from start up to end of a file of size bytes,
+// failing unless the server sends that range and nothing else.
+func (dt *downloadTask) fetchRange(client *http.Client, request *http.Request, start, end, size int64) ([]byte, error) {
+	rangeRequest := request.Clone(dt.ctx)
+	rangeRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	response, err := dt.do(client, rangeRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("range answered with %s", response.Status)
+	}
+	if contentRange, want := response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", start, end-1, size); contentRange != want {
+		return nil, fmt.Errorf("asked for %q, got %q", want, contentRange)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start {
+		return nil, fmt.Errorf("range of %d bytes had %d", end-start, len(data))
+	}
+	return data, nil
+}
+
+// setRanges records the task's range support.
+func (dt *downloadTask) setRanges(ranges rangeSupport) {
+	dt.mutex.Lock()
+	dt.ranges = ranges
+	dt.mutex.Unlock()
+}
+
+// getRangesString returns the task's range support for the task line, or
+// "upload" for gograb put, where it doesn't apply.
+func (dt *downloadTask) getRangesString() string {
+	if dt.uploadFile != "" {
+		return "upload"
+	}
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	return dt.ranges.String()
+}
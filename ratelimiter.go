@@ -1,8 +1,12 @@
 package main
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type rateLimiter struct {
+	mutex         sync.Mutex
 	lastReadBytes int64     // Bytes read so far
 	lastCheckTime time.Time // Time of the last check
 	limit         int64     // Byte limit per second
@@ -10,6 +14,9 @@ type rateLimiter struct {
 
 // wait enforces the rate limit by pausing if the read bytes exceed the limit within a 1-second interval.
 func (rl *rateLimiter) wait(currentReadBytes int64) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
 	now := time.Now()
 
 	// Calculate time elapsed since the last check
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const defaultReleaseSums = "{url}.sha256" // Where --release-verify looks for a download's checksum
+
+// releaseVerifier checks downloads the way release notes ask users to: it
+// fetches the checksum file published next to the download and its detached
+// OpenPGP signature, checks the signature with gpgv against a keyring of
+// trusted keys, and then verifies the download against the signed checksum.
+type releaseVerifier struct {
+	keyring string // Absolute path of the keyring for gpgv
+	sumsURL string // Template of the checksum file's URL, e.g. "{dir}/SHA256SUMS"
+}
+
+// newReleaseVerifier builds the verifier from --release-verify and
+// --release-sums, or returns nil if --release-verify isn't set.
+func newReleaseVerifier(keyring, sumsURL string) (*releaseVerifier, error) {
+	if keyring == "" {
+		return nil, nil
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		return nil, fmt.Errorf("--release-verify needs gpgv: %v", err)
+	}
+	// gpgv looks for keyrings without a slash in ~/.gnupg.
+	keyring, err := filepath.Abs(keyring)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(keyring); err != nil {
+		return nil, fmt.Errorf("invalid --release-verify: %v", err)
+	}
+	if !strings.Contains(sumsURL, "{") {
+		return nil, fmt.Errorf("invalid --release-sums %q: must contain {url}, {dir} or {name}", sumsURL)
+	}
+	return &releaseVerifier{keyring: keyring, sumsURL: sumsURL}, nil
+}
+
+// checksumLocation returns the URL of a download's checksum file from a
+// template, replacing {url} with the download's URL, {dir} with the URL up
+// to its last slash and {name} with the file name.
+func checksumLocation(template, downloadURL string) (string, error) {
+	parsed, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(parsed.Path)
+	dir := *parsed
+	dir.Path, dir.RawPath, dir.RawQuery, dir.Fragment = path.Dir(parsed.Path), "", "", ""
+	return strings.NewReplacer("{url}", downloadURL, "{dir}", strings.TrimSuffix(dir.String(), "/"), "{name}", name).Replace(template), nil
+}
+
+// checksumFor returns the digest a downloaded checksum file gives for the
+// download's URL, or "" if it doesn't list it. A checksum file of its own
+// may hold nothing but the digest.
+func checksumFor(sums []byte, sumsURL, downloadURL string) (string, error) {
+	if fields := strings.Fields(string(sums)); len(fields) == 1 {
+		digest := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(digest); err == nil && len(digest) == sha256.Size*2 {
+			return digest, nil
+		}
+	}
+	entries, err := parseChecksums(bytes.NewReader(sums), sumsURL)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(parsed.Path)
+	for _, entry := range entries {
+		if path.Base(entry.name) == name {
+			return entry.digest, nil
+		}
+	}
+	return "", nil
+}
+
+// releaseSum fetches and checks the signed checksum of the task's download
+// and returns its SHA-256.
+func (dt *downloadTask) releaseSum(client *http.Client) (string, error) {
+	rv := dt.options.release
+	sumsURL, err := checksumLocation(rv.sumsURL, dt.downloadURL)
+	if err != nil {
+		return "", err
+	}
+	sums, err := dt.fetchSmall(client, sumsURL)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %v", sumsURL, err)
+	}
+	signature, err := dt.fetchSmall(client, sumsURL+".asc")
+	if err != nil {
+		return "", fmt.Errorf("fetching %s.asc: %v", sumsURL, err)
+	}
+	if err := rv.checkSignature(dt, sums, signature); err != nil {
+		return "", &verifyError{fileName: sumsURL, err: fmt.Errorf("%w: %v", ErrBadSignature, err)}
+	}
+	digest, err := checksumFor(sums, sumsURL, dt.downloadURL)
+	if err == nil && digest == "" {
+		err = fmt.Errorf("%s doesn't list %s", sumsURL, dt.downloadURL)
+	}
+	return digest, err
+}
+
+// fetchSmall downloads a small file, such as a checksum or a signature, with
+// the task's headers.
+func (dt *downloadTask) fetchSmall(client *http.Client, rawURL string) ([]byte, error) {
+	request, err := newRequestWithHeaders(dt.ctx, "GET", rawURL, dt.options.headers)
+	if err != nil {
+		return nil, err
+	}
+	response, err := dt.do(client, request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(io.LimitReader(response.Body, maxListingSize))
+}
+
+// checkSignature runs gpgv on the checksum file and its signature, which
+// succeeds only if a key in the keyring made the signature.
+func (rv *releaseVerifier) checkSignature(dt *downloadTask, sums, signature []byte) error {
+	dir, err := os.MkdirTemp("", "gograb-release-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	sumsFile := filepath.Join(dir, "sums")
+	if err := os.WriteFile(sumsFile, sums, 0600); err != nil {
+		return err
+	}
+	return runGPGV(dt.ctx, rv.keyring, signature, sumsFile)
+}
+
+// runGPGV checks a detached signature of dataFile with gpgv, against keyring
+// or, if it is "", gpgv's default trustedkeys.kbx.
+func runGPGV(ctx context.Context, keyring string, signature []byte, dataFile string) error {
+	signatureFile, err := os.CreateTemp("", "gograb-*.asc")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(signatureFile.Name())
+	_, err = signatureFile.Write(signature)
+	if closeErr := signatureFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	if keyring != "" {
+		args = append(args, "--keyring", keyring)
+	}
+	args = append(args, signatureFile.Name(), dataFile)
+	output, err := exec.CommandContext(ctx, "gpgv", args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// gpgv explains itself on the last line, e.g. "Can't check signature: No public key".
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if reason := strings.TrimPrefix(strings.TrimSpace(lines[len(lines)-1]), "gpgv: "); reason != "" {
+		return errors.New(reason)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnpinned fails downloads under --reproducible that have no SHA-256 to
+// be verified against.
+var errUnpinned = errors.New("no pinned SHA-256 (--reproducible)")
+
+// sourceDateEpoch returns the time --reproducible gives every file: the
+// SOURCE_DATE_EPOCH environment variable used by reproducible builds, or the
+// Unix epoch if it isn't set.
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: must be a Unix timestamp", value)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// checkPinned returns an error listing the tasks that have no SHA-256 pinned
+// by --sums or a sync manifest, so that --reproducible refuses a batch before
+// downloading any of it.
+func checkPinned(tasks []*downloadTask) error {
+	var unpinned []string
+	for _, task := range tasks {
+		if task == nil || task.expectedSum != "" {
+			continue
+		}
+		if name, err := task.plannedName(); err == nil && task.options.checksums[filepath.Base(name)] != "" {
+			continue
+		}
+		unpinned = append(unpinned, task.downloadURL)
+	}
+	if len(unpinned) > 0 {
+		return fmt.Errorf("%w: %s", errUnpinned, strings.Join(unpinned, ", "))
+	}
+	return nil
+}
+
+// normalizeFiles gives the files the batch saved the same metadata on every
+// run: mode 0644 regardless of the umask, and epoch as their modification
+// and access times.
+func normalizeFiles(tasks []*downloadTask, epoch time.Time) error {
+	for _, task := range savedTasks(tasks) {
+		if err := os.Chmod(task.fileName, 0644); err != nil {
+			return err
+		}
+		if err := os.Chtimes(task.fileName, epoch, epoch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// traceRemoteAddr records the address of the server each request goes to,
+// for --show-resolved. Behind a proxy or --cache-server it's their address,
+// and through --ssh-tunnel the host name the jump host resolves.
+func (dt *downloadTask) traceRemoteAddr(request *http.Request) *http.Request {
+	if !dt.options.showResolved {
+		return request
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			dt.mutex.Lock()
+			dt.remoteAddr = info.Conn.RemoteAddr().String()
+			dt.mutex.Unlock()
+		},
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
+
+// getResolvedString describes where the download is coming from for
+// --show-resolved: the server's IP address, then the final URL if redirects
+// led away from the one given, e.g. "|203.0.113.7|https://edge-3.cdn.example/f.zip".
+func (dt *downloadTask) getResolvedString() string {
+	if !dt.options.showResolved {
+		return ""
+	}
+	dt.mutex.Lock()
+	remoteAddr := dt.remoteAddr
+	dt.mutex.Unlock()
+	if remoteAddr == "" {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	resolved := "|" + remoteAddr
+	if response := dt.getLastResponse(); response != nil {
+		if finalURL := response.Request.URL.String(); finalURL != dt.downloadURL {
+			resolved += "|" + finalURL
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const resolverTimeout = time.Minute // Longest an external resolver may take for one URL
+
+// resolvedDownload is one file a resolver found behind a URL.
+type resolvedDownload struct {
+	URL     string            `json:"url"`
+	Name    string            `json:"name,omitempty"`    // File name to save as, "" to take it from the response
+	Headers map[string]string `json:"headers,omitempty"` // Extra headers the URL must be requested with
+}
+
+// resolver turns the URL of a page, such as a video or file sharing page,
+// into the files to download from it. resolve returns no downloads for URLs
+// the resolver doesn't handle.
+type resolver interface {
+	name() string
+	resolve(ctx context.Context, rawURL string) ([]resolvedDownload, error)
+}
+
+// builtinResolvers are tried, in order, after the --resolver commands.
+var builtinResolvers []resolver
+
+// registerResolver adds a built-in resolver. Built-in resolvers register
+// themselves from init functions.
+func registerResolver(r resolver) {
+	builtinResolvers = append(builtinResolvers, r)
+}
+
+func init() {
+	registerResolver(shareLinkResolver{})
+}
+
+// shareLinkResolver resolves Google Drive and OneDrive share links.
+type shareLinkResolver struct{}
+
+func (shareLinkResolver) name() string { return "share-links" }
+
+func (shareLinkResolver) resolve(ctx context.Context, rawURL string) ([]resolvedDownload, error) {
+	if resolved := shareLinkURL(rawURL); resolved != rawURL {
+		return []resolvedDownload{{URL: resolved}}, nil
+	}
+	return nil, nil
+}
+
+// commandResolver runs an external command for URLs whose host matches its
+// pattern, "" for every URL. The command is given the URL as its only
+// argument and prints {"downloads": [{"url": ..., "name": ..., "headers":
+// {...}}]} to stdout, with an empty list for URLs it doesn't handle. A
+// non-zero exit status fails the URL.
+type commandResolver struct {
+	pattern string
+	command []string
+}
+
+// parseResolvers parses --resolver values, "[host glob=]command [args...]".
+func parseResolvers(values []string) ([]resolver, error) {
+	var parsed []resolver
+	for _, value := range values {
+		pattern, command := "", value
+		if before, after, ok := strings.Cut(value, "="); ok && !strings.ContainsAny(before, " \t/") {
+			pattern, command = before, after
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --resolver %q: %v", value, err)
+		}
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid --resolver %q: must be [host glob=]command", value)
+		}
+		parsed = append(parsed, &commandResolver{pattern: pattern, command: fields})
+	}
+	return parsed, nil
+}
+
+func (cr *commandResolver) name() string { return cr.command[0] }
+
+func (cr *commandResolver) resolve(ctx context.Context, rawURL string) ([]resolvedDownload, error) {
+	if cr.pattern != "" {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, nil
+		}
+		if ok, _ := path.Match(cr.pattern, strings.ToLower(parsed.Hostname())); !ok {
+			return nil, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cr.command[0], append(cr.command[1:], rawURL)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	var result struct {
+		Downloads []resolvedDownload `json:"downloads"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("invalid output: %v", err)
+	}
+	return result.Downloads, nil
+}
+
+// resolveTasks replaces each task whose URL a resolver handles with a task
+// for each download it found, keeping the task's rate limit and directory.
+// The --resolver commands are tried first, so they can override the
+// built-in resolvers; the first resolver to return downloads wins. A task
+// whose resolver fails is kept, to fail with the error when it runs, so that
+// the rest of the batch goes ahead.
+func resolveTasks(tasks []*downloadTask, external []resolver) []*downloadTask {
+	resolvers := append(append([]resolver{}, external...), builtinResolvers...)
+	var resolved []*downloadTask
+	for _, task := range tasks {
+		var downloads []resolvedDownload
+		for _, r := range resolvers {
+			var err error
+			if downloads, err = r.resolve(task.ctx, task.downloadURL); err != nil {
+				task.resolveErr = fmt.Errorf("resolving %s with %s: %v", task.downloadURL, r.name(), err)
+				break
+			}
+			if len(downloads) > 0 {
+				break
+			}
+		}
+		if len(downloads) == 0 || task.resolveErr != nil {
+			resolved = append(resolved, task)
+			continue
+		}
+
+		var fileTasks []*downloadTask
+		for _, download := range downloads {
+			fileTask, err := newDownloadTask(task.ctx, download.URL, task.options)
+			if err != nil {
+				task.resolveErr = fmt.Errorf("resolving %s: %v", task.downloadURL, err)
+				break
+			}
+			fileTask.rateLimiter.limit = task.rateLimiter.limit
+			fileTask.outputDir = task.outputDir
+			if download.Name != "" {
+				fileTask.outputName = platformFileName(filepath.Base(filepath.FromSlash(download.Name)))
+			}
+			fileTask.headers = download.Headers
+			fileTasks = append(fileTasks, fileTask)
+		}
+		if task.resolveErr != nil {
+			resolved = append(resolved, task)
+			continue
+		}
+		resolved = append(resolved, fileTasks...)
+	}
+	return resolved
+}
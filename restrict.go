@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRestrictedDir = errors.New("output path is outside the --restrict-to directory")
+
+// resolvePath returns the absolute form of p with symlinks resolved for as
+// much of it as exists, so that a symlinked directory or file can't be used
+// to write outside a restricted directory.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	existing, rest := abs, ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(existing); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// checkOutputPath returns an error unless fileName resolves to a path inside
+// the --restrict-to directory. Without --restrict-to every path is allowed.
+func (options *taskOptions) checkOutputPath(fileName string) error {
+	if options.restrictTo == "" {
+		return nil
+	}
+	resolved, err := resolvePath(fileName)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(options.restrictTo, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("%s: %w", fileName, errOutsideRestrictedDir)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retryBaseDelay = time.Second      // Backoff before the first retry
+	retryMaxDelay  = 30 * time.Second // Upper bound for computed backoff
+	retryAfterMax  = 5 * time.Minute  // Upper bound for a wait asked for by Retry-After
+)
+
+// retryPolicy decides which failed requests are retried and how long to wait
+// before trying again.
+type retryPolicy struct {
+	maxRetries  int          // Retries per request, 0 disables retrying
+	retryStatus map[int]bool // Additional status codes to retry (--retry-on)
+}
+
+// parseRetryOn converts --retry-on values, each a status code or a
+// comma-separated list of them, into a set.
+func parseRetryOn(values []string) (map[int]bool, error) {
+	statuses := make(map[int]bool)
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid --retry-on status code %q", field)
+			}
+			statuses[code] = true
+		}
+	}
+	return statuses, nil
+}
+
+// shouldRetry reports whether a request that failed with err is worth retrying.
+// Transport errors, 408, 429 and 5xx are retried; other client errors such as
+// 401, 403 and 404 are not unless listed in --retry-on. A certificate that
+// fails --pin-sha256 won't change on retry.
+func (p *retryPolicy) shouldRetry(err error) bool {
+	var pinErr *pinError
+	if errors.Is(err, context.Canceled) || errors.As(err, &pinErr) {
+		return false
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		if p.retryStatus[statusErr.statusCode] {
+			return true
+		}
+		switch {
+		case statusErr.statusCode == http.StatusRequestTimeout, statusErr.statusCode == http.StatusTooManyRequests:
+			return true
+		case statusErr.statusCode >= 500 && statusErr.statusCode != http.StatusNotImplemented:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// shouldRetry reports whether the task retries a failed request: as the
+// --script should_retry hook decides, or otherwise as the retry policy does.
+func (dt *downloadTask) shouldRetry(request *http.Request, err error, attempt int) bool {
+	if retry, decided := dt.options.script.retryDecision(request.URL.String(), attempt, err); decided {
+		return retry
+	}
+	return dt.options.retry.shouldRetry(err)
+}
+
+// delay returns how long to wait before retry number attempt (starting at 0).
+// A Retry-After value sent by the server takes precedence over the
+// exponential backoff.
+func (p *retryPolicy) delay(err error, attempt int) time.Duration {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		return statusErr.retryAfter
+	}
+
+	delay := retryBaseDelay << uint(attempt)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// parseRetryAfter parses a Retry-After header given either as a number of
+// seconds or as an HTTP date. Waits longer than retryAfterMax are cut down
+// to it, so that a misconfigured server can't stall the batch for hours.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int(retryAfterMax/time.Second) {
+			return retryAfterMax, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := date.Sub(now)
+		switch {
+		case wait > retryAfterMax:
+			return retryAfterMax, true
+		case wait > 0:
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
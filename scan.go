@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scan runs --scan-cmd on a completed download. "{}" in the command is
+// replaced by the file name, which is appended if the command has no "{}". A
+// file the scanner rejects, or that can't be scanned, is renamed with a
+// ".quarantine" suffix and the task fails with a verifyError. The command
+// also gets the task's details in its environment, from hookEnv.
+func (dt *downloadTask) scan(err error) error {
+	if err != io.EOF || dt.options.scanCmd == "" || dt.options.discard {
+		return err
+	}
+
+	args := hookArgs(dt.options.scanCmd, dt.fileName)
+	cmd := exec.CommandContext(dt.ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), dt.hookEnv("ok")...)
+	output, scanErr := cmd.CombinedOutput()
+	if scanErr == nil {
+		return err
+	}
+	if dt.ctx.Err() != nil {
+		return dt.ctx.Err()
+	}
+
+	reason := fmt.Sprintf("rejected by %s (%v)", args[0], scanErr)
+	if firstLine, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n"); firstLine != "" {
+		reason += ": " + firstLine
+	}
+	quarantine := dt.fileName + ".quarantine"
+	if renameErr := os.Rename(dt.fileName, quarantine); renameErr != nil {
+		reason += fmt.Sprintf("; quarantine failed: %v", renameErr)
+	} else {
+		reason += "; moved to " + quarantine
+	}
+	return &verifyError{fileName: dt.fileName, err: fmt.Errorf("scan %s", reason)}
+}
+
+// hookArgs splits a command run on a file, such as --scan-cmd, into its
+// arguments, replacing "{}" with the file name, or appending the file name
+// if the command has no "{}".
+func hookArgs(command, fileName string) []string {
+	args := strings.Fields(command)
+	substituted := false
+	for i, arg := range args {
+		if strings.Contains(arg, "{}") {
+			args[i] = strings.ReplaceAll(arg, "{}", fileName)
+			substituted = true
+		}
+	}
+	if !substituted {
+		args = append(args, fileName)
+	}
+	return args
+}
+
+// hookEnv describes the task to the commands it runs, as environment
+// variables, so scripts don't have to parse their arguments: GOGRAB_URL,
+// GOGRAB_PATH, GOGRAB_SHA256, GOGRAB_STATUS and GOGRAB_DURATION, the
+// transfer time in seconds.
+func (dt *downloadTask) hookEnv(status string) []string {
+	sum := dt.expectedSum
+	if dt.hasher != nil {
+		sum = hex.EncodeToString(dt.hasher.Sum(nil))
+	} else if sum == "" {
+		sum, _ = hashFile(dt.fileName)
+	}
+	var duration time.Duration
+	if !dt.startTime.IsZero() {
+		duration = time.Since(dt.startTime)
+	}
+	return []string{
+		"GOGRAB_URL=" + dt.downloadURL,
+		"GOGRAB_PATH=" + dt.fileName,
+		"GOGRAB_SHA256=" + sum,
+		"GOGRAB_STATUS=" + status,
+		"GOGRAB_DURATION=" + strconv.FormatFloat(duration.Seconds(), 'f', 3, 64),
+	}
+}
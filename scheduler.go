@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errNotStarted = fmt.Errorf("not started: batch stopped after too many failures (%w)", ErrCancelled)
+
+// schedulerOptions controls how the tasks of a batch are started.
+type schedulerOptions struct {
+	maxConcurrent int           // Maximum number of tasks running at once, 0 for unlimited
+	maxFailures   int           // Stop starting new tasks after this many failures, 0 for no limit
+	abortOnError  bool          // Cancel running tasks on the first failure
+	wait          time.Duration // Minimum delay between starting tasks for the same host
+	randomWait    bool          // Vary wait between 0.5 and 1.5 times its value
+}
+
+// scheduler starts download tasks, optionally bounding how many run at once
+// and spacing out requests to the same host, and applies the batch failure
+// policy.
+type scheduler struct {
+	schedulerOptions
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	failures int
+}
+
+// newScheduler creates a scheduler whose tasks are cancelled through cancel.
+func newScheduler(ctx context.Context, cancel context.CancelFunc, options schedulerOptions) *scheduler {
+	return &scheduler{
+		schedulerOptions: options,
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+}
+
+// runQueue starts tasks in the order they arrive on the queue, such as URLs
+// read from stdin while the batch runs, and returns once the queue is closed
+// and every task taken from it has finished. A task is only taken when a
+// slot is free, so a fast producer waits for the downloads.
+func (s *scheduler) runQueue(queue <-chan *downloadTask) {
+	var wg sync.WaitGroup
+	var slots chan struct{}
+	if s.maxConcurrent > 0 {
+		slots = make(chan struct{}, s.maxConcurrent)
+	}
+
+	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		task, ok := <-queue
+		if !ok {
+			break
+		}
+		if task == nil {
+			if slots != nil {
+				<-slots
+			}
+			continue
+		}
+		if err := s.stopped(); err != nil {
+			task.finish(err)
+			if slots != nil {
+				<-slots
+			}
+			continue
+		}
+
+		wg.Add(1)
+		schedulerLog.Debug("starting task", "url", task.downloadURL)
+		go func(task *downloadTask) {
+			defer wg.Done()
+			entered, err := task.group.enter(task.ctx, slots)
+			if err == nil {
+				err = task.resolveErr
+			}
+			if err == nil {
+				err = task.waitForSignIn()
+			}
+			if err == nil {
+				err = s.pace(task)
+			}
+			if err != nil {
+				task.finish(err)
+			} else {
+				task.start()
+			}
+			if entered {
+				task.group.leave()
+			}
+			s.finish(task)
+			if slots != nil {
+				<-slots
+			}
+		}(task)
+	}
+
+	wg.Wait()
+}
+
+// pace delays a task until the politeness delay since the previous task for
+// the same host has passed.
+func (s *scheduler) pace(task *downloadTask) error {
+	if s.wait <= 0 {
+		return nil
+	}
+	parsed, err := url.Parse(task.downloadURL)
+	if err != nil {
+		return nil
+	}
+
+	delay := s.wait
+	if s.randomWait {
+		delay = time.Duration(float64(s.wait) * (0.5 + rand.Float64()))
+	}
+	until := task.options.hosts.reserveStart(parsed.Host, delay)
+	if time.Until(until) <= 0 {
+		return nil
+	}
+	return task.pause(until, "waiting", "politeness delay")
+}
+
+// stopped returns the reason the batch should not start any more tasks, or
+// nil if queued tasks may still run.
+func (s *scheduler) stopped() error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.maxFailures > 0 && s.failures >= s.maxFailures {
+		return errNotStarted
+	}
+	return nil
+}
+
+// finish records the outcome of a completed task.
+func (s *scheduler) finish(task *downloadTask) {
+	status, err := task.finishStatus(task.error)
+	if err != nil {
+		schedulerLog.Info("task finished", "url", task.downloadURL, "status", status, "error", err)
+	} else {
+		schedulerLog.Info("task finished", "url", task.downloadURL, "status", status, "file", task.fileName)
+	}
+	if !task.failed() || task.canceled() {
+		return
+	}
+
+	s.mutex.Lock()
+	s.failures++
+	failures := s.failures
+	s.mutex.Unlock()
+
+	if s.abortOnError {
+		schedulerLog.Warn("cancelling the batch after a failure", "url", task.downloadURL)
+		s.cancel()
+	} else if s.maxFailures > 0 && failures == s.maxFailures {
+		schedulerLog.Warn("not starting more tasks", "failures", failures)
+	}
+}
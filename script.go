@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// taskScript holds the hooks defined by a --script file, a Starlark program
+// that customizes tasks beyond what flags can express. Each hook is an
+// optional top-level function:
+//
+//	rename(url, name)                         -> file name to save as, or None to keep name
+//	request_headers(url)                      -> dict of headers to add, or None
+//	should_retry(url, attempt, status, error) -> True, False, or None for the default
+//
+// Starlark threads aren't safe for concurrent use, so calls are serialized.
+type taskScript struct {
+	mutex          sync.Mutex
+	thread         *starlark.Thread
+	rename         starlark.Value
+	requestHeaders starlark.Value
+	shouldRetry    starlark.Value
+}
+
+// loadScript runs a --script file and collects the hooks it defines.
+func loadScript(fileName string) (*taskScript, error) {
+	thread := &starlark.Thread{Name: "gograb"}
+	globals, err := starlark.ExecFile(thread, fileName, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("loading --script: %v", err)
+	}
+	script := &taskScript{
+		thread:         thread,
+		rename:         globals["rename"],
+		requestHeaders: globals["request_headers"],
+		shouldRetry:    globals["should_retry"],
+	}
+	for name, hook := range map[string]starlark.Value{"rename": script.rename, "request_headers": script.requestHeaders, "should_retry": script.shouldRetry} {
+		if _, ok := hook.(starlark.Callable); hook != nil && !ok {
+			return nil, fmt.Errorf("loading --script: %s must be a function", name)
+		}
+	}
+	return script, nil
+}
+
+// call runs a hook, returning None for hooks the script doesn't define. The
+// hooks' callers check for a nil script themselves, as they read its fields.
+func (ts *taskScript) call(hook starlark.Value, args ...starlark.Value) (starlark.Value, error) {
+	if hook == nil {
+		return starlark.None, nil
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return starlark.Call(ts.thread, hook, starlark.Tuple(args), nil)
+}
+
+// renameFile returns the name to save a download under, as the rename hook
+// decides. The hook can only choose a file name, not a path.
+func (ts *taskScript) renameFile(url, name string) (string, error) {
+	if ts == nil {
+		return name, nil
+	}
+	result, err := ts.call(ts.rename, starlark.String(url), starlark.String(name))
+	if err != nil {
+		return "", fmt.Errorf("--script rename: %v", err)
+	}
+	if result == starlark.None {
+		return name, nil
+	}
+	renamed, ok := starlark.AsString(result)
+	if !ok || renamed == "" || strings.ContainsAny(renamed, `/\`) || renamed == "." || renamed == ".." {
+		return "", fmt.Errorf("--script rename: must return a file name or None, got %s", result)
+	}
+	return platformFileName(renamed), nil
+}
+
+// headers returns the headers the request_headers hook adds for a URL.
+func (ts *taskScript) headers(url string) (map[string]string, error) {
+	if ts == nil {
+		return nil, nil
+	}
+	result, err := ts.call(ts.requestHeaders, starlark.String(url))
+	if err != nil {
+		return nil, fmt.Errorf("--script request_headers: %v", err)
+	}
+	if result == starlark.None {
+		return nil, nil
+	}
+	dict, ok := result.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("--script request_headers: must return a dict or None, got %s", result.Type())
+	}
+	headers := make(map[string]string)
+	for _, item := range dict.Items() {
+		key, keyOK := starlark.AsString(item[0])
+		value, valueOK := starlark.AsString(item[1])
+		if !keyOK || !valueOK {
+			return nil, errors.New("--script request_headers: header names and values must be strings")
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+// retryDecision asks the should_retry hook whether to retry a failed
+// request. decided is false when the hook isn't defined, returns None or
+// fails, leaving the decision to the retry policy.
+func (ts *taskScript) retryDecision(url string, attempt int, err error) (retry, decided bool) {
+	if ts == nil {
+		return false, false
+	}
+	status := 0
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		status = statusErr.statusCode
+	}
+	result, callErr := ts.call(ts.shouldRetry, starlark.String(url), starlark.MakeInt(attempt+1), starlark.MakeInt(status), starlark.String(err.Error()))
+	if callErr != nil {
+		transportLog.Warn("--script should_retry failed, using the retry policy", "url", url, "error", callErr)
+		return false, false
+	}
+	if result == starlark.None {
+		return false, false
+	}
+	return bool(result.Truth()), true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxSegments          = 8               // Upper bound on connections per download
+	minSegmentSize       = 4 * Megabyte    // Ranges smaller than this are never split
+	segmentProbeInterval = 2 * time.Second // How long throughput is measured before deciding
+	segmentGainThreshold = 1.10            // Required throughput gain to keep adding segments
+)
+
+// segment is a byte range of the output file downloaded over its own connection.
+type segment struct {
+	mutex  sync.Mutex
+	offset int64 // Next byte to write
+	end    int64 // One past the last byte to write
+	body   io.ReadCloser
+}
+
+// remaining returns the number of bytes left in the segment.
+func (seg *segment) remaining() int64 {
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+	return seg.end - seg.offset
+}
+
+// canAutoSegment reports whether a fresh download may be split across several
+// connections: the server must advertise byte ranges and the size must be known
+// and large enough to be worth splitting.
+func canAutoSegment(response *http.Response) bool {
+	return response.StatusCode == http.StatusOK &&
+		response.Header.Get("Accept-Ranges") == "bytes" &&
+		response.ContentLength >= 2*minSegmentSize
+}
+
+// downloadSegmented downloads the response into file using a growing number of
+// connections. It starts with the connection already open and, after each
+// measurement interval, adds one more segment only if the previous addition
+// improved throughput by at least segmentGainThreshold.
+func (dt *downloadTask) downloadSegmented(client *http.Client, request *http.Request, response *http.Response, file outputFile) error {
+	ctx, cancel := context.WithCancel(dt.ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var segmentsMutex sync.Mutex
+	errs := make(chan error, maxSegments)
+	segments := []*segment{{offset: 0, end: response.ContentLength, body: response.Body}}
+
+	run := func(seg *segment) {
+		defer wg.Done()
+		if err := dt.readSegment(seg, file); err != nil {
+			errs <- err
+			cancel()
+			segmentsMutex.Lock()
+			for _, other := range segments {
+				other.body.Close()
+			}
+			segmentsMutex.Unlock()
+		}
+	}
+
+	wg.Add(1)
+	go run(segments[0])
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(segmentProbeInterval)
+	defer ticker.Stop()
+
+	var lastThroughput float64
+	lastBytes := dt.getBytesRead()
+	growing := true
+
+	for {
+		select {
+		case <-done:
+			select {
+			case err := <-errs:
+				return err
+			default:
+				return io.EOF
+			}
+		case <-ticker.C:
+			currentBytes := dt.getBytesRead()
+			throughput := float64(currentBytes-lastBytes) / segmentProbeInterval.Seconds()
+			lastBytes = currentBytes
+
+			if !growing {
+				continue
+			}
+			if lastThroughput > 0 && throughput < lastThroughput*segmentGainThreshold {
+				growing = false
+				continue
+			}
+			lastThroughput = throughput
+
+			segmentsMutex.Lock()
+			count := len(segments)
+			segmentsMutex.Unlock()
+			if count >= maxSegments {
+				growing = false
+				continue
+			}
+
+			seg, err := dt.splitSegment(ctx, client, request, segments)
+			if err != nil || seg == nil {
+				growing = false
+				continue
+			}
+			segmentsMutex.Lock()
+			segments = append(segments, seg)
+			segmentsMutex.Unlock()
+			wg.Add(1)
+			go run(seg)
+		}
+	}
+}
+
+// splitSegment splits the segment with the most bytes remaining in two and
+// opens a ranged connection for the second half. It returns nil if no segment
+// is large enough to split.
+func (dt *downloadTask) splitSegment(ctx context.Context, client *http.Client, request *http.Request, segments []*segment) (*segment, error) {
+	var largest *segment
+	var largestRemaining int64
+	for _, seg := range segments {
+		if remaining := seg.remaining(); remaining > largestRemaining {
+			largest, largestRemaining = seg, remaining
+		}
+	}
+	if largest == nil || largestRemaining < 2*minSegmentSize {
+		return nil, nil
+	}
+
+	largest.mutex.Lock()
+	end := largest.end
+	mid := largest.offset + (end-largest.offset)/2
+	largest.mutex.Unlock()
+
+	rangeRequest := request.Clone(ctx)
+	rangeRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", mid, end-1))
+	response, err := dt.do(client, rangeRequest)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return nil, nil
+	}
+
+	// The original segment kept downloading while the request was in flight;
+	// only take over the second half if it hasn't been reached yet.
+	largest.mutex.Lock()
+	defer largest.mutex.Unlock()
+	if largest.end != end || largest.offset >= mid {
+		response.Body.Close()
+		return nil, nil
+	}
+	largest.end = mid
+	return &segment{offset: mid, end: end, body: response.Body}, nil
+}
+
+// readSegment copies a segment's body into its range of the file.
+func (dt *downloadTask) readSegment(seg *segment, file outputFile) error {
+	defer seg.body.Close()
+	buffer := make([]byte, len(dt.buffer))
+
+	for {
+		if seg.remaining() <= 0 {
+			return nil
+		}
+		if dt.rateLimiter.limit > 0 {
+			dt.rateLimiter.wait(dt.getBytesRead())
+		}
+
+		bytesRead, err := seg.body.Read(buffer)
+		if bytesRead > 0 {
+			// The segment may have been shortened by a split since the read started.
+			seg.mutex.Lock()
+			offset := seg.offset
+			if remaining := seg.end - offset; int64(bytesRead) > remaining {
+				bytesRead = int(remaining)
+			}
+			seg.offset += int64(bytesRead)
+			seg.mutex.Unlock()
+
+			if _, writeErr := file.WriteAt(buffer[:bytesRead], offset); writeErr != nil {
+				return writeErr
+			}
+			atomic.AddInt64(&dt.bytesRead, int64(bytesRead))
+			dt.waitBudgets(bytesRead)
+		}
+
+		if err == io.EOF {
+			if seg.remaining() > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	driveFileRegex   = regexp.MustCompile(`^/file/d/([^/]+)`)
+	driveFormRegex   = regexp.MustCompile(`(?is)<form[^>]*id="download-form"[^>]*action="([^"]+)"[^>]*>(.*?)</form>`)
+	hiddenInputRegex = regexp.MustCompile(`(?i)<input[^>]*type="hidden"[^>]*name="([^"]+)"[^>]*value="([^"]*)"`)
+)
+
+// shareLinkURL turns a Google Drive or OneDrive share link, which opens a web
+// page showing the file, into a URL that downloads it. Other URLs are
+// returned unchanged.
+func shareLinkURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	host := strings.ToLower(parsed.Hostname())
+	switch {
+	case host == "drive.google.com":
+		id := parsed.Query().Get("id")
+		if match := driveFileRegex.FindStringSubmatch(parsed.Path); match != nil {
+			id = match[1]
+		}
+		if id == "" {
+			return rawURL
+		}
+		return "https://drive.usercontent.google.com/download?" + url.Values{"id": {id}, "export": {"download"}}.Encode()
+	case host == "1drv.ms", host == "onedrive.live.com" && parsed.Path != "/download":
+		// The shares API downloads a personal OneDrive item from its share
+		// link, encoded as described in the OneDrive API documentation.
+		return "https://api.onedrive.com/v1.0/shares/u!" + base64.RawURLEncoding.EncodeToString([]byte(rawURL)) + "/root/content"
+	case strings.HasSuffix(host, ".sharepoint.com") && strings.HasPrefix(parsed.Path, "/:"):
+		query := parsed.Query()
+		query.Set("download", "1")
+		parsed.RawQuery = query.Encode()
+		return parsed.String()
+	}
+	return rawURL
+}
+
+// followInterstitial gets past the page Google Drive serves instead of files
+// too large to scan for viruses, by submitting its download form like the
+// "Download anyway" button does. Any other response is returned as it is.
+func (dt *downloadTask) followInterstitial(client *http.Client, request *http.Request, response *http.Response) (*http.Request, *http.Response, error) {
+	host := strings.ToLower(response.Request.URL.Hostname())
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if (host != "drive.usercontent.google.com" && host != "drive.google.com") || mediaType != "text/html" {
+		return request, response, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxListingSize))
+	response.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	form := driveFormRegex.FindSubmatch(body)
+	if form == nil {
+		return nil, nil, errors.New("Google Drive sent a web page instead of the file: check that it is shared with anyone with the link")
+	}
+	action, err := response.Request.URL.Parse(html.UnescapeString(string(form[1])))
+	if err != nil {
+		return nil, nil, err
+	}
+	query := action.Query()
+	for _, input := range hiddenInputRegex.FindAllSubmatch(form[2], -1) {
+		query.Set(html.UnescapeString(string(input[1])), html.UnescapeString(string(input[2])))
+	}
+	action.RawQuery = query.Encode()
+
+	if request, err = newRequestWithHeaders(dt.ctx, "GET", action.String(), dt.options.headers); err != nil {
+		return nil, nil, err
+	}
+	if response, err = dt.do(client, request); err != nil {
+		return nil, nil, err
+	}
+	return request, response, nil
+}
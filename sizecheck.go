@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// sizeUnchanged reports whether, for --if-size-differs, the local file has
+// the size the server reports for the URL, as a cheap sign that it hasn't
+// changed when no checksums are published. It asks with a HEAD request,
+// naming the file from its response as the download would. Servers that
+// refuse HEAD or don't send a Content-Length count as changed, so the file
+// is downloaded.
+func (dt *downloadTask) sizeUnchanged(client *http.Client) (bool, error) {
+	request, err := dt.newRequest("HEAD")
+	if err != nil {
+		return false, err
+	}
+	response, err := dt.do(client, request)
+	if err != nil {
+		if dt.ctx.Err() != nil {
+			return false, dt.ctx.Err()
+		}
+		transportLog.Info("HEAD request failed, downloading", "url", dt.downloadURL, "error", err)
+		return false, nil
+	}
+	response.Body.Close()
+	if response.ContentLength < 0 {
+		return false, nil
+	}
+
+	fileName := dt.outputName
+	if fileName == "" {
+		if fileName, err = dt.outputFilename(response); err != nil {
+			return false, nil
+		}
+	}
+	fileName = filepath.Join(dt.outputDir, fileName)
+	fileInfo, err := os.Stat(longPath(fileName))
+	if err != nil || !fileInfo.Mode().IsRegular() || fileInfo.Size() != response.ContentLength {
+		return false, nil
+	}
+	dt.fileName = fileName
+	return true, nil
+}
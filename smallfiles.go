@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	smallFilesConcurrency = 32 // Downloads at once under --small-files without --max-concurrent
+	smallFilesSyncWorkers = 16 // Files flushed to disk at once at the end of the batch
+)
+
+// smallFiles tunes a batch of many tiny files for --small-files, where the
+// cost of each file lies in its connection, its flush to disk and its line
+// of progress rather than in its bytes. All downloads share one client, so
+// that requests to a host reuse its keep-alive connections, or are
+// multiplexed over one HTTP/2 connection, instead of each download dialing
+// its own. --fsync and --sync-dir flush the files together at the end of
+// the batch instead of one after another as they complete, and the progress
+// display is a count of files instead of a line for each.
+type smallFiles struct {
+	connections int // Idle connections kept per host, as many as downloads run at once
+
+	clientOnce sync.Once
+	client     *http.Client
+
+	mutex    sync.Mutex
+	unsynced []string        // Completed files not yet flushed to disk
+	dirs     map[string]bool // Their directories, for --sync-dir
+}
+
+// newSmallFiles returns the settings for --small-files, or nil if it isn't
+// on.
+func newSmallFiles(enabled bool, maxConcurrent int) *smallFiles {
+	if !enabled {
+		return nil
+	}
+	if maxConcurrent <= 0 {
+		maxConcurrent = smallFilesConcurrency
+	}
+	return &smallFiles{connections: maxConcurrent, dirs: make(map[string]bool)}
+}
+
+// httpClient returns the client the batch's downloads share, made from the
+// first task's options.
+func (sf *smallFiles) httpClient(options *taskOptions) *http.Client {
+	sf.clientOnce.Do(func() {
+		sf.client = newHTTPClient(options)
+		transport := sf.client.Transport
+		if cacheTransport, ok := transport.(*cacheServerTransport); ok {
+			transport = cacheTransport.next
+		}
+		// By default only two idle connections are kept per host, and a
+		// connection is dialed again for every other download.
+		httpTransport := transport.(*http.Transport)
+		httpTransport.MaxIdleConnsPerHost = sf.connections
+		httpTransport.ForceAttemptHTTP2 = true
+	})
+	return sf.client
+}
+
+// syncLater puts off flushing a completed file, its directory or both to
+// disk until the end of the batch.
+func (sf *smallFiles) syncLater(fileName string, file, dir bool) {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	if file {
+		sf.unsynced = append(sf.unsynced, fileName)
+	}
+	if dir {
+		sf.dirs[filepath.Dir(fileName)] = true
+	}
+}
+
+// flush flushes the files and directories put off to disk, several at once
+// so that the file system can commit them together, and returns the first
+// failure.
+func (sf *smallFiles) flush() error {
+	if sf == nil {
+		return nil
+	}
+	sf.mutex.Lock()
+	files, dirs := sf.unsynced, sf.dirs
+	sf.unsynced, sf.dirs = nil, make(map[string]bool)
+	sf.mutex.Unlock()
+
+	var mutex sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mutex.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mutex.Unlock()
+	}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < smallFilesSyncWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fileName := range jobs {
+				if err := syncFile(fileName); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	for _, fileName := range files {
+		jobs <- fileName
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Directories last, once the files in them are on disk.
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			fail(err)
+		}
+	}
+	return firstErr
+}
+
+// syncFile flushes a file to disk.
+func syncFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// smallFilesTotals returns the progress line of a --small-files batch: how
+// many files are done, how fast they are completing, and how many failed.
+func smallFilesTotals(tasks []*downloadTask, started time.Time) string {
+	var done, failed int
+	var bytes int64
+	for _, task := range tasks {
+		switch {
+		case task.failed():
+			failed++
+		case task.error != nil:
+			done++
+		}
+		bytes += task.getBytesRead()
+	}
+	rate := float64(done) / time.Since(started).Seconds()
+	line := fmt.Sprintf("%s, %s, %s", trf("%d of %d done", done, len(tasks)), trf("%.1f files/s", rate), strings.TrimSpace(humanReadableSize(bytes)))
+	if failed > 0 {
+		line += ", " + trf("%d failed", failed)
+	}
+	return line
+}
+
+// printFailures lists the downloads of a --small-files batch that failed,
+// whose errors the progress line only counts.
+func printFailures(tasks []*downloadTask) {
+	for _, task := range tasks {
+		if task != nil && task.failed() && !task.canceled() {
+			fmt.Println(trf("%s: Error: %s", task.displayName(), task.error.Error()))
+		}
+	}
+}
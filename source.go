@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// sourceAddrs are the local addresses connections are made from, given by
+// --interface and --source-ip. With more than one, connections take them in
+// turn, so the connections of a segmented download are striped across the
+// links.
+type sourceAddrs struct {
+	addrs []*net.TCPAddr
+	next  uint32
+}
+
+// parseSources resolves the --interface names and --source-ip addresses, or
+// returns nil if there are neither.
+func parseSources(interfaces, ips []string) (*sourceAddrs, error) {
+	var sources sourceAddrs
+	for _, name := range interfaces {
+		ip, err := interfaceIP(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --interface %q: %v", name, err)
+		}
+		sources.addrs = append(sources.addrs, &net.TCPAddr{IP: ip})
+	}
+	for _, value := range ips {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid --source-ip %q: not an IP address", value)
+		}
+		sources.addrs = append(sources.addrs, &net.TCPAddr{IP: ip})
+	}
+	if len(sources.addrs) == 0 {
+		return nil, nil
+	}
+	return &sources, nil
+}
+
+// interfaceIP returns the address to bind to for an interface: its first
+// global IPv4 address, or its first global IPv6 address if it has no IPv4
+// one.
+func interfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface is down")
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return nil, fmt.Errorf("interface has no usable address")
+	}
+	return ipv6, nil
+}
+
+// pick returns the local address for the next connection, or nil to let the
+// system choose.
+func (sa *sourceAddrs) pick() net.Addr {
+	if sa == nil {
+		return nil
+	}
+	n := atomic.AddUint32(&sa.next, 1) - 1
+	return sa.addrs[n%uint32(len(sa.addrs))]
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// joinCommand reassembles a download saved with --split-output.
+var joinCommand = cli.Command{
+	Name:      "join",
+	Usage:     "Reassemble a file saved with --split-output from its parts",
+	ArgsUsage: "<name.parts.json>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "output, o",
+		},
+		cli.BoolFlag{
+			Name: "delete",
+		},
+	},
+	Action: joinAction,
+}
+
+// splitPart describes one part file of a split download.
+type splitPart struct {
+	Path   string `json:"path"` // Relative to the manifest's directory
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// splitManifest lists the parts of a split download, in order, for gograb
+// join to check and reassemble them.
+type splitManifest struct {
+	File     string      `json:"file"` // Name of the reassembled file
+	Size     int64       `json:"size"`
+	PartSize int64       `json:"partSize"`
+	Parts    []splitPart `json:"parts"`
+}
+
+// splitManifestName returns the name of the manifest written for a download
+// saved to fileName with --split-output.
+func splitManifestName(fileName string) string {
+	return fileName + ".parts.json"
+}
+
+// splitOutput writes a download into numbered part files of at most partSize
+// bytes, "name.001", "name.002" and so on, for file systems and media that
+// limit file sizes, such as FAT32. Each part is hashed as it is written, so
+// the manifest costs no second pass over the data. Parts are written in
+// order, so split downloads are neither segmented nor resumed.
+type splitOutput struct {
+	fileName string
+	partSize int64
+	files    []*os.File
+	parts    []splitPart
+	hasher   hash.Hash // Hash of the current part
+}
+
+func newSplitOutput(fileName string, partSize int64) *splitOutput {
+	return &splitOutput{fileName: fileName, partSize: partSize}
+}
+
+func (so *splitOutput) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if len(so.parts) == 0 || so.parts[len(so.parts)-1].Size == so.partSize {
+			if err := so.nextPart(); err != nil {
+				return written, err
+			}
+		}
+		part := &so.parts[len(so.parts)-1]
+		chunk := p
+		if room := so.partSize - part.Size; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := so.files[len(so.files)-1].Write(chunk)
+		so.hasher.Write(chunk[:n])
+		part.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// nextPart finishes the current part's hash and starts the next part file.
+func (so *splitOutput) nextPart() error {
+	so.finishPart()
+	name := fmt.Sprintf("%s.%03d", so.fileName, len(so.parts)+1)
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	so.files = append(so.files, file)
+	so.parts = append(so.parts, splitPart{Path: filepath.Base(name)})
+	so.hasher = sha256.New()
+	return nil
+}
+
+// finishPart records the hash of the current part, if there is one.
+func (so *splitOutput) finishPart() {
+	if so.hasher != nil {
+		so.parts[len(so.parts)-1].SHA256 = hex.EncodeToString(so.hasher.Sum(nil))
+		so.hasher = nil
+	}
+}
+
+// WriteAt isn't supported: parts are written in order.
+func (so *splitOutput) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("split output only supports sequential writes")
+}
+
+// Sync flushes every part to disk.
+func (so *splitOutput) Sync() error {
+	for _, file := range so.files {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (so *splitOutput) Close() error {
+	var err error
+	for _, file := range so.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// writeManifest writes the manifest listing the parts written, once the
+// download is complete.
+func (so *splitOutput) writeManifest() error {
+	so.finishPart()
+	manifest := splitManifest{File: filepath.Base(so.fileName), PartSize: so.partSize, Parts: so.parts}
+	for _, part := range so.parts {
+		manifest.Size += part.Size
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(splitManifestName(so.fileName), append(data, '\n'), 0644)
+}
+
+// joinAction reassembles the file a split manifest describes, next to the
+// manifest unless --output says otherwise, checking each part's size and
+// hash as it is copied. --delete removes the parts and the manifest once the
+// file is complete.
+func joinAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("usage: gograb join [--output file] [--delete] <name.parts.json>", exitUsageError)
+	}
+	manifestFile := c.Args().First()
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	var manifest splitManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %v", manifestFile, err), exitUsageError)
+	}
+	if manifest.File == "" {
+		return cli.NewExitError(fmt.Sprintf("%s: not a split manifest", manifestFile), exitUsageError)
+	}
+
+	dir := filepath.Dir(manifestFile)
+	output := c.String("output")
+	if output == "" {
+		output = filepath.Join(dir, filepath.Base(manifest.File))
+	}
+	if err := joinParts(dir, manifest.Parts, output); err != nil {
+		os.Remove(output)
+		if errors.Is(err, ErrChecksumMismatch) {
+			return cli.NewExitError(err.Error(), exitVerifyError)
+		}
+		return cli.NewExitError(err.Error(), exitAllFailed)
+	}
+
+	if c.Bool("delete") {
+		for _, part := range manifest.Parts {
+			os.Remove(filepath.Join(dir, filepath.Base(part.Path)))
+		}
+		os.Remove(manifestFile)
+	}
+	fmt.Printf("Joined %d parts into %s (%s).\n", len(manifest.Parts), output, strings.TrimSpace(humanReadableSize(manifest.Size)))
+	return nil
+}
+
+// joinParts concatenates the parts, found in dir, into output.
+func joinParts(dir string, parts []splitPart, output string) error {
+	destination, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	for _, part := range parts {
+		source, err := os.Open(filepath.Join(dir, filepath.Base(part.Path)))
+		if err != nil {
+			return err
+		}
+		hasher := sha256.New()
+		n, err := io.Copy(io.MultiWriter(destination, hasher), source)
+		source.Close()
+		if err != nil {
+			return err
+		}
+		if n != part.Size {
+			return fmt.Errorf("%s: %w: expected %d bytes, got %d", part.Path, ErrChecksumMismatch, part.Size, n)
+		}
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != part.SHA256 {
+			return fmt.Errorf("%s: %w: sha256 expected %s, got %s", part.Path, ErrChecksumMismatch, part.SHA256, sum)
+		}
+	}
+	return destination.Close()
+}
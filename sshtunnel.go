@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sshTunnel reaches download hosts through an SSH jump host, for hosts only
+// reachable inside a private network. Every connection runs "ssh -W", which
+// has the jump host connect to the download host and relays the bytes over
+// ssh's standard input and output, as an OpenSSH ProxyCommand does. Keys,
+// agents and ~/.ssh/config apply as they do for ssh itself, and host names
+// are resolved by the jump host.
+type sshTunnel struct {
+	host string // Jump host as [user@]host, as ssh takes it
+	port string // SSH port, "" for ssh's default
+}
+
+// parseSSHTunnel parses --ssh-tunnel as [user@]host[:port], or returns nil
+// if value is "".
+func parseSSHTunnel(value string) (*sshTunnel, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return nil, fmt.Errorf("--ssh-tunnel needs ssh: %v", err)
+	}
+	tunnel := &sshTunnel{host: value}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		tunnel.host, tunnel.port = host, port
+	}
+	if tunnel.host == "" || strings.HasPrefix(tunnel.host, "-") || strings.HasSuffix(tunnel.host, "@") {
+		return nil, fmt.Errorf("invalid --ssh-tunnel %q: must be [user@]host[:port]", value)
+	}
+	return tunnel, nil
+}
+
+// dialContext connects to address through the jump host. The ssh process
+// lives as long as the connection, which can outlast the dial's context, so
+// the context only bounds starting it.
+func (st *sshTunnel) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	args := []string{"-W", address, "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes"}
+	if st.port != "" {
+		args = append(args, "-p", st.port)
+	}
+	args = append(args, "--", st.host)
+
+	// Pipes from os.Pipe rather than cmd.StdoutPipe, so that the connection
+	// can pass on deadlines where the platform supports them for pipes.
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, err
+	}
+	conn := &sshConn{
+		cmd:    exec.Command("ssh", args...),
+		stdin:  stdinWriter,
+		stdout: stdoutReader,
+		local:  sshAddr("ssh " + st.host),
+		remote: sshAddr(address),
+	}
+	conn.cmd.Stdin = stdinReader
+	conn.cmd.Stdout = stdoutWriter
+	conn.cmd.Stderr = &conn.stderr
+	err = conn.cmd.Start()
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if err != nil {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		return nil, fmt.Errorf("--ssh-tunnel: %v", err)
+	}
+	transportLog.Debug("tunneling connection", "jump_host", st.host, "address", address)
+	return conn, nil
+}
+
+// sshAddr is either end of a tunneled connection, for net.Conn.
+type sshAddr string
+
+func (sa sshAddr) Network() string { return "ssh" }
+func (sa sshAddr) String() string  { return string(sa) }
+
+// sshConn is a connection relayed by an "ssh -W" process.
+type sshConn struct {
+	cmd      *exec.Cmd
+	stdin    *os.File
+	stdout   *os.File
+	stderr   bytes.Buffer // What ssh printed, read once it has exited
+	local    sshAddr
+	remote   sshAddr
+	received bool // Whether any bytes came through, to tell ssh's failures apart
+	once     sync.Once
+	waitErr  error
+}
+
+// wait ends the ssh process, once.
+func (sc *sshConn) wait() error {
+	sc.once.Do(func() {
+		sc.stdin.Close()
+		sc.waitErr = sc.cmd.Wait()
+	})
+	return sc.waitErr
+}
+
+// Read reads what the download host sent. If ssh exits before relaying
+// anything, it failed to reach the jump host or the download host, and what
+// it printed is returned as the error.
+func (sc *sshConn) Read(p []byte) (int, error) {
+	n, err := sc.stdout.Read(p)
+	if n > 0 {
+		sc.received = true
+	}
+	if err != nil && !sc.received {
+		if waitErr := sc.wait(); waitErr != nil {
+			message := strings.TrimSpace(sc.stderr.String())
+			if message == "" {
+				message = waitErr.Error()
+			}
+			return n, fmt.Errorf("--ssh-tunnel to %s: %s", sc.remote, message)
+		}
+	}
+	return n, err
+}
+
+func (sc *sshConn) Write(p []byte) (int, error) {
+	return sc.stdin.Write(p)
+}
+
+// Close stops the ssh process, which closes the connection on the jump host.
+func (sc *sshConn) Close() error {
+	sc.stdout.Close()
+	if sc.cmd.Process != nil {
+		sc.cmd.Process.Kill()
+	}
+	sc.wait()
+	return nil
+}
+
+func (sc *sshConn) LocalAddr() net.Addr  { return sc.local }
+func (sc *sshConn) RemoteAddr() net.Addr { return sc.remote }
+
+func (sc *sshConn) SetDeadline(t time.Time) error {
+	if err := sc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return sc.SetWriteDeadline(t)
+}
+
+func (sc *sshConn) SetReadDeadline(t time.Time) error  { return sc.stdout.SetReadDeadline(t) }
+func (sc *sshConn) SetWriteDeadline(t time.Time) error { return sc.stdin.SetWriteDeadline(t) }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// stagingArea holds the downloads of an --all-or-nothing batch until every
+// one of them has succeeded, so that a failed batch leaves the files already
+// in place untouched instead of half-updated.
+type stagingArea struct {
+	mutex   sync.Mutex
+	dir     string // Created on first use, "" until then
+	next    int
+	inOrder bool // Files are moved into place one by one by the releaser, for --in-order
+	held    bool // A staged file couldn't be moved out, so the directory is kept for it
+}
+
+// stage returns the path to download finalName to instead: a file of the
+// same name in a directory of its own inside the staging directory. The
+// staging directory is created in the working directory, rather than the
+// system temp directory, so moving files into place is usually a rename.
+func (sa *stagingArea) stage(finalName string) (string, error) {
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+	if sa.dir == "" {
+		dir, err := os.MkdirTemp(".", ".gograb-staging-")
+		if err != nil {
+			return "", err
+		}
+		sa.dir = dir
+	}
+	sa.next++
+	dir := filepath.Join(sa.dir, strconv.Itoa(sa.next))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(finalName)), nil
+}
+
+// finish ends the batch: if every task succeeded, their staged files are
+// moved into place, otherwise none are. Under --in-order the files have
+// already been released, and only the staged files of failed downloads are
+// left. The staging directory is then removed, unless a file couldn't be
+// moved out of it, in which case it is kept and named in the error so that
+// the download isn't lost with it.
+func (sa *stagingArea) finish(tasks []*downloadTask) error {
+	if sa == nil || sa.dir == "" {
+		return nil
+	}
+	var firstErr error
+	if !sa.inOrder {
+		if batchExitCode(tasks) != exitOK {
+			fmt.Println("Not every download succeeded, so none were moved into place (--all-or-nothing).")
+		} else {
+			for _, task := range tasks {
+				if task == nil {
+					continue
+				}
+				if err := task.unstage(); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	sa.mutex.Lock()
+	held := sa.held
+	sa.mutex.Unlock()
+	if held {
+		if firstErr == nil {
+			firstErr = errors.New("not every download could be moved into place")
+		}
+		return fmt.Errorf("%w; the downloads not moved are kept in %s", firstErr, sa.dir)
+	}
+	os.RemoveAll(sa.dir)
+	return nil
+}
+
+// hold keeps the staging directory when the batch is over, because a staged
+// file couldn't be moved out of it.
+func (sa *stagingArea) hold() {
+	if sa == nil {
+		return
+	}
+	sa.mutex.Lock()
+	sa.held = true
+	sa.mutex.Unlock()
+}
+
+// unstage moves the task's staged file into place, if it was downloaded.
+func (dt *downloadTask) unstage() error {
+	if dt.finalName == "" || dt.error != io.EOF {
+		return nil
+	}
+	if err := moveFile(dt.fileName, dt.finalName, dt.options.fsync); err != nil {
+		dt.options.staging.hold()
+		return err
+	}
+	if dt.options.syncDir {
+		if err := syncDir(filepath.Dir(dt.finalName)); err != nil {
+			return err
+		}
+	}
+	dt.fileName, dt.finalName = dt.finalName, ""
+	return nil
+}
+
+// moveFile renames a file into place, falling back to copying it when that
+// fails, as it does when the destination is on another file system. With
+// fsync set, a copy is flushed to disk like the download was.
+func moveFile(from, to string, fsync bool) error {
+	if dir := filepath.Dir(to); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	if fsync {
+		if err := destination.Sync(); err != nil {
+			destination.Close()
+			return err
+		}
+	}
+	return destination.Close()
+}
+
+// displayName returns the name to show for the task: where the file will
+// end up, even while it is downloaded to a staging directory.
+func (dt *downloadTask) displayName() string {
+	if dt.finalName != "" {
+		return dt.finalName
+	}
+	return dt.fileName
+}
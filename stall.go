@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallGuard fails a read of a response body that receives nothing for the
+// --stall-timeout, by closing the body under it, with an error wrapping
+// ErrStalled. Only time spent in a read counts, so pauses between reads for
+// the rate limit or the battery don't make a download look stalled.
+type stallGuard struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32 // Set once the timer closed the body
+}
+
+// guardStall returns the body of a download's response, guarded against
+// stalls if --stall-timeout is set.
+func (dt *downloadTask) guardStall(body io.ReadCloser) io.ReadCloser {
+	if dt.options.stallTimeout <= 0 {
+		return body
+	}
+	sg := &stallGuard{body: body, timeout: dt.options.stallTimeout}
+	sg.timer = time.AfterFunc(sg.timeout, func() {
+		atomic.StoreInt32(&sg.stalled, 1)
+		body.Close()
+	})
+	sg.timer.Stop()
+	return sg
+}
+
+func (sg *stallGuard) Read(p []byte) (int, error) {
+	sg.timer.Reset(sg.timeout)
+	n, err := sg.body.Read(p)
+	sg.timer.Stop()
+	if atomic.LoadInt32(&sg.stalled) != 0 {
+		return n, fmt.Errorf("%w: nothing received for %s", ErrStalled, sg.timeout)
+	}
+	return n, err
+}
+
+func (sg *stallGuard) Close() error {
+	sg.timer.Stop()
+	return sg.body.Close()
+}
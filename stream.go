@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// stdinArg is the URL argument that reads further URLs from stdin.
+const stdinArg = "-"
+
+// streamTasks reads URLs from r, one per line, as a producer writes them,
+// and sends their tasks, expanded by prepare, on the returned channel, which
+// is closed at the end of the input or when ctx is done. Blank lines and
+// lines starting with # are skipped, and URLs that are invalid or can't be
+// prepared are logged and skipped, since the batch is already running.
+func streamTasks(ctx context.Context, r io.Reader, options *taskOptions, prepare func([]*downloadTask) ([]*downloadTask, error)) <-chan *downloadTask {
+	feed := make(chan *downloadTask)
+	go func() {
+		defer close(feed)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			task, err := newDownloadTask(ctx, line, options)
+			if err != nil {
+				uiLog.Warn("skipping a URL from stdin", "url", line, "error", err)
+				continue
+			}
+			tasks, err := prepare([]*downloadTask{task})
+			if err != nil {
+				uiLog.Warn("skipping a URL from stdin", "url", line, "error", err)
+				continue
+			}
+			for _, task := range tasks {
+				select {
+				case feed <- task:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			uiLog.Warn("reading URLs from stdin failed", "error", err)
+		}
+	}()
+	return feed
+}
+
+// liveTasks is the list of a batch's tasks, which grows while it runs when
+// URLs are streamed in.
+type liveTasks struct {
+	mutex sync.Mutex
+	tasks []*downloadTask
+	added int // Tasks added so far, including those retired
+
+	// A --watch-dir batch runs until it is stopped, so downloads that
+	// succeeded are dropped once shown; failures stay for the summary.
+	retiring bool
+	shown    map[*downloadTask]bool // Finished successfully when progress was last shown
+	retired  int                    // Successful downloads dropped from the list
+}
+
+// add appends a task, numbering it for --numbered and reserving the name
+// its URL gives.
+func (lt *liveTasks) add(task *downloadTask) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	lt.tasks = append(lt.tasks, task)
+	lt.added++
+	task.index = lt.added
+	task.options.names.reserve(task)
+}
+
+// list returns the tasks so far.
+func (lt *liveTasks) list() []*downloadTask {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	return append([]*downloadTask(nil), lt.tasks...)
+}
+
+// retire is called after each progress update. Under --watch-dir it drops
+// the downloads that had already succeeded at the update before, so that
+// each has been shown finished, and that the releaser is done with, then
+// notes those that have succeeded since for the next call.
+func (lt *liveTasks) retire(rl *releaser) {
+	if !lt.retiring {
+		return
+	}
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if lt.shown == nil {
+		lt.shown = make(map[*downloadTask]bool)
+	}
+	kept := lt.tasks[:0]
+	for _, task := range lt.tasks {
+		if lt.shown[task] && rl.isReleased(task) && !task.failed() {
+			delete(lt.shown, task)
+			rl.forget(task)
+			lt.retired++
+			continue
+		}
+		kept = append(kept, task)
+	}
+	for i := len(kept); i < len(lt.tasks); i++ {
+		lt.tasks[i] = nil
+	}
+	lt.tasks = kept
+
+	for _, task := range lt.tasks {
+		select {
+		case <-task.completionChan:
+			if !task.failed() {
+				lt.shown[task] = true
+			}
+		default:
+		}
+	}
+}
+
+// retiredCount returns how many successful downloads retire dropped.
+func (lt *liveTasks) retiredCount() int {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	return lt.retired
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// syncCommand makes a local directory match a manifest of remote files.
+var syncCommand = cli.Command{
+	Name:      "sync",
+	Usage:     "Make a directory match a manifest of URLs, sizes and hashes",
+	ArgsUsage: "<dir>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "manifest",
+		},
+		cli.BoolFlag{
+			Name: "delete",
+		},
+	},
+	Action: syncAction,
+}
+
+// manifestEntry describes one file of a sync manifest.
+type manifestEntry struct {
+	URL    string `json:"url"`
+	Path   string `json:"path,omitempty"`   // Where to save the file, relative to the directory
+	Size   int64  `json:"size,omitempty"`   // Expected size in bytes, 0 if unknown
+	SHA256 string `json:"sha256,omitempty"` // Expected hex digest, "" if unknown
+}
+
+// syncManifest lists the files a directory should contain.
+type syncManifest struct {
+	Files []manifestEntry `json:"files"`
+}
+
+// loadManifest reads and validates a sync manifest. Entries without a path
+// are saved under the name in their URL, kept percent-encoded if keepEncoded
+// is set.
+func loadManifest(fileName string, keepEncoded bool) (*syncManifest, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var manifest syncManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	for i := range manifest.Files {
+		entry := &manifest.Files[i]
+		if entry.URL == "" {
+			return nil, fmt.Errorf("%s: entry %d has no url", fileName, i+1)
+		}
+		if entry.Path == "" {
+			if entry.Path, err = filenameFromURL(entry.URL, keepEncoded); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", fileName, i+1, err)
+			}
+		}
+		entry.Path = cleanRelDir(entry.Path)
+		if entry.Path == "" {
+			return nil, fmt.Errorf("%s: entry %d has an empty path", fileName, i+1)
+		}
+		entry.SHA256 = strings.ToLower(entry.SHA256)
+	}
+	return &manifest, nil
+}
+
+// upToDate reports whether the local file matches the manifest entry. Files
+// are compared by size, then by hash when the manifest lists one; an entry
+// with neither is satisfied by any existing file.
+func (entry *manifestEntry) upToDate(localPath string) bool {
+	fileInfo, err := os.Stat(localPath)
+	if err != nil || fileInfo.IsDir() {
+		return false
+	}
+	if entry.Size > 0 && fileInfo.Size() != entry.Size {
+		return false
+	}
+	if entry.SHA256 != "" {
+		sum, err := hashFile(localPath)
+		return err == nil && sum == entry.SHA256
+	}
+	return true
+}
+
+// syncAction downloads the manifest files that are missing or changed in the
+// directory and, with --delete, removes local files the manifest doesn't list.
+func syncAction(c *cli.Context) error {
+	if c.NArg() != 1 || c.String("manifest") == "" {
+		return cli.NewExitError("usage: gograb sync --manifest <manifest.json> [--delete] <dir>", exitUsageError)
+	}
+	dir := c.Args().First()
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	manifest, err := loadManifest(c.String("manifest"), options.keepEncodedNames)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tasks, wanted, err := manifestTasks(ctx, dir, manifest, options)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("delete") {
+		if err := deleteUnlisted(dir, wanted); err != nil {
+			return cli.NewExitError(err.Error(), exitAllFailed)
+		}
+	}
+
+	fmt.Printf("%d of %d files need downloading.\n", len(tasks), len(manifest.Files))
+	if len(tasks) == 0 {
+		return nil
+	}
+	return runBatch(ctx, cancel, c, tasks)
+}
+
+// manifestTasks creates tasks for the manifest files that are missing or
+// changed in dir. It also returns the local paths the manifest lists. Errors
+// are returned as cli exit errors.
+func manifestTasks(ctx context.Context, dir string, manifest *syncManifest, options *taskOptions) ([]*downloadTask, map[string]bool, error) {
+	var tasks []*downloadTask
+	wanted := make(map[string]bool)
+	for _, entry := range manifest.Files {
+		localPath := filepath.Join(dir, entry.Path)
+		if err := options.checkOutputPath(localPath); err != nil {
+			return nil, nil, cli.NewExitError(err.Error(), exitUsageError)
+		}
+		wanted[localPath] = true
+		if entry.upToDate(localPath) {
+			continue
+		}
+
+		// A changed file is downloaded again from scratch; a shorter one may be
+		// an interrupted download and is left in place to be resumed.
+		if fileInfo, err := os.Stat(localPath); err == nil && !fileInfo.IsDir() && (entry.Size == 0 || fileInfo.Size() >= entry.Size) {
+			if err := os.Remove(localPath); err != nil {
+				return nil, nil, cli.NewExitError(err.Error(), exitAllFailed)
+			}
+		}
+
+		task, err := newDownloadTask(ctx, entry.URL, options)
+		if err != nil {
+			return nil, nil, cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+		}
+		task.outputDir = filepath.Dir(localPath)
+		task.outputName = filepath.Base(localPath)
+		task.expectedSum = entry.SHA256
+		tasks = append(tasks, task)
+	}
+	return tasks, wanted, nil
+}
+
+// deleteUnlisted removes regular files under dir that aren't in wanted.
+func deleteUnlisted(dir string, wanted map[string]bool) error {
+	return filepath.Walk(dir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && localPath == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || wanted[localPath] {
+			return nil
+		}
+		fmt.Printf("Deleting %s\n", localPath)
+		return os.Remove(localPath)
+	})
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type downloadTask struct {
+	ctx            context.Context
 	completionChan chan struct{}
 	source         io.ReadCloser
-	destination    io.WriteCloser
+	destination    outputFile
 	bytesPerSecond float64
 	error          error
 	startTime      time.Time
@@ -27,7 +38,50 @@ type downloadTask struct {
 	rateLimiter    *rateLimiter
 	downloadURL    string
 	isResumable    bool
-	headers        map[string]string
+	options        *taskOptions
+	waitUntil      time.Time    // End of the current pause, if any
+	waitLabel      string       // What the task is waiting for, e.g. "backing off"
+	waitReason     string       // Why the task is waiting
+	expectedSum    string       // SHA-256 listed for the file in --sums
+	hasher         hash.Hash    // Digest of the bytes written, when streamed from the start
+	outputDir      string       // Directory to save into, relative to the working directory
+	outputName     string       // File name to save as instead of the one derived from the response
+	ranges         rangeSupport // Whether the server accepts range requests
+	log            *taskLog     // Per-task log from --task-logs, nil if not enabled
+	spanID         string       // Trace span of the download, "" if not traced
+	spanStart      time.Time    // When the download span started
+	uploadBytes    int64        // Bytes of the --form body sent so far
+	uploadTotal    int64        // Size of the --form body, 0 if there is none
+	uploadFile     string       // Local file sent by gograb put, "" for a download
+	uploadMethod   string       // HTTP method of the upload, PUT or POST
+	uploadType     string       // Content-Type of the upload, "" to guess it from the file name
+	updateFile     string       // Local file gograb update patches, "" for a download
+	blockMap       string       // Where gograb update finds the block map, from {url}, {dir} and {name}
+	finalName      string       // Where a staged --all-or-nothing download is moved once the batch succeeds
+	batteryLimited bool         // Whether the rate limit is lowered by --battery-rate-limit
+	normalLimit    int64        // Rate limit to restore once the battery recovers
+	compressed     int64        // Bytes written to the file by --compress so far
+	parts          *splitOutput // Part files of a --split-output download, nil if not split
+	pieces         *pieceHasher // Piece hashes of the data streamed, nil unless --piece-hashes
+	pipe           *pipeFeed    // Feed of the --pipe-to command, nil until it starts
+	bucketListing  string       // Listing of the objects under an s3:// or gs:// prefix, "" for other URLs
+	proxy          *url.URL     // Proxy from the task's queue entry, nil to connect directly
+	proxySet       bool         // Whether proxy replaces the --proxy-for rules for this task
+	signature      []byte       // Detached OpenPGP signature found by --auto-verify, nil if none
+	cachedSum      string       // SHA-256 of the --cache file copied instead of downloading, "" if downloaded
+	suspect        string       // What --html-guard found in place of the file, "" if nothing suspect
+	muxBegun       bool         // Whether --stdout-mux sent the download's begin frame
+	renamedFrom    string       // Path the download asked for, when another download of the batch had it, "" if not renamed
+	remoteAddr     string       // Address of the server the latest request went to, for --show-resolved
+	index          int          // Position in the batch, from 1, for --numbered
+	group          *taskGroup   // Group from --group, nil if the URL is in none
+	resolveErr     error        // Why a resolver failed on the URL, which fails the task without starting it
+
+	// Extra headers for the task's requests, from the resolver that found its URL
+	headers map[string]string
+
+	// Latest response received, for --dump-headers and the task log
+	lastResponse *http.Response
 }
 
 // getBytesRead returns the number of bytes read so far.
@@ -38,16 +92,332 @@ func (dt *downloadTask) getBytesRead() int64 {
 	return atomic.LoadInt64(&dt.bytesRead)
 }
 
-// newDownloadTask initializes a new download task.
-func newDownloadTask(url string, headers map[string]string) *downloadTask {
-	limit, url := extractRateLimit(url)
+// failed reports whether the task finished with an error. A file that was
+// already fully downloaded, or that --newer-than skipped, is not treated as
+// a failure.
+func (dt *downloadTask) failed() bool {
+	return dt.error != nil && dt.error != io.EOF && dt.error != errAlreadyDownloaded && dt.error != errNotModified
+}
+
+// canceled reports whether the task was stopped or never started because of
+// the batch failure policy rather than failing on its own.
+func (dt *downloadTask) canceled() bool {
+	return errors.Is(dt.error, ErrCancelled)
+}
+
+// finish records the task's final error and signals its completion. A task
+// stopped through its context finishes with an error wrapping ErrCancelled.
+func (dt *downloadTask) finish(err error) {
+	if errors.Is(err, context.Canceled) && !errors.Is(err, ErrCancelled) {
+		err = fmt.Errorf("%w: %w", ErrCancelled, err)
+	}
+	dt.error = err
+	dt.leaveBudgets()
+	dt.logFinish(err)
+	dt.traceFinish(err)
+	dt.options.headerDump.write(dt)
+	if err == io.EOF {
+		dt.options.cache.store(dt)
+	}
+	dt.options.dedupe.finished(dt, err == io.EOF)
+	dt.options.mux.end(dt, err)
+	if dt.failed() && !dt.canceled() {
+		dt.options.chat.taskFailed(dt)
+	}
+	close(dt.completionChan)
+	dt.endTime = time.Now()
+}
+
+// newDownloadTask initializes a new download task from a "[rate limit:]url"
+// argument, returning an error if the URL is not a valid download target.
+func newDownloadTask(ctx context.Context, arg string, options *taskOptions) (*downloadTask, error) {
+	limit, rawURL, err := extractRateLimit(arg)
+	if err != nil {
+		return nil, err
+	}
+	rawURL, listing, err := bucketURL(rawURL, options.s3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	url, err := normalizeURL(rawURL, options.defaultScheme)
+	if err != nil {
+		return nil, err
+	}
+	if url, err = options.secureURL(url); err != nil {
+		return nil, err
+	}
 	return &downloadTask{
+		ctx:            ctx,
 		downloadURL:    url,
 		completionChan: make(chan struct{}, 1),
-		buffer:         make([]byte, 32*1024),
-		rateLimiter:    &rateLimiter{limit: limit * 1000},
-		headers:        headers,
+		buffer:         make([]byte, options.bufferSize()),
+		rateLimiter:    &rateLimiter{limit: limit},
+		options:        options,
+		bucketListing:  listing,
+		group:          options.groups.match(url),
+	}, nil
+}
+
+// newHTTPClient creates the HTTP client used for downloads. Redirects are
+// upgraded to HTTPS, or refused, like the URLs given on the command line.
+func newHTTPClient(options *taskOptions) *http.Client {
+	dialContext := options.tcp.dialContext()
+	if options.sshTunnel != nil {
+		dialContext = options.sshTunnel.dialContext
+	} else if options.prefetch != nil {
+		dialContext = options.prefetch.dialContext(dialContext)
+	}
+	httpTransport := &http.Transport{
+		Proxy:           options.proxies.proxy,
+		DialContext:     dialContext,
+		TLSClientConfig: &tls.Config{VerifyConnection: verifyPins(options.pins)},
+	}
+	if options.prefetch != nil && options.prefetch.tls {
+		httpTransport.DialTLSContext = options.prefetch.dialTLS
+	}
+	var transport http.RoundTripper = httpTransport
+	if options.cacheServer != nil {
+		transport = &cacheServerTransport{server: options.cacheServer, next: transport}
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return options.hsts.secure(request.URL)
+		},
+	}
+}
+
+// newRequestWithHeaders creates an HTTP request with the custom headers applied.
+func newRequestWithHeaders(ctx context.Context, method, url string, headers map[string]string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	return request, nil
+}
+
+// newRequest creates an HTTP request for the task's URL with the custom
+// headers applied, then those its resolver asked for, then those of the
+// --script request_headers hook.
+func (dt *downloadTask) newRequest(method string) (*http.Request, error) {
+	request, err := newRequestWithHeaders(dt.ctx, method, dt.downloadURL, dt.options.headers)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range dt.headers {
+		request.Header.Set(key, value)
+	}
+	scriptHeaders, err := dt.options.script.headers(dt.downloadURL)
+	if err != nil {
+		return nil, err
 	}
+	for key, value := range scriptHeaders {
+		request.Header.Set(key, value)
+	}
+	if dt.options.cacheServer != nil && dt.expectedSum != "" {
+		request.Header.Set(cacheSumHeader, dt.expectedSum)
+	}
+	return request, nil
+}
+
+// do sends the request, retrying failures the retry policy allows until it
+// succeeds or the retries are used up.
+func (dt *downloadTask) do(client *http.Client, request *http.Request) (*http.Response, error) {
+	retry := &dt.options.retry
+	host := request.URL.Host
+	// A probe of the host's circuit that ends without an outcome, such as
+	// when the task is cancelled while backing off, lets another through.
+	probing := false
+	defer func() {
+		if probing {
+			dt.options.hosts.endProbe(host)
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		// Request bodies, such as a --form upload, are opened afresh for
+		// every attempt.
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request.Body = body
+		}
+		for {
+			var until time.Time
+			if until, probing = dt.options.hosts.admit(host); until.IsZero() {
+				break
+			}
+			if err := dt.pause(until, "waiting", "circuit open for "+host); err != nil {
+				return nil, err
+			}
+		}
+		if until, reason := dt.options.hosts.backoffFor(host); !until.IsZero() {
+			if err := dt.pause(until, "backing off", reason); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := dt.send(client, request)
+
+		// Failures while the network is down don't count against the host
+		// or the retries.
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			if offline, waitErr := dt.waitForNetwork(); waitErr != nil {
+				return nil, waitErr
+			} else if offline {
+				if probing {
+					dt.options.hosts.endProbe(host)
+					probing = false
+				}
+				attempt--
+				continue
+			}
+		}
+
+		dt.options.hosts.record(host, err)
+		probing = false
+		if err == nil || attempt >= retry.maxRetries || !dt.shouldRetry(request, err, attempt) {
+			return response, err
+		}
+
+		reason := fmt.Sprintf("attempt %d/%d", attempt+2, retry.maxRetries+1)
+		delay := retry.delay(err, attempt)
+		transportLog.Info("retrying request", "url", request.URL.String(), "attempt", attempt+2, "delay", delay, "error", err)
+		dt.log.event("retry", map[string]interface{}{"attempt": attempt + 2, "error": err.Error(), "delay": delay.String()})
+		if err := dt.pause(time.Now().Add(delay), "retrying in", reason); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pause blocks until the given time, or until the task is cancelled, while
+// the task line shows what it is waiting for.
+func (dt *downloadTask) pause(until time.Time, label, reason string) error {
+	dt.mutex.Lock()
+	dt.waitUntil, dt.waitLabel, dt.waitReason = until, label, reason
+	dt.mutex.Unlock()
+
+	defer func() {
+		dt.mutex.Lock()
+		dt.waitUntil, dt.waitLabel, dt.waitReason = time.Time{}, "", ""
+		dt.mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-dt.ctx.Done():
+		return dt.ctx.Err()
+	}
+}
+
+// getWaitString describes the task's current pause, e.g.
+// "backing off 30s (server throttled)", or returns "" if it isn't paused.
+func (dt *downloadTask) getWaitString() string {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	remaining := time.Until(dt.waitUntil)
+	if remaining <= 0 {
+		return ""
+	}
+	wait := fmt.Sprintf("%s %s", tr(dt.waitLabel), strings.TrimSpace(durationToString(int64(math.Ceil(remaining.Seconds())))))
+	if dt.waitReason != "" {
+		wait += fmt.Sprintf(" (%s)", tr(dt.waitReason))
+	}
+	return wait
+}
+
+// send sends the request once and checks the response status. Credentials
+// from --credential-helper, or else a token from gograb login, are added
+// unless --header set an Authorization header. Transport errors are returned
+// as is; unexpected statuses are returned as an httpStatusError that carries
+// the start of the response body when --show-error-body is set.
+func (dt *downloadTask) send(client *http.Client, request *http.Request) (*http.Response, error) {
+	if request.Header.Get("Authorization") == "" {
+		authorization, err := dt.options.credentials.authorization(request.URL)
+		if err == nil && authorization == "" {
+			authorization, err = dt.options.tokens.authorization(request.URL.Host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+	}
+	dt.options.hsts.warnCredentials(request)
+
+	transportLog.Debug("sending request", "method", request.Method, "url", request.URL.String(), "range", request.Header.Get("Range"))
+	dt.log.event("request", map[string]interface{}{"method": request.Method, "url": request.URL.String(), "range": request.Header.Get("Range")})
+	sent := time.Now()
+	requestSpan := span{spanID: dt.options.tracer.newSpanID(), parentID: dt.spanID, name: "HTTP " + request.Method, kind: spanKindClient, start: sent,
+		attributes: map[string]string{"url.full": request.URL.String()}}
+	traced, traceID := dt.options.wireTrace.trace(dt.traceRemoteAddr(request))
+	response, err := client.Do(dt.options.tracer.withTrace(traced, requestSpan.spanID))
+	dt.options.wireTrace.traceResponse(traceID, response, err)
+	requestSpan.end = time.Now()
+	if err != nil {
+		dt.log.event("error", map[string]interface{}{"error": err.Error(), "latency": time.Since(sent).Round(time.Millisecond).String()})
+		requestSpan.err = err.Error()
+		dt.options.tracer.record(requestSpan)
+		return nil, err
+	}
+	requestSpan.attributes["http.response.status_code"] = strconv.Itoa(response.StatusCode)
+	if response.StatusCode >= 400 {
+		requestSpan.err = response.Status
+	}
+	dt.options.tracer.record(requestSpan)
+	dt.mutex.Lock()
+	dt.lastResponse = response
+	dt.mutex.Unlock()
+	transportLog.Debug("received response", "url", response.Request.URL.String(), "status", response.StatusCode, "proto", response.Proto)
+	dt.log.event("response", map[string]interface{}{
+		"status":  response.Status,
+		"proto":   response.Proto,
+		"url":     response.Request.URL.String(),
+		"headers": response.Header,
+		"latency": time.Since(sent).Round(time.Millisecond).String(),
+	})
+	dt.options.hosts.observe(request.URL.Host, response)
+	dt.options.hsts.observe(response)
+	if response.StatusCode == http.StatusOK || response.StatusCode == http.StatusPartialContent {
+		return response, nil
+	}
+	defer response.Body.Close()
+
+	statusErr := &httpStatusError{statusCode: response.StatusCode}
+	statusErr.retryAfter, _ = parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+	if dt.options.errorBodyLimit > 0 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, dt.options.errorBodyLimit))
+		statusErr.body = strings.Join(strings.Fields(string(body)), " ")
+	}
+	return nil, statusErr
+}
+
+// plannedName returns the file name the task is expected to save as before
+// any request is made: the explicit output name, the name in the URL path,
+// or else --default-name, as for the response.
+func (dt *downloadTask) plannedName() (string, error) {
+	if dt.outputName != "" {
+		return dt.outputName, nil
+	}
+	fileName, err := filenameFromURL(dt.downloadURL, dt.options.keepEncodedNames)
+	if err == ErrMissingFilename && dt.options.defaultName != "" {
+		if parsed, parseErr := url.Parse(dt.downloadURL); parseErr == nil {
+			return platformFileName(dt.options.defaultFilename(parsed.Hostname())), nil
+		}
+	}
+	return fileName, err
 }
 
 // start begins the download task.
@@ -56,14 +426,12 @@ func (dt *downloadTask) start() {
 		if err := recover(); err != nil {
 			switch e := err.(type) {
 			case string:
-				dt.error = errors.New(e)
+				dt.finish(errors.New(e))
 			case error:
-				dt.error = e
+				dt.finish(e)
 			default:
-				dt.error = errors.New("unknown panic occurred")
+				dt.finish(errors.New("unknown panic occurred"))
 			}
-			close(dt.completionChan)
-			dt.endTime = time.Now()
 		}
 	}()
 
@@ -72,84 +440,389 @@ func (dt *downloadTask) start() {
 	var fileName string
 	var fileInfo os.FileInfo
 
+	dt.spanID, dt.spanStart = dt.options.tracer.newSpanID(), time.Now()
+	if dt.options.taskLogDir != "" {
+		logFile, err := dt.openTaskLog(dt.options.taskLogDir)
+		if err != nil {
+			dt.finish(err)
+			return
+		}
+		dt.log = logFile
+	}
+
+	if dt.uploadFile != "" {
+		dt.finish(dt.upload())
+		return
+	}
+	if dt.updateFile != "" {
+		dt.finish(dt.update())
+		return
+	}
+
+	// Skip the request entirely when the file named by the URL is already
+	// present with the checksum listed in --sums.
+	if urlName, err := dt.plannedName(); err == nil && dt.checksumMatches(filepath.Join(dt.outputDir, urlName)) {
+		dt.fileName = filepath.Join(dt.outputDir, urlName)
+		dt.finish(errAlreadyDownloaded)
+		return
+	}
+
+	client := dt.httpClient()
+	if dt.options.release != nil && dt.expectedSum == "" {
+		expectedSum, err := dt.releaseSum(client)
+		if err != nil {
+			dt.finish(err)
+			return
+		}
+		dt.expectedSum = expectedSum
+	}
+	if dt.options.autoVerify && dt.expectedSum == "" && !dt.listedInSums() {
+		if err := dt.discoverChecksum(client); err != nil {
+			dt.finish(err)
+			return
+		}
+	}
+	if dt.options.ifSizeDiffers && dt.options.form == nil {
+		if unchanged, err := dt.sizeUnchanged(client); err != nil || unchanged {
+			if err == nil {
+				err = errAlreadyDownloaded
+			}
+			dt.finish(err)
+			return
+		}
+	}
+
 	// Create HTTP request
-	request, _ := http.NewRequest("GET", dt.downloadURL, nil)
-	if dt.headers != nil {
-		for key, value := range dt.headers {
-			request.Header.Set(key, value)
+	request, err := dt.newDownloadRequest()
+	if err != nil {
+		dt.finish(err)
+		return
+	}
+
+	response, err := dt.do(client, request)
+	if err == nil {
+		request, response, err = dt.followInterstitial(client, request, response)
+	}
+	if dt.options.notNewer(response, err) {
+		if err == nil {
+			response.Body.Close()
 		}
+		dt.finish(errNotModified)
+		return
+	}
+	if err != nil {
+		dt.finish(err)
+		return
 	}
+	dt.setRanges(rangeSupportOf(response))
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-		},
+	if dt.options.metered.holdBack(response.ContentLength) {
+		response.Body.Close()
+		if err = dt.waitUnmetered(); err == nil {
+			response, err = dt.do(client, request)
+		}
+		if err != nil {
+			dt.finish(err)
+			return
+		}
+	}
+	dt.applyMeteredLimit()
+
+	if fileName = dt.outputName; fileName == "" {
+		fileName, err = dt.outputFilename(response)
+	}
+	if err == nil {
+		if err = dt.options.checkOutputPath(filepath.Join(dt.outputDir, fileName)); err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
 	}
-	response, err := client.Do(request)
-	if err != nil || (response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent) {
-		dt.error = fmt.Errorf("HTTP request failed with status: %d", response.StatusCode)
-		close(dt.completionChan)
-		dt.endTime = time.Now()
+	if err == nil && dt.outputDir != "" {
+		if err = os.MkdirAll(longPath(dt.outputDir), 0755); err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
+		fileName = filepath.Join(dt.outputDir, fileName)
+	}
+	if err == nil {
+		claimed := dt.options.names.claim(dt, fileName)
+		if claimed != fileName {
+			dt.renamedFrom = fileName
+		}
+		fileName = longPath(claimed)
+	}
+
+	// --sums lists a renamed download under the name it asked for.
+	if dt.expectedSum == "" {
+		listedName := fileName
+		if dt.renamedFrom != "" {
+			listedName = dt.renamedFrom
+		}
+		dt.expectedSum = dt.options.checksums[filepath.Base(listedName)]
+	}
+	if dt.expectedSum == "" && dt.options.reproducible {
+		response.Body.Close()
+		dt.finish(&verifyError{fileName: fileName, err: errUnpinned})
+		return
+	}
+	if dt.expectedSum != "" && dt.checksumMatches(fileName) {
+		response.Body.Close()
+		dt.fileName = fileName
+		dt.finish(errAlreadyDownloaded)
 		return
 	}
+	if err == nil {
+		if err = dt.guardHTML(response, fileName); err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
+	}
+
+	if err == nil && dt.options.compress != "" && !dt.options.discard {
+		fileName += compressionExtensions[dt.options.compress]
+	}
+	if err == nil && dt.options.recipient != nil && !dt.options.discard {
+		fileName += ".age"
+	}
+
+	// Under --all-or-nothing the file is downloaded into the staging area,
+	// and only moved to fileName once the whole batch has succeeded.
+	if err == nil && dt.options.staging != nil && !dt.options.discard {
+		dt.finalName = fileName
+		if fileName, err = dt.options.staging.stage(fileName); err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
+	}
 
-	fileName, err = extractFilename(response)
+	// A file already in the --cache is copied rather than downloaded again.
+	if dt.options.cache != nil && !dt.options.discard && !dt.options.streamsOutput() && dt.options.form == nil {
+		hit, err := dt.fromCache(response, fileName)
+		if err != nil {
+			transportLog.Warn("copying from cache failed, downloading", "url", dt.downloadURL, "error", err)
+		} else if hit {
+			response.Body.Close()
+			dt.finish(dt.scan(dt.verify(dt.endPipe(client, io.EOF))))
+			return
+		}
+	}
 
+	// Under --dedupe, a file another download of the batch is already
+	// fetching is copied from it once it's done, rather than fetched twice.
+	if entry := dt.options.dedupe.claim(dt, response); entry != nil {
+		response.Body.Close()
+		hit, err := dt.fromDuplicate(entry, fileName)
+		if err != nil {
+			dt.finish(err)
+			return
+		}
+		if hit {
+			dt.finish(dt.scan(dt.verify(dt.endPipe(client, io.EOF))))
+			return
+		}
+		if response, err = dt.do(client, request); err != nil {
+			dt.finish(err)
+			return
+		}
+	}
+
+	// Under --resume-from, the partial file from another URL is checked
+	// against this one and moved into place to be resumed.
+	if dt.options.resumeFrom != "" {
+		if err = dt.adoptResumeFrom(client, request, fileName, response.ContentLength); err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
+	}
+
+	// Under --zsync, a file already at fileName is brought up to date by
+	// downloading only the blocks of it that changed. Without one, the file
+	// is downloaded as usual.
+	if dt.options.zsync {
+		seed := fileName
+		if dt.finalName != "" {
+			seed = dt.finalName
+		}
+		if fileInfo, statErr := os.Stat(seed); statErr == nil && fileInfo.Mode().IsRegular() {
+			response.Body.Close()
+			go dt.monitorSpeed()
+			dt.startTime = time.Now()
+			dt.fileName = fileName
+			if err = dt.zsyncUpdate(client, request, seed, fileName, response.ContentLength); err != nil {
+				dt.finish(err)
+				return
+			}
+			dt.finish(dt.scan(dt.verify(io.EOF)))
+			return
+		}
+	}
+
+	// A form submission's response can't be requested again from an offset,
+	// and a compressed or encrypted file can't be continued, so they are
+	// always downloaded in full.
+	if dt.options.adoptPartials && !dt.options.discard && dt.options.form == nil && !dt.options.streamsOutput() {
+		if err = adoptAria2(fileName); err == nil {
+			err = adoptPartial(fileName, response.ContentLength)
+		}
+		if err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
+	}
+
+	// Under --if-size-differs, a file of another size is out of date, so it
+	// is replaced rather than resumed.
 	fileInfo, err = os.Stat(fileName)
-	if err == nil {
-		if !fileInfo.IsDir() {
+	if err == nil && !dt.options.discard && dt.options.form == nil && !dt.options.streamsOutput() && !dt.options.ifSizeDiffers {
+		// A listed file whose checksum didn't match is only resumed if it's
+		// shorter than the remote one; otherwise it's downloaded again.
+		if !fileInfo.IsDir() && (dt.expectedSum == "" || fileInfo.Size() < response.ContentLength) {
 			response.Body.Close()
 			if fileInfo.Size() == response.ContentLength {
-				dt.error = errors.New("file already downloaded")
-				close(dt.completionChan)
-				dt.endTime = time.Now()
+				dt.finish(errAlreadyDownloaded)
 				return
 			}
 			request.Header.Set("Range", fmt.Sprintf("bytes=%d-", fileInfo.Size()))
-			response, err = client.Do(request)
-			if err != nil || (response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent) {
-				dt.error = fmt.Errorf("HTTP request failed with status: %d", response.StatusCode)
-				close(dt.completionChan)
-				dt.endTime = time.Now()
+			response, err = dt.do(client, request)
+			if err != nil {
+				dt.finish(err)
 				return
 			}
-			if response.Header.Get("Accept-Ranges") == "bytes" || response.Header.Get("Content-Range") != "" {
+			// A server that ignores the range sends the whole file with a
+			// 200, which must replace the partial file rather than extend it.
+			if response.StatusCode == http.StatusPartialContent {
+				dt.setRanges(rangesSupported)
 				destinationFile, err = os.OpenFile(fileName, os.O_RDWR, 0666)
 				if err != nil {
-					close(dt.completionChan)
-					dt.endTime = time.Now()
+					dt.finish(err)
 					return
 				}
 				destinationFile.Seek(0, os.SEEK_END)
 				dt.bytesRead = fileInfo.Size()
 				dt.isResumable = true
+			} else {
+				dt.setRanges(rangesUnsupported)
+				// Under --resume-unsafe the fresh stream is trusted to
+				// start with the bytes already on disk, which are read and
+				// dropped rather than written again.
+				if dt.options.resumeUnsafe {
+					if err = dt.skipPrefix(response.Body, fileInfo.Size()); err != nil {
+						response.Body.Close()
+						dt.finish(err)
+						return
+					}
+					destinationFile, err = os.OpenFile(fileName, os.O_RDWR, 0666)
+					if err != nil {
+						response.Body.Close()
+						dt.finish(err)
+						return
+					}
+					destinationFile.Seek(0, os.SEEK_END)
+					dt.bytesRead = fileInfo.Size()
+					dt.isResumable = true
+				}
 			}
 		}
 	}
 
-	if destinationFile == nil {
+	var output outputFile = destinationFile
+	if dt.options.discard {
+		output = discardOutput{}
+	} else if dt.options.splitSize > 0 {
+		dt.parts = newSplitOutput(fileName, dt.options.splitSize)
+		output = dt.parts
+	} else if dt.options.mux != nil {
+		if output, err = dt.options.mux.open(dt, fileName, response.ContentLength); err != nil {
+			response.Body.Close()
+			dt.finish(err)
+			return
+		}
+	} else if destinationFile == nil {
 		destinationFile, err = os.Create(fileName)
 		if err != nil {
-			close(dt.completionChan)
-			dt.endTime = time.Now()
+			dt.finish(err)
+			return
+		}
+		output = destinationFile
+	}
+	if dt.options.directIO && !dt.options.discard {
+		if output, err = newDirectOutput(destinationFile); err != nil {
+			destinationFile.Close()
+			dt.finish(err)
 			return
 		}
 	}
 
-	dt.destination = destinationFile
-	dt.source = response.Body
+	// The download is compressed before it is encrypted, as encrypted data
+	// doesn't compress.
+	if dt.options.recipient != nil && !dt.options.discard {
+		encrypted, err := newEncryptedOutput(output, dt.options.recipient)
+		if err != nil {
+			output.Close()
+			dt.finish(err)
+			return
+		}
+		output = encrypted
+	}
+	if dt.options.compress != "" && !dt.options.discard {
+		compressed, err := newCompressedOutput(output, dt.options.compress, &dt.compressed)
+		if err != nil {
+			output.Close()
+			dt.finish(err)
+			return
+		}
+		output = compressed
+	}
+
+	dt.destination = output
+	dt.source = dt.guardStall(response.Body)
 	dt.fileName = fileName
-	if response.ContentLength > 0 && dt.isResumable && fileInfo != nil {
+	if response.ContentLength > 0 && dt.isResumable && fileInfo != nil && response.StatusCode == http.StatusPartialContent {
 		dt.totalFileSize = response.ContentLength + fileInfo.Size()
 	} else {
 		dt.totalFileSize = response.ContentLength
 	}
+	sentSize := dt.totalFileSize
+	if dt.totalFileSize <= 0 {
+		dt.totalFileSize = dt.options.expectedSize(dt.downloadURL)
+	}
 
 	go dt.monitorSpeed()
 
 	dt.startTime = time.Now()
 
+	// Discarded downloads can only be verified while streaming, so they aren't
+	// segmented, and neither are those from servers that get ranges wrong.
+	if dt.options.autoSegments && !dt.isResumable && dt.options.form == nil && dt.options.pipeTo == "" && !dt.options.directIO && !dt.options.streamsOutput() && canAutoSegment(response) && !(dt.options.discard && dt.expectedSum != "") && dt.checkRanges(client, request, response.ContentLength) {
+		dt.finish(dt.scan(dt.verify(dt.closeOutput(dt.downloadSegmented(client, request, response, output)))))
+		return
+	}
+
+	if (dt.expectedSum != "" || dt.options.scanCmd != "") && !dt.isResumable {
+		dt.hasher = sha256.New()
+	}
+	if dt.options.pieceLength > 0 && !dt.isResumable {
+		dt.pieces = newPieceHasher(dt.options.pieceLength, dt.options.pieceAlgorithm)
+	}
+	if err = dt.startPipe(client, sentSize); err != nil {
+		response.Body.Close()
+		dt.finish(dt.closeOutput(err))
+		return
+	}
+
 	for {
+		if err = dt.checkBattery(client, request); err != nil {
+			break
+		}
+		if err = dt.pipe.failure(); err != nil {
+			break
+		}
 		if dt.rateLimiter.limit > 0 {
 			dt.rateLimiter.wait(dt.bytesRead)
 		}
@@ -157,21 +830,31 @@ func (dt *downloadTask) start() {
 		bytesRead, err = dt.source.Read(dt.buffer)
 		if bytesRead > 0 {
 			bytesWritten, err = dt.destination.Write(dt.buffer[:bytesRead])
-			if err != nil || bytesRead != bytesWritten {
-				dt.error = io.ErrShortWrite
+			if err == nil && bytesRead != bytesWritten {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
 				break
 			}
+			if dt.hasher != nil {
+				dt.hasher.Write(dt.buffer[:bytesRead])
+			}
+			if dt.pieces != nil {
+				dt.pieces.Write(dt.buffer[:bytesRead])
+			}
 			atomic.AddInt64(&dt.bytesRead, int64(bytesRead))
+			dt.waitBudgets(bytesRead)
 		}
 
 		if err != nil {
+			if err != io.EOF && dt.resumeAfterOutage(client, request) {
+				continue
+			}
 			break
 		}
 	}
 
-	dt.error = err
-	close(dt.completionChan)
-	dt.endTime = time.Now()
+	dt.finish(dt.scan(dt.verify(dt.endPipe(client, dt.closeOutput(err)))))
 }
 
 // monitorSpeed calculates the download speed periodically.
@@ -208,13 +891,46 @@ func (dt *downloadTask) getSpeedString() string {
 	return humanReadableSize(int64(dt.bytesPerSecond))
 }
 
-// getETAString calculates and returns the estimated time remaining as a string.
-func (dt *downloadTask) getETAString() string {
+// longETA is the remaining time from which the ETA also shows the time of
+// day the download should finish, which is easier to plan around.
+const longETA = 10 * time.Minute
+
+// remainingTime estimates how long the download has left at the current
+// speed, reporting false if the size or speed is unknown.
+func (dt *downloadTask) remainingTime() (time.Duration, bool) {
 	dt.mutex.Lock()
 	defer dt.mutex.Unlock()
-	if dt.totalFileSize == 0 || dt.bytesPerSecond == 0 {
-		return "N/A"
+	if dt.totalFileSize <= 0 || dt.bytesPerSecond < 1 {
+		return 0, false
 	}
 	remainingTime := (dt.totalFileSize - dt.getBytesRead()) / int64(dt.bytesPerSecond)
-	return durationToString(remainingTime)
+	if remainingTime < 0 {
+		remainingTime = 0
+	}
+	return time.Duration(remainingTime) * time.Second, true
+}
+
+// getETAString calculates and returns the estimated time remaining as a
+// string, followed for long downloads by when it should be done, e.g.
+// "1h12m 5s done ~14:32".
+func (dt *downloadTask) getETAString() string {
+	remaining, ok := dt.remainingTime()
+	if !ok {
+		return tr("N/A")
+	}
+	eta := durationToString(int64(remaining / time.Second))
+	if remaining >= longETA {
+		eta += " " + trf("done ~%s", clockTime(time.Now().Add(remaining)))
+	}
+	return eta
+}
+
+// clockTime formats a time of day in the next few days for the progress
+// display, with the weekday if it isn't today.
+func clockTime(t time.Time) string {
+	now := time.Now()
+	if t.Year() == now.Year() && t.YearDay() == now.YearDay() {
+		return t.Format("15:04")
+	}
+	return t.Format("Mon 15:04")
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// taskLog writes one JSON object per line describing what happened to a
+// single task. A nil taskLog discards everything, so call sites don't need to
+// check whether --task-logs is set.
+type taskLog struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+}
+
+// taskLogCount numbers the log files in the order the tasks start.
+var taskLogCount int64
+
+// openTaskLog creates the log file for a task in dir, named after the file
+// the task downloads, e.g. "007-dataset.zip.log".
+func (dt *downloadTask) openTaskLog(dir string) (*taskLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name, err := dt.plannedName()
+	if err != nil {
+		if parsed, err := url.Parse(dt.downloadURL); err == nil {
+			name = parsed.Host
+		}
+	}
+	logName := fmt.Sprintf("%03d-%s.log", atomic.AddInt64(&taskLogCount, 1), filepath.Base(name))
+	file, err := os.Create(filepath.Join(dir, logName))
+	if err != nil {
+		return nil, err
+	}
+	return &taskLog{file: file, encoder: json.NewEncoder(file), start: time.Now()}, nil
+}
+
+// event appends a log line with the given fields.
+func (tl *taskLog) event(name string, fields map[string]interface{}) {
+	if tl == nil {
+		return
+	}
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.file == nil {
+		return
+	}
+
+	line := map[string]interface{}{
+		"time":    time.Now().Format(time.RFC3339Nano),
+		"elapsed": time.Since(tl.start).Round(time.Millisecond).String(),
+		"event":   name,
+	}
+	for key, value := range fields {
+		line[key] = value
+	}
+	tl.encoder.Encode(line)
+}
+
+// close closes the log file; later events are dropped.
+func (tl *taskLog) close() {
+	if tl == nil {
+		return
+	}
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.file != nil {
+		tl.file.Close()
+		tl.file = nil
+	}
+}
+
+// finishStatus describes how the task finished: "ok", "skipped", "canceled"
+// or "failed", with the error for the last two.
+func (dt *downloadTask) finishStatus(err error) (string, error) {
+	switch {
+	case err == nil || err == io.EOF:
+		return "ok", nil
+	case err == errAlreadyDownloaded, err == errNotModified:
+		return "skipped", nil
+	case dt.canceled():
+		return "canceled", err
+	}
+	return "failed", err
+}
+
+// logFinish records the task's final status, with the headers of the last
+// response it received, and closes its log.
+func (dt *downloadTask) logFinish(err error) {
+	status, err := dt.finishStatus(err)
+	fields := map[string]interface{}{
+		"status": status,
+		"file":   dt.fileName,
+		"bytes":  dt.getBytesRead(),
+	}
+	if !dt.startTime.IsZero() {
+		fields["transfer"] = time.Since(dt.startTime).Round(time.Millisecond).String()
+		if dt.totalFileSize <= 0 {
+			fields["size"] = "unknown"
+		}
+	}
+	if response := dt.getLastResponse(); response != nil {
+		fields["headers"] = response.Header
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	dt.log.event("finish", fields)
+	dt.log.close()
+}
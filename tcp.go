@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"time"
+)
+
+// tcpOptions tunes the sockets used for downloads, mainly for long fat
+// networks where the default receive buffer caps throughput.
+type tcpOptions struct {
+	noDelay    bool         // Disable Nagle's algorithm (Go's default)
+	readBuffer int          // SO_RCVBUF size in bytes, 0 for the system default
+	congestion string       // Congestion control algorithm, e.g. "bbr" (Linux only)
+	sources    *sourceAddrs // Local addresses to connect from, nil for the system's choice
+}
+
+// validate checks that the options are supported on this platform.
+func (tcp tcpOptions) validate() error {
+	if tcp.readBuffer < 0 {
+		return errors.New("--tcp-read-buffer must not be negative")
+	}
+	if tcp.congestion != "" && runtime.GOOS != "linux" {
+		return errors.New("--tcp-congestion is only supported on Linux")
+	}
+	return nil
+}
+
+// dialContext returns a dial function applying the options to every connection.
+func (tcp tcpOptions) dialContext() func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   tcp.control,
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialer := dialer
+		if source := tcp.sources.pick(); source != nil {
+			// Copied, as connections are dialed concurrently.
+			bound := *dialer
+			bound.LocalAddr = source
+			dialer = &bound
+		}
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := tcp.tune(tcpConn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+// tune applies the options that can be set on an established connection.
+func (tcp tcpOptions) tune(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(tcp.noDelay); err != nil {
+		return err
+	}
+	if tcp.readBuffer > 0 && !readBufferBeforeConnect {
+		return conn.SetReadBuffer(tcp.readBuffer)
+	}
+	return nil
+}
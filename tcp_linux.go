@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// readBufferBeforeConnect is true when control sets SO_RCVBUF before the
+// handshake, which lets the kernel advertise a large enough window scale.
+const readBufferBeforeConnect = true
+
+// control sets socket options that must be applied before connecting.
+func (tcp tcpOptions) control(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		if tcp.readBuffer > 0 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, tcp.readBuffer); sockErr != nil {
+				return
+			}
+		}
+		if tcp.congestion != "" {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, tcp.congestion)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// readBufferBeforeConnect is false on platforms where the receive buffer is
+// only set once the connection is established.
+const readBufferBeforeConnect = false
+
+// control sets socket options that must be applied before connecting. There
+// are none outside Linux.
+func (tcp tcpOptions) control(network, address string, conn syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes, from the OpenTelemetry protocol.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusCodeError  = 2
+)
+
+// span is a finished OpenTelemetry span.
+type span struct {
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start, end time.Time
+	attributes map[string]string
+	err        string
+}
+
+// tracer collects the spans of a batch, all in one trace under a root
+// "gograb" span, and exports them over OTLP/HTTP when the batch is done. A nil
+// tracer records nothing, so call sites don't need to check whether tracing is
+// enabled.
+type tracer struct {
+	mutex    sync.Mutex
+	endpoint string // OTLP/HTTP traces URL
+	traceID  string
+	rootID   string // ID of the batch span
+	parentID string // Span of the calling process, from TRACEPARENT
+	start    time.Time
+	spans    []span
+}
+
+// newTracer creates a tracer exporting to the OTLP/HTTP collector at endpoint,
+// e.g. http://localhost:4318, or returns nil if endpoint is empty. When gograb
+// runs inside a traced build, the W3C TRACEPARENT environment variable makes
+// the batch part of the caller's trace.
+func newTracer(endpoint string) *tracer {
+	if endpoint == "" {
+		return nil
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	t := &tracer{endpoint: endpoint, traceID: randomID(16), rootID: randomID(8), start: time.Now()}
+
+	// traceparent: version-traceid-parentid-flags
+	if parts := strings.Split(os.Getenv("TRACEPARENT"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		t.traceID, t.parentID = parts[1], parts[2]
+	}
+	return t
+}
+
+// randomID returns n random bytes in hex, for trace and span IDs.
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// newSpanID returns an ID for a span that will be recorded later, so that its
+// children can refer to it, or "" when tracing is disabled.
+func (t *tracer) newSpanID() string {
+	if t == nil {
+		return ""
+	}
+	return randomID(8)
+}
+
+// record adds a finished span.
+func (t *tracer) record(s span) {
+	if t == nil {
+		return
+	}
+	if s.spanID == "" {
+		s.spanID = randomID(8)
+	}
+	if s.parentID == "" {
+		s.parentID = t.rootID
+	}
+	t.mutex.Lock()
+	t.spans = append(t.spans, s)
+	t.mutex.Unlock()
+}
+
+// export sends the collected spans, together with the batch span, to the collector.
+func (t *tracer) export() error {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	spans := append(t.spans, span{spanID: t.rootID, parentID: t.parentID, name: "gograb", kind: spanKindInternal, start: t.start, end: time.Now()})
+	t.spans = nil
+	t.mutex.Unlock()
+
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           t.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parentID != "" {
+			otlpSpan["parentSpanId"] = s.parentID
+		}
+		if s.err != "" {
+			otlpSpan["status"] = map[string]interface{}{"code": statusCodeError, "message": s.err}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": "gograb"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "gograb"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	response, err := http.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("exporting traces: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("exporting traces: %s", response.Status)
+	}
+	return nil
+}
+
+// otlpAttributes converts string attributes to OTLP key/value pairs.
+func otlpAttributes(attributes map[string]string) []interface{} {
+	pairs := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		pairs = append(pairs, map[string]interface{}{
+			"key":   key,
+			"value": map[string]string{"stringValue": value},
+		})
+	}
+	return pairs
+}
+
+// withTrace attaches a client trace to the request that records the
+// resolve, connect and TLS phases of new connections as spans under parentID.
+func (t *tracer) withTrace(request *http.Request, parentID string) *http.Request {
+	if t == nil {
+		return request
+	}
+	var dnsStart, tlsStart time.Time
+	var connectMutex sync.Mutex
+	connectStarts := make(map[string]time.Time)
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			s := span{parentID: parentID, name: "resolve", kind: spanKindClient, start: dnsStart, end: time.Now(),
+				attributes: map[string]string{"net.peer.name": request.URL.Hostname()}}
+			if info.Err != nil {
+				s.err = info.Err.Error()
+			}
+			t.record(s)
+		},
+		// Dual-stack dialing may try several addresses at once.
+		ConnectStart: func(network, addr string) {
+			connectMutex.Lock()
+			connectStarts[network+addr] = time.Now()
+			connectMutex.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			connectMutex.Lock()
+			start := connectStarts[network+addr]
+			connectMutex.Unlock()
+			s := span{parentID: parentID, name: "connect", kind: spanKindClient, start: start, end: time.Now(),
+				attributes: map[string]string{"net.peer.address": addr, "net.transport": network}}
+			if err != nil {
+				s.err = err.Error()
+			}
+			t.record(s)
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			s := span{parentID: parentID, name: "tls", kind: spanKindClient, start: tlsStart, end: time.Now(),
+				attributes: map[string]string{"tls.version": tls.VersionName(state.Version)}}
+			if err != nil {
+				s.err = err.Error()
+			}
+			t.record(s)
+		},
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
+
+// traceFinish records the task's download span, and its transfer span if the
+// body was read.
+func (dt *downloadTask) traceFinish(err error) {
+	tracer := dt.options.tracer
+	if tracer == nil || dt.spanID == "" {
+		return
+	}
+	now := time.Now()
+	status, err := dt.finishStatus(err)
+	if !dt.startTime.IsZero() {
+		tracer.record(span{parentID: dt.spanID, name: "transfer", kind: spanKindInternal, start: dt.startTime, end: now,
+			attributes: map[string]string{"bytes": strconv.FormatInt(dt.getBytesRead(), 10)}})
+	}
+	s := span{spanID: dt.spanID, name: "download", kind: spanKindInternal, start: dt.spanStart, end: now,
+		attributes: map[string]string{"url.full": dt.downloadURL, "file": dt.fileName, "status": status}}
+	if err != nil {
+		s.err = err.Error()
+	}
+	tracer.record(s)
+}
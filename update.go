@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// updateCommand patches a local file into the version at a URL, as a
+// download task that only fetches the blocks that differ.
+var updateCommand = cli.Command{
+	Name:      "update",
+	Usage:     "Update a local file to the version at a URL, downloading only the blocks that changed",
+	ArgsUsage: "<old-file> <[rate limit:]url>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "blockmap",
+			Value: defaultPipePieces,
+		},
+	},
+	Action: updateAction,
+}
+
+// updateAction updates the file with the global options, so headers,
+// credentials, retries and the rate limit prefix work as they do for
+// downloads.
+func updateAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("usage: gograb update [--blockmap url] <old-file> <[rate limit:]url>", exitUsageError)
+	}
+	fileName := c.Args().Get(0)
+	if fileInfo, err := os.Stat(fileName); err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	} else if !fileInfo.Mode().IsRegular() {
+		return cli.NewExitError(fmt.Sprintf("%s is not a regular file", fileName), exitUsageError)
+	}
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	task, err := newDownloadTask(ctx, c.Args().Get(1), options)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+	}
+	task.updateFile = fileName
+	task.blockMap = c.String("blockmap")
+	return runBatch(ctx, cancel, c, []*downloadTask{task})
+}
+
+// update patches the task's update file in place into the file at its URL.
+// The block map is a piece manifest, as --piece-hashes writes it: each piece
+// of the local file whose hash differs from the map's is downloaded with a
+// range request and written over it, runs of them in one request, and then
+// checked against the map. The bytes downloaded are the task's progress.
+// Pieces already patched match the map, so an update that is interrupted
+// picks up where it stopped when run again.
+func (dt *downloadTask) update() error {
+	dt.fileName = dt.updateFile
+	client := dt.httpClient()
+	manifest, err := dt.fetchPieceManifest(client, dt.blockMap)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dt.updateFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stale, err := manifest.stalePieces(file)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 && fileInfo.Size() == manifest.Size {
+		return errAlreadyDownloaded
+	}
+
+	// Runs of stale pieces are fetched together, as [start, end) ranges.
+	var ranges [][2]int64
+	var total int64
+	for _, i := range stale {
+		start := int64(i) * manifest.PieceLength
+		end := start + manifest.PieceLength
+		if end > manifest.Size {
+			end = manifest.Size
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == start {
+			ranges[n-1][1] = end
+		} else {
+			ranges = append(ranges, [2]int64{start, end})
+		}
+		total += end - start
+	}
+	transportLog.Info("updating from the block map", "url", dt.downloadURL, "file", dt.updateFile, "pieces", len(stale), "of", len(manifest.Pieces), "download", total)
+	dt.log.event("update", map[string]interface{}{"pieces": len(stale), "download": total})
+	dt.totalFileSize = total
+	go dt.monitorSpeed()
+	dt.startTime = time.Now()
+
+	request, err := dt.newDownloadRequest()
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, len(dt.buffer))
+	for _, r := range ranges {
+		if err := dt.patchRange(client, request, file, manifest.Size, r[0], r[1], buffer); err != nil {
+			return err
+		}
+	}
+	if err := file.Truncate(manifest.Size); err != nil {
+		return err
+	}
+
+	if stale, err = manifest.stalePieces(file); err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		return &verifyError{fileName: dt.updateFile, err: fmt.Errorf("%w: piece %d of %d doesn't match the block map after updating", ErrChecksumMismatch, stale[0]+1, len(manifest.Pieces))}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// patchRange downloads the bytes from start up to end of the file at the
+// task's URL, size bytes long, and writes them over the file.
+func (dt *downloadTask) patchRange(client *http.Client, request *http.Request, file *os.File, size, start, end int64, buffer []byte) error {
+	rangeRequest := request.Clone(dt.ctx)
+	rangeRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	response, err := dt.do(client, rangeRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("gograb update needs range requests, which %s answered with %s", dt.downloadURL, response.Status)
+	}
+	// A server whose file isn't the one the block map is for sends another
+	// size here.
+	if contentRange, want := response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", start, end-1, size); contentRange != want {
+		return fmt.Errorf("%s sent %q for %q: the block map isn't for this file", dt.downloadURL, contentRange, want)
+	}
+	return dt.copyRange(response.Body, file, start, end, buffer)
+}
+
+// stalePieces returns the pieces of file that don't match the manifest,
+// including those past its end.
+func (manifest *pieceManifest) stalePieces(file *os.File) ([]int, error) {
+	var stale []int
+	buffer := make([]byte, manifest.PieceLength)
+	for i := range manifest.Pieces {
+		offset := int64(i) * manifest.PieceLength
+		piece := buffer
+		if remaining := manifest.Size - offset; remaining < int64(len(piece)) {
+			piece = piece[:remaining]
+		}
+		n, err := file.ReadAt(piece, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n < len(piece) || !manifest.pieceMatches(i, piece) {
+			stale = append(stale, i)
+		}
+	}
+	return stale, nil
+}
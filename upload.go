@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// putCommand uploads a local file, as a download task running the other way.
+var putCommand = cli.Command{
+	Name:      "put",
+	Usage:     "Upload a file to a URL with progress, rate limiting and retries",
+	ArgsUsage: "<file> <[rate limit:]url>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "method",
+			Value: "PUT",
+		},
+		cli.StringFlag{
+			Name: "content-type",
+		},
+	},
+	Action: putAction,
+}
+
+// putAction uploads the file with the global options, so headers,
+// credentials, retries and the rate limit prefix work as they do for
+// downloads.
+func putAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("usage: gograb put [--method PUT|POST] [--content-type type] <file> <[rate limit:]url>", exitUsageError)
+	}
+	method := strings.ToUpper(c.String("method"))
+	if method != http.MethodPut && method != http.MethodPost {
+		return cli.NewExitError(fmt.Sprintf("invalid --method %q: must be PUT or POST", c.String("method")), exitUsageError)
+	}
+	fileName := c.Args().Get(0)
+	if fileInfo, err := os.Stat(fileName); err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	} else if !fileInfo.Mode().IsRegular() {
+		return cli.NewExitError(fmt.Sprintf("%s is not a regular file", fileName), exitUsageError)
+	}
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	task, err := newDownloadTask(ctx, c.Args().Get(1), options)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+	}
+	task.uploadFile = fileName
+	task.uploadMethod = method
+	task.uploadType = c.String("content-type")
+	return runBatch(ctx, cancel, c, []*downloadTask{task})
+}
+
+// upload sends the task's upload file to its URL. The bytes sent are the
+// task's progress, and the rate limit applies to them, so the task line shows
+// an upload like a download. The response body is discarded: its status alone
+// decides whether the upload succeeded.
+func (dt *downloadTask) upload() error {
+	fileInfo, err := os.Stat(dt.uploadFile)
+	if err != nil {
+		return err
+	}
+	dt.fileName = dt.uploadFile
+	dt.totalFileSize = fileInfo.Size()
+
+	request, err := dt.newRequest(dt.uploadMethod)
+	if err != nil {
+		return err
+	}
+	if dt.uploadType != "" {
+		request.Header.Set("Content-Type", dt.uploadType)
+	} else if request.Header.Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(filepath.Ext(dt.uploadFile))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		request.Header.Set("Content-Type", contentType)
+	}
+	if fileInfo.Size() > 0 {
+		request.ContentLength = fileInfo.Size()
+		request.GetBody = func() (io.ReadCloser, error) {
+			file, err := os.Open(dt.uploadFile)
+			if err != nil {
+				return nil, err
+			}
+			atomic.StoreInt64(&dt.bytesRead, 0)
+			return &uploadReader{file: file, task: dt}, nil
+		}
+	}
+
+	go dt.monitorSpeed()
+	dt.startTime = time.Now()
+
+	response, err := dt.do(dt.httpClient(), request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return io.EOF
+}
+
+// uploadReader reads an upload file at the task's rate limit, counting the
+// bytes read as the task's progress.
+type uploadReader struct {
+	file *os.File
+	task *downloadTask
+}
+
+func (ur *uploadReader) Read(p []byte) (int, error) {
+	if ur.task.rateLimiter.limit > 0 {
+		ur.task.rateLimiter.wait(ur.task.getBytesRead())
+	}
+	n, err := ur.file.Read(p)
+	atomic.AddInt64(&ur.task.bytesRead, int64(n))
+	return n, err
+}
+
+func (ur *uploadReader) Close() error {
+	return ur.file.Close()
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"mime"
 	"net/http"
+	"net/url"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -21,8 +23,45 @@ const (
 	Terabyte = 1024 * Gigabyte
 )
 
-// humanReadableSize formats bytes into a human-readable string.
+// sizeUnits is how sizes are displayed: "binary" for 1024-based units, the
+// default, "si" for 1000-based units with --si, or "bytes" for the raw count
+// with --bytes.
+var sizeUnits = "binary"
+
+// setSizeUnits chooses how sizes are displayed from --si and --bytes.
+func setSizeUnits(si, bytes bool) error {
+	switch {
+	case si && bytes:
+		return errors.New("--si and --bytes can't be combined")
+	case si:
+		sizeUnits = "si"
+	case bytes:
+		sizeUnits = "bytes"
+	default:
+		sizeUnits = "binary"
+	}
+	return nil
+}
+
+// sizeWidth returns the width humanReadableSize pads sizes to, so that they
+// line up in columns: 8 for sizes in units, or with --bytes enough for
+// counts up to 99TB.
+func sizeWidth() int {
+	if sizeUnits == "bytes" {
+		return 19
+	}
+	return 8
+}
+
+// humanReadableSize formats bytes into a human-readable string, padded to
+// sizeWidth.
 func humanReadableSize(size int64) string {
+	switch sizeUnits {
+	case "si":
+		return decimalSize(size)
+	case "bytes":
+		return fmt.Sprintf("%*s", sizeWidth(), groupDigits(size)+"B")
+	}
 	switch {
 	case size >= Terabyte:
 		return fmt.Sprintf("%6.2fTB", float64(size)/Terabyte)
@@ -37,6 +76,41 @@ func humanReadableSize(size int64) string {
 	}
 }
 
+// decimalSize formats bytes in SI units, where 1MB is 10^6 bytes, as network
+// speeds are quoted.
+func decimalSize(size int64) string {
+	switch {
+	case size >= 1e12:
+		return fmt.Sprintf("%6.2fTB", float64(size)/1e12)
+	case size >= 1e9:
+		return fmt.Sprintf("%6.2fGB", float64(size)/1e9)
+	case size >= 1e6:
+		return fmt.Sprintf("%6.2fMB", float64(size)/1e6)
+	case size >= 1e3:
+		return fmt.Sprintf("%6.2fkB", float64(size)/1e3)
+	default:
+		return fmt.Sprintf("%7dB", size)
+	}
+}
+
+// groupDigits formats a number with commas between groups of three digits,
+// e.g. "1,048,576".
+func groupDigits(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return sign + grouped.String()
+}
+
 // durationToString converts a duration in seconds to a readable string.
 func durationToString(seconds int64) string {
 	switch {
@@ -61,9 +135,11 @@ func durationToString(seconds int64) string {
 
 var ErrMissingFilename = errors.New("unable to determine filename")
 
-// extractFilename attempts to derive a filename from the HTTP response.
-func extractFilename(response *http.Response) (string, error) {
-	filename := response.Request.URL.Path
+// extractFilename attempts to derive a filename from the HTTP response: the
+// Content-Disposition filename, or else the last segment of the URL path,
+// percent-decoded unless keepEncoded is set.
+func extractFilename(response *http.Response, keepEncoded bool) (string, error) {
+	filename := pathFilename(response.Request.URL, keepEncoded)
 	if contentDisposition := response.Header.Get("Content-Disposition"); contentDisposition != "" {
 		if _, params, err := mime.ParseMediaType(contentDisposition); err == nil {
 			filename = params["filename"]
@@ -82,6 +158,32 @@ func extractFilename(response *http.Response) (string, error) {
 	return filename, nil
 }
 
+// pathFilename returns the last segment of a URL path, "" if the path ends in
+// a slash. The path is split before it is decoded, so an encoded slash (%2F)
+// stays part of the name, as "_", and so do bytes that aren't valid UTF-8.
+func pathFilename(u *url.URL, keepEncoded bool) string {
+	escaped := u.EscapedPath()
+	segment := escaped[strings.LastIndex(escaped, "/")+1:]
+	if keepEncoded {
+		return segment
+	}
+	decoded, err := url.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return strings.ToValidUTF8(strings.ReplaceAll(decoded, "/", "_"), "_")
+}
+
+// filenameFromURL derives the filename a download would be saved under from
+// the URL path alone, before any request is made.
+func filenameFromURL(rawURL string, keepEncoded bool) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return extractFilename(&http.Response{Request: &http.Request{URL: parsed}, Header: http.Header{}}, keepEncoded)
+}
+
 var ansiEscapeRegex = regexp.MustCompile("\x1b\x5b[0-9]+\x6d")
 
 // visibleWidth calculates the visible width of a string by ignoring ANSI escape codes.
@@ -93,17 +195,109 @@ func visibleWidth(input string) int {
 	return width
 }
 
-// extractRateLimit splits a URL into a speed limit and the actual URL.
-func extractRateLimit(url string) (int64, string) {
-	parts := strings.Split(url, ":")
-	if len(parts) >= 2 {
-		limit, err := strconv.ParseInt(parts[0], 0, 0)
-		if err != nil {
-			return -1, url
+// parseSize parses a size such as "512", "64K", "4M" or "4.7G". Suffixes are
+// binary multiples, matching humanReadableSize, and may end in "B" or "iB".
+func parseSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	number = strings.TrimSuffix(strings.TrimSuffix(number, "B"), "I")
+
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = Kilobyte
+		case 'M':
+			multiplier = Megabyte
+		case 'G':
+			multiplier = Gigabyte
+		case 'T':
+			multiplier = Terabyte
+		}
+		if multiplier != 1 {
+			number = number[:len(number)-1]
+		}
+	}
+
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 || math.IsNaN(size) || math.IsInf(size, 0) {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit.
+	bytes := size * float64(multiplier)
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return int64(bytes), nil
+}
+
+// parseRate parses a rate in bytes per second. A bare number is in KiB/s; a
+// size suffix such as "512K" or "100B" sets the unit explicitly.
+func parseRate(value string) (int64, error) {
+	if strings.IndexAny(value, "KMGTkmgtBb") < 0 {
+		value += "K"
+	}
+	return parseSize(value)
+}
+
+var rateLimitRegex = regexp.MustCompile(`(?i)^-?[0-9]+(\.[0-9]+)?([KMGT]i?)?B?$`)
+
+// extractRateLimit splits a "[rate limit:]url" argument into a speed limit in
+// bytes per second and the URL. A bare number is in KiB/s; a size suffix such
+// as "512K", "1.5M" or "100B" sets the unit explicitly, with the same binary
+// multiples as humanReadableSize. A limit of 0, like no limit, means
+// unlimited; negative limits are rejected. A prefix that isn't a rate, such
+// as the IP address of a URL given without a scheme, is part of the URL.
+func extractRateLimit(arg string) (int64, string, error) {
+	prefix, rawURL, ok := strings.Cut(arg, ":")
+	if !ok || !rateLimitRegex.MatchString(prefix) {
+		return 0, arg, nil
+	}
+	if strings.HasPrefix(prefix, "-") {
+		return 0, "", fmt.Errorf("invalid rate limit %q in %q: must not be negative", prefix, arg)
+	}
+
+	limit, err := parseRate(prefix)
+	if err != nil {
+		return 0, arg, nil
+	}
+	return limit, rawURL, nil
+}
+
+// normalizeURL validates that rawURL is an absolute http or https URL. URLs
+// given without a scheme are rejected with a suggested fix, or prefixed with
+// defaultScheme when it is set.
+func normalizeURL(rawURL, defaultScheme string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		if defaultScheme == "" {
+			return "", fmt.Errorf("missing scheme in %q: did you mean https://%s?", rawURL, rawURL)
+		}
+		rawURL = defaultScheme + "://" + rawURL
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q in %q: only http and https are supported", parsed.Scheme, rawURL)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("missing host in %q", rawURL)
+	}
+	return parsed.String(), nil
+}
+
+// splitList flattens flag values that may each hold a comma-separated list.
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
 		}
-		return limit, strings.Join(parts[1:], ":")
 	}
-	return -1, url
+	return items
 }
 
 // parseHeaders converts a slice of header strings into a map.
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestExtractRateLimit(t *testing.T) {
+	tests := []struct {
+		arg     string
+		limit   int64
+		url     string
+		wantErr bool
+	}{
+		{arg: "https://example.com/f.iso", url: "https://example.com/f.iso"},
+		{arg: "example.com/f.iso", url: "example.com/f.iso"},
+		{arg: "localhost:8080/f.iso", url: "localhost:8080/f.iso"},
+		{arg: "192.168.1.5:8080/f.iso", url: "192.168.1.5:8080/f.iso"},
+		{arg: "192.168.1.5/f.iso", url: "192.168.1.5/f.iso"},
+		{arg: "1.2.3:example.com/f.iso", url: "1.2.3:example.com/f.iso"},
+		{arg: "500:https://example.com/f.iso", limit: 500 * Kilobyte, url: "https://example.com/f.iso"},
+		{arg: "0:https://example.com/f.iso", limit: 0, url: "https://example.com/f.iso"},
+		{arg: "100B:https://example.com/f.iso", limit: 100, url: "https://example.com/f.iso"},
+		{arg: "512K:https://example.com/f.iso", limit: 512 * Kilobyte, url: "https://example.com/f.iso"},
+		{arg: "1.5M:https://example.com/f.iso", limit: 3 * Megabyte / 2, url: "https://example.com/f.iso"},
+		{arg: "2GiB:https://example.com/f.iso", limit: 2 * Gigabyte, url: "https://example.com/f.iso"},
+		{arg: "1m:example.com:8080/f.iso", limit: Megabyte, url: "example.com:8080/f.iso"},
+		{arg: "-1:https://example.com/f.iso", wantErr: true},
+		{arg: "-1.5M:https://example.com/f.iso", wantErr: true},
+	}
+	for _, test := range tests {
+		limit, rawURL, err := extractRateLimit(test.arg)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("extractRateLimit(%q) succeeded, want an error", test.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("extractRateLimit(%q) failed: %v", test.arg, err)
+			continue
+		}
+		if limit != test.limit || rawURL != test.url {
+			t.Errorf("extractRateLimit(%q) = %d, %q, want %d, %q", test.arg, limit, rawURL, test.limit, test.url)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		size    int64
+		wantErr bool
+	}{
+		{value: "512", size: 512},
+		{value: "64K", size: 64 * Kilobyte},
+		{value: "4M", size: 4 * Megabyte},
+		{value: "4.5G", size: 9 * Gigabyte / 2},
+		{value: "2TiB", size: 2 * Terabyte},
+		{value: "100b", size: 100},
+		{value: " 1 M ", size: Megabyte},
+		{value: "8388607T", size: 8388607 * Terabyte},
+		{value: "", wantErr: true},
+		{value: "K", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "lots", wantErr: true},
+		{value: "Inf", wantErr: true},
+		{value: "+InfK", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "nanM", wantErr: true},
+		{value: "1e400", wantErr: true},
+		{value: "9223372036854775807", wantErr: true},
+		{value: "8388608T", wantErr: true},
+		{value: "1e10G", wantErr: true},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", test.value, size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSize(%q) failed: %v", test.value, err)
+			continue
+		}
+		if size != test.size {
+			t.Errorf("parseSize(%q) = %d, want %d", test.value, size, test.size)
+		}
+	}
+}
+
+func TestPathFilename(t *testing.T) {
+	tests := []struct {
+		rawURL      string
+		keepEncoded bool
+		want        string
+	}{
+		{rawURL: "https://example.com/files/report.pdf", want: "report.pdf"},
+		{rawURL: "https://example.com/files/report.pdf?download=1#page=2", want: "report.pdf"},
+		{rawURL: "https://example.com/files/", want: ""},
+		{rawURL: "https://example.com", want: ""},
+		{rawURL: "https://example.com/a%20b.txt", want: "a b.txt"},
+		{rawURL: "https://example.com/a+b.txt", want: "a+b.txt"},
+		{rawURL: "https://example.com/100%25.txt", want: "100%.txt"},
+		{rawURL: "https://example.com/dir/a%2Fb.txt", want: "a_b.txt"},
+		{rawURL: "https://example.com/dir/a%2fb.txt", want: "a_b.txt"},
+		{rawURL: "https://example.com/%2E%2E%2Fetc%2Fpasswd", want: ".._etc_passwd"},
+		{rawURL: "https://example.com/caf%C3%A9.tar.gz", want: "café.tar.gz"},
+		{rawURL: "https://example.com/%E6%97%A5%E6%9C%AC%E8%AA%9E.txt", want: "日本語.txt"},
+		{rawURL: "https://example.com/naïve.txt", want: "naïve.txt"},
+		{rawURL: "https://example.com/%F0%9F%93%A6.zip", want: "📦.zip"},
+		{rawURL: "https://example.com/bad%FF.bin", want: "bad_.bin"},
+		{rawURL: "https://example.com/half%E6%97.bin", want: "half_.bin"},
+		{rawURL: "https://example.com/a%20b.txt", keepEncoded: true, want: "a%20b.txt"},
+		{rawURL: "https://example.com/dir/a%2Fb.txt", keepEncoded: true, want: "a%2Fb.txt"},
+		{rawURL: "https://example.com/caf%C3%A9.tar.gz", keepEncoded: true, want: "caf%C3%A9.tar.gz"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.rawURL)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.rawURL, err)
+		}
+		if got := pathFilename(u, test.keepEncoded); got != test.want {
+			t.Errorf("pathFilename(%q, %v) = %q, want %q", test.rawURL, test.keepEncoded, got, test.want)
+		}
+	}
+}
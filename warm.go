@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// warmCommand requests URLs without saving them, purely to populate CDN caches.
+var warmCommand = cli.Command{
+	Name:      "warm",
+	Usage:     "Warm CDN caches by requesting URLs at a controlled rate",
+	ArgsUsage: "url...",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "method",
+			Value: "head",
+		},
+		cli.Int64Flag{
+			Name:  "bytes",
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "repeat",
+			Value: 1,
+		},
+		cli.Float64Flag{
+			Name:  "rate",
+			Value: 10,
+		},
+		cli.DurationFlag{
+			Name: "ramp",
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Value: 8,
+		},
+	},
+	Action: warmAction,
+}
+
+// warmStats tallies the outcome of warming requests by status code.
+type warmStats struct {
+	mutex   sync.Mutex
+	counts  map[string]int
+	latency map[string]time.Duration
+}
+
+// add records one request outcome.
+func (ws *warmStats) add(status string, latency time.Duration) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.counts[status]++
+	ws.latency[status] += latency
+}
+
+// print writes the per-status summary.
+func (ws *warmStats) print() {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	statuses := make([]string, 0, len(ws.counts))
+	for status := range ws.counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	fmt.Println("Status  Requests  Avg latency")
+	for _, status := range statuses {
+		average := ws.latency[status] / time.Duration(ws.counts[status])
+		fmt.Printf("%-6s  %8d  %s\n", status, ws.counts[status], average.Round(time.Millisecond))
+	}
+}
+
+// warmAction sends HEAD or first-N-bytes range requests for every URL,
+// --repeat times, ramping the request rate linearly from one per second up to
+// --rate over --ramp, with at most --concurrency requests in flight.
+func warmAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		displayUsage()
+		return nil
+	}
+
+	options, err := newTaskOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsageError)
+	}
+	method := c.String("method")
+	if method != "head" && method != "range" {
+		return cli.NewExitError(fmt.Sprintf("invalid --method %q: must be head or range", method), exitUsageError)
+	}
+	rate, ramp := c.Float64("rate"), c.Duration("ramp")
+	if rate <= 0 || c.Int("concurrency") <= 0 || c.Int64("bytes") <= 0 {
+		return cli.NewExitError("--rate, --concurrency and --bytes must be positive", exitUsageError)
+	}
+
+	ctx := context.Background()
+	var tasks []*downloadTask
+	for i := 0; i < c.Int("repeat"); i++ {
+		for _, arg := range c.Args() {
+			task, err := newDownloadTask(ctx, arg, options)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Error: %s", err), exitUsageError)
+			}
+			tasks = append(tasks, task)
+		}
+	}
+
+	client := newHTTPClient(options)
+	stats := &warmStats{counts: make(map[string]int), latency: make(map[string]time.Duration)}
+	slots := make(chan struct{}, c.Int("concurrency"))
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for _, task := range tasks {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(task *downloadTask) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			stats.add(task.warm(client, method, c.Int64("bytes")))
+		}(task)
+
+		currentRate := rate
+		if elapsed := time.Since(start); ramp > 0 && elapsed < ramp && rate > 1 {
+			currentRate = 1 + (rate-1)*elapsed.Seconds()/ramp.Seconds()
+		}
+		time.Sleep(time.Duration(float64(time.Second) / currentRate))
+	}
+	wg.Wait()
+
+	stats.print()
+
+	var ok int
+	for status, count := range stats.counts {
+		if code, err := strconv.Atoi(status); err == nil && code < 400 {
+			ok += count
+		}
+	}
+	switch {
+	case ok == len(tasks):
+		return nil
+	case ok == 0:
+		return cli.NewExitError("", exitAllFailed)
+	default:
+		return cli.NewExitError("", exitPartialFailure)
+	}
+}
+
+// warm sends a single warming request and returns its status code, or
+// "error" for transport failures, along with its latency.
+func (dt *downloadTask) warm(client *http.Client, method string, bytes int64) (string, time.Duration) {
+	httpMethod := "HEAD"
+	if method == "range" {
+		httpMethod = "GET"
+	}
+	request, err := dt.newRequest(httpMethod)
+	if err != nil {
+		return "error", 0
+	}
+	if method == "range" {
+		request.Header.Set("Range", fmt.Sprintf("bytes=0-%d", bytes-1))
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return "error", time.Since(start)
+	}
+	io.Copy(io.Discard, io.LimitReader(response.Body, bytes))
+	response.Body.Close()
+	return strconv.Itoa(response.StatusCode), time.Since(start)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchInterval is how often --watch-dir is checked for new job files.
+const watchInterval = 2 * time.Second
+
+// Subdirectories of --watch-dir that job files are moved to once read.
+const (
+	processedJobsDir = "processed"
+	failedJobsDir    = "failed"
+)
+
+// jobFileStat is what a job file looked like when last seen. A file is only
+// read once it has stayed the same for a whole interval, so that one still
+// being copied onto a share isn't read half-written.
+type jobFileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchJobs polls dir for job files, .txt lists of URLs like those given on
+// the command line or .json queues written by export-queue, and sends their
+// tasks, expanded by prepare, on the returned channel until ctx is done. Each
+// file is moved to processed/ once its tasks are queued, or to failed/ if it
+// can't be read or has an invalid URL, in which case none of its URLs are
+// downloaded.
+func watchJobs(ctx context.Context, dir string, options *taskOptions, prepare func([]*downloadTask) ([]*downloadTask, error)) <-chan *downloadTask {
+	feed := make(chan *downloadTask)
+	go func() {
+		defer close(feed)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		seen := make(map[string]jobFileStat)
+		// Files that couldn't be moved away, skipped until they change.
+		stuck := make(map[string]jobFileStat)
+		for {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				uiLog.Warn("reading --watch-dir failed", "dir", dir, "error", err)
+			}
+			current := make(map[string]jobFileStat)
+			for _, entry := range entries {
+				name := entry.Name()
+				if entry.IsDir() || strings.HasPrefix(name, ".") || !isJobFile(name) {
+					continue
+				}
+				info, err := entry.Info()
+				if err != nil {
+					continue
+				}
+				stat := jobFileStat{size: info.Size(), modTime: info.ModTime()}
+				if last, ok := stuck[name]; ok && last.equal(stat) {
+					current[name] = stat
+					continue
+				}
+				delete(stuck, name)
+				if last, ok := seen[name]; !ok || !last.equal(stat) {
+					current[name] = stat
+					continue
+				}
+
+				tasks, err := readJobFile(ctx, filepath.Join(dir, name), options)
+				if err == nil {
+					tasks, err = prepare(tasks)
+				}
+				moveTo := processedJobsDir
+				if err != nil {
+					uiLog.Warn("skipping a job file", "file", name, "error", err)
+					moveTo = failedJobsDir
+				}
+				if err := moveJobFile(dir, name, moveTo); err != nil {
+					uiLog.Warn("moving a job file failed, skipping it until it changes", "file", name, "error", err)
+					stuck[name] = stat
+					current[name] = stat
+					continue
+				}
+				for _, task := range tasks {
+					select {
+					case feed <- task:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			seen = current
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return feed
+}
+
+func (js jobFileStat) equal(other jobFileStat) bool {
+	return js.size == other.size && js.modTime.Equal(other.modTime)
+}
+
+// isJobFile reports whether --watch-dir reads the file.
+func isJobFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".json":
+		return true
+	}
+	return false
+}
+
+// readJobFile returns the tasks of a job file, failing if any of its URLs
+// is invalid. The paths of a .json queue are relative to the current
+// directory, and its headers apply to its downloads unless given with
+// --header.
+func readJobFile(ctx context.Context, fileName string, options *taskOptions) ([]*downloadTask, error) {
+	var tasks []*downloadTask
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		var state queueState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		for i, entry := range state.Tasks {
+			task, err := entry.newTask(ctx, options)
+			if err != nil {
+				return nil, fmt.Errorf("task %d: %s", i+1, err)
+			}
+			for key, value := range state.Headers {
+				if _, ok := options.headers[key]; ok {
+					continue
+				}
+				if task.headers == nil {
+					task.headers = make(map[string]string)
+				}
+				task.headers[key] = value
+			}
+			tasks = append(tasks, task)
+		}
+		return tasks, nil
+	}
+
+	urls, err := readURLList(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range urls {
+		task, err := newDownloadTask(ctx, arg, options)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// moveJobFile moves a job file into a subdirectory of dir, adding the time
+// to its name if a job of the same name was already moved there.
+func moveJobFile(dir, name, subdir string) error {
+	target := filepath.Join(dir, subdir)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	newPath := filepath.Join(target, name)
+	if _, err := os.Lstat(newPath); err == nil {
+		newPath = filepath.Join(target, time.Now().Format("20060102-150405-")+name)
+	}
+	return os.Rename(filepath.Join(dir, name), newPath)
+}
+
+// mergeFeeds returns a channel that receives the tasks of all the feeds,
+// closed once they all are.
+func mergeFeeds(feeds ...<-chan *downloadTask) <-chan *downloadTask {
+	if len(feeds) == 1 {
+		return feeds[0]
+	}
+	merged := make(chan *downloadTask)
+	var wg sync.WaitGroup
+	for _, feed := range feeds {
+		wg.Add(1)
+		go func(feed <-chan *downloadTask) {
+			defer wg.Done()
+			for task := range feed {
+				merged <- task
+			}
+		}(feed)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wireTraceBodyBytes = 256 // Bytes of each response body shown in --trace
+	wireTraceReads     = 64  // Body reads logged per response before going quiet
+)
+
+// redactedHeaders are replaced by "[redacted]" in --trace output.
+var redactedHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+// wireTrace logs what happens on the wire for every request to the --trace
+// file, in the spirit of curl --trace: connections, TLS handshakes, the
+// headers sent and received, and the chunks the body arrives in. Credentials
+// are redacted and only the start of each body is shown. Each line starts
+// with the time and the request's number, as requests of different tasks
+// interleave.
+type wireTrace struct {
+	mutex sync.Mutex
+	file  *os.File
+	count int64
+}
+
+// newWireTrace creates the --trace file, or returns nil if fileName is "".
+func newWireTrace(fileName string) (*wireTrace, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trace: %v", err)
+	}
+	return &wireTrace{file: file}, nil
+}
+
+func (wt *wireTrace) printf(id int64, format string, args ...interface{}) {
+	wt.mutex.Lock()
+	defer wt.mutex.Unlock()
+	fmt.Fprintf(wt.file, "%s [%d] %s\n", time.Now().Format("15:04:05.000000"), id, fmt.Sprintf(format, args...))
+}
+
+// trace numbers a request, logs its request line and attaches a client
+// trace logging the connection and the headers as they are written.
+func (wt *wireTrace) trace(request *http.Request) (*http.Request, int64) {
+	if wt == nil {
+		return request, 0
+	}
+	id := atomic.AddInt64(&wt.count, 1)
+	wt.printf(id, "> %s %s", request.Method, request.URL)
+
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) { wt.printf(id, "* getting a connection to %s", hostPort) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				wt.printf(id, "* reusing connection to %s, idle for %s", info.Conn.RemoteAddr(), info.IdleTime)
+			} else {
+				wt.printf(id, "* connected to %s from %s", info.Conn.RemoteAddr(), info.Conn.LocalAddr())
+			}
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) { wt.printf(id, "* resolving %s", info.Host) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				wt.printf(id, "* resolving failed: %v", info.Err)
+				return
+			}
+			addrs := make([]string, len(info.Addrs))
+			for i, addr := range info.Addrs {
+				addrs[i] = addr.String()
+			}
+			wt.printf(id, "* resolved to %s", strings.Join(addrs, ", "))
+		},
+		ConnectStart: func(network, addr string) { wt.printf(id, "* connecting to %s over %s", addr, network) },
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				wt.printf(id, "* connecting to %s failed: %v", addr, err)
+			}
+		},
+		TLSHandshakeStart: func() { wt.printf(id, "* TLS handshake started") },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				wt.printf(id, "* TLS handshake failed: %v", err)
+				return
+			}
+			wt.printf(id, "* TLS handshake done: %s, %s, ALPN %q, server name %q", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol, state.ServerName)
+			for _, cert := range state.PeerCertificates {
+				wt.printf(id, "*   certificate %q issued by %q, valid %s to %s", cert.Subject, cert.Issuer, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+			}
+		},
+		WroteHeaderField: func(key string, values []string) {
+			wt.printf(id, "> %s: %s", key, redactHeader(key, strings.Join(values, ", ")))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				wt.printf(id, "* writing the request failed: %v", info.Err)
+			}
+		},
+		GotFirstResponseByte: func() { wt.printf(id, "* first response byte") },
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace)), id
+}
+
+// traceResponse logs the status line and headers of a response, or the
+// error the request failed with, and wraps the body to log its chunks.
+func (wt *wireTrace) traceResponse(id int64, response *http.Response, err error) {
+	if wt == nil {
+		return
+	}
+	if err != nil {
+		wt.printf(id, "* request failed: %v", err)
+		return
+	}
+	wt.printf(id, "< %s %s", response.Proto, response.Status)
+	keys := make([]string, 0, len(response.Header))
+	for key := range response.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		wt.printf(id, "< %s: %s", key, redactHeader(key, strings.Join(response.Header[key], ", ")))
+	}
+	response.Body = &wireTraceBody{body: response.Body, trace: wt, id: id}
+}
+
+// redactHeader hides the values of headers that carry credentials.
+func redactHeader(key, value string) string {
+	if redactedHeaders[strings.ToLower(key)] {
+		return "[redacted]"
+	}
+	return value
+}
+
+// wireTraceBody logs the reads of a response body: the size of each chunk
+// as it arrives, up to wireTraceReads of them, the first wireTraceBodyBytes
+// of the data, and the total once the body ends.
+type wireTraceBody struct {
+	body  io.ReadCloser
+	trace *wireTrace
+	id    int64
+	reads int
+	total int64
+}
+
+func (tb *wireTraceBody) Read(p []byte) (int, error) {
+	n, err := tb.body.Read(p)
+	if n > 0 {
+		tb.reads++
+		if tb.total < wireTraceBodyBytes {
+			shown := p[:n]
+			if int64(len(shown)) > wireTraceBodyBytes-tb.total {
+				shown = shown[:wireTraceBodyBytes-tb.total]
+			}
+			tb.trace.printf(tb.id, "< body %q", shown)
+		}
+		tb.total += int64(n)
+		switch {
+		case tb.reads < wireTraceReads:
+			tb.trace.printf(tb.id, "< chunk of %d bytes, %d so far", n, tb.total)
+		case tb.reads == wireTraceReads:
+			tb.trace.printf(tb.id, "< chunk of %d bytes, %d so far; further chunks aren't logged", n, tb.total)
+		}
+	}
+	if err == io.EOF {
+		tb.trace.printf(tb.id, "< body ended after %d bytes", tb.total)
+	} else if err != nil {
+		tb.trace.printf(tb.id, "* reading the body failed after %d bytes: %v", tb.total, err)
+	}
+	return n, err
+}
+
+func (tb *wireTraceBody) Close() error {
+	tb.trace.printf(tb.id, "* body closed after %d bytes", tb.total)
+	return tb.body.Close()
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultZsyncFile = "{url}.zsync" // Where --zsync looks for a download's control file
+	zsyncMergeGap    = 64 * 1024     // Blocks found locally are fetched anyway when fewer bytes than this lie between missing ones, to save requests
+)
+
+// zsyncControl is a zsync control file, as zsyncmake writes it: a header of
+// "Key: value" lines, then for each block of the file its weak rolling
+// checksum and the start of its MD4, in as few bytes as zsyncmake found
+// safe for the file's size.
+type zsyncControl struct {
+	blockSize     int
+	length        int64
+	seqMatches    int // Blocks in a row that must match, 1 or 2
+	rsumBytes     int // Bytes of the rolling checksum kept per block
+	checksumBytes int // Bytes of the MD4 kept per block
+	sha1          string
+	blocks        []zsyncBlock
+}
+
+type zsyncBlock struct {
+	rsum     uint32 // The rolling checksum, masked to rsumBytes
+	checksum []byte
+}
+
+// parseZsync parses a control file. Control files for compressed files,
+// which zsync rebuilds from the compressed stream, aren't supported.
+func parseZsync(data []byte) (*zsyncControl, error) {
+	header, body, ok := bytes.Cut(data, []byte("\n\n"))
+	if !ok {
+		return nil, fmt.Errorf("no end of header")
+	}
+	zc := &zsyncControl{seqMatches: 1, rsumBytes: 4, checksumBytes: 16}
+	var err error
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Blocksize":
+			zc.blockSize, err = strconv.Atoi(value)
+		case "Length":
+			zc.length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			lengths := strings.Split(value, ",")
+			if len(lengths) != 3 {
+				return nil, fmt.Errorf("invalid Hash-Lengths %q", value)
+			}
+			if zc.seqMatches, err = strconv.Atoi(lengths[0]); err == nil {
+				if zc.rsumBytes, err = strconv.Atoi(lengths[1]); err == nil {
+					zc.checksumBytes, err = strconv.Atoi(lengths[2])
+				}
+			}
+		case "SHA-1":
+			zc.sha1 = strings.ToLower(value)
+		case "Z-URL", "Z-Map2":
+			return nil, fmt.Errorf("control files for compressed files aren't supported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	switch {
+	case zc.blockSize <= 0 || zc.blockSize&(zc.blockSize-1) != 0:
+		return nil, fmt.Errorf("invalid Blocksize %d", zc.blockSize)
+	case zc.length < 0:
+		return nil, fmt.Errorf("invalid Length %d", zc.length)
+	case zc.seqMatches < 1 || zc.seqMatches > 2 || zc.rsumBytes < 1 || zc.rsumBytes > 4 || zc.checksumBytes < 3 || zc.checksumBytes > 16:
+		return nil, fmt.Errorf("invalid Hash-Lengths %d,%d,%d", zc.seqMatches, zc.rsumBytes, zc.checksumBytes)
+	case len(zc.sha1) != sha1.Size*2:
+		return nil, fmt.Errorf("no SHA-1")
+	}
+
+	count := (zc.length + int64(zc.blockSize) - 1) / int64(zc.blockSize)
+	entry := zc.rsumBytes + zc.checksumBytes
+	if int64(len(body)) != count*int64(entry) {
+		return nil, fmt.Errorf("%d bytes of checksums for %d blocks", len(body), count)
+	}
+	zc.blocks = make([]zsyncBlock, count)
+	for i := range zc.blocks {
+		record := body[i*entry : (i+1)*entry]
+		// The rolling checksum is stored big-endian, without its leading bytes.
+		var rsum [4]byte
+		copy(rsum[4-zc.rsumBytes:], record[:zc.rsumBytes])
+		zc.blocks[i] = zsyncBlock{rsum: binary.BigEndian.Uint32(rsum[:]), checksum: record[zc.rsumBytes:]}
+	}
+	return zc, nil
+}
+
+// rsumMask keeps the bytes of a rolling checksum the control file has.
+func (zc *zsyncControl) rsumMask() uint32 {
+	return 0xffffffff >> (8 * (4 - zc.rsumBytes))
+}
+
+// rsumBlock computes zsync's rolling checksum of a block: a is the sum of its
+// bytes and b the sum of each byte times its distance from the end.
+func rsumBlock(block []byte) (a, b uint16) {
+	n := len(block)
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(n-i) * uint16(c)
+	}
+	return a, b
+}
+
+// matchesBlock reports whether data, a block's worth of bytes, is block i.
+func (zc *zsyncControl) matchesBlock(i int, data []byte) bool {
+	a, b := rsumBlock(data)
+	if (uint32(a)<<16|uint32(b))&zc.rsumMask() != zc.blocks[i].rsum {
+		return false
+	}
+	sum := md4Sum(data)
+	return bytes.Equal(sum[:zc.checksumBytes], zc.blocks[i].checksum)
+}
+
+// match finds the blocks of the file in seed, a local file with much of the
+// same content, such as yesterday's build, wherever they have moved to. It
+// returns the offset in seed of each block, or -1 for blocks not found.
+// The window rolls through seed a byte at a time, and only offsets whose
+// rolling checksum is that of some block are hashed with MD4.
+func (zc *zsyncControl) match(seed io.Reader) ([]int64, error) {
+	bs := zc.blockSize
+	found := make([]int64, len(zc.blocks))
+	// The filter, a bit per low 20 bits of the checksums, rules out most
+	// offsets without a map lookup.
+	index := make(map[uint32][]int)
+	filter := make([]uint64, 1<<20/64)
+	for i, block := range zc.blocks {
+		found[i] = -1
+		index[block.rsum] = append(index[block.rsum], i)
+		filter[block.rsum&0xfffff/64] |= 1 << (block.rsum % 64)
+	}
+	mask := zc.rsumMask()
+
+	size := 1 << 20
+	if size < 4*bs {
+		size = 4 * bs
+	}
+	buffer := make([]byte, 0, size+bs)
+	var base int64 // Offset in seed of buffer[0]
+	eof := false
+	p := 0
+	var a, b uint16
+	rolled := false // Whether a and b are those of buffer[p:p+bs]
+	for {
+		// Two blocks are kept ahead of p, for blocks that must match in
+		// a row. At the end of seed, a block of zeros is added, as the last
+		// block of the file is padded with them.
+		if len(buffer)-p < 2*bs && !eof {
+			buffer = buffer[:copy(buffer, buffer[p:])]
+			base += int64(p)
+			p = 0
+			for !eof && len(buffer) < size {
+				n, err := seed.Read(buffer[len(buffer):size])
+				buffer = buffer[:len(buffer)+n]
+				if err == io.EOF {
+					eof = true
+					buffer = append(buffer, make([]byte, bs)...)
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(buffer)-p < bs {
+			return found, nil
+		}
+		if !rolled {
+			a, b = rsumBlock(buffer[p : p+bs])
+			rolled = true
+		}
+
+		matched := false
+		var sum [16]byte
+		hashed := false
+		rsum := (uint32(a)<<16 | uint32(b)) & mask
+		var candidates []int
+		if filter[rsum&0xfffff/64]&(1<<(rsum%64)) != 0 {
+			candidates = index[rsum]
+		}
+		for _, i := range candidates {
+			if found[i] >= 0 {
+				continue
+			}
+			if !hashed {
+				sum, hashed = md4Sum(buffer[p:p+bs]), true
+			}
+			if !bytes.Equal(sum[:zc.checksumBytes], zc.blocks[i].checksum) {
+				continue
+			}
+			// With a short checksum, the next block must match as well.
+			next := i + 1
+			if zc.seqMatches > 1 && next < len(zc.blocks) {
+				if len(buffer)-p < 2*bs || !zc.matchesBlock(next, buffer[p+bs:p+2*bs]) {
+					continue
+				}
+				if found[next] < 0 {
+					found[next] = base + int64(p+bs)
+				}
+			}
+			found[i] = base + int64(p)
+			matched = true
+		}
+
+		if matched {
+			p += bs
+			rolled = false
+			continue
+		}
+		if p+bs >= len(buffer) {
+			return found, nil
+		}
+		out, in := uint16(buffer[p]), uint16(buffer[p+bs])
+		a += in - out
+		b += a - uint16(bs)*out
+		p++
+	}
+}
+
+// zsyncUpdate brings the file at seed up to date with the task's URL, for
+// --zsync: the blocks still in it are copied from it into fileName, and only
+// the rest is downloaded, with range requests. The result must match the
+// SHA-1 in the control file. Progress counts the bytes downloaded, out of
+// those missing.
+func (dt *downloadTask) zsyncUpdate(client *http.Client, request *http.Request, seed, fileName string, remoteSize int64) error {
+	location, err := checksumLocation(dt.options.zsyncFile, dt.downloadURL)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if strings.Contains(location, "://") {
+		data, err = dt.fetchSmall(client, location)
+	} else {
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return fmt.Errorf("fetching zsync file %s: %v", location, err)
+	}
+	zc, err := parseZsync(data)
+	if err != nil {
+		return fmt.Errorf("zsync file %s: %v", location, err)
+	}
+	if remoteSize >= 0 && remoteSize != zc.length {
+		return fmt.Errorf("zsync file %s is for %d bytes, %s has %d", location, zc.length, dt.downloadURL, remoteSize)
+	}
+
+	seedFile, err := os.Open(seed)
+	if err != nil {
+		return err
+	}
+	defer seedFile.Close()
+	found, err := zc.match(seedFile)
+	if err != nil {
+		return err
+	}
+
+	partName := fileName + ".zsync-part"
+	out, err := os.Create(partName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partName)
+	err = dt.assembleZsync(client, request, zc, found, seedFile, out, location)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	digest, err := hashFileWith(partName, sha1.New())
+	if err != nil {
+		return err
+	}
+	if digest != zc.sha1 {
+		return &verifyError{fileName: fileName, err: fmt.Errorf("%w: doesn't match the SHA-1 in %s", ErrChecksumMismatch, location)}
+	}
+	return os.Rename(partName, fileName)
+}
+
+// assembleZsync writes the file into out: the blocks found in seed, then
+// the missing ranges, downloaded.
+func (dt *downloadTask) assembleZsync(client *http.Client, request *http.Request, zc *zsyncControl, found []int64, seed *os.File, out *os.File, location string) error {
+	bs := int64(zc.blockSize)
+	blockEnd := func(i int) int64 {
+		if end := int64(i+1) * bs; end < zc.length {
+			return end
+		}
+		return zc.length
+	}
+
+	var reused int64
+	var missing [][2]int64 // Ranges to download, start and end
+	block := make([]byte, bs)
+	for i, offset := range found {
+		start, end := int64(i)*bs, blockEnd(i)
+		if offset < 0 {
+			if n := len(missing); n > 0 && start-missing[n-1][1] <= zsyncMergeGap {
+				missing[n-1][1] = end
+			} else {
+				missing = append(missing, [2]int64{start, end})
+			}
+			continue
+		}
+		// A block found in the padding past the end of seed is zeros.
+		n, err := seed.ReadAt(block[:end-start], offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for j := n; j < int(end-start); j++ {
+			block[j] = 0
+		}
+		if _, err := out.WriteAt(block[:end-start], start); err != nil {
+			return err
+		}
+		reused += end - start
+	}
+	if err := out.Truncate(zc.length); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, r := range missing {
+		total += r[1] - r[0]
+	}
+	transportLog.Info("zsync: downloading what changed", "url", dt.downloadURL, "control", location, "reused", reused, "download", total)
+	dt.log.event("zsync", map[string]interface{}{"reused": reused, "download": total})
+	dt.totalFileSize = total
+
+	buffer := make([]byte, len(dt.buffer))
+	for _, r := range missing {
+		rangeRequest := request.Clone(dt.ctx)
+		rangeRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r[0], r[1]-1))
+		response, err := dt.do(client, rangeRequest)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != http.StatusPartialContent {
+			response.Body.Close()
+			return fmt.Errorf("zsync needs range requests, which %s answered with %s", dt.downloadURL, response.Status)
+		}
+		err = dt.copyRange(response.Body, out, r[0], r[1], buffer)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRange writes the body of a response to a range request into out, from
+// offset start up to end, counting the bytes as the task's progress.
+func (dt *downloadTask) copyRange(body io.Reader, out *os.File, start, end int64, buffer []byte) error {
+	for offset := start; offset < end; {
+		if dt.rateLimiter.limit > 0 {
+			dt.rateLimiter.wait(dt.getBytesRead())
+		}
+		n, err := body.Read(buffer)
+		if int64(n) > end-offset {
+			n = int(end - offset)
+		}
+		if n > 0 {
+			if _, writeErr := out.WriteAt(buffer[:n], offset); writeErr != nil {
+				return writeErr
+			}
+			offset += int64(n)
+			atomic.AddInt64(&dt.bytesRead, int64(n))
+			dt.waitBudgets(n)
+		}
+		if err == io.EOF && offset < end {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+// md4Sum returns the MD4 digest of data (RFC 1320), which zsync uses for its
+// block checksums.
+func md4Sum(data []byte) [16]byte {
+	state := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	length := uint64(len(data)) << 3
+	full := len(data) &^ 63
+	for i := 0; i < full; i += 64 {
+		md4Block(&state, data[i:i+64])
+	}
+	var tail [128]byte
+	n := copy(tail[:], data[full:])
+	tail[n] = 0x80
+	padded := 64
+	if n >= 56 {
+		padded = 128
+	}
+	binary.LittleEndian.PutUint64(tail[padded-8:], length)
+	for i := 0; i < padded; i += 64 {
+		md4Block(&state, tail[i:i+64])
+	}
+
+	var sum [16]byte
+	for i, word := range state {
+		binary.LittleEndian.PutUint32(sum[i*4:], word)
+	}
+	return sum
+}
+
+var (
+	md4Shifts = [3][4]int{{3, 7, 11, 19}, {3, 5, 9, 13}, {3, 9, 11, 15}}
+	md4Order  = [3][16]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+		{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15},
+		{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15},
+	}
+)
+
+// md4Block runs MD4's three rounds on a 64-byte chunk.
+func md4Block(state *[4]uint32, chunk []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(chunk[i*4:])
+	}
+	a, b, c, d := state[0], state[1], state[2], state[3]
+	for round := 0; round < 3; round++ {
+		for i, k := range md4Order[round] {
+			var f uint32
+			switch round {
+			case 0:
+				f = (b & c) | (^b & d)
+			case 1:
+				f = ((b & c) | (b & d) | (c & d)) + 0x5a827999
+			default:
+				f = (b ^ c ^ d) + 0x6ed9eba1
+			}
+			a, b, c, d = d, bits.RotateLeft32(a+f+x[k], md4Shifts[round][i%4]), b, c
+		}
+	}
+	state[0] += a
+	state[1] += b
+	state[2] += c
+	state[3] += d
+}
+
+// hashFileWith returns the hex digest of a file with the given hash.
+func hashFileWith(fileName string, hasher hash.Hash) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}